@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lithammer/shortuuid/v3"
 	"gopkg.in/ini.v1"
+	"maunium.net/go/mautrix/id"
 )
 
 // @Summary Get a list of email names and IDs.
@@ -516,8 +519,10 @@ func (app *appContext) MatrixSendPIN(gc *gin.Context) {
 		}
 	}
 
-	ok := app.matrix.SendStart(req.UserID)
-	if !ok {
+	if err := app.matrix.SendStart(req.UserID, "", app.mediaServer()); err == ErrInvalidMatrixUserID {
+		respond(400, "errorInvalidMatrixID", gc)
+		return
+	} else if err != nil {
 		respondBool(500, false, gc)
 		return
 	}
@@ -542,7 +547,7 @@ func (app *appContext) MatrixCheckPIN(gc *gin.Context) {
 	}
 	userID := gc.Param("userID")
 	pin := gc.Param("pin")
-	user, ok := app.matrix.tokens[pin]
+	user, ok := app.matrix.token(pin)
 	if !ok {
 		app.debug.Println("Matrix: PIN not found")
 		respondBool(200, false, gc)
@@ -554,32 +559,45 @@ func (app *appContext) MatrixCheckPIN(gc *gin.Context) {
 		return
 	}
 	user.Verified = true
-	app.matrix.tokens[pin] = user
+	app.matrix.setToken(pin, user)
 	respondBool(200, true, gc)
 }
 
-// @Summary Generates a Matrix access token from a username and password.
+// @Summary Generates a Matrix access token from a username and password, or validates an existing one.
 // @Produce json
 // @Success 200 {object} boolResponse
 // @Failure 400 {object} stringResponse
 // @Failure 401 {object} boolResponse
 // @Failure 500 {object} boolResponse
-// @Param MatrixLoginDTO body MatrixLoginDTO true "Username & password."
+// @Param MatrixLoginDTO body MatrixLoginDTO true "Username & password, or access token."
 // @Router /matrix/login [post]
 // @Security Bearer
 // @tags Other
 func (app *appContext) MatrixLogin(gc *gin.Context) {
 	var req MatrixLoginDTO
 	gc.BindJSON(&req)
-	if req.Username == "" || req.Password == "" {
-		respond(400, "errorLoginBlank", gc)
-		return
-	}
-	token, err := app.matrix.generateAccessToken(req.Homeserver, req.Username, req.Password)
-	if err != nil {
-		app.err.Printf("Matrix: Failed to generate token: %v", err)
-		respond(401, "Unauthorized", gc)
-		return
+	var token string
+	var err error
+	if req.Token != "" {
+		req.Username, err = app.matrix.validateAccessToken(req.Homeserver, req.Token)
+		if err != nil {
+			app.err.Printf("Matrix: %v", err)
+			respondMatrixLoginError(err, gc)
+			return
+		}
+		token = req.Token
+	} else {
+		if req.Username == "" || req.Password == "" {
+			respond(400, "errorLoginBlank", gc)
+			return
+		}
+		deviceID, deviceName := app.matrix.loginDevice(app.config, req.Homeserver, req.Username)
+		token, err = app.matrix.generateAccessToken(req.Homeserver, req.Username, req.Password, deviceID, deviceName)
+		if err != nil {
+			app.err.Printf("Matrix: Failed to generate token: %v", err)
+			respondMatrixLoginError(err, gc)
+			return
+		}
 	}
 	tempConfig, _ := ini.Load(app.configPath)
 	matrix := tempConfig.Section("matrix")
@@ -595,6 +613,279 @@ func (app *appContext) MatrixLogin(gc *gin.Context) {
 	respondBool(200, true, gc)
 }
 
+// respondMatrixLoginError responds with the notification key describing a MatrixLoginError,
+// 401 if the credentials were refused and 400 otherwise.
+func respondMatrixLoginError(err error, gc *gin.Context) {
+	var loginErr *MatrixLoginError
+	if !errors.As(err, &loginErr) {
+		respond(400, "errorUnknown", gc)
+		return
+	}
+	status := 400
+	if loginErr.Unauthorized() {
+		status = 401
+	}
+	respond(status, loginErr.Code, gc)
+}
+
+// @Summary Get the connection status of the Matrix bot.
+// @Produce json
+// @Success 200 {object} MatrixStatusDTO
+// @Router /matrix/status [get]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixStatus(gc *gin.Context) {
+	connected, lastSync, lastError := app.matrix.Status()
+	resp := MatrixStatusDTO{Connected: connected, LastError: lastError, Queued: app.queuedMessages(app.matrix.Name())}
+	if !lastSync.IsZero() {
+		resp.LastSync = lastSync.Unix()
+	}
+	gc.JSON(200, resp)
+}
+
+// @Summary Get all users with a linked Matrix account.
+// @Produce json
+// @Success 200 {object} MatrixUsersDTO
+// @Router /matrix/users [get]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixGetUsers(gc *gin.Context) {
+	names := map[string]string{}
+	jfUsers, status, err := app.jf.GetUsers(false)
+	if !(status == 200 || status == 204) || err != nil {
+		app.err.Printf("Failed to get users from Jellyfin (%d): %v", status, err)
+	}
+	for _, jfUser := range jfUsers {
+		names[jfUser.ID] = jfUser.Name
+	}
+	users := app.storage.GetMatrix()
+	resp := MatrixUsersDTO{Users: make([]MatrixUserDTO, len(users))}
+	for i, u := range users {
+		resp.Users[i] = MatrixUserDTO{
+			JellyfinID: u.JellyfinID,
+			Username:   names[u.JellyfinID],
+			MatrixID:   u.UserID,
+			RoomID:     u.RoomID,
+			Encrypted:  u.Encrypted,
+			Lang:       u.Lang,
+			Contact:    u.Contact,
+			Muted:      u.Muted,
+		}
+	}
+	gc.JSON(200, resp)
+}
+
+// @Summary Invite a user with a linked Matrix account to a new room with the bot, e.g. if they deleted the old one.
+// @Produce json
+// @Param forUserDTO body forUserDTO true "User's Jellyfin ID."
+// @Success 200 {object} boolResponse
+// @Failure 400 {object} boolResponse
+// @Failure 500 {object} boolResponse
+// @Router /matrix/users/reinvite [post]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixReinviteUser(gc *gin.Context) {
+	var req forUserDTO
+	gc.BindJSON(&req)
+	user, ok := app.storage.GetMatrixKey(req.ID)
+	if !ok {
+		respondBool(400, false, gc)
+		return
+	}
+	if _, err := app.matrix.ReinviteUser(req.ID); err != nil {
+		app.err.Printf("Matrix: Failed to recreate room for \"%s\": %v", user.UserID, err)
+		respondBool(500, false, gc)
+		return
+	}
+	respondBool(200, true, gc)
+}
+
+// @Summary Export the Matrix bot's encryption keys, so messages in encrypted rooms can still be read if its crypto store is lost.
+// @Produce plain
+// @Param MatrixKeysDTO body MatrixKeysDTO true "Passphrase to encrypt the export with."
+// @Success 200
+// @Failure 400 {object} boolResponse
+// @Failure 500 {object} boolResponse
+// @Router /matrix/keys/export [post]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixExportKeys(gc *gin.Context) {
+	var req MatrixKeysDTO
+	gc.BindJSON(&req)
+	if req.Passphrase == "" {
+		respondBool(400, false, gc)
+		return
+	}
+	data, err := ExportMatrixKeys(app.matrix, req.Passphrase)
+	if err == ErrMatrixEncryptionUnavailable {
+		respondBool(400, false, gc)
+		return
+	} else if err != nil {
+		app.err.Printf("Matrix: Failed to export keys: %v", err)
+		respondBool(500, false, gc)
+		return
+	}
+	app.info.Println("Matrix: Exported encryption keys")
+	gc.Header("Content-Disposition", "attachment; filename=\"jfa-go-matrix-keys.txt\"")
+	gc.Data(200, "text/plain", data)
+}
+
+// @Summary Import encryption keys previously exported from the Matrix bot, e.g. after its crypto store was lost.
+// @Produce json
+// @Param MatrixKeysDTO body MatrixKeysDTO true "Key export and its passphrase."
+// @Success 200 {object} MatrixKeyImportResponseDTO
+// @Failure 400 {object} boolResponse
+// @Router /matrix/keys/import [post]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixImportKeys(gc *gin.Context) {
+	var req MatrixKeysDTO
+	gc.BindJSON(&req)
+	if req.Passphrase == "" || req.Data == "" {
+		respondBool(400, false, gc)
+		return
+	}
+	imported, total, err := ImportMatrixKeys(app.matrix, req.Passphrase, []byte(req.Data))
+	if err == ErrMatrixEncryptionUnavailable {
+		respondBool(400, false, gc)
+		return
+	} else if err != nil {
+		// Most likely the wrong passphrase.
+		app.err.Printf("Matrix: Failed to import keys: %v", err)
+		respondBool(400, false, gc)
+		return
+	}
+	app.info.Printf("Matrix: Imported %d of %d encryption keys", imported, total)
+	gc.JSON(200, MatrixKeyImportResponseDTO{Imported: imported, Total: total})
+}
+
+// @Summary Broadcast a message to all linked Matrix users.
+// @Produce json
+// @Param MatrixBroadcastDTO body MatrixBroadcastDTO true "Broadcast request object"
+// @Success 200 {object} MatrixBroadcastResponseDTO
+// @Failure 400 {object} boolResponse
+// @Failure 500 {object} boolResponse
+// @Router /matrix/broadcast [post]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixBroadcast(gc *gin.Context) {
+	var req MatrixBroadcastDTO
+	gc.BindJSON(&req)
+	if req.Message == "" {
+		respondBool(400, false, gc)
+		return
+	}
+	msg, err := app.email.constructTemplate(req.Subject, req.Message, app)
+	if err != nil {
+		app.err.Printf("Failed to construct broadcast message: %v", err)
+		respondBool(500, false, gc)
+		return
+	}
+	if req.Urgent {
+		msg.Priority = PriorityCritical
+	}
+	sent, failed := app.matrix.Broadcast(msg)
+	app.info.Printf("Broadcast Matrix message to %d rooms, %d failed", sent, len(failed))
+	gc.JSON(200, MatrixBroadcastResponseDTO{Sent: sent, Failed: len(failed)})
+}
+
+// @Summary Send a test message to a Matrix user, to check the bot is set up correctly.
+// @Produce json
+// @Param MatrixSendPINDTO body MatrixSendPINDTO true "User's Matrix ID."
+// @Success 200 {object} MatrixTestResponseDTO
+// @Failure 400 {object} stringResponse
+// @Router /matrix/test [post]
+// @Security Bearer
+// @tags Other
+func (app *appContext) MatrixSendTest(gc *gin.Context) {
+	var req MatrixSendPINDTO
+	gc.BindJSON(&req)
+	if req.UserID == "" {
+		respond(400, "errorNoUserID", gc)
+		return
+	}
+	roomID, created, encrypted, err := app.matrix.SendTest(req.UserID)
+	if err == ErrInvalidMatrixUserID {
+		respond(400, "errorInvalidMatrixID", gc)
+		return
+	}
+	resp := MatrixTestResponseDTO{Success: err == nil, RoomID: string(roomID), NewRoom: created, Encrypted: encrypted}
+	if err != nil {
+		app.err.Printf("Matrix: Failed to send test message to \"%s\": %v", req.UserID, err)
+		resp.Error = err.Error()
+	} else {
+		app.info.Printf("Matrix: Sent test message to \"%s\"", req.UserID)
+	}
+	gc.JSON(200, resp)
+}
+
+// @Summary Send a message to a linked Matrix user or a room through the bot, e.g. from monitoring or automation. Authenticated with matrix.webhook_secret as a bearer token.
+// @Produce json
+// @Param MatrixWebhookDTO body MatrixWebhookDTO true "Target and message."
+// @Success 200 {object} boolResponse
+// @Failure 400 {object} stringResponse
+// @Failure 401 {object} stringResponse
+// @Failure 500 {object} stringResponse
+// @Router /matrix/webhook [post]
+// @tags Other
+func (app *appContext) MatrixWebhook(gc *gin.Context) {
+	secret := app.config.Section("matrix").Key("webhook_secret").String()
+	header := strings.SplitN(gc.Request.Header.Get("Authorization"), " ", 2)
+	if secret == "" || len(header) != 2 || header[0] != "Bearer" || subtle.ConstantTimeCompare([]byte(header[1]), []byte(secret)) != 1 {
+		app.logIpDebug(gc, false, "Matrix: Rejected webhook with invalid secret")
+		respond(401, "Unauthorized", gc)
+		return
+	}
+	var req MatrixWebhookDTO
+	if err := gc.ShouldBindJSON(&req); err != nil {
+		respond(400, "Invalid JSON", gc)
+		return
+	}
+	if (req.JellyfinID == "") == (req.RoomID == "") {
+		respond(400, "Give one of jellyfin_id or room_id", gc)
+		return
+	}
+	if req.Text == "" && req.Markdown == "" {
+		respond(400, "No message given", gc)
+		return
+	}
+	// Images are sent as links, as the sender may not be trusted with the bot's file system or network.
+	msg := &Message{Text: req.Text, Markdown: linkImages(req.Markdown)}
+	switch req.Priority {
+	case "", "normal":
+	case "critical":
+		msg.Priority = PriorityCritical
+	default:
+		respond(400, "Invalid priority", gc)
+		return
+	}
+	if req.RoomID != "" {
+		err := app.matrix.SendToRoom(req.RoomID, msg)
+		if errors.Is(err, ErrInvalidMatrixRoomID) {
+			respond(400, "Invalid room ID", gc)
+			return
+		}
+		if err != nil {
+			app.err.Printf("Matrix: Failed to send webhook message to room \"%s\": %v", req.RoomID, err)
+			respond(500, "Failed to send", gc)
+			return
+		}
+		respondBool(200, true, gc)
+		return
+	}
+	user, ok := app.storage.GetMatrixKey(req.JellyfinID)
+	if !ok {
+		respond(400, "User not linked", gc)
+		return
+	}
+	if err := app.matrix.Send(msg, user); err != nil {
+		app.err.Printf("Matrix: Failed to send webhook message to \"%s\": %v", user.UserID, err)
+		respond(500, "Failed to send", gc)
+		return
+	}
+	respondBool(200, true, gc)
+}
+
 // @Summary Links a Matrix user to a Jellyfin account via user IDs. Notifications are turned on by default.
 // @Produce json
 // @Success 200 {object} boolResponse
@@ -607,9 +898,6 @@ func (app *appContext) MatrixLogin(gc *gin.Context) {
 func (app *appContext) MatrixConnect(gc *gin.Context) {
 	var req MatrixConnectUserDTO
 	gc.BindJSON(&req)
-	if app.storage.GetMatrix() == nil {
-		app.storage.deprecatedMatrix = matrixStore{}
-	}
 	roomID, encrypted, err := app.matrix.CreateRoom(req.UserID)
 	if err != nil {
 		app.err.Printf("Matrix: Failed to create room: %v", err)
@@ -623,7 +911,7 @@ func (app *appContext) MatrixConnect(gc *gin.Context) {
 		Contact:   true,
 		Encrypted: encrypted,
 	})
-	app.matrix.isEncrypted[roomID] = encrypted
+	app.matrix.setRoomEncrypted(roomID, encrypted)
 	respondBool(200, true, gc)
 }
 
@@ -764,7 +1052,14 @@ func (app *appContext) UnlinkMatrix(gc *gin.Context) {
 		respond(400, "User not found", gc)
 		return
 	} */
+	user, linked := app.storage.GetMatrixKey(req.ID)
 	app.storage.DeleteMatrixKey(req.ID)
+	// Leave the room too, so the user isn't left talking to a bot that no longer knows them.
+	// Other accounts linked in the room still use it, and leaving would unlink them too.
+	if linked && matrixEnabled && len(app.matrix.roomAccounts(id.RoomID(user.RoomID))) == 0 {
+		app.matrix.forgetRoom(id.RoomID(user.RoomID))
+		go app.matrix.Leave(id.RoomID(user.RoomID))
+	}
 
 	app.storage.SetActivityKey(shortuuid.New(), Activity{
 		Type:       ActivityContactUnlinked,
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"strings"
@@ -22,14 +24,21 @@ const (
 // @Router /my/details [get]
 // @tags User Page
 func (app *appContext) MyDetails(gc *gin.Context) {
-	resp := MyDetailsDTO{
-		Id: gc.GetString("jfId"),
+	resp, err := app.myDetails(gc.GetString("jfId"))
+	if err != nil {
+		app.err.Printf("Failed to get Jellyfin user: %v", err)
+		respond(500, "Failed to get user", gc)
+		return
 	}
+	gc.JSON(200, resp)
+}
 
+// myDetails collects the details shown on the user page for the user with the given Jellyfin ID.
+func (app *appContext) myDetails(jfID string) (resp MyDetailsDTO, err error) {
+	resp.Id = jfID
 	user, status, err := app.jf.UserByID(resp.Id, false)
 	if status != 200 || err != nil {
-		app.err.Printf("Failed to get Jellyfin user (%d): %+v\n", status, err)
-		respond(500, "Failed to get user", gc)
+		err = fmt.Errorf("failed to get Jellyfin user (%d): %v", status, err)
 		return
 	}
 	resp.Username = user.Name
@@ -91,15 +100,46 @@ func (app *appContext) MyDetails(gc *gin.Context) {
 		} else {
 			// 2. Look for a template matching the key found in the user storage
 			//    Since this key is shared between users in a profile, we make a copy.
-			user, ok := app.storage.GetEmailsKey(gc.GetString("jfId"))
+			user, ok := app.storage.GetEmailsKey(jfID)
 			err = app.storage.db.Get(user.ReferralTemplateKey, &inv)
 			if ok && err == nil {
 				resp.HasReferrals = true
 			}
 		}
 	}
+	return resp, nil
+}
 
-	gc.JSON(200, resp)
+// accountExport collects everything stored about the user with the given Jellyfin ID: their user page details,
+// when their account was made, and their settings.
+func (app *appContext) accountExport(jfID string) (resp AccountExportDTO, err error) {
+	resp.MyDetailsDTO, err = app.myDetails(jfID)
+	if err != nil {
+		return
+	}
+	creation := Activity{}
+	if app.storage.db.FindOne(&creation, badgerhold.Where("Type").Eq(ActivityCreation).And("UserID").Eq(jfID)) == nil {
+		resp.Created = creation.Time.Unix()
+	}
+	if email, ok := app.storage.GetEmailsKey(jfID); ok {
+		resp.Label = email.Label
+	}
+	if matrix, ok := app.storage.GetMatrixKey(jfID); ok {
+		resp.Matrix = &MatrixSettingsExportDTO{
+			RoomID:     matrix.RoomID,
+			Language:   matrix.Lang,
+			Timezone:   matrix.Timezone,
+			Muted:      matrix.Muted,
+			PlainOnly:  matrix.PlainOnly,
+			QuietStart: matrix.QuietStart,
+			QuietEnd:   matrix.QuietEnd,
+		}
+	}
+	if prefs, ok := app.storage.GetNotificationPreferencesKey(jfID); ok {
+		resp.NotificationsDisabled = prefs.Disabled
+	}
+	resp.Exported = time.Now().Unix()
+	return
 }
 
 // @Summary Sets whether to notify yourself through telegram/discord/matrix/email or not.
@@ -122,6 +162,50 @@ func (app *appContext) SetMyContactMethods(gc *gin.Context) {
 	app.setContactMethods(req, gc)
 }
 
+// @Summary Returns which contact methods each type of notification is sent through.
+// @Produce json
+// @Success 200 {object} NotificationPreferencesDTO
+// @Router /my/notifications [get]
+// @Security Bearer
+// @tags User Page
+func (app *appContext) GetMyNotificationPreferences(gc *gin.Context) {
+	prefs, _ := app.storage.GetNotificationPreferencesKey(gc.GetString("jfId"))
+	resp := NotificationPreferencesDTO{Preferences: map[string]map[string]bool{}}
+	for _, notification := range notificationTypes {
+		resp.Preferences[notification] = map[string]bool{}
+		for _, method := range app.contactMethods() {
+			resp.Preferences[notification][strings.ToLower(method.Name())] = prefs.Allowed(notification, method.Name())
+		}
+	}
+	gc.JSON(200, resp)
+}
+
+// @Summary Sets whether a type of notification is sent through a contact method.
+// @Produce json
+// @Param SetNotificationPreferenceDTO body SetNotificationPreferenceDTO true "Notification type, contact method and whether to enable it."
+// @Success 200 {object} boolResponse
+// @Failure 400 {object} boolResponse
+// @Router /my/notifications [post]
+// @Security Bearer
+// @tags User Page
+func (app *appContext) SetMyNotificationPreference(gc *gin.Context) {
+	var req SetNotificationPreferenceDTO
+	gc.BindJSON(&req)
+	validMethod := false
+	for _, method := range app.contactMethods() {
+		validMethod = validMethod || strings.EqualFold(method.Name(), req.Method)
+	}
+	if !validNotificationType(req.Notification) || !validMethod {
+		respondBool(400, false, gc)
+		return
+	}
+	id := gc.GetString("jfId")
+	prefs, _ := app.storage.GetNotificationPreferencesKey(id)
+	prefs.Set(req.Notification, req.Method, req.Enabled)
+	app.storage.SetNotificationPreferencesKey(id, prefs)
+	respondBool(200, true, gc)
+}
+
 // @Summary Logout by deleting refresh token from cookies.
 // @Produce json
 // @Success 200 {object} boolResponse
@@ -200,38 +284,84 @@ func (app *appContext) confirmMyAction(gc *gin.Context, key string) {
 		gc.Redirect(http.StatusSeeOther, "/my/account")
 		return
 	} else if target == UserEmailChange {
-		emailStore, ok := app.storage.GetEmailsKey(id)
-		if !ok {
-			emailStore = EmailAddress{
-				Contact: true,
-			}
+		app.setMyEmail(id, claims["email"].(string), gc)
+		gc.Redirect(http.StatusSeeOther, "/my/account")
+		return
+	}
+}
+
+// setMyEmail sets the email address of the given user, as requested by themselves. gc may be nil.
+func (app *appContext) setMyEmail(id, address string, gc *gin.Context) {
+	emailStore, ok := app.storage.GetEmailsKey(id)
+	if !ok {
+		emailStore = EmailAddress{
+			Contact: true,
 		}
-		emailStore.Addr = claims["email"].(string)
-		app.storage.SetEmailsKey(id, emailStore)
-
-		app.storage.SetActivityKey(shortuuid.New(), Activity{
-			Type:       ActivityContactLinked,
-			UserID:     gc.GetString("jfId"),
-			SourceType: ActivityUser,
-			Source:     gc.GetString("jfId"),
-			Value:      "email",
-			Time:       time.Now(),
-		}, gc, true)
-
-		if app.config.Section("ombi").Key("enabled").MustBool(false) {
-			ombiUser, code, err := app.getOmbiUser(id)
-			if code == 200 && err == nil {
-				ombiUser["emailAddress"] = claims["email"].(string)
-				code, err = app.ombi.ModifyUser(ombiUser)
-				if code != 200 || err != nil {
-					app.err.Printf("%s: Failed to change ombi email address (%d): %v", ombiUser["userName"].(string), code, err)
-				}
+	}
+	emailStore.Addr = address
+	app.storage.SetEmailsKey(id, emailStore)
+
+	app.storage.SetActivityKey(shortuuid.New(), Activity{
+		Type:       ActivityContactLinked,
+		UserID:     id,
+		SourceType: ActivityUser,
+		Source:     id,
+		Value:      "email",
+		Time:       time.Now(),
+	}, gc, true)
+
+	if app.config.Section("ombi").Key("enabled").MustBool(false) {
+		ombiUser, code, err := app.getOmbiUser(id)
+		if code == 200 && err == nil {
+			ombiUser["emailAddress"] = address
+			code, err = app.ombi.ModifyUser(ombiUser)
+			if code != 200 || err != nil {
+				app.err.Printf("%s: Failed to change ombi email address (%d): %v", ombiUser["userName"].(string), code, err)
 			}
 		}
+	}
 
-		app.info.Println("Email list modified")
-		gc.Redirect(http.StatusSeeOther, "/my/account")
-		return
+	app.info.Println("Email list modified")
+}
+
+// validEmail returns whether the given email address is acceptable.
+func validEmail(address string) bool {
+	return strings.ContainsRune(address, '@')
+}
+
+// emailChangeKey generates a confirmation key for changing the given user's email address.
+func (app *appContext) emailChangeKey(id, address string) (string, error) {
+	claims := jwt.MapClaims{
+		"valid":  true,
+		"id":     id,
+		"email":  address,
+		"type":   "confirmation",
+		"target": UserEmailChange,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return tk.SignedString([]byte(os.Getenv("JFA_SECRET")))
+}
+
+// emailConfirmationRequired returns whether email changes must be confirmed by clicking a link sent to the new address.
+func (app *appContext) emailConfirmationRequired() bool {
+	return emailEnabled && app.config.Section("email_confirmation").Key("enabled").MustBool(false)
+}
+
+// sendEmailChangeConfirmation sends the confirmation link for an email change to the new address.
+func (app *appContext) sendEmailChangeConfirmation(id, address, key string) {
+	user, status, err := app.jf.UserByID(id, false)
+	name := ""
+	if status == 200 && err == nil {
+		name = user.Name
+	}
+	msg, err := app.email.constructConfirmation("", name, key, app, false)
+	if err != nil {
+		app.err.Printf("%s: Failed to construct confirmation email: %v", name, err)
+	} else if err := app.email.send(msg, address); err != nil {
+		app.err.Printf("%s: Failed to send user confirmation email: %v", name, err)
+	} else {
+		app.info.Printf("%s: Sent user confirmation email to \"%s\"", name, address)
 	}
 }
 
@@ -249,23 +379,14 @@ func (app *appContext) ModifyMyEmail(gc *gin.Context) {
 	var req ModifyMyEmailDTO
 	gc.BindJSON(&req)
 	app.debug.Println("Email modification requested")
-	if !strings.ContainsRune(req.Email, '@') {
+	if !validEmail(req.Email) {
 		respond(400, "Invalid Email Address", gc)
 		return
 	}
 	id := gc.GetString("jfId")
 
 	// We'll use the ConfirmMyAction route to do the work, even if we don't need to confirm the address.
-	claims := jwt.MapClaims{
-		"valid":  true,
-		"id":     id,
-		"email":  req.Email,
-		"type":   "confirmation",
-		"target": UserEmailChange,
-		"exp":    time.Now().Add(time.Hour).Unix(),
-	}
-	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	key, err := tk.SignedString([]byte(os.Getenv("JFA_SECRET")))
+	key, err := app.emailChangeKey(id, req.Email)
 
 	if err != nil {
 		app.err.Printf("Failed to generate confirmation token: %v", err)
@@ -273,22 +394,10 @@ func (app *appContext) ModifyMyEmail(gc *gin.Context) {
 		return
 	}
 
-	if emailEnabled && app.config.Section("email_confirmation").Key("enabled").MustBool(false) {
-		user, status, err := app.jf.UserByID(id, false)
-		name := ""
-		if status == 200 && err == nil {
-			name = user.Name
-		}
+	if app.emailConfirmationRequired() {
 		app.debug.Printf("%s: Email confirmation required", id)
 		respond(401, "confirmEmail", gc)
-		msg, err := app.email.constructConfirmation("", name, key, app, false)
-		if err != nil {
-			app.err.Printf("%s: Failed to construct confirmation email: %v", name, err)
-		} else if err := app.email.send(msg, req.Email); err != nil {
-			app.err.Printf("%s: Failed to send user confirmation email: %v", name, err)
-		} else {
-			app.info.Printf("%s: Sent user confirmation email to \"%s\"", name, req.Email)
-		}
+		app.sendEmailChangeConfirmation(id, req.Email, key)
 		return
 	}
 
@@ -457,8 +566,10 @@ func (app *appContext) MatrixSendMyPIN(gc *gin.Context) {
 		}
 	}
 
-	ok := app.matrix.SendStart(req.UserID)
-	if !ok {
+	if err := app.matrix.SendStart(req.UserID, gc.GetString("jfId"), app.mediaServer()); err == ErrInvalidMatrixUserID {
+		respond(400, "errorInvalidMatrixID", gc)
+		return
+	} else if err != nil {
 		respondBool(500, false, gc)
 		return
 	}
@@ -478,7 +589,7 @@ func (app *appContext) MatrixSendMyPIN(gc *gin.Context) {
 func (app *appContext) MatrixCheckMyPIN(gc *gin.Context) {
 	userID := gc.Param("userID")
 	pin := gc.Param("pin")
-	user, ok := app.matrix.tokens[pin]
+	user, ok := app.matrix.token(pin)
 	if !ok {
 		app.debug.Println("Matrix: PIN not found")
 		respondBool(200, false, gc)
@@ -509,7 +620,9 @@ func (app *appContext) MatrixCheckMyPIN(gc *gin.Context) {
 		Time:       time.Now(),
 	}, gc, true)
 
-	delete(app.matrix.tokens, pin)
+	app.matrix.deleteToken(pin)
+	app.matrix.verified(gc.GetString("jfId"), mxUser, MatrixVerifiedUserPage)
+	app.matrix.SendLinkedSummary(mxUser, "")
 	respondBool(200, true, gc)
 }
 
@@ -622,10 +735,7 @@ func (app *appContext) ResetMyPassword(gc *gin.Context) {
 		}
 		return
 	}
-	if app.internalPWRs == nil {
-		app.internalPWRs = map[string]InternalPWR{}
-	}
-	app.internalPWRs[pwr.PIN] = pwr
+	app.addInternalReset(pwr)
 	// FIXME: Send to all contact methods
 	msg, err := app.email.constructReset(
 		PasswordReset{
@@ -642,7 +752,7 @@ func (app *appContext) ResetMyPassword(gc *gin.Context) {
 			return
 		}
 		return
-	} else if err := app.sendByID(msg, jfUser.ID); err != nil {
+	} else if err := app.sendResetByID(msg, jfUser.ID); err != nil {
 		app.err.Printf("Failed to send password reset message to \"%s\": %v", address, err)
 	} else {
 		app.info.Printf("Sent password reset message to \"%s\"", address)
@@ -739,20 +849,38 @@ func (app *appContext) ChangeMyPassword(gc *gin.Context) {
 // @Security Bearer
 // @Tags User Page
 func (app *appContext) GetMyReferral(gc *gin.Context) {
+	inv, err := app.referral(gc.GetString("jfId"))
+	if err != nil {
+		respondBool(400, false, gc)
+		return
+	}
+	gc.JSON(200, GetMyReferralRespDTO{
+		Code:          inv.Code,
+		RemainingUses: inv.RemainingUses,
+		NoLimit:       inv.NoLimit,
+		Expiry:        inv.ValidTill.Unix(),
+		UseExpiry:     inv.UseReferralExpiry,
+	})
+}
+
+var ErrReferralsDisabled = errors.New("referrals aren't enabled for this user")
+var ErrReferralExpired = errors.New("referral expired, and no more can be made")
+
+// referral returns the user's referral invite, creating one from their profile's template if they don't have one,
+// or renewing it if it's expired. Also used by the Matrix invite command.
+func (app *appContext) referral(jfID string) (inv Invite, err error) {
 	// 1. Look for existing template bound to this Jellyfin ID
 	//    If one exists, that means its just for us and so we
 	//    can use it directly.
-	inv := Invite{}
-	err := app.storage.db.FindOne(&inv, badgerhold.Where("ReferrerJellyfinID").Eq(gc.GetString("jfId")))
+	err = app.storage.db.FindOne(&inv, badgerhold.Where("ReferrerJellyfinID").Eq(jfID))
 	if err != nil {
 		// 2. Look for a template matching the key found in the user storage
 		//    Since this key is shared between users in a profile, we make a copy.
-		user, ok := app.storage.GetEmailsKey(gc.GetString("jfId"))
+		user, ok := app.storage.GetEmailsKey(jfID)
 		err = app.storage.db.Get(user.ReferralTemplateKey, &inv)
 		if !ok || err != nil || user.ReferralTemplateKey == "" {
 			app.debug.Printf("Ignoring referral request, couldn't find template.")
-			respondBool(400, false, gc)
-			return
+			return Invite{}, ErrReferralsDisabled
 		}
 		inv.Code = GenerateInviteCode()
 		expiryDelta := inv.ValidTill.Sub(inv.Created)
@@ -763,7 +891,7 @@ func (app *appContext) GetMyReferral(gc *gin.Context) {
 			inv.ValidTill = inv.Created.Add(REFERRAL_EXPIRY_DAYS * 24 * time.Hour)
 		}
 		inv.IsReferral = true
-		inv.ReferrerJellyfinID = gc.GetString("jfId")
+		inv.ReferrerJellyfinID = jfID
 		app.storage.SetInvitesKey(inv.Code, inv)
 	} else if time.Now().After(inv.ValidTill) {
 		// 3. We found an invite for us, but it's expired.
@@ -771,25 +899,18 @@ func (app *appContext) GetMyReferral(gc *gin.Context) {
 		//    If UseReferralExpiry is enabled, we delete it and return nothing.
 		app.storage.DeleteInvitesKey(inv.Code)
 		if inv.UseReferralExpiry {
-			user, ok := app.storage.GetEmailsKey(gc.GetString("jfId"))
+			user, ok := app.storage.GetEmailsKey(jfID)
 			if ok {
 				user.ReferralTemplateKey = ""
-				app.storage.SetEmailsKey(gc.GetString("jfId"), user)
+				app.storage.SetEmailsKey(jfID, user)
 			}
 			app.debug.Printf("Ignoring referral request, expired.")
-			respondBool(400, false, gc)
-			return
+			return Invite{}, ErrReferralExpired
 		}
 		inv.Code = GenerateInviteCode()
 		inv.Created = time.Now()
 		inv.ValidTill = inv.Created.Add(REFERRAL_EXPIRY_DAYS * 24 * time.Hour)
 		app.storage.SetInvitesKey(inv.Code, inv)
 	}
-	gc.JSON(200, GetMyReferralRespDTO{
-		Code:          inv.Code,
-		RemainingUses: inv.RemainingUses,
-		NoLimit:       inv.NoLimit,
-		Expiry:        inv.ValidTill.Unix(),
-		UseExpiry:     inv.UseReferralExpiry,
-	})
+	return inv, nil
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -180,7 +183,7 @@ func (app *appContext) newUser(req newUserDTO, confirmed bool, gc *gin.Context)
 				return
 			}
 		} else {
-			user, ok := app.matrix.tokens[req.MatrixPIN]
+			user, ok := app.matrix.token(req.MatrixPIN)
 			if !ok || !user.Verified {
 				matrixVerified = false
 				f = func(gc *gin.Context) {
@@ -333,6 +336,9 @@ func (app *appContext) newUser(req newUserDTO, confirmed bool, gc *gin.Context)
 		Value:      user.Name,
 		Time:       time.Now(),
 	}, gc, true)
+	if matrixEnabled {
+		app.matrix.AdminNotice(AdminNoticeSignup, user.Name)
+	}
 
 	emailStore := EmailAddress{
 		Addr:    req.Email,
@@ -470,11 +476,10 @@ func (app *appContext) newUser(req newUserDTO, confirmed bool, gc *gin.Context)
 	}
 	if matrixVerified {
 		matrixUser.Contact = req.MatrixContact
-		delete(app.matrix.tokens, req.MatrixPIN)
-		if app.storage.deprecatedMatrix == nil {
-			app.storage.deprecatedMatrix = matrixStore{}
-		}
+		app.matrix.deleteToken(req.MatrixPIN)
 		app.storage.SetMatrixKey(user.ID, matrixUser)
+		app.matrix.verified(user.ID, matrixUser, MatrixVerifiedSignup)
+		app.matrix.SendLinkedSummary(matrixUser, req.Username)
 	}
 	if (emailEnabled && app.config.Section("welcome_email").Key("enabled").MustBool(false) && req.Email != "") || telegramVerified || discordVerified || matrixVerified {
 		name := app.getAddressOrName(user.ID)
@@ -602,6 +607,9 @@ func (app *appContext) EnableDisableUsers(gc *gin.Context) {
 			app.err.Printf("Failed to set policy for user \"%s\" (%d): %v", userID, status, err)
 			continue
 		}
+		if matrixEnabled {
+			app.matrix.clearSelfDisabled(userID)
+		}
 
 		// Record activity
 		app.storage.SetActivityKey(shortuuid.New(), Activity{
@@ -884,7 +892,9 @@ func (app *appContext) Announce(gc *gin.Context) {
 				app.err.Printf("Failed to construct announcement message: %v", err)
 				respondBool(500, false, gc)
 				return
-			} else if err := app.sendByID(msg, userID); err != nil {
+			}
+			msg.Notification = NotificationAnnouncement
+			if err := app.sendByID(msg, userID); err != nil {
 				app.err.Printf("Failed to send announcement message: %v", err)
 				respondBool(500, false, gc)
 				return
@@ -896,7 +906,9 @@ func (app *appContext) Announce(gc *gin.Context) {
 			app.err.Printf("Failed to construct announcement messages: %v", err)
 			respondBool(500, false, gc)
 			return
-		} else if err := app.sendByID(msg, req.Users...); err != nil {
+		}
+		msg.Notification = NotificationAnnouncement
+		if err := app.sendByID(msg, req.Users...); err != nil {
 			app.err.Printf("Failed to send announcement messages: %v", err)
 			respondBool(500, false, gc)
 			return
@@ -1005,10 +1017,7 @@ func (app *appContext) AdminPasswordReset(gc *gin.Context) {
 			respondBool(500, false, gc)
 			return
 		}
-		if app.internalPWRs == nil {
-			app.internalPWRs = map[string]InternalPWR{}
-		}
-		app.internalPWRs[pwr.PIN] = pwr
+		app.addInternalReset(pwr)
 		sendAddress := app.getAddressOrName(id)
 		if sendAddress == "" || len(req.Users) == 1 {
 			resp.Link, err = app.GenResetLink(pwr.PIN)
@@ -1030,7 +1039,7 @@ func (app *appContext) AdminPasswordReset(gc *gin.Context) {
 				app.err.Printf("Failed to construct password reset message for \"%s\": %v", pwr.Username, err)
 				respondBool(500, false, gc)
 				return
-			} else if err := app.sendByID(msg, id); err != nil {
+			} else if err := app.sendResetByID(msg, id); err != nil {
 				app.err.Printf("Failed to send password reset message to \"%s\": %v", sendAddress, err)
 			} else {
 				app.info.Printf("Sent password reset message to \"%s\"", sendAddress)
@@ -1377,3 +1386,80 @@ func (app *appContext) ApplySettings(gc *gin.Context) {
 	}
 	gc.JSON(code, errors)
 }
+
+var ErrUnknownLocale = errors.New("locale not offered by the server")
+
+// jellyfinLocale is a display language offered by Jellyfin's clients.
+type jellyfinLocale struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// jellyfinLocales returns the display languages the server offers, which mediabrowser doesn't expose itself.
+func (app *appContext) jellyfinLocales() (locales []jellyfinLocale, err error) {
+	req, err := http.NewRequest("GET", app.jf.Server+"/Localization/Options", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Emby-Token", app.jf.AccessToken)
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to get locales (%d)", resp.StatusCode)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&locales)
+	return
+}
+
+// jellyfinLocale returns the display language set in the user's Jellyfin settings, or "" if they use their browser's.
+func (app *appContext) jellyfinLocale(jfID string) (string, error) {
+	displayprefs, status, err := app.jf.GetDisplayPreferences(jfID)
+	if !(status == 200 || status == 204) || err != nil {
+		return "", fmt.Errorf("failed to get displayprefs (%d): %v", status, err)
+	}
+	prefs, _ := displayprefs["CustomPrefs"].(map[string]interface{})
+	locale, _ := prefs["language"].(string)
+	return locale, nil
+}
+
+// setJellyfinLocale sets the display language in the user's Jellyfin settings, synced to their clients.
+// The code is matched case-insensitively against those offered by the server, and the canonical form is returned.
+func (app *appContext) setJellyfinLocale(jfID, code string) (string, error) {
+	locales, err := app.jellyfinLocales()
+	if err != nil {
+		return "", err
+	}
+	locale := ""
+	for _, l := range locales {
+		if strings.EqualFold(l.Value, code) {
+			locale = l.Value
+			break
+		}
+	}
+	if locale == "" {
+		return "", ErrUnknownLocale
+	}
+	displayprefs, status, err := app.jf.GetDisplayPreferences(jfID)
+	if !(status == 200 || status == 204) || err != nil {
+		return "", fmt.Errorf("failed to get displayprefs (%d): %v", status, err)
+	}
+	if displayprefs == nil {
+		displayprefs = map[string]interface{}{}
+	}
+	prefs, ok := displayprefs["CustomPrefs"].(map[string]interface{})
+	if !ok {
+		prefs = map[string]interface{}{}
+	}
+	prefs["language"] = locale
+	displayprefs["CustomPrefs"] = prefs
+	status, err = app.jf.SetDisplayPreferences(jfID, displayprefs)
+	if !(status == 200 || status == 204) || err != nil {
+		return "", fmt.Errorf("failed to set displayprefs (%d): %v", status, err)
+	}
+	return locale, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"strings"
 	"time"
 
@@ -53,6 +54,21 @@ func (app *appContext) formatDatetime(dt time.Time) string {
 	return d + " " + t
 }
 
+// expiryMessage describes when an account expires for the messaging bots, including the number of days left if it's in the future.
+// strs is the bot's strings in the user's language, e.g. from storage.lang.Telegram or storage.lang.Matrix.
+func (app *appContext) expiryMessage(strs telegramLang, expiry time.Time) string {
+	date, t := app.prettyTime(expiry)
+	days := int(math.Ceil(time.Until(expiry).Hours() / 24))
+	if days < 1 {
+		return strs.Strings.template("accountExpiry", tmpl{"date": date, "time": t})
+	}
+	return strs.Strings.template("accountExpiryDays", tmpl{
+		"days": strs.quantity("days", days),
+		"date": date,
+		"time": t,
+	})
+}
+
 // https://stackoverflow.com/questions/36530251/time-since-with-months-and-years/36531443#36531443 THANKS
 func timeDiff(a, b time.Time) (year, month, day, hour, min, sec int) {
 	if a.Location() != b.Location() {
@@ -135,12 +151,12 @@ func (app *appContext) ResetSetPassword(gc *gin.Context) {
 	}
 
 	var userID, username string
-	if reset, ok := app.internalPWRs[req.PIN]; ok {
+	if reset, ok := app.internalReset(req.PIN); ok {
 		isInternal = true
 		if time.Now().After(reset.Expiry) {
 			app.info.Printf("Password reset failed: PIN \"%s\" has expired", reset.PIN)
 			respondBool(401, false, gc)
-			delete(app.internalPWRs, req.PIN)
+			app.deleteInternalReset(req.PIN)
 			return
 		}
 		userID = reset.ID
@@ -152,7 +168,7 @@ func (app *appContext) ResetSetPassword(gc *gin.Context) {
 			respondBool(status, false, gc)
 			return
 		}
-		delete(app.internalPWRs, req.PIN)
+		app.deleteInternalReset(req.PIN)
 	} else {
 		resp, status, err := app.jf.ResetPassword(req.PIN)
 		if status != 200 || err != nil || !resp.Success {
@@ -174,6 +174,9 @@ func (app *appContext) validateJellyfinCredentials(username, password string, gc
 	if status != 200 || err != nil {
 		if status == 401 || status == 400 {
 			app.logIpInfo(gc, userpage, "Auth denied: Invalid username/password (Jellyfin)")
+			if matrixEnabled {
+				app.matrix.AdminNotice(AdminNoticeLoginFailed, username)
+			}
 			respond(401, "Unauthorized", gc)
 			return
 		}
@@ -216,6 +219,9 @@ func (app *appContext) getTokenLogin(gc *gin.Context) {
 	}
 	if !app.jellyfinLogin && !match {
 		app.logIpInfo(gc, false, "Auth denied: Invalid username/password")
+		if matrixEnabled {
+			app.matrix.AdminNotice(AdminNoticeLoginFailed, username)
+		}
 		respond(401, "Unauthorized", gc)
 		return
 	}
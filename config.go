@@ -50,7 +50,7 @@ func (app *appContext) loadConfig() error {
 	for _, key := range []string{"user_configuration", "user_displayprefs", "user_profiles", "ombi_template", "invites", "emails", "user_template", "custom_emails", "users", "telegram_users", "discord_users", "matrix_users", "announcements", "custom_user_page_content"} {
 		app.config.Section("files").Key(key).SetValue(app.config.Section("files").Key(key).MustString(filepath.Join(app.dataPath, (key + ".json"))))
 	}
-	for _, key := range []string{"matrix_sql"} {
+	for _, key := range []string{"matrix_sql", "matrix_crypto_sql"} {
 		app.config.Section("files").Key(key).SetValue(app.config.Section("files").Key(key).MustString(filepath.Join(app.dataPath, (key + ".db"))))
 	}
 	app.URLBase = strings.TrimSuffix(app.config.Section("ui").Key("url_base").MustString(""), "/")
@@ -108,13 +108,41 @@ func (app *appContext) loadConfig() error {
 	app.MustSetValue("user_expiry", "adjustment_email_html", "jfa-go:"+"expiry-adjusted.html")
 	app.MustSetValue("user_expiry", "adjustment_email_text", "jfa-go:"+"expiry-adjusted.txt")
 
-	app.MustSetValue("matrix", "topic", "Jellyfin notifications")
 	app.MustSetValue("matrix", "show_on_reg", "true")
+	app.MustSetValue("matrix", "device_id", "jfa-go")
+	app.MustSetValue("matrix", "device_name", "jfa-go")
+	app.MustSetValue("matrix", "command_prefix", "!")
+	app.MustSetValue("matrix", "commands_enabled", "true")
+	app.MustSetValue("matrix", "rate_limit_retries", "3")
+	app.MustSetValue("matrix", "transient_retries", "3")
+	app.MustSetValue("matrix", "sync_timeout_seconds", "30")
+	app.MustSetValue("matrix", "broadcast_workers", "4")
+	app.MustSetValue("matrix", "command_rate_limit", "20")
+	app.MustSetValue("matrix", "command_burst", "5")
+	app.MustSetValue("matrix", "reset_cooldown_minutes", "10")
+	app.MustSetValue("matrix", "contact_cooldown_minutes", "5")
+	app.MustSetValue("matrix", "start_cooldown_minutes", "5")
+	app.MustSetValue("matrix", "admin_notice_delay_seconds", "30")
+	app.MustSetValue("matrix", "pin_expiry_minutes", "30")
+	app.MustSetValue("matrix", "reminder_earliest_hour", "9")
+	app.MustSetValue("matrix", "reminder_latest_hour", "21")
+	app.MustSetValue("matrix", "notify_expired_pins", "false")
+	app.MustSetValue("matrix", "auto_verify", "false")
+	app.MustSetValue("matrix", "show_typing", "false")
+	app.MustSetValue("matrix", "reply_in_thread", "false")
+	app.MustSetValue("matrix", "reaction_with_text", "false")
+	app.MustSetValue("matrix", "force_encryption", "false")
+	app.MustSetValue("matrix", "disable_encryption", "false")
 
 	app.MustSetValue("discord", "show_on_reg", "true")
+	app.MustSetValue("discord", "reset_cooldown_minutes", "10")
 
 	app.MustSetValue("telegram", "show_on_reg", "true")
 
+	app.MustSetValue("messages", "retry_max_age_hours", "24")
+
+	app.MustSetValue("password_resets", "allow_matrix", "true")
+
 	app.MustSetValue("backups", "every_n_minutes", "1440")
 	app.MustSetValue("backups", "path", filepath.Join(app.dataPath, "backups"))
 	app.MustSetValue("backups", "keep_n_backups", "20")
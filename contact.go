@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Notification types users can choose the contact methods of, set as Message.Notification.
+const (
+	NotificationWelcome      = "welcome"
+	NotificationExpiry       = "expiry"
+	NotificationReset        = "reset"
+	NotificationAnnouncement = "announcement"
+)
+
+var notificationTypes = []string{NotificationWelcome, NotificationExpiry, NotificationReset, NotificationAnnouncement}
+
+func validNotificationType(notification string) bool {
+	for _, n := range notificationTypes {
+		if n == notification {
+			return true
+		}
+	}
+	return false
+}
+
+// ContactMethod is a platform notifications can be sent through, e.g. email or a messaging bot.
+type ContactMethod interface {
+	// Name returns a human-readable name for the platform, for use in logs.
+	Name() string
+	// Reachable returns whether the user with the given Jellyfin ID has linked this platform and wants to be contacted through it.
+	Reachable(jfID string) bool
+	// SendByID sends the message to the users with the given Jellyfin IDs, skipping any which aren't reachable.
+	SendByID(message *Message, jfID ...string) error
+}
+
+// Allowed returns whether the given type of notification should be sent through the named contact method.
+// Everything is allowed unless the user has turned it off.
+func (p NotificationPreferences) Allowed(notification, method string) bool {
+	for _, m := range p.Disabled[notification] {
+		if strings.EqualFold(m, method) {
+			return false
+		}
+	}
+	return true
+}
+
+// Set enables or disables the given type of notification for the named contact method.
+func (p *NotificationPreferences) Set(notification, method string, enabled bool) {
+	if p.Disabled == nil {
+		p.Disabled = map[string][]string{}
+	}
+	method = strings.ToLower(method)
+	methods := []string{}
+	for _, m := range p.Disabled[notification] {
+		if m != method {
+			methods = append(methods, m)
+		}
+	}
+	if !enabled {
+		methods = append(methods, method)
+	}
+	p.Disabled[notification] = methods
+}
+
+// contactMethods returns the enabled contact methods.
+func (app *appContext) contactMethods() (methods []ContactMethod) {
+	if telegramEnabled {
+		methods = append(methods, app.telegram)
+	}
+	if discordEnabled {
+		methods = append(methods, app.discord)
+	}
+	if matrixEnabled {
+		methods = append(methods, app.matrix)
+	}
+	if emailEnabled {
+		methods = append(methods, emailContact{app})
+	}
+	return
+}
+
+func (t *TelegramDaemon) Name() string { return "Telegram" }
+
+func (t *TelegramDaemon) Reachable(jfID string) bool {
+	tgChat, ok := t.app.storage.GetTelegramKey(jfID)
+	return ok && tgChat.Contact
+}
+
+func (t *TelegramDaemon) SendByID(message *Message, jfID ...string) (err error) {
+	for _, id := range jfID {
+		if tgChat, ok := t.app.storage.GetTelegramKey(id); ok && tgChat.Contact {
+			err = errors.Join(err, t.Send(message, tgChat.ChatID))
+		}
+	}
+	return
+}
+
+func (d *DiscordDaemon) Name() string { return "Discord" }
+
+func (d *DiscordDaemon) Reachable(jfID string) bool {
+	dcChat, ok := d.app.storage.GetDiscordKey(jfID)
+	return ok && dcChat.Contact
+}
+
+func (d *DiscordDaemon) SendByID(message *Message, jfID ...string) (err error) {
+	for _, id := range jfID {
+		if dcChat, ok := d.app.storage.GetDiscordKey(id); ok && dcChat.Contact {
+			err = errors.Join(err, d.Send(message, dcChat.ChannelID))
+		}
+	}
+	return
+}
+
+func (d *MatrixDaemon) Name() string { return "Matrix" }
+
+func (d *MatrixDaemon) Reachable(jfID string) bool {
+	mxChat, ok := d.app.storage.GetMatrixKey(jfID)
+	return ok && mxChat.Contact
+}
+
+func (d *MatrixDaemon) SendByID(message *Message, jfID ...string) (err error) {
+	for _, id := range jfID {
+		if mxChat, ok := d.app.storage.GetMatrixKey(id); ok && mxChat.Contact {
+			err = errors.Join(err, d.Send(message, mxChat))
+		}
+	}
+	return
+}
+
+// emailContact sends to users' stored email addresses, as the Emailer itself has no access to storage.
+type emailContact struct {
+	app *appContext
+}
+
+func (e emailContact) Name() string { return "Email" }
+
+func (e emailContact) Reachable(jfID string) bool {
+	address, ok := e.app.storage.GetEmailsKey(jfID)
+	return ok && address.Contact
+}
+
+func (e emailContact) SendByID(message *Message, jfID ...string) (err error) {
+	for _, id := range jfID {
+		if address, ok := e.app.storage.GetEmailsKey(id); ok && address.Contact {
+			err = errors.Join(err, e.app.email.send(message, address.Addr))
+		}
+	}
+	return
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	dg "github.com/bwmarrin/discordgo"
 	"github.com/timshannon/badgerhold/v4"
 )
 
+// Number of times to retry registering commands if rate-limited.
+const DISCORD_COMMAND_REGISTER_RETRIES = 3
+
 type DiscordDaemon struct {
 	Stopped                                                    bool
 	ShutdownChannel                                            chan string
@@ -25,6 +30,9 @@ type DiscordDaemon struct {
 	commandHandlers                                            map[string]func(s *dg.Session, i *dg.InteractionCreate, lang string)
 	commandIDs                                                 []string
 	commandDescriptions                                        []*dg.ApplicationCommand
+	resetCooldown                                              time.Duration
+	lastReset                                                  map[string]time.Time // Map of user IDs to the time they last requested a password reset.
+	lastResetLock                                              sync.Mutex
 }
 
 func newDiscordDaemon(app *appContext) (*DiscordDaemon, error) {
@@ -47,11 +55,16 @@ func newDiscordDaemon(app *appContext) (*DiscordDaemon, error) {
 		roleID:          app.config.Section("discord").Key("apply_role").String(),
 		commandHandlers: map[string]func(s *dg.Session, i *dg.InteractionCreate, lang string){},
 		commandIDs:      []string{},
+		resetCooldown:   time.Duration(app.config.Section("discord").Key("reset_cooldown_minutes").MustInt(10)) * time.Minute,
+		lastReset:       map[string]time.Time{},
 	}
 	dd.commandHandlers[app.config.Section("discord").Key("start_command").MustString("start")] = dd.cmdStart
 	dd.commandHandlers["lang"] = dd.cmdLang
 	dd.commandHandlers["pin"] = dd.cmdPIN
 	dd.commandHandlers["inv"] = dd.cmdInvite
+	dd.commandHandlers["help"] = dd.cmdHelp
+	dd.commandHandlers["expiry"] = dd.cmdExpiry
+	dd.commandHandlers["reset"] = dd.cmdReset
 	for _, user := range app.storage.GetDiscord() {
 		dd.users[user.ID] = user
 	}
@@ -377,6 +390,18 @@ func (d *DiscordDaemon) registerCommands() {
 				},
 			},
 		},
+		{
+			Name:        "help",
+			Description: "Show the available commands.",
+		},
+		{
+			Name:        "expiry",
+			Description: "Check when your account expires.",
+		},
+		{
+			Name:        "reset",
+			Description: "Request a password reset.",
+		},
 	}
 	d.commandDescriptions[1].Options[0].Choices = make([]*dg.ApplicationCommandOptionChoice, len(d.app.storage.lang.Telegram))
 	i := 0
@@ -402,16 +427,25 @@ func (d *DiscordDaemon) registerCommands() {
 	// d.deregisterCommands()
 
 	d.commandIDs = make([]string, len(d.commandDescriptions))
-	// cCommands, err := d.bot.ApplicationCommandBulkOverwrite(d.bot.State.User.ID, d.guildID, commands)
-	// if err != nil {
-	// 	d.app.err.Printf("Discord: Cannot create commands: %v", err)
-	// }
-	for i, cmd := range d.commandDescriptions {
-		command, err := d.bot.ApplicationCommandCreate(d.bot.State.User.ID, d.guildID, cmd)
-		if err != nil {
-			d.app.err.Printf("Discord: Cannot create command \"%s\": %v", cmd.Name, err)
-		} else {
-			d.app.debug.Printf("Discord: registered command \"%s\"", cmd.Name)
+	// Registering all commands at once uses a single request, rather than one for each, which quickly hits the rate limit.
+	var commands []*dg.ApplicationCommand
+	var err error
+	for attempt := 0; ; attempt++ {
+		commands, err = d.bot.ApplicationCommandBulkOverwrite(d.bot.State.User.ID, d.guildID, d.commandDescriptions, dg.WithRetryOnRatelimit(false))
+		var rlErr *dg.RateLimitError
+		if !errors.As(err, &rlErr) || attempt >= DISCORD_COMMAND_REGISTER_RETRIES {
+			break
+		}
+		d.app.debug.Printf("Discord: Rate limited registering commands, retrying in %s", rlErr.RetryAfter)
+		time.Sleep(rlErr.RetryAfter)
+	}
+	if err != nil {
+		d.app.err.Printf("Discord: Cannot create commands: %v", err)
+		return
+	}
+	for i, command := range commands {
+		if i < len(d.commandIDs) {
+			d.app.debug.Printf("Discord: registered command \"%s\"", command.Name)
 			d.commandIDs[i] = command.ID
 		}
 	}
@@ -572,6 +606,113 @@ func (d *DiscordDaemon) cmdLang(s *dg.Session, i *dg.InteractionCreate, lang str
 	}
 }
 
+// respond replies to the interaction with a message only visible to the user.
+func (d *DiscordDaemon) respond(s *dg.Session, i *dg.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &dg.InteractionResponse{
+		Type: dg.InteractionResponseChannelMessageWithSource,
+		Data: &dg.InteractionResponseData{
+			Content: content,
+			Flags:   64, // Ephemeral
+		},
+	})
+	if err != nil {
+		d.app.err.Printf("Discord: Failed to send message to \"%s\": %v", i.Interaction.Member.User.Username, err)
+	}
+}
+
+// linkedUser returns the stored user with the given Discord ID, if they're linked to a Jellyfin account.
+func (d *DiscordDaemon) linkedUser(userID string) (DiscordUser, bool) {
+	for _, u := range d.app.storage.GetDiscord() {
+		if u.ID == userID && u.JellyfinID != "" {
+			return u, true
+		}
+	}
+	return DiscordUser{}, false
+}
+
+func (d *DiscordDaemon) cmdHelp(s *dg.Session, i *dg.InteractionCreate, lang string) {
+	content := d.app.storage.lang.Telegram[lang].Strings.get("discordHelpMessage") + "\n"
+	for _, cmd := range d.commandDescriptions {
+		content += fmt.Sprintf("/%s: %s\n", cmd.Name, cmd.Description)
+	}
+	d.respond(s, i, content)
+}
+
+func (d *DiscordDaemon) cmdExpiry(s *dg.Session, i *dg.InteractionCreate, lang string) {
+	user, ok := d.linkedUser(i.Interaction.Member.User.ID)
+	if !ok {
+		d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("discordNotLinked"))
+		return
+	}
+	content := d.app.storage.lang.Telegram[lang].Strings.get("accountNoExpiry")
+	if expiry, ok := d.app.storage.GetUserExpiryKey(user.JellyfinID); ok {
+		content = d.app.expiryMessage(d.app.storage.lang.Telegram[lang], expiry.Expiry)
+	}
+	d.respond(s, i, content)
+}
+
+func (d *DiscordDaemon) cmdReset(s *dg.Session, i *dg.InteractionCreate, lang string) {
+	user, ok := d.linkedUser(i.Interaction.Member.User.ID)
+	if !ok {
+		d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("discordNotLinked"))
+		return
+	}
+	d.lastResetLock.Lock()
+	last, ok := d.lastReset[user.ID]
+	d.lastResetLock.Unlock()
+	if ok && time.Since(last) < d.resetCooldown {
+		d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("resetCooldown"))
+		return
+	}
+	pwr, err := d.app.GenInternalReset(user.JellyfinID)
+	if err != nil {
+		d.app.err.Printf("Failed to get user from Jellyfin: %v", err)
+		d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("resetFailed"))
+		return
+	}
+	d.app.addInternalReset(pwr)
+	d.lastResetLock.Lock()
+	d.lastReset[user.ID] = time.Now()
+	d.lastResetLock.Unlock()
+	msg, err := d.app.email.constructReset(
+		PasswordReset{
+			Pin:      pwr.PIN,
+			Username: pwr.Username,
+			Expiry:   pwr.Expiry,
+			Internal: true,
+		}, d.app, false,
+	)
+	if err != nil {
+		d.app.err.Printf("Failed to construct password reset message for \"%s\": %v", pwr.Username, err)
+		d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("resetFailed"))
+		return
+	}
+	// Discord is sent to directly, as the request came from here whether or not the user wants contact through it.
+	methods := []ContactMethod{}
+	for _, method := range d.app.contactMethods() {
+		if _, ok := method.(*DiscordDaemon); ok {
+			continue
+		}
+		if _, ok := method.(*MatrixDaemon); ok && !d.app.matrixResetsAllowed() {
+			continue
+		}
+		methods = append(methods, method)
+	}
+	otherErr := d.app.sendByIDVia(methods, msg, user.JellyfinID)
+	discordErr := d.Send(msg, user.ChannelID)
+	if err := errors.Join(otherErr, discordErr); err != nil {
+		d.app.err.Printf("Failed to send password reset message to \"%s\": %v", RenderDiscordUsername(user), err)
+		if discordErr != nil {
+			d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("resetFailed"))
+		} else {
+			d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("resetPartlySent"))
+		}
+		return
+	}
+	d.app.info.Printf("Sent password reset message to \"%s\"", RenderDiscordUsername(user))
+	d.respond(s, i, d.app.storage.lang.Telegram[lang].Strings.get("resetSent"))
+}
+
 func (d *DiscordDaemon) cmdInvite(s *dg.Session, i *dg.InteractionCreate, lang string) {
 	channel, err := s.UserChannelCreate(i.Interaction.Member.User.ID)
 	if err != nil {
@@ -845,35 +986,40 @@ func (d *DiscordDaemon) Send(message *Message, channelID ...string) error {
 		msg = message.Text
 	}
 	for _, id := range channelID {
-		var err error
-		if len(embeds) != 0 {
-			_, err = d.bot.ChannelMessageSendComplex(
-				id,
-				&dg.MessageSend{
-					Content: msg,
-					Embed:   embeds[0],
-				},
-			)
-			if err != nil {
-				return err
-			}
-			for i := 1; i < len(embeds); i++ {
-				_, err := d.bot.ChannelMessageSendEmbed(id, embeds[i])
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			_, err := d.bot.ChannelMessageSend(
-				id,
-				msg,
-			)
+		err := d.sendToChannel(id, msg, embeds)
+		notificationMetrics.record("discord", message, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DiscordDaemon) sendToChannel(id, msg string, embeds []*dg.MessageEmbed) error {
+	if len(embeds) != 0 {
+		_, err := d.bot.ChannelMessageSendComplex(
+			id,
+			&dg.MessageSend{
+				Content: msg,
+				Embed:   embeds[0],
+			},
+		)
+		if err != nil {
+			return err
+		}
+		for i := 1; i < len(embeds); i++ {
+			_, err := d.bot.ChannelMessageSendEmbed(id, embeds[i])
 			if err != nil {
 				return err
 			}
 		}
+		return nil
 	}
-	return nil
+	_, err := d.bot.ChannelMessageSend(
+		id,
+		msg,
+	)
+	return err
 }
 
 // UserVerified returns whether or not a token with the given PIN has been verified, and the user itself.
@@ -22,12 +22,19 @@ import (
 	"github.com/hrfee/jfa-go/easyproxy"
 	"github.com/hrfee/mediabrowser"
 	"github.com/itchyny/timefmt-go"
+	"github.com/lithammer/shortuuid/v3"
 	"github.com/mailgun/mailgun-go/v4"
 	"github.com/timshannon/badgerhold/v4"
 	sMail "github.com/xhit/go-simple-mail/v2"
 )
 
-var markdownRenderer = html.NewRenderer(html.RendererOptions{Flags: html.Smartypants})
+var markdownRenderer = newMarkdownRenderer()
+
+// newMarkdownRenderer returns a renderer like markdownRenderer. Renderers keep state while rendering,
+// so code which renders from several goroutines at once needs one each.
+func newMarkdownRenderer() *html.Renderer {
+	return html.NewRenderer(html.RendererOptions{Flags: html.Smartypants})
+}
 
 // EmailClient implements email sending, right now via smtp, mailgun or a dummy client.
 type EmailClient interface {
@@ -47,8 +54,50 @@ type Message struct {
 	HTML     string `json:"html"`
 	Text     string `json:"text"`
 	Markdown string `json:"markdown"`
+	// Type of notification, checked against the user's NotificationPreferences. Left blank for messages which should always be sent.
+	Notification string `json:"-"`
+	// Whether the message can be held back by features like muting.
+	Priority MessagePriority `json:"priority"`
+	// If set, called once for each Matrix user sent the message, with whether they read it within MATRIX_DELIVERY_TIMEOUT.
+	OnMatrixRead func(user MatrixUser, read bool) `json:"-"`
+	// Identifies the message across retries, so Matrix homeservers can drop duplicates. Set by sendByIDVia if blank.
+	TxnID string `json:"txnID,omitempty"`
+	// Sent after the text by contact methods which support them, and ignored by those which don't.
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// AttachmentType is what an Attachment holds, which decides how contact methods send it.
+type AttachmentType string
+
+const (
+	AttachmentFile     AttachmentType = "file"
+	AttachmentImage    AttachmentType = "image"
+	AttachmentLocation AttachmentType = "location"
+)
+
+// Attachment is a file, image or location sent along with a message.
+// Each contact method maps it onto its own way of uploading or sending them.
+type Attachment struct {
+	Type AttachmentType `json:"type"`
+	// File name, or a description of a location.
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	// Location as a geo: URI (RFC 5870), e.g. "geo:51.5,-0.12".
+	GeoURI string `json:"geoURI,omitempty"`
 }
 
+// MessagePriority decides whether a message can be held back by features like muting. Defaults to PriorityNormal.
+type MessagePriority int
+
+const (
+	// PriorityNormal messages, e.g. announcements, aren't sent to users who've muted notifications.
+	PriorityNormal MessagePriority = iota
+	// PriorityCritical messages concern the user's account, e.g. a password reset, it being disabled or expiring soon,
+	// and are sent even if they've muted notifications.
+	PriorityCritical
+)
+
 func (emailer *Emailer) formatExpiry(expiry time.Time, tzaware bool, datePattern, timePattern string) (d, t, expiresIn string) {
 	d = timefmt.Format(expiry, datePattern)
 	t = timefmt.Format(expiry, timePattern)
@@ -368,6 +417,8 @@ func (emailer *Emailer) constructTemplate(subject, md string, app *appContext, u
 		md = templateEmail(md, []string{"{username}"}, nil, map[string]interface{}{"username": username[0]})
 		subject = templateEmail(subject, []string{"{username}"}, nil, map[string]interface{}{"username": username[0]})
 	}
+	md = app.resolvePlaceholders(md)
+	subject = app.resolvePlaceholders(subject)
 	email := &Message{Subject: subject}
 	html := markdown.ToHTML([]byte(md), nil, markdownRenderer)
 	text := stripMarkdown(md)
@@ -389,15 +440,36 @@ func (emailer *Emailer) constructTemplate(subject, md string, app *appContext, u
 	return email, nil
 }
 
-func (emailer *Emailer) inviteValues(code string, invite Invite, app *appContext, noSub bool) map[string]interface{} {
-	expiry := invite.ValidTill
-	d, t, expiresIn := emailer.formatExpiry(expiry, false, app.datePattern, app.timePattern)
-	message := app.config.Section("messages").Key("message").String()
+// MediaServer is the Jellyfin/Emby server a user is being given access to, for messages which name it.
+type MediaServer struct {
+	Name string
+	URL  string // Where users log in.
+}
+
+// mediaServer returns the server invites give access to.
+// Each jfa-go instance manages a single server, so it's the same for every invite.
+func (app *appContext) mediaServer() MediaServer {
+	server := MediaServer{URL: app.config.Section("jellyfin").Key("public_server").String()}
+	if app.jf != nil {
+		server.Name = app.jf.ServerInfo.Name
+	}
+	return server
+}
+
+// inviteURL returns the public link to the invite with the given code, based on invite_emails.url_base.
+func (app *appContext) inviteURL(code string) string {
 	inviteLink := app.config.Section("invite_emails").Key("url_base").String()
 	if !strings.HasSuffix(inviteLink, "/invite") {
 		inviteLink += "/invite"
 	}
-	inviteLink = fmt.Sprintf("%s/%s", inviteLink, code)
+	return fmt.Sprintf("%s/%s", inviteLink, code)
+}
+
+func (emailer *Emailer) inviteValues(code string, invite Invite, app *appContext, noSub bool) map[string]interface{} {
+	expiry := invite.ValidTill
+	d, t, expiresIn := emailer.formatExpiry(expiry, false, app.datePattern, app.timePattern)
+	message := app.config.Section("messages").Key("message").String()
+	inviteLink := app.inviteURL(code)
 	template := map[string]interface{}{
 		"hello":              emailer.lang.InviteEmail.get("hello"),
 		"youHaveBeenInvited": emailer.lang.InviteEmail.get("youHaveBeenInvited"),
@@ -612,6 +684,8 @@ func (emailer *Emailer) constructReset(pwr PasswordReset, app *appContext, noSub
 	if err != nil {
 		return nil, err
 	}
+	email.Notification = NotificationReset
+	email.Priority = PriorityCritical
 	return email, nil
 }
 
@@ -654,6 +728,7 @@ func (emailer *Emailer) constructDeleted(reason string, app *appContext, noSub b
 	if err != nil {
 		return nil, err
 	}
+	email.Priority = PriorityCritical
 	return email, nil
 }
 
@@ -696,6 +771,7 @@ func (emailer *Emailer) constructDisabled(reason string, app *appContext, noSub
 	if err != nil {
 		return nil, err
 	}
+	email.Priority = PriorityCritical
 	return email, nil
 }
 
@@ -804,6 +880,7 @@ func (emailer *Emailer) constructExpiryAdjusted(username string, expiry time.Tim
 	if err != nil {
 		return nil, err
 	}
+	email.Notification = NotificationExpiry
 	return email, nil
 }
 
@@ -870,6 +947,7 @@ func (emailer *Emailer) constructWelcome(username string, expiry time.Time, app
 	if err != nil {
 		return nil, err
 	}
+	email.Notification = NotificationWelcome
 	return email, nil
 }
 
@@ -906,43 +984,63 @@ func (emailer *Emailer) constructUserExpired(app *appContext, noSub bool) (*Mess
 	if err != nil {
 		return nil, err
 	}
+	email.Notification = NotificationExpiry
+	email.Priority = PriorityCritical
 	return email, nil
 }
 
 // calls the send method in the underlying emailClient.
 func (emailer *Emailer) send(email *Message, address ...string) error {
-	return emailer.sender.Send(emailer.fromName, emailer.fromAddr, email, address...)
+	err := emailer.sender.Send(emailer.fromName, emailer.fromAddr, email, address...)
+	for range address {
+		notificationMetrics.record("email", email, err)
+	}
+	return err
 }
 
 func (app *appContext) sendByID(email *Message, ID ...string) (err error) {
-	for _, id := range ID {
-		if tgChat, ok := app.storage.GetTelegramKey(id); ok && tgChat.Contact && telegramEnabled {
-			err = app.telegram.Send(email, tgChat.ChatID)
-			// if err != nil {
-			// 	return err
-			// }
-		}
-		if dcChat, ok := app.storage.GetDiscordKey(id); ok && dcChat.Contact && discordEnabled {
-			err = app.discord.Send(email, dcChat.ChannelID)
-			// if err != nil {
-			// 	return err
-			// }
-		}
-		if mxChat, ok := app.storage.GetMatrixKey(id); ok && mxChat.Contact && matrixEnabled {
-			err = app.matrix.Send(email, mxChat)
-			// if err != nil {
-			// 	return err
-			// }
+	return app.sendByIDVia(app.contactMethods(), email, ID...)
+}
+
+// sendResetByID is sendByID for password resets, which skips Matrix if password_resets.allow_matrix is disabled.
+func (app *appContext) sendResetByID(email *Message, ID ...string) (err error) {
+	methods := []ContactMethod{}
+	for _, method := range app.contactMethods() {
+		if _, ok := method.(*MatrixDaemon); ok && !app.matrixResetsAllowed() {
+			continue
 		}
-		if address, ok := app.storage.GetEmailsKey(id); ok && address.Contact && emailEnabled {
-			err = app.email.send(email, address.Addr)
-			// if err != nil {
-			// 	return err
-			// }
+		methods = append(methods, method)
+	}
+	return app.sendByIDVia(methods, email, ID...)
+}
+
+func (app *appContext) matrixResetsAllowed() bool {
+	return app.config.Section("password_resets").Key("allow_matrix").MustBool(true)
+}
+
+func (app *appContext) sendByIDVia(methods []ContactMethod, email *Message, ID ...string) (err error) {
+	retry := app.config.Section("messages").Key("retry_failed").MustBool(false)
+	if email.TxnID == "" {
+		// Copied, so the caller can reuse the message for a separate send.
+		msg := *email
+		msg.TxnID = shortuuid.New()
+		email = &msg
+	}
+	for _, method := range methods {
+		for _, id := range ID {
+			if email.Notification != "" {
+				if prefs, ok := app.storage.GetNotificationPreferencesKey(id); ok && !prefs.Allowed(email.Notification, method.Name()) {
+					continue
+				}
+			}
+			if e := method.SendByID(email, id); e != nil {
+				app.debug.Printf("Failed to send by %s: %v", method.Name(), e)
+				err = errors.Join(err, e)
+				if retry {
+					app.queueMessage(email, method.Name(), id, e)
+				}
+			}
 		}
-		// if err != nil {
-		// 	return err
-		// }
 	}
 	return
 }
@@ -38,6 +38,7 @@ require (
 	github.com/hrfee/mediabrowser v0.3.13
 	github.com/itchyny/timefmt-go v0.1.5
 	github.com/lithammer/shortuuid/v3 v3.0.7
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/mailgun/mailgun-go/v4 v4.9.1
 	github.com/robert-nix/ansihtml v1.0.1
 	github.com/steambap/captcha v1.4.1
@@ -46,6 +47,7 @@ require (
 	github.com/timshannon/badgerhold/v4 v4.0.2
 	github.com/writeas/go-strip-markdown v2.0.1+incompatible
 	github.com/xhit/go-simple-mail/v2 v2.16.0
+	golang.org/x/net v0.15.0
 	gopkg.in/ini.v1 v1.67.0
 	maunium.net/go/mautrix v0.15.3
 )
@@ -123,7 +125,6 @@ require (
 	golang.org/x/crypto v0.13.0 // indirect
 	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df // indirect
 	golang.org/x/image v0.8.0 // indirect
-	golang.org/x/net v0.15.0 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/tools v0.10.0 // indirect
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"strconv"
+	"strings"
+)
+
 type langMeta struct {
 	Name string `json:"name"`
 	// Language to fall back on if strings are missing. Defaults to en-us.
@@ -11,6 +16,15 @@ type quantityString struct {
 	Plural   string `json:"plural"`
 }
 
+// get returns the form of the string for the quantity n, with {n} replaced by it. Falls back to the singular form if there's no plural.
+func (qs quantityString) get(n int) string {
+	s := qs.Plural
+	if n == 1 || s == "" {
+		s = qs.Singular
+	}
+	return strings.ReplaceAll(s, "{n}", strconv.Itoa(n))
+}
+
 type adminLangs map[string]adminLang
 
 func (ls *adminLangs) getOptions() [][2]string {
@@ -147,8 +161,14 @@ func (ls *setupLangs) getOptions() [][2]string {
 type telegramLangs map[string]telegramLang
 
 type telegramLang struct {
-	Meta    langMeta    `json:"meta"`
-	Strings langSection `json:"strings"`
+	Meta            langMeta                  `json:"meta"`
+	Strings         langSection               `json:"strings"`
+	QuantityStrings map[string]quantityString `json:"quantityStrings"`
+}
+
+// quantity returns the quantity string with the given key for n, shared by the Telegram, Discord and Matrix bots.
+func (tl telegramLang) quantity(key string, n int) string {
+	return tl.QuantityStrings[key].get(n)
 }
 
 func (ts *telegramLangs) getOptions() [][2]string {
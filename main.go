@@ -122,6 +122,7 @@ type appContext struct {
 	proxyTransport       *http.Transport
 	proxyConfig          easyproxy.ProxyConfig
 	internalPWRs         map[string]InternalPWR
+	internalPWRsLock     sync.Mutex
 	pwrCaptchas          map[string]Captcha
 	ConfirmationKeys     map[string]map[string]newUserDTO // Map of invite code to jwt to request
 	confirmationKeysLock sync.Mutex
@@ -306,6 +307,7 @@ func start(asDaemon, firstCall bool) {
 	app.storage.lang.AdminPath = "admin"
 	app.storage.lang.EmailPath = "email"
 	app.storage.lang.TelegramPath = "telegram"
+	app.storage.lang.MatrixPath = "matrix"
 	app.storage.lang.PasswordResetPath = "pwreset"
 	externalLang := app.config.Section("files").Key("lang_files").MustString("")
 	var err error
@@ -482,6 +484,12 @@ func start(asDaemon, firstCall bool) {
 			go app.checkForUpdates()
 		}
 
+		if app.config.Section("messages").Key("retry_failed").MustBool(false) {
+			retryDaemon := newRetryQueueDaemon(app)
+			go retryDaemon.run()
+			defer retryDaemon.Shutdown()
+		}
+
 		var backupDaemon *housekeepingDaemon
 		if app.config.Section("backups").Key("enabled").MustBool(false) {
 			backupDaemon = newBackupDaemon(app)
@@ -552,6 +560,9 @@ func start(asDaemon, firstCall bool) {
 		app.loadSetup(router)
 		app.info.Printf("Loading setup @ %s", address)
 	}
+	if address := app.config.Section("advanced").Key("metrics_address").String(); !firstRun && address != "" && app.config.Section("advanced").Key("metrics").MustBool(false) {
+		go app.serveMetrics(address)
+	}
 	go func() {
 		if app.config.Section("advanced").Key("tls").MustBool(false) {
 			cert := app.config.Section("advanced").Key("tls_cert").MustString("")
@@ -1,34 +1,265 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata" // So !tz works on hosts without a timezone database, e.g. minimal containers.
+	"unicode/utf8"
 
 	"github.com/gomarkdown/markdown"
+	"github.com/hrfee/mediabrowser"
+	"github.com/lithammer/shortuuid/v3"
 	"github.com/timshannon/badgerhold/v4"
+	"gopkg.in/ini.v1"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
+const (
+	MATRIX_SYNC_MIN_BACKOFF = 5 * time.Second
+	MATRIX_SYNC_MAX_BACKOFF = 5 * time.Minute
+	// Used if the homeserver rate-limits us without saying how long to wait.
+	MATRIX_RATE_LIMIT_DEFAULT_WAIT = 5 * time.Second
+	// Wait before the first retry of a request which failed transiently, doubling after each.
+	MATRIX_RETRY_BACKOFF = time.Second
+	// How often unverified tokens are checked for expiry.
+	MATRIX_TOKEN_SWEEP_INTERVAL = time.Minute
+	// How often to check for accounts needing an expiry reminder.
+	MATRIX_EXPIRY_REMINDER_INTERVAL = time.Hour
+	// How often to check for messages held back by quiet hours which can now be sent.
+	MATRIX_QUIET_HOURS_INTERVAL = time.Minute
+	// Typing notifications are cleared after sending, this is just in case that fails.
+	MATRIX_TYPING_TIMEOUT = 10 * time.Second
+	// Sync long-polls for 30s, so if we haven't had a response in this long, something is wrong.
+	MATRIX_SYNC_STALE_AFTER = 2 * time.Minute
+	// Maximum number of invites listed by the invites command.
+	MATRIX_INVITE_LIST_LIMIT = 20
+	// Number of sent notifications remembered per room, so they can later be edited or redacted.
+	MATRIX_SENT_HISTORY = 20
+	// How long Shutdown waits for in-flight sends before tearing down encryption anyway.
+	MATRIX_SHUTDOWN_TIMEOUT = 10 * time.Second
+	// Account data type recording the avatar last uploaded, so it isn't uploaded again on every start.
+	MATRIX_AVATAR_ACCOUNT_DATA = "com.github.hrfee.jfa-go.avatar"
+	// Height in pixels the logo is shown at, small enough not to dwarf the message.
+	MATRIX_LOGO_HEIGHT = "48"
+	// Reactions acknowledging commands in matrix.reaction_commands.
+	MATRIX_REACTION_SUCCESS = "✅"
+	MATRIX_REACTION_FAILURE = "❌"
+	// How long to wait for a read receipt for messages with Message.OnMatrixRead set.
+	MATRIX_DELIVERY_TIMEOUT = 30 * time.Minute
+	// Account data type recording the room opened with matrix.contact_target, if it's a user.
+	MATRIX_CONTACT_ACCOUNT_DATA = "com.github.hrfee.jfa-go.contact"
+	// How long the status command waits for the media server, so it answers quickly if the server's down.
+	MATRIX_STATUS_TIMEOUT = 5 * time.Second
+	// Largest image uploadImage will read from a file or URL.
+	MATRIX_MAX_IMAGE_SIZE = 10 * 1024 * 1024
+	// Number of uploaded images remembered, so the cache doesn't grow with every distinct image sent.
+	MATRIX_MEDIA_CACHE_SIZE = 64
+)
+
+var ErrInvalidMatrixUserID = errors.New("invalid Matrix user ID, should be of the form @user:server")
+var ErrMatrixEncryptionUnavailable = errors.New("encryption is required but unavailable")
+var ErrMatrixStopped = errors.New("the Matrix bot is shutting down")
+var ErrInvalidMatrixRoomID = errors.New("invalid Matrix room ID, should be of the form !room:server")
+var ErrMatrixUnknownRoom = errors.New("the Matrix bot isn't in the room, or can't send to it")
+var ErrMatrixUnknownUser = errors.New("no Jellyfin user is linked to that Matrix account")
+var ErrMatrixRetriesExhausted = errors.New("the homeserver kept failing")
+var ErrMatrixImageTooLarge = errors.New("image is too large to upload")
+var ErrMatrixNothingToMigrate = errors.New("no account on that platform is linked to the user")
+
+// initMatrixCrypto is called to set up encryption when the daemon starts. Replaced in tests.
+var initMatrixCrypto = InitMatrixCrypto
+
+// shutdownMatrixCrypto is called to save encryption state when the daemon stops. Replaced in tests.
+var shutdownMatrixCrypto = CryptoShutdown
+
 type MatrixDaemon struct {
 	Stopped         bool
 	ShutdownChannel chan string
 	bot             *mautrix.Client
 	userID          id.UserID
 	tokens          map[string]UnverifiedUser // Map of tokens to users
-	languages       map[id.RoomID]string      // Map of roomIDs to language codes
+	tokensLock      sync.Mutex
+	languages       map[id.RoomID]string // Map of roomIDs to language codes, guarded by roomsLock.
 	Encryption      bool
-	isEncrypted     map[id.RoomID]bool
+	isEncrypted     map[id.RoomID]bool // Guarded by roomsLock.
+	roomsLock       sync.RWMutex
 	crypto          Crypto
 	app             *appContext
 	start           int64
+	commands        map[string]matrixCommand // Map of command names (without prefix) to their handlers.
+	prefix          string                   // Command prefix, "!" by default.
+	maxRetries      int                      // Number of times to retry a send when rate-limited.
+	resetCooldown   time.Duration
+	pinExpiry       time.Duration
+	notifyExpired   bool                     // Whether to tell the room when its PIN expires.
+	showTyping      bool                     // Whether to show a typing notification while sending.
+	replyInThread   bool                     // Whether to reply to commands in a thread.
+	adminUsers      map[id.UserID]bool       // Users allowed to use admin commands.
+	adminRooms      map[id.RoomID]bool       // Rooms in which anyone can use admin commands.
+	topic           string                   // Room topic from the config. If blank, a translated one is used.
+	forceEncryption bool                     // Whether to refuse to create unencrypted rooms.
+	noEncryption    bool                     // Whether to create new rooms without encryption.
+	signupURL       string                   // Sign-up page linked to in the welcome message, with the PIN added. Omitted if blank.
+	reminderDays    []int                    // Days before expiry to remind users, in descending order.
+	cryptoFailed    bool                     // Whether encryption was enabled but failed to initialize, making encrypted rooms unusable.
+	acceptInvites   bool                     // Whether to join rooms expected users invite the bot to.
+	openEnrollment  bool                     // Whether to accept invites from anyone, when acceptInvites is set.
+	inviteAllowlist map[string]bool          // User IDs and homeservers to accept invites from, when acceptInvites is set.
+	lastReset       map[id.RoomID]time.Time  // Map of roomIDs to the time a password reset was last requested from them.
+	media           map[string]id.ContentURI // Map of image URLs/paths to their uploaded copies.
+	mediaLock       sync.Mutex
+	status          matrixStatus // State of the sync loop, guarded by statusLock.
+	statusLock      sync.Mutex
+	sent            map[id.RoomID][]sentMatrixMessage // Recently sent notifications per room, oldest first, guarded by sentLock.
+	sentLock        sync.Mutex
+	sending         sync.WaitGroup // Sends in progress, waited for by Shutdown.
+	stopping        bool           // Set by Shutdown to refuse new sends, guarded by sendingLock.
+	sendingLock     sync.Mutex
+	decryptNotice   bool                 // Whether to tell users when their messages can't be decrypted.
+	undecryptable   map[id.RoomID]string // Map of roomIDs to the last session the user was told couldn't be decrypted.
+	commandRate     float64              // Commands each room can send per second on average, or 0 for no limit.
+	commandBurst    float64              // Commands each room can send at once before being limited.
+	// Map of roomIDs to their command rate limits. Only used from the sync goroutine.
+	commandBuckets map[id.RoomID]*commandBucket
+	displayName    string // Display name to give the bot on startup, if not blank.
+	avatar         string // Path, URL or mxc:// URI of the avatar to give the bot on startup, if not blank.
+	contactTarget  string // Room or user ID !contact messages are forwarded to, or "" if the command is disabled.
+	contactRoom    id.RoomID
+	contactWait    time.Duration // Minimum time between !contact messages from the same room.
+	lastContact    map[id.RoomID]time.Time
+	// Map of forwarded !contact messages to the rooms they came from, so replies can be relayed. Only used from the sync goroutine.
+	contacts map[id.EventID]id.RoomID
+	// Messages waiting for a read receipt, guarded by deliveriesLock.
+	deliveries      map[id.RoomID][]*matrixDelivery
+	deliveriesLock  sync.Mutex
+	deliveryTimeout time.Duration
+	welcomeTemplate string // Layout of the PIN message from the config, overriding matrixWelcomeTemplate if not blank.
+	logo            string // Path, URL or mxc:// URI of an image shown atop welcome messages and announcements, if not blank.
+	// Number of rooms Broadcast sends to at once.
+	broadcastWorkers int
+	// Time until which sends wait, after the homeserver rate-limited one of them. Guarded by limitedLock.
+	limitedUntil time.Time
+	limitedLock  sync.Mutex
+	// Commands acknowledged with a reaction on the user's message rather than a text reply.
+	reactCommands map[string]bool
+	reactWithText bool // Send the text reply as well as the reaction.
+	// Hours of the user's day reminders are sent in, from reminderFrom until reminderUntil. Any time if they're equal.
+	reminderFrom  int
+	reminderUntil int
+	// Long-poll timeout passed to /sync.
+	syncTimeout     time.Duration
+	skipInitialSync bool // If there's no saved sync token, don't process the first sync's history.
+	stopSync        context.CancelFunc
+	syncContext     context.Context
+	noCommands      bool            // Set if matrix.commands_enabled is false, so the bot only sends notifications.
+	enabledCommands map[string]bool // Commands to register from matrix.enabled_commands, or nil for all of them.
+	// Create a new room for a user when theirs is lost, rather than unlinking them.
+	reinviteLost bool
+	// Messages longer than this many characters are split into several, or never if 0.
+	maxLength int
+	// Whether users can disable their own account with the disable command.
+	selfDisable bool
+	// Space rooms the bot creates are added to, or "" for none.
+	space id.RoomID
+	// How long SendStart resends a user's pending PIN rather than creating another room.
+	startCooldown time.Duration
+	// How long the status command waits for the media server.
+	statusTimeout time.Duration
+	// Number of times to retry creating a room when the homeserver fails transiently, and the wait before the first.
+	transientRetries int
+	retryBackoff     time.Duration
+	// Whether to send new users their PIN in the language from their profile.
+	detectLang bool
+	// Called when a user verifies their PIN, added with OnVerified.
+	verifiedHooks     []func(MatrixVerification)
+	verifiedHooksLock sync.Mutex
+	// Room events like sign-ups are announced in, if set. Notices are collected for adminNoticeDelay then sent together.
+	adminRoom        id.RoomID
+	adminNoticeDelay time.Duration
+	adminNotices     map[string][]string // Notice kind to the users it happened to. Guarded by adminNoticesLock.
+	adminNoticeKinds []string            // Kinds in adminNotices, in the order they first happened.
+	adminNoticeTimer *time.Timer
+	adminNoticesLock sync.Mutex
+}
+
+// matrixDelivery is a sent message with Message.OnMatrixRead set, waiting to be read.
+type matrixDelivery struct {
+	user     MatrixUser
+	eventID  id.EventID
+	sent     time.Time
+	callback func(user MatrixUser, read bool)
+	timer    *time.Timer
+}
+
+// commandBucket is a token bucket limiting the rate of commands from a room.
+type commandBucket struct {
+	tokens float64
+	last   time.Time
+	warned bool // Whether the room has been told it's being limited, reset once a command is allowed again.
+}
+
+// sentMatrixMessage records a notification sent by the bot, so it can be found again to edit or redact.
+type sentMatrixMessage struct {
+	EventID      id.EventID
+	Notification string // Message.Notification of the message sent, if any.
+}
+
+// matrixStatus describes the state of the sync loop, for diagnosing a disconnected bot.
+type matrixStatus struct {
+	syncing   bool
+	lastSync  time.Time
+	lastError string
+}
+
+// matrixCommand is a bot command, with the key of its description in the Telegram string table.
+// Admin commands can only be used by admin users or in admin rooms.
+type matrixCommand struct {
+	handler     func(evt *event.Event, sects []string, lang string)
+	description string
+	admin       bool
 }
 
 type UnverifiedUser struct {
-	Verified bool
-	User     *MatrixUser
+	Verified   bool
+	User       *MatrixUser
+	JellyfinID string    // Set if the PIN was requested from the user page, so the account can be linked from the bot.
+	Created    time.Time // Used to expire the PIN after d.pinExpiry.
+	// The server the PIN gives access to, named in the welcome message.
+	Server MediaServer
+}
+
+// Where a user entered their PIN, given as MatrixVerification.Source.
+const (
+	MatrixVerifiedCommand  = "command"  // The verify command.
+	MatrixVerifiedUserPage = "userpage" // The "My Account" page.
+	MatrixVerifiedSignup   = "signup"   // The sign-up form.
+)
+
+// MatrixVerification describes a user linking their Matrix account with a PIN, passed to OnVerified hooks.
+type MatrixVerification struct {
+	User   MatrixUser // As stored, with JellyfinID set.
+	Source string
+	Time   time.Time
 }
 
 type MatrixUser struct {
@@ -37,7 +268,60 @@ type MatrixUser struct {
 	UserID     string
 	Lang       string
 	Contact    bool
+	Muted      bool   // Set with the mute command, only urgent messages are sent.
+	PlainOnly  bool   // Set with the format command, messages are sent without formatting.
+	Timezone   string // IANA timezone set with the tz command, or "" for the server's.
+	QuietStart string // Start and end (as 15:04, in the user's timezone) of quiet hours set with the quiet command, or "" for none.
+	QuietEnd   string
 	JellyfinID string `badgerhold:"key"`
+	// Set with the disable command, so the enable command can't re-enable accounts disabled by an admin or expiry.
+	SelfDisabled bool
+	// Deprecated: the switch command stores a MatrixSelection instead. Only read by migrateMatrixSelections.
+	Selected bool
+}
+
+// Location returns the user's timezone, or the server's if they haven't set one.
+func (u MatrixUser) Location() *time.Location {
+	if u.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// QuietUntil returns whether now is within the user's quiet hours, and if so, when they end.
+// The hours may span midnight, e.g. 22:00 until 08:00.
+func (u MatrixUser) QuietUntil(now time.Time) (until time.Time, quiet bool) {
+	start, err := time.Parse("15:04", u.QuietStart)
+	if err != nil {
+		return
+	}
+	end, err := time.Parse("15:04", u.QuietEnd)
+	if err != nil {
+		return
+	}
+	local := now.In(u.Location())
+	minute := local.Hour()*60 + local.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	switch {
+	case from == to:
+		return
+	case from < to:
+		quiet = minute >= from && minute < to
+	default:
+		quiet = minute >= from || minute < to
+	}
+	if !quiet {
+		return
+	}
+	until = time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return
 }
 
 var matrixFilter = mautrix.Filter{
@@ -47,9 +331,16 @@ var matrixFilter = mautrix.Filter{
 				event.EventMessage,
 				event.EventEncrypted,
 				event.StateMember,
+				event.StateEncryption,
 			},
 		},
+		// Read receipts are needed for Message.OnMatrixRead, typing notifications etc. aren't.
+		Ephemeral: mautrix.FilterPart{
+			Types: []event.Type{event.EphemeralEventReceipt},
+		},
 	},
+	// "content" includes all its subfields (body, membership, m.relates_to, etc.).
+	// Without "origin_server_ts", evt.Timestamp is zero and every message looks older than d.start.
 	EventFields: []string{
 		"type",
 		"event_id",
@@ -57,9 +348,8 @@ var matrixFilter = mautrix.Filter{
 		"state_key",
 		"sender",
 		"content",
-		"timestamp",
-		// "content.body",
-		// "content.membership",
+		"origin_server_ts",
+		"unsigned",
 	},
 }
 
@@ -75,207 +365,3740 @@ func newMatrixDaemon(app *appContext) (d *MatrixDaemon, err error) {
 		isEncrypted:     map[id.RoomID]bool{},
 		app:             app,
 		start:           time.Now().UnixNano() / 1e6,
+		prefix:          matrix.Key("command_prefix").MustString("!"),
+		maxRetries:      matrix.Key("rate_limit_retries").MustInt(3),
+		resetCooldown:   time.Duration(matrix.Key("reset_cooldown_minutes").MustInt(10)) * time.Minute,
+		pinExpiry:       time.Duration(matrix.Key("pin_expiry_minutes").MustInt(30)) * time.Minute,
+		notifyExpired:   matrix.Key("notify_expired_pins").MustBool(false),
+		showTyping:      matrix.Key("show_typing").MustBool(false),
+		replyInThread:   matrix.Key("reply_in_thread").MustBool(false),
+		lastReset:       map[id.RoomID]time.Time{},
+		media:           map[string]id.ContentURI{},
+		sent:            map[id.RoomID][]sentMatrixMessage{},
+		adminUsers:      map[id.UserID]bool{},
+		adminRooms:      map[id.RoomID]bool{},
+		topic:           matrix.Key("topic").String(),
+		forceEncryption: matrix.Key("force_encryption").MustBool(false),
+		noEncryption:    matrix.Key("disable_encryption").MustBool(false),
+		signupURL:       matrix.Key("signup_url").String(),
+		acceptInvites:   matrix.Key("accept_invites").MustBool(false),
+		openEnrollment:  matrix.Key("open_enrollment").MustBool(false),
+		inviteAllowlist: map[string]bool{},
+		decryptNotice:   matrix.Key("notify_decryption_failures").MustBool(false),
+		undecryptable:   map[id.RoomID]string{},
+		commandRate:     matrix.Key("command_rate_limit").MustFloat64(20) / 60,
+		commandBurst:    matrix.Key("command_burst").MustFloat64(5),
+		commandBuckets:  map[id.RoomID]*commandBucket{},
+		displayName:     matrix.Key("display_name").String(),
+		avatar:          matrix.Key("avatar_path").String(),
+		contactTarget:   strings.TrimSpace(matrix.Key("contact_target").String()),
+		contactWait:     time.Duration(matrix.Key("contact_cooldown_minutes").MustInt(5)) * time.Minute,
+		lastContact:     map[id.RoomID]time.Time{},
+		contacts:        map[id.EventID]id.RoomID{},
+		deliveries:      map[id.RoomID][]*matrixDelivery{},
+		deliveryTimeout: MATRIX_DELIVERY_TIMEOUT,
+		// The setting is a single line, so newlines are written as \n.
+		welcomeTemplate: strings.ReplaceAll(matrix.Key("welcome_template").String(), `\n`, "\n"),
+		// Enough to keep a slow room from holding up a broadcast, without flooding the homeserver.
+		broadcastWorkers: matrix.Key("broadcast_workers").MustInt(4),
+	}
+	d.reactCommands = map[string]bool{}
+	for _, c := range strings.Split(matrix.Key("reaction_commands").String(), ",") {
+		if c = strings.TrimPrefix(strings.TrimSpace(c), d.prefix); c != "" {
+			d.reactCommands[c] = true
+		}
+	}
+	d.reactWithText = matrix.Key("reaction_with_text").MustBool(false)
+	d.reminderFrom = matrix.Key("reminder_earliest_hour").MustInt(9) % 24
+	d.reminderUntil = matrix.Key("reminder_latest_hour").MustInt(21) % 24
+	d.syncTimeout = time.Duration(matrix.Key("sync_timeout_seconds").MustInt(30)) * time.Second
+	d.skipInitialSync = matrix.Key("skip_initial_sync").MustBool(false)
+	d.syncContext, d.stopSync = context.WithCancel(context.Background())
+	d.reinviteLost = matrix.Key("reinvite_lost_rooms").MustBool(false)
+	d.maxLength = matrix.Key("max_message_length").MustInt(0)
+	d.selfDisable = matrix.Key("self_service_disable").MustBool(false)
+	d.space = id.RoomID(strings.TrimSpace(matrix.Key("space_id").String()))
+	d.startCooldown = time.Duration(matrix.Key("start_cooldown_minutes").MustInt(5)) * time.Minute
+	d.statusTimeout = MATRIX_STATUS_TIMEOUT
+	d.transientRetries = matrix.Key("transient_retries").MustInt(3)
+	d.retryBackoff = MATRIX_RETRY_BACKOFF
+	d.detectLang = matrix.Key("detect_language").MustBool(false)
+	d.adminRoom = id.RoomID(strings.TrimSpace(matrix.Key("admin_room_id").String()))
+	d.adminNoticeDelay = time.Duration(matrix.Key("admin_notice_delay_seconds").MustInt(30)) * time.Second
+	d.OnVerified(d.announceVerified)
+	if matrix.Key("show_logo").MustBool(false) {
+		d.logo = strings.TrimSpace(matrix.Key("logo_path").String())
+	}
+	for _, u := range strings.Split(matrix.Key("admin_users").String(), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			d.adminUsers[id.UserID(u)] = true
+		}
+	}
+	for _, u := range strings.Split(matrix.Key("invite_allowlist").String(), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			d.inviteAllowlist[u] = true
+		}
+	}
+	for _, r := range strings.Split(matrix.Key("admin_rooms").String(), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			d.adminRooms[id.RoomID(r)] = true
+		}
+	}
+	for _, days := range strings.Split(matrix.Key("expiry_reminder_days").String(), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(days)); err == nil && n > 0 {
+			d.reminderDays = append(d.reminderDays, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(d.reminderDays)))
+	d.noCommands = !matrix.Key("commands_enabled").MustBool(true)
+	if list := strings.TrimSpace(matrix.Key("enabled_commands").String()); list != "" {
+		d.enabledCommands = map[string]bool{}
+		for _, c := range strings.Split(list, ",") {
+			if c = strings.TrimPrefix(strings.TrimSpace(c), d.prefix); c != "" {
+				d.enabledCommands[c] = true
+			}
+		}
+	}
+	d.registerCommands()
+	homeserver, err = resolveHomeserver(homeserver)
+	if err != nil {
+		return
 	}
 	d.bot, err = mautrix.NewClient(homeserver, d.userID, token)
 	if err != nil {
 		return
 	}
-	// resp, err := d.bot.CreateFilter(&matrixFilter)
-	// if err != nil {
-	// 	return
-	// }
-	// d.bot.Store.SaveFilterID(d.userID, resp.FilterID)
+	d.bot.Store = &matrixSyncStore{MemorySyncStore: mautrix.NewMemorySyncStore(), storage: &app.storage}
+	if err = d.checkToken(homeserver); err != nil {
+		return
+	}
+	if err := d.registerFilter(); err != nil {
+		app.info.Printf("Matrix: Failed to register sync filter, will retry on sync: %v", err)
+	}
 	for _, user := range app.storage.GetMatrix() {
 		if user.Lang != "" {
-			d.languages[id.RoomID(user.RoomID)] = user.Lang
+			d.setRoomLang(id.RoomID(user.RoomID), user.Lang)
 		}
-		d.isEncrypted[id.RoomID(user.RoomID)] = user.Encrypted
+		d.setRoomEncrypted(id.RoomID(user.RoomID), user.Encrypted)
 	}
-	err = InitMatrixCrypto(d)
+	d.checkSpace()
+	d.initCrypto()
 	return
 }
 
-func (d *MatrixDaemon) generateAccessToken(homeserver, username, password string) (string, error) {
+// checkSpace makes sure the configured space exists and the bot can add rooms to it, turning the feature off if not.
+// If the homeserver can't be reached, it's left on and errors are logged when rooms are created.
+func (d *MatrixDaemon) checkSpace() {
+	if d.space == "" {
+		return
+	}
+	var problem string
+	create := event.CreateEventContent{}
+	powerLevels := event.PowerLevelsEventContent{}
+	err := d.bot.StateEvent(d.space, event.StateCreate, "", &create)
+	if err == nil {
+		err = d.bot.StateEvent(d.space, event.StatePowerLevels, "", &powerLevels)
+	}
+	var respErr mautrix.RespError
+	switch {
+	case errors.As(err, &respErr):
+		problem = fmt.Sprintf("it doesn't exist, or the bot isn't in it: %v", err)
+	case err != nil:
+		d.app.debug.Printf("Matrix: Couldn't check space \"%s\": %v", d.space, err)
+		return
+	case create.Type != event.RoomTypeSpace:
+		problem = "it isn't a space"
+	case powerLevels.GetUserLevel(d.userID) < powerLevels.GetEventLevel(event.StateSpaceChild):
+		problem = "the bot doesn't have permission to add rooms to it"
+	default:
+		return
+	}
+	d.app.err.Printf("Matrix: Not adding rooms to space \"%s\", %s", d.space, problem)
+	d.space = ""
+}
+
+// addToSpace adds a room the bot created to the configured space, so they're grouped together in admins' clients.
+// Failing to isn't fatal, the room is just left outside of the space.
+func (d *MatrixDaemon) addToSpace(roomID id.RoomID) {
+	if d.space == "" {
+		return
+	}
+	_, server, _ := d.userID.Parse()
+	_, err := d.bot.SendStateEvent(d.space, event.StateSpaceChild, string(roomID), &event.SpaceChildEventContent{Via: []string{server}})
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to add room \"%s\" to space \"%s\": %v", roomID, d.space, err)
+	}
+}
+
+// checkToken asks the homeserver who the configured token belongs to, so a revoked token or wrong user ID is reported at startup rather than as a sync failure.
+// If the homeserver can't be reached, the check is skipped, leaving the sync loop to retry.
+func (d *MatrixDaemon) checkToken(homeserver string) error {
+	resp, err := d.bot.Whoami()
+	if err != nil {
+		var httpErr mautrix.HTTPError
+		if !errors.As(err, &httpErr) || httpErr.Response == nil {
+			d.app.info.Printf("Matrix: Couldn't reach %s to check access token, will retry on sync: %v", homeserver, err)
+			return nil
+		}
+		if errors.Is(err, mautrix.MUnknownToken) {
+			return fmt.Errorf("access token is invalid or has expired: %v", err)
+		}
+		return fmt.Errorf("failed to validate access token: %v", err)
+	}
+	if resp.UserID != d.userID {
+		return fmt.Errorf("access token belongs to \"%s\", not the configured user ID \"%s\"", resp.UserID, d.userID)
+	}
+	// Encryption needs to know which device it's acting as.
+	d.bot.DeviceID = resp.DeviceID
+	return nil
+}
+
+// initCrypto sets up encryption. If it fails, the daemon continues in plaintext-only mode,
+// and messages to already encrypted rooms fail with ErrMatrixEncryptionUnavailable.
+func (d *MatrixDaemon) initCrypto() {
+	if err := initMatrixCrypto(d); err != nil {
+		d.app.info.Printf("Matrix: Failed to initialize encryption, continuing without it: %v", err)
+		d.Encryption = false
+		d.cryptoFailed = true
+	}
+}
+
+// registerFilter uploads matrixFilter to the homeserver and saves its ID for syncing with, unless one has already been saved.
+// If it fails, the syncer creates the filter itself when it starts.
+func (d *MatrixDaemon) registerFilter() error {
+	if syncer, ok := d.bot.Syncer.(*mautrix.DefaultSyncer); ok {
+		syncer.FilterJSON = &matrixFilter
+	}
+	if d.bot.Store.LoadFilterID(d.userID) != "" {
+		return nil
+	}
+	resp, err := d.bot.CreateFilter(&matrixFilter)
+	if err != nil {
+		return err
+	}
+	d.bot.Store.SaveFilterID(d.userID, resp.FilterID)
+	return nil
+}
+
+// registerCommands adds the bot's commands to d.commands, which handleMessage and commandHelp use.
+func (d *MatrixDaemon) registerCommands() {
+	d.commands = map[string]matrixCommand{
+		"help":     {d.commandHelp, "matrixHelpDescription", false},
+		"lang":     {d.commandLang, "matrixLangDescription", false},
+		"expiry":   {d.commandExpiry, "matrixExpiryDescription", false},
+		"reset":    {d.commandReset, "matrixResetDescription", false},
+		"unlink":   {d.commandUnlink, "matrixUnlinkDescription", false},
+		"verify":   {d.commandVerify, "matrixVerifyDescription", false},
+		"resend":   {d.commandResend, "matrixResendDescription", false},
+		"email":    {d.commandEmail, "matrixEmailDescription", false},
+		"invites":  {d.commandInvites, "matrixInvitesDescription", true},
+		"status":   {d.commandStatus, "matrixStatusDescription", true},
+		"invite":   {d.commandNewInvite, "matrixNewInviteDescription", false},
+		"mute":     {d.commandMute, "matrixMuteDescription", false},
+		"unmute":   {d.commandUnmute, "matrixUnmuteDescription", false},
+		"notify":   {d.commandNotify, "matrixNotifyDescription", false},
+		"format":   {d.commandFormat, "matrixFormatDescription", false},
+		"locale":   {d.commandLocale, "matrixLocaleDescription", false},
+		"whoami":   {d.commandWhoami, "matrixWhoamiDescription", false},
+		"tz":       {d.commandTimezone, "matrixTimezoneDescription", false},
+		"version":  {d.commandVersion, "matrixVersionDescription", false},
+		"quiet":    {d.commandQuiet, "matrixQuietDescription", false},
+		"export":   {d.commandExport, "matrixExportDescription", false},
+		"disable":  {d.commandDisable, "matrixDisableDescription", false},
+		"enable":   {d.commandEnable, "matrixEnableDescription", false},
+		"migrate":  {d.commandMigrate, "matrixMigrateDescription", false},
+		"accounts": {d.commandAccounts, "matrixAccountsDescription", false},
+		"switch":   {d.commandSwitch, "matrixSwitchDescription", false},
+		"messages": {d.commandMessages, "matrixMessagesDescription", false},
+	}
+	if d.contactTarget != "" {
+		d.commands["contact"] = matrixCommand{d.commandContact, "matrixContactDescription", false}
+	}
+	if d.enabledCommands == nil {
+		return
+	}
+	for name := range d.enabledCommands {
+		if _, ok := d.commands[name]; !ok {
+			d.app.err.Printf("Matrix: Unknown command \"%s\" in enabled_commands, ignoring", name)
+		}
+	}
+	// Help is kept so users can see what's available, and unknown command replies can point to it.
+	for name := range d.commands {
+		if name != "help" && !d.enabledCommands[name] {
+			delete(d.commands, name)
+		}
+	}
+}
+
+// hasCommand returns whether users can send the named command.
+func (d *MatrixDaemon) hasCommand(name string) bool {
+	_, ok := d.commands[name]
+	return ok && !d.noCommands
+}
+
+// discoverMatrixClient fetches a server's .well-known/matrix/client. Replaced in tests.
+var discoverMatrixClient = mautrix.DiscoverClientAPI
+
+// Homeservers resolved from plain domains, guarded by homeserverCacheLock.
+var homeserverCache = map[string]string{}
+var homeserverCacheLock sync.Mutex
+
+// resolveHomeserver returns the client API URL for the given homeserver setting.
+// Full URLs are used as-is, while plain domains (e.g. example.com) are looked up through .well-known discovery,
+// falling back to https://<domain> if the server doesn't have a .well-known file.
+func resolveHomeserver(homeserver string) (string, error) {
+	homeserver = strings.TrimSuffix(strings.TrimSpace(homeserver), "/")
+	if strings.Contains(homeserver, "://") {
+		return homeserver, nil
+	}
+	if homeserver == "" {
+		return "", fmt.Errorf("no homeserver set")
+	}
+	homeserverCacheLock.Lock()
+	defer homeserverCacheLock.Unlock()
+	if resolved, ok := homeserverCache[homeserver]; ok {
+		return resolved, nil
+	}
+	wellKnown, err := discoverMatrixClient(homeserver)
+	if err != nil {
+		return "", fmt.Errorf("couldn't discover homeserver for \"%s\", try entering its full URL instead: %v", homeserver, err)
+	}
+	resolved := "https://" + homeserver
+	if wellKnown != nil && wellKnown.Homeserver.BaseURL != "" {
+		resolved = strings.TrimSuffix(wellKnown.Homeserver.BaseURL, "/")
+	}
+	homeserverCache[homeserver] = resolved
+	return resolved, nil
+}
+
+// MatrixLoginError is returned when logging in or checking an access token fails.
+// Code is the key of a notification explaining the problem in the "Add Matrix" form.
+type MatrixLoginError struct {
+	Code string
+	Err  error
+}
+
+func (e *MatrixLoginError) Error() string { return e.Err.Error() }
+func (e *MatrixLoginError) Unwrap() error { return e.Err }
+
+// Unauthorized returns whether the homeserver was reached but refused the credentials.
+func (e *MatrixLoginError) Unauthorized() bool {
+	return e.Code == "errorMatrixInvalidCredentials" || e.Code == "errorMatrixInvalidToken" || e.Code == "errorMatrixForbidden"
+}
+
+// newMatrixLoginError works out why a request made while logging in failed.
+func newMatrixLoginError(err error) *MatrixLoginError {
+	code := "errorUnknown"
+	var httpErr mautrix.HTTPError
+	switch {
+	case errors.Is(err, mautrix.MForbidden):
+		code = "errorMatrixForbidden"
+	case errors.Is(err, mautrix.MUnknownToken), errors.Is(err, mautrix.MMissingToken):
+		code = "errorMatrixInvalidToken"
+	case errors.Is(err, mautrix.MInvalidUsername), errors.Is(err, mautrix.MUserDeactivated):
+		code = "errorMatrixInvalidCredentials"
+	case !errors.As(err, &httpErr):
+	case httpErr.Response == nil:
+		code = "errorMatrixUnreachable"
+	case httpErr.RespError == nil:
+		// Something answered, but not with a Matrix error, so it probably isn't a homeserver.
+		code = "errorMatrixBadHomeserver"
+	case httpErr.Response.StatusCode == http.StatusUnauthorized:
+		code = "errorMatrixInvalidCredentials"
+	}
+	return &MatrixLoginError{Code: code, Err: err}
+}
+
+func (d *MatrixDaemon) generateAccessToken(homeserver, username, password string, deviceID id.DeviceID, deviceName string) (string, error) {
 	req := &mautrix.ReqLogin{
 		Type: mautrix.AuthTypePassword,
 		Identifier: mautrix.UserIdentifier{
 			Type: mautrix.IdentifierTypeUser,
 			User: username,
 		},
-		Password: password,
-		DeviceID: id.DeviceID("jfa-go-" + commit),
+		Password:                 password,
+		DeviceID:                 deviceID,
+		InitialDeviceDisplayName: deviceName,
+	}
+	homeserver, err := resolveHomeserver(homeserver)
+	if err != nil {
+		return "", &MatrixLoginError{Code: "errorMatrixBadHomeserver", Err: err}
 	}
 	bot, err := mautrix.NewClient(homeserver, id.UserID(username), "")
 	if err != nil {
-		return "", err
+		return "", &MatrixLoginError{Code: "errorMatrixBadHomeserver", Err: err}
 	}
 	resp, err := bot.Login(req)
 	if err != nil {
-		return "", err
+		return "", newMatrixLoginError(err)
 	}
 	return resp.AccessToken, nil
 }
 
+// validateAccessToken checks an existing access token against the homeserver, returning the user ID it belongs to.
+func (d *MatrixDaemon) validateAccessToken(homeserver, token string) (string, error) {
+	resp, err := d.whoami(homeserver, token)
+	if err != nil {
+		return "", err
+	}
+	return string(resp.UserID), nil
+}
+
+// whoami returns the user and device an access token belongs to.
+func (d *MatrixDaemon) whoami(homeserver, token string) (*mautrix.RespWhoami, error) {
+	homeserver, err := resolveHomeserver(homeserver)
+	if err != nil {
+		return nil, &MatrixLoginError{Code: "errorMatrixBadHomeserver", Err: err}
+	}
+	bot, err := mautrix.NewClient(homeserver, "", token)
+	if err != nil {
+		return nil, &MatrixLoginError{Code: "errorMatrixBadHomeserver", Err: err}
+	}
+	resp, err := bot.Whoami()
+	if err != nil {
+		loginErr := newMatrixLoginError(err)
+		if loginErr.Code == "errorMatrixInvalidToken" {
+			loginErr.Err = fmt.Errorf("access token is invalid or has expired")
+		} else {
+			loginErr.Err = fmt.Errorf("failed to validate access token: %w", err)
+		}
+		return nil, loginErr
+	}
+	return resp, nil
+}
+
+// loginDevice returns the device ID and name to log in as with a username and password.
+// The ID stays the same between versions, so old devices aren't left behind and encryption keys are kept.
+// If the bot is already logged in as the same user, its current device is reused, e.g. one created by an older version.
+func (d *MatrixDaemon) loginDevice(config *ini.File, homeserver, username string) (id.DeviceID, string) {
+	matrix := config.Section("matrix")
+	deviceID := id.DeviceID(matrix.Key("device_id").MustString("jfa-go"))
+	deviceName := matrix.Key("device_name").MustString("jfa-go")
+	token := matrix.Key("token").String()
+	if token == "" || matrix.Key("homeserver").String() != homeserver {
+		return deviceID, deviceName
+	}
+	resp, err := d.whoami(homeserver, token)
+	if err != nil || resp.DeviceID == "" {
+		return deviceID, deviceName
+	}
+	// The username may be a full user ID or just the localpart.
+	if string(resp.UserID) == username || strings.HasPrefix(string(resp.UserID), "@"+strings.TrimPrefix(username, "@")+":") {
+		deviceID = resp.DeviceID
+	}
+	return deviceID, deviceName
+}
+
 func (d *MatrixDaemon) run() {
 	startTime := d.start
 	d.app.info.Println("Starting Matrix bot daemon")
 	syncer := d.bot.Syncer.(*mautrix.DefaultSyncer)
 	HandleSyncerCrypto(startTime, d, syncer)
-	syncer.OnEventType(event.EventMessage, d.handleMessage)
+	if !d.Encryption && !d.noCommands {
+		// Otherwise messages in encrypted rooms would be silently ignored.
+		syncer.OnEventType(event.EventEncrypted, func(source mautrix.EventSource, evt *event.Event) {
+			if evt.Timestamp < startTime {
+				return
+			}
+			d.handleDecryptionFailure(evt, ErrMatrixEncryptionUnavailable)
+		})
+	}
+	if !d.noCommands {
+		syncer.OnEventType(event.EventMessage, d.handleMessage)
+	}
+	syncer.OnEventType(event.StateMember, d.handleMembership)
+	syncer.OnEventType(event.EphemeralEventReceipt, d.handleReceipt)
+	if d.pinExpiry != 0 {
+		go d.sweepTokens()
+	}
+	if len(d.reminderDays) != 0 {
+		go d.remindExpiries()
+	}
+	go d.releaseHeldMessages()
+	if d.displayName != "" || d.avatar != "" {
+		go d.updateProfile()
+	}
+	attempt := 0
+	// Sync handlers run in this goroutine, so this is safe.
+	syncer.OnSync(func(resp *mautrix.RespSync, since string) bool {
+		attempt = 0
+		d.statusLock.Lock()
+		d.status.lastSync = time.Now()
+		d.statusLock.Unlock()
+		return true
+	})
+
+	for {
+		d.setSyncing(true, nil)
+		err := d.sync(d.syncContext)
+		d.setSyncing(false, err)
+		// sync only returns nil once Shutdown has been called.
+		if err == nil || d.Stopped {
+			return
+		}
+		if errors.Is(err, mautrix.MUnknownToken) {
+			d.app.err.Printf("Matrix sync failed, access token is invalid: %v", err)
+			return
+		}
+		attempt++
+		backoff := matrixSyncBackoff(attempt)
+		d.app.info.Print(warning(fmt.Sprintf("Matrix sync failed, reconnecting in %s (attempt %d): %v", backoff, attempt, err)))
+		select {
+		case <-d.ShutdownChannel:
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// sync is mautrix's Client.Sync, but with a configurable long-poll timeout, and optionally skipping the first sync's history.
+// It runs until ctx is cancelled, returning nil, or the homeserver returns an error that can't be retried.
+func (d *MatrixDaemon) sync(ctx context.Context) error {
+	nextBatch := d.bot.Store.LoadNextBatch(d.userID)
+	filterID := d.bot.Store.LoadFilterID(d.userID)
+	if filterID == "" {
+		resp, err := d.bot.CreateFilter(d.bot.Syncer.GetFilterJSON(d.userID))
+		if err != nil {
+			return err
+		}
+		filterID = resp.FilterID
+		d.bot.Store.SaveFilterID(d.userID, filterID)
+	}
+	skip := nextBatch == "" && d.skipInitialSync
+	for {
+		resp, err := d.bot.FullSyncRequest(mautrix.ReqSync{
+			Timeout:     int(d.syncTimeout / time.Millisecond),
+			Since:       nextBatch,
+			FilterID:    filterID,
+			SetPresence: d.bot.SyncPresence,
+			Context:     ctx,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			wait, err := d.bot.Syncer.OnFailedSync(resp, err)
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+				continue
+			}
+		}
+		// Saved before processing, so an event which makes a handler panic isn't processed again on every start.
+		d.bot.Store.SaveNextBatch(d.userID, resp.NextBatch)
+		if skip {
+			d.app.info.Println("Matrix: Skipped history from initial sync")
+			skip = false
+		} else if err := d.bot.Syncer.ProcessResponse(resp, nextBatch); err != nil {
+			return err
+		}
+		nextBatch = resp.NextBatch
+	}
+}
+
+// matrixSyncStore keeps the sync token in the database, so a restart resumes where the bot left off rather than starting a new initial sync.
+// The filter ID is only kept in memory, so changes to matrixFilter are picked up on restart.
+type matrixSyncStore struct {
+	*mautrix.MemorySyncStore
+	storage *Storage
+}
+
+func (s *matrixSyncStore) SaveNextBatch(userID id.UserID, nextBatchToken string) {
+	s.storage.SetMatrixSyncTokenKey(string(userID), nextBatchToken)
+}
+
+func (s *matrixSyncStore) LoadNextBatch(userID id.UserID) string {
+	return s.storage.GetMatrixSyncTokenKey(string(userID))
+}
+
+func (d *MatrixDaemon) setSyncing(syncing bool, err error) {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	d.status.syncing = syncing
+	if err != nil {
+		d.status.lastError = err.Error()
+	}
+}
+
+// Connected returns whether the bot is currently syncing and has recently received a response from the homeserver.
+func (d *MatrixDaemon) Connected() bool {
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	return d.status.syncing && time.Since(d.status.lastSync) < MATRIX_SYNC_STALE_AFTER
+}
+
+// Status returns whether the bot is connected, when it last synced successfully, and the last sync error.
+func (d *MatrixDaemon) Status() (connected bool, lastSync time.Time, lastError string) {
+	connected = d.Connected()
+	d.statusLock.Lock()
+	defer d.statusLock.Unlock()
+	return connected, d.status.lastSync, d.status.lastError
+}
 
-	if err := d.bot.Sync(); err != nil {
-		d.app.err.Printf("Matrix sync failed: %v", err)
+// matrixSyncBackoff returns the time to wait before the given reconnect attempt, doubling each time up to MATRIX_SYNC_MAX_BACKOFF.
+func matrixSyncBackoff(attempt int) time.Duration {
+	backoff := MATRIX_SYNC_MIN_BACKOFF
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= MATRIX_SYNC_MAX_BACKOFF {
+			return MATRIX_SYNC_MAX_BACKOFF
+		}
 	}
+	return backoff
 }
 
+// Shutdown stops syncing, then waits up to MATRIX_SHUTDOWN_TIMEOUT for in-flight sends to finish
+// before saving encryption state, so messages being encrypted aren't dropped.
 func (d *MatrixDaemon) Shutdown() {
-	CryptoShutdown(d)
-	d.bot.StopSync()
+	if d.stopSync != nil {
+		d.stopSync()
+	}
+	d.flushAdminNotices()
+	d.sendingLock.Lock()
+	d.stopping = true
+	d.sendingLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(MATRIX_SHUTDOWN_TIMEOUT):
+		d.app.info.Printf("Matrix: Timed out waiting for messages to send, shutting down anyway")
+	}
+	shutdownMatrixCrypto(d)
 	d.Stopped = true
 	close(d.ShutdownChannel)
 }
 
+// beginSend registers a send with d.sending, returning false if the daemon is shutting down.
+func (d *MatrixDaemon) beginSend() bool {
+	d.sendingLock.Lock()
+	defer d.sendingLock.Unlock()
+	if d.stopping {
+		return false
+	}
+	d.sending.Add(1)
+	return true
+}
+
 func (d *MatrixDaemon) handleMessage(source mautrix.EventSource, evt *event.Event) {
+	// Decrypted messages are passed here directly rather than through the syncer.
+	if d.noCommands {
+		return
+	}
 	if evt.Timestamp < d.start {
 		return
 	}
 	if evt.Sender == d.userID {
 		return
 	}
-	lang := "en-us"
-	if l, ok := d.languages[evt.RoomID]; ok {
-		if _, ok := d.app.storage.lang.Telegram[l]; ok {
-			lang = l
-		}
+	// Images, stickers, etc. either have no body or one we don't care about.
+	if msgType, ok := evt.Content.Raw["msgtype"].(string); ok && msgType != string(event.MsgText) {
+		d.app.debug.Printf("Matrix: Ignoring \"%s\" message from \"%s\"", msgType, evt.Sender)
+		return
 	}
-	sects := strings.Split(evt.Content.Raw["body"].(string), " ")
-	switch sects[0] {
-	case "!lang":
-		if len(sects) == 2 {
-			d.commandLang(evt, sects[1], lang)
-		} else {
-			d.commandLang(evt, "", lang)
+	body, ok := evt.Content.Raw["body"].(string)
+	if !ok {
+		d.app.debug.Printf("Matrix: Ignoring message without text body from \"%s\"", evt.Sender)
+		return
+	}
+	lang := d.resolveLang(evt.RoomID)
+	if d.contactRoom != "" && evt.RoomID == d.contactRoom && d.relayContactReply(evt, body) {
+		return
+	}
+	sects := strings.Split(body, " ")
+	if !strings.HasPrefix(sects[0], d.prefix) {
+		return
+	}
+	if allowed, warn := d.allowCommand(evt.RoomID, time.Now()); !allowed {
+		d.app.debug.Printf("Matrix: Rate limited command from \"%s\"", evt.Sender)
+		if warn {
+			if err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixRateLimited")); err != nil {
+				d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+			}
 		}
+		return
+	}
+	defer d.markRead(evt)
+	name := strings.TrimPrefix(sects[0], d.prefix)
+	if cmd, ok := d.commands[name]; ok && (!cmd.admin || d.isAdmin(evt)) {
+		cmd.handler(evt, sects, lang)
+		return
+	}
+	// Just the prefix, so show what's available.
+	if name == "" {
+		d.commandHelp(evt, sects, lang)
+		return
 	}
+	d.commandUnknown(evt, name, lang)
 }
 
-func (d *MatrixDaemon) commandLang(evt *event.Event, code, lang string) {
-	if code == "" {
-		list := "!lang <lang>\n"
-		for c := range d.app.storage.lang.Telegram {
-			list += fmt.Sprintf("%s: %s\n", c, d.app.storage.lang.Telegram[c].Meta.Name)
+// Maximum edit distance for a command to be suggested in place of an unknown one.
+const matrixSuggestMaxDistance = 2
+
+// commandUnknown tells the user the command doesn't exist, suggesting the closest one they can use if it's a likely typo.
+func (d *MatrixDaemon) commandUnknown(evt *event.Event, name, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	vals := tmpl{"command": d.prefix + name, "help": d.prefix + "help"}
+	content := strs.template("matrixUnknownCommand", vals)
+	if suggestion := d.suggestCommand(name, d.isAdmin(evt)); suggestion != "" {
+		vals["suggestion"] = d.prefix + suggestion
+		content = strs.template("matrixUnknownCommandSuggestion", vals)
+	}
+	if err := d.Reply(evt, content); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// suggestCommand returns the command closest to name, or "" if none are within matrixSuggestMaxDistance edits.
+// Ties go to the alphabetically first, so the suggestion doesn't change between calls.
+func (d *MatrixDaemon) suggestCommand(name string, admin bool) (suggestion string) {
+	name = strings.ToLower(name)
+	best := matrixSuggestMaxDistance
+	for c, cmd := range d.commands {
+		if cmd.admin && !admin {
+			continue
 		}
-		_, err := d.bot.SendText(
-			evt.RoomID,
-			list,
-		)
-		if err != nil {
-			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		dist := levenshtein(name, c)
+		// Replacing the whole of a short command isn't a typo.
+		if dist >= len(c) || dist > best || (dist == best && suggestion != "" && c > suggestion) {
+			continue
 		}
-		return
+		best, suggestion = dist, c
 	}
-	if _, ok := d.app.storage.lang.Telegram[code]; !ok {
-		return
+	return
+}
+
+// levenshtein returns the number of single-character insertions, deletions or substitutions needed to turn a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
 	}
-	d.languages[evt.RoomID] = code
-	if u, ok := d.app.storage.GetMatrixKey(string(evt.RoomID)); ok {
-		u.Lang = code
-		d.app.storage.SetMatrixKey(string(evt.RoomID), u)
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
 	}
+	return prev[len(rb)]
 }
 
-func (d *MatrixDaemon) CreateRoom(userID string) (roomID id.RoomID, encrypted bool, err error) {
-	var room *mautrix.RespCreateRoom
-	room, err = d.bot.CreateRoom(&mautrix.ReqCreateRoom{
-		Visibility: "private",
-		Invite:     []id.UserID{id.UserID(userID)},
-		Topic:      d.app.config.Section("matrix").Key("topic").String(),
-		IsDirect:   true,
-	})
-	if err != nil {
-		return
+// allowCommand takes a token from the room's bucket, returning whether the command should be handled.
+// If not, warn is true the first time, so the user can be told once rather than for every dropped command.
+func (d *MatrixDaemon) allowCommand(roomID id.RoomID, now time.Time) (allowed, warn bool) {
+	if d.commandRate <= 0 {
+		return true, false
 	}
-	encrypted = EncryptRoom(d, room, id.UserID(userID))
-	roomID = room.RoomID
-	return
+	if d.commandBuckets == nil {
+		d.commandBuckets = map[id.RoomID]*commandBucket{}
+	}
+	bucket, ok := d.commandBuckets[roomID]
+	if !ok {
+		bucket = &commandBucket{tokens: d.commandBurst, last: now}
+		d.commandBuckets[roomID] = bucket
+	}
+	bucket.tokens = math.Min(d.commandBurst, bucket.tokens+now.Sub(bucket.last).Seconds()*d.commandRate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.warned = false
+		return true, false
+	}
+	warn = !bucket.warned
+	bucket.warned = true
+	return false, warn
 }
 
-func (d *MatrixDaemon) SendStart(userID string) (ok bool) {
-	roomID, encrypted, err := d.CreateRoom(userID)
-	if err != nil {
-		d.app.err.Printf("Failed to create room for user \"%s\": %v", userID, err)
+// handleDecryptionFailure logs an encrypted message which couldn't be decrypted, with the session ID to help debug key requests.
+// If matrix.notify_decryption_failures is set, the sender is told once per session.
+func (d *MatrixDaemon) handleDecryptionFailure(evt *event.Event, err error) {
+	sessionID, _ := evt.Content.Raw["session_id"].(string)
+	d.app.err.Printf("Matrix: Failed to decrypt message from \"%s\" in room \"%s\" (session \"%s\"): %v", evt.Sender, evt.RoomID, sessionID, err)
+	if !d.decryptNotice || evt.Sender == d.userID || d.undecryptable[evt.RoomID] == sessionID {
 		return
 	}
-	lang := "en-us"
-	pin := genAuthToken()
-	d.tokens[pin] = UnverifiedUser{
-		false,
-		&MatrixUser{
-			RoomID:    string(roomID),
-			UserID:    userID,
-			Lang:      lang,
-			Encrypted: encrypted,
-		},
-	}
-	err = d.sendToRoom(
-		&event.MessageEventContent{
-			MsgType: event.MsgText,
-			Body: d.app.storage.lang.Telegram[lang].Strings.get("matrixStartMessage") + "\n\n" + pin + "\n\n" +
-				d.app.storage.lang.Telegram[lang].Strings.template("languageMessage", tmpl{"command": "!lang"}),
-		},
-		roomID,
-	)
+	d.undecryptable[evt.RoomID] = sessionID
+	lang := d.resolveLang(evt.RoomID)
+	err = d.sendToRoom(&event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    d.app.storage.lang.Matrix[lang].Strings.get("matrixDecryptionFailed"),
+	}, evt.RoomID)
 	if err != nil {
-		d.app.err.Printf("Matrix: Failed to send welcome message to \"%s\": %v", userID, err)
-		return
+		d.app.debug.Printf("Matrix: Failed to tell \"%s\" their message couldn't be decrypted: %v", evt.Sender, err)
 	}
-	ok = true
-	return
 }
 
-func (d *MatrixDaemon) sendToRoom(content *event.MessageEventContent, roomID id.RoomID) (err error) {
-	if encrypted, ok := d.isEncrypted[roomID]; ok && encrypted {
-		err = SendEncrypted(d, content, roomID)
-	} else {
-		_, err = d.bot.SendMessageEvent(roomID, event.EventMessage, content, mautrix.ReqSendEvent{})
+// markRead sends a read receipt for the event, so the user's client shows their command was seen.
+// Receipts are unencrypted, so they're not sent in encrypted rooms.
+func (d *MatrixDaemon) markRead(evt *event.Event) {
+	if encrypted, _ := d.roomEncrypted(evt.RoomID); encrypted {
+		return
+	}
+	if err := d.bot.MarkRead(evt.RoomID, evt.ID); err != nil {
+		d.app.debug.Printf("Matrix: Failed to send read receipt in room \"%s\": %v", evt.RoomID, err)
 	}
-	return
 }
 
-func (d *MatrixDaemon) send(content *event.MessageEventContent, roomID id.RoomID) (err error) {
-	_, err = d.bot.SendMessageEvent(roomID, event.EventMessage, content, mautrix.ReqSendEvent{})
-	return
+// isAdmin returns whether admin commands can be used by the event's sender in its room.
+func (d *MatrixDaemon) isAdmin(evt *event.Event) bool {
+	return d.adminUsers[evt.Sender] || d.adminRooms[evt.RoomID]
 }
 
-func (d *MatrixDaemon) Send(message *Message, users ...MatrixUser) (err error) {
-	md := ""
-	if message.Markdown != "" {
-		// Convert images to links
-		md = string(markdown.ToHTML([]byte(strings.ReplaceAll(message.Markdown, "![", "[")), nil, markdownRenderer))
+// helpMessage returns the list of available commands and their descriptions. Admin commands are only included if admin is true.
+func (d *MatrixDaemon) helpMessage(lang string, admin bool) string {
+	names := make([]string, 0, len(d.commands))
+	for name, cmd := range d.commands {
+		if cmd.admin && !admin {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	list := strs.get("matrixHelpMessage") + "\n"
+	for _, name := range names {
+		list += fmt.Sprintf("%s%s: %s\n", d.prefix, name, strs.template(d.commands[name].description, tmpl{"command": d.prefix + name}))
+	}
+	return list
+}
+
+// Reply sends a plain text message to the room the given event came from, in a thread under it if enabled.
+func (d *MatrixDaemon) Reply(evt *event.Event, content string) error {
+	for _, part := range splitMatrixText(content, d.maxLength) {
+		msg := &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    part,
+		}
+		if d.replyInThread {
+			// Replies to a message already in a thread should go in the same one.
+			root := evt.Content.AsMessage().RelatesTo.GetThreadParent()
+			if root == "" {
+				root = evt.ID
+			}
+			// The fallback reply is shown by clients which don't support threads.
+			msg.RelatesTo = (&event.RelatesTo{}).SetThread(root, evt.ID)
+		}
+		if err := d.sendToRoom(msg, evt.RoomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Acknowledge tells the user whether their command succeeded. If it's in d.reactCommands, a reaction is added to their message,
+// and the text reply is only sent if d.reactWithText is set, or the reaction fails.
+// Reactions would be sent unencrypted, so encrypted rooms always get the text reply.
+func (d *MatrixDaemon) Acknowledge(evt *event.Event, command string, success bool, content string) error {
+	if encrypted, _ := d.roomEncrypted(evt.RoomID); d.reactCommands[command] && !encrypted {
+		key := MATRIX_REACTION_SUCCESS
+		if !success {
+			key = MATRIX_REACTION_FAILURE
+		}
+		err := d.react(evt, key)
+		if err == nil && !d.reactWithText {
+			return nil
+		}
+		if err != nil {
+			d.app.debug.Printf("Matrix: Failed to react in room \"%s\", replying instead: %v", evt.RoomID, err)
+		}
+	}
+	return d.Reply(evt, content)
+}
+
+// react adds an m.reaction with the given key to the event.
+func (d *MatrixDaemon) react(evt *event.Event, key string) error {
+	if !d.beginSend() {
+		return ErrMatrixStopped
+	}
+	defer d.sending.Done()
+	content := &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: evt.ID, Key: key},
+	}
+	return d.retryRateLimited(func() error {
+		_, err := d.bot.SendMessageEvent(evt.RoomID, event.EventReaction, content)
+		return err
+	})
+}
+
+func (d *MatrixDaemon) commandHelp(evt *event.Event, sects []string, lang string) {
+	err := d.Reply(evt, d.helpMessage(lang, d.isAdmin(evt)))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+func (d *MatrixDaemon) commandExpiry(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		d.app.debug.Printf("Matrix: Ignoring expiry request from unlinked room \"%s\"", evt.RoomID)
+		return
+	}
+	content := d.app.storage.lang.Matrix[lang].Strings.get("accountNoExpiry")
+	if expiry, ok := d.app.storage.GetUserExpiryKey(user.JellyfinID); ok {
+		content = d.app.expiryMessage(d.app.storage.lang.Matrix[lang], expiry.Expiry.In(user.Location()))
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+func (d *MatrixDaemon) commandLang(evt *event.Event, sects []string, lang string) {
+	code := ""
+	if len(sects) == 2 {
+		code = sects[1]
+	}
+	if code == "" {
+		list := d.prefix + "lang <lang>\n"
+		codes := make([]string, 0, len(d.app.storage.lang.Matrix))
+		for c := range d.app.storage.lang.Matrix {
+			codes = append(codes, c)
+		}
+		sort.Strings(codes)
+		for _, c := range codes {
+			list += fmt.Sprintf("%s: %s\n", c, d.app.storage.lang.Matrix[c].Meta.Name)
+		}
+		err := d.Reply(evt, list)
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	match, options := d.matchLang(code)
+	if match == "" {
+		strs := d.app.storage.lang.Matrix[lang].Strings
+		reply := strs.template("languageNotFound", tmpl{"language": code, "command": d.prefix + "lang"})
+		if len(options) != 0 {
+			reply = strs.template("matrixLanguageAmbiguous", tmpl{"language": code, "options": strings.Join(options, ", "), "command": d.prefix + "lang"})
+		}
+		err := d.Reply(evt, reply)
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	code = match
+	d.setRoomLang(evt.RoomID, code)
+	// The language is the room's, so it applies to every account linked there.
+	for _, u := range d.roomAccounts(evt.RoomID) {
+		u.Lang = code
+		d.app.storage.SetMatrixKey(u.JellyfinID, u)
+	}
+	// Users may change language before they've entered their PIN.
+	d.tokensLock.Lock()
+	for _, token := range d.tokens {
+		if id.RoomID(token.User.RoomID) == evt.RoomID {
+			token.User.Lang = code
+		}
+	}
+	d.tokensLock.Unlock()
+	if d.topic == "" {
+		_, err := d.bot.SendStateEvent(evt.RoomID, event.StateTopic, "", &event.TopicEventContent{Topic: d.roomTopic(code)})
+		if err != nil {
+			d.app.debug.Printf("Matrix: Failed to update topic of room \"%s\": %v", evt.RoomID, err)
+		}
+	}
+	err := d.Reply(evt, d.app.storage.lang.Matrix[code].Strings.template("languageSet", tmpl{"language": d.app.storage.lang.Matrix[code].Meta.Name}))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// Profile fields clients and homeservers may store a user's locale in. There's no standard one yet.
+var matrixLocaleFields = []string{"m.locale", "locale", "language"}
+
+// profileLang returns the language closest to the locale in the user's profile, e.g. "pt-BR" or "pt_BR",
+// trying the language alone ("pt") if there's no exact match. Returns "" if detection is disabled or nothing matches.
+func (d *MatrixDaemon) profileLang(userID string) string {
+	if !d.detectLang {
+		return ""
+	}
+	profile := map[string]interface{}{}
+	if _, err := d.bot.MakeRequest(http.MethodGet, d.bot.BuildClientURL("v3", "profile", userID), nil, &profile); err != nil {
+		d.app.debug.Printf("Matrix: Failed to get profile of \"%s\" to detect their language: %v", userID, err)
+		return ""
+	}
+	for _, field := range matrixLocaleFields {
+		locale, ok := profile[field].(string)
+		if !ok || strings.TrimSpace(locale) == "" {
+			continue
+		}
+		language := strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0]
+		for _, l := range []string{locale, language} {
+			if code, _ := d.matchLang(l); code != "" {
+				d.app.debug.Printf("Matrix: Detected language \"%s\" for \"%s\" from locale \"%s\"", code, userID, locale)
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// matchLang resolves what a user typed to a language code, e.g. "en" or "English" to "en-us".
+// An exact code takes precedence, then a unique code or name prefix. If the prefix matches several, they're returned as options.
+func (d *MatrixDaemon) matchLang(input string) (code string, options []string) {
+	input = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(input), "_", "-"))
+	if input == "" {
+		return
+	}
+	for c := range d.app.storage.lang.Matrix {
+		if strings.ToLower(c) == input {
+			return c, nil
+		}
+	}
+	for c, l := range d.app.storage.lang.Matrix {
+		if strings.HasPrefix(strings.ToLower(c), input) || strings.HasPrefix(strings.ToLower(l.Meta.Name), input) {
+			options = append(options, c)
+		}
+	}
+	if len(options) == 1 {
+		return options[0], nil
+	}
+	sort.Strings(options)
+	return
+}
+
+// roomTopic returns the topic for a room in the given language. The topic from the config is used if set.
+func (d *MatrixDaemon) roomTopic(lang string) string {
+	if d.topic != "" {
+		return d.topic
+	}
+	return d.app.storage.lang.Matrix[lang].Strings.get("matrixRoomTopic")
+}
+
+// roomLang returns the language chosen for the room, and whether there is one.
+func (d *MatrixDaemon) roomLang(roomID id.RoomID) (string, bool) {
+	d.roomsLock.RLock()
+	defer d.roomsLock.RUnlock()
+	lang, ok := d.languages[roomID]
+	return lang, ok
+}
+
+func (d *MatrixDaemon) setRoomLang(roomID id.RoomID, lang string) {
+	d.roomsLock.Lock()
+	defer d.roomsLock.Unlock()
+	d.languages[roomID] = lang
+}
+
+// roomEncrypted returns whether the room is encrypted, and whether that's known yet.
+func (d *MatrixDaemon) roomEncrypted(roomID id.RoomID) (encrypted, known bool) {
+	d.roomsLock.RLock()
+	defer d.roomsLock.RUnlock()
+	encrypted, known = d.isEncrypted[roomID]
+	return
+}
+
+func (d *MatrixDaemon) setRoomEncrypted(roomID id.RoomID, encrypted bool) {
+	d.roomsLock.Lock()
+	defer d.roomsLock.Unlock()
+	d.isEncrypted[roomID] = encrypted
+}
+
+// forgetRoom drops the room's language and encryption state, once the bot has no more use for it.
+func (d *MatrixDaemon) forgetRoom(roomID id.RoomID) {
+	d.roomsLock.Lock()
+	defer d.roomsLock.Unlock()
+	delete(d.languages, roomID)
+	delete(d.isEncrypted, roomID)
+}
+
+// resolveLang returns the language to use in the given room.
+// Linked users are checked first, then users awaiting verification, then the default is used.
+// It's called from any goroutine, so only reads; the lang command is what records a room's choice.
+func (d *MatrixDaemon) resolveLang(roomID id.RoomID) string {
+	valid := func(code string) bool {
+		_, ok := d.app.storage.lang.Matrix[code]
+		return ok
+	}
+	if l, ok := d.roomLang(roomID); ok && valid(l) {
+		return l
+	}
+	if u, ok := d.userByRoom(roomID); ok && valid(u.Lang) {
+		return u.Lang
+	}
+	d.tokensLock.Lock()
+	defer d.tokensLock.Unlock()
+	for _, token := range d.tokens {
+		if id.RoomID(token.User.RoomID) == roomID && valid(token.User.Lang) {
+			return token.User.Lang
+		}
+	}
+	return d.defaultLang()
+}
+
+// defaultLang returns the language to use when the recipient's is unknown.
+func (d *MatrixDaemon) defaultLang() string {
+	if lang := d.app.storage.lang.chosenTelegramLang; lang != "" {
+		if _, ok := d.app.storage.lang.Matrix[lang]; ok {
+			return lang
+		}
+	}
+	return "en-us"
+}
+
+// CreateRoom creates a private room with the user, encrypting it unless disabled.
+// If encryption is forced and the room can't be encrypted, ErrMatrixEncryptionUnavailable is returned and the room is left.
+func (d *MatrixDaemon) CreateRoom(userID string) (roomID id.RoomID, encrypted bool, err error) {
+	if d.forceEncryption && !d.Encryption {
+		err = ErrMatrixEncryptionUnavailable
+		return
+	}
+	var room *mautrix.RespCreateRoom
+	err = d.retryTransient(func() (err error) {
+		// The user's language isn't known until they've verified, so use the default for the topic.
+		room, err = d.bot.CreateRoom(&mautrix.ReqCreateRoom{
+			Visibility: "private",
+			Invite:     []id.UserID{id.UserID(userID)},
+			Topic:      d.roomTopic(d.defaultLang()),
+			IsDirect:   true,
+		})
+		return
+	})
+	if err != nil {
+		return
+	}
+	roomID = room.RoomID
+	if !d.noEncryption {
+		err := d.retryTransient(func() (err error) {
+			encrypted, err = EncryptRoom(d, room, id.UserID(userID))
+			return
+		})
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to encrypt room \"%s\": %v", roomID, err)
+		}
+	}
+	if d.forceEncryption && !encrypted {
+		if _, err := d.bot.LeaveRoom(roomID); err != nil {
+			d.app.err.Printf("Matrix: Failed to leave room \"%s\": %v", roomID, err)
+		}
+		return "", false, ErrMatrixEncryptionUnavailable
+	}
+	d.setRoomEncrypted(roomID, encrypted)
+	d.addToSpace(roomID)
+	return
+}
+
+// User enters ID on sign-up, a PIN is sent to them. They enter it on sign-up.
+
+// Message the user first, to avoid E2EE by default
+
+// SendStart creates a room with the given user and sends them a verification PIN.
+// jellyfinID should be given if the user is already logged in, so the account can be linked with the verify command.
+// server is the one the invite or account is for, which the welcome message names.
+// Returns ErrInvalidMatrixUserID if userID isn't of the form @user:server.
+func (d *MatrixDaemon) SendStart(userID, jellyfinID string, server MediaServer) (err error) {
+	if !validMatrixUserID(userID) {
+		d.app.debug.Printf("Matrix: Invalid user ID \"%s\"", userID)
+		return ErrInvalidMatrixUserID
+	}
+	// Repeated requests, e.g. from a double click, get the same PIN again rather than another room.
+	if pin, roomID, ok := d.recentStart(userID, jellyfinID); ok {
+		d.app.debug.Printf("Matrix: Resending PIN to \"%s\" in existing room \"%s\"", userID, roomID)
+		err = d.sendToRoom(d.welcomeContent(d.resolveLang(roomID), pin), roomID)
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send welcome message to \"%s\": %v", userID, err)
+		}
+		return
+	}
+	roomID, encrypted, err := d.CreateRoom(userID)
+	if err != nil {
+		d.app.err.Printf("Failed to create room for user \"%s\": %v", userID, err)
+		return
+	}
+	return d.sendPIN(roomID, userID, jellyfinID, encrypted, server)
+}
+
+// sendPIN generates a verification PIN for the user and sends it in the given room, which they should already be in or invited to.
+func (d *MatrixDaemon) sendPIN(roomID id.RoomID, userID, jellyfinID string, encrypted bool, server MediaServer) (err error) {
+	lang := d.resolveLang(roomID)
+	// A language the user picked with the lang command takes precedence.
+	if _, chosen := d.roomLang(roomID); !chosen {
+		if detected := d.profileLang(userID); detected != "" {
+			lang = detected
+		}
+	}
+	pin := genAuthToken()
+	d.setToken(pin, UnverifiedUser{
+		false,
+		&MatrixUser{
+			RoomID:    string(roomID),
+			UserID:    userID,
+			Lang:      lang,
+			Encrypted: encrypted,
+		},
+		jellyfinID,
+		time.Now(),
+		server,
+	})
+	err = d.sendToRoom(d.welcomeContent(lang, pin), roomID)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send welcome message to \"%s\": %v", userID, err)
+	}
+	return
+}
+
+// Stands in for the sign-up link in the formatted body until the rest has been escaped.
+const matrixSignupLinkMarker = "\x00signup\x00"
+
+// welcomeContent renders the PIN message from welcomeTemplate, or the language's matrixWelcomeTemplate.
+// Placeholders are {pin}, {signupLink} (a new line with the sign-up link, if configured), {langCommand}, {verifyCommand},
+// {serverName} and {serverURL} of the server the PIN is for, and the translated {startMessage}, {serverMessage}
+// (a new line naming the server, if its URL is known), {verifyMessage} and {languageMessage}.
+func (d *MatrixDaemon) welcomeContent(lang, pin string) *event.MessageEventContent {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	layout := d.welcomeTemplate
+	if layout == "" {
+		layout = strs.get("matrixWelcomeTemplate")
+	}
+	vals := tmpl{
+		"pin":             pin,
+		"langCommand":     d.prefix + "lang",
+		"verifyCommand":   d.prefix + "verify",
+		"startMessage":    strs.get("matrixStartMessage"),
+		"verifyMessage":   strs.template("matrixVerifyMessage", tmpl{"command": d.prefix + "verify"}),
+		"languageMessage": strs.template("languageMessage", tmpl{"command": d.prefix + "lang"}),
+		"serverName":      "",
+		"serverURL":       "",
+		"serverMessage":   "",
+		"signupLink":      "",
+	}
+	var server MediaServer
+	if token, ok := d.token(pin); ok {
+		server = token.Server
+	}
+	if server.Name == "" && d.app.jf != nil {
+		server.Name = d.app.jf.ServerInfo.Name
+	}
+	vals["serverName"], vals["serverURL"] = server.Name, server.URL
+	if server.URL != "" {
+		vals["serverMessage"] = "\n" + strs.template("matrixServerMessage", tmpl{"serverName": server.Name, "serverURL": server.URL})
+	}
+	// Don't point users to commands they can't use.
+	if !d.hasCommand("verify") {
+		vals["verifyMessage"] = ""
+	}
+	if !d.hasCommand("lang") {
+		vals["languageMessage"] = ""
+	}
+	link := d.signupLink(pin)
+	if link != "" {
+		vals["signupLink"] = "\n" + link
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    templateString(layout, vals),
+	}
+	// The PIN and link are kept in the plain body for clients which don't render links.
+	if link != "" {
+		vals["signupLink"] = "\n" + matrixSignupLinkMarker
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(
+			matrixParagraphs(templateString(layout, vals)),
+			matrixSignupLinkMarker,
+			"<a href=\""+html.EscapeString(link)+"\">"+html.EscapeString(strs.get("matrixSignupLink"))+"</a>",
+		)
+	}
+	d.addLogo(content)
+	return content
+}
+
+// addLogo puts the configured logo above the content's formatted body, creating one from the plain body if needed.
+// The logo is uploaded on first use, and left out if that fails.
+func (d *MatrixDaemon) addLogo(content *event.MessageEventContent) {
+	if d.logo == "" {
+		return
+	}
+	uri, err := d.uploadImage(d.logo)
+	if err != nil {
+		d.app.debug.Printf("Matrix: Failed to upload logo \"%s\", sending without it: %v", d.logo, err)
+		return
+	}
+	if content.FormattedBody == "" {
+		content.FormattedBody = matrixParagraphs(content.Body)
+	}
+	alt := "Logo"
+	if d.app.jf != nil && d.app.jf.ServerInfo.Name != "" {
+		alt = d.app.jf.ServerInfo.Name
+	}
+	content.Format = event.FormatHTML
+	content.FormattedBody = "<img src=\"" + html.EscapeString(uri.String()) + "\" alt=\"" + html.EscapeString(alt) + "\" height=\"" + MATRIX_LOGO_HEIGHT + "\">" + content.FormattedBody
+}
+
+// SendTest sends a test message to the given user, in their linked room if they have one, or otherwise a new room.
+// Returns the room used, whether it was created for the test, and whether it's encrypted.
+func (d *MatrixDaemon) SendTest(userID string) (roomID id.RoomID, created, encrypted bool, err error) {
+	if !validMatrixUserID(userID) {
+		err = ErrInvalidMatrixUserID
+		return
+	}
+	for _, user := range d.app.storage.GetMatrix() {
+		if user.UserID == userID {
+			roomID = id.RoomID(user.RoomID)
+			encrypted, _ = d.roomEncrypted(roomID)
+			break
+		}
+	}
+	if roomID == "" {
+		roomID, encrypted, err = d.CreateRoom(userID)
+		if err != nil {
+			return
+		}
+		created = true
+	}
+	lang := d.resolveLang(roomID)
+	err = d.sendToRoom(&event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    d.app.storage.lang.Matrix[lang].Strings.get("matrixTestMessage"),
+	}, roomID)
+	return
+}
+
+// signupLink returns the configured sign-up URL with the PIN added as a query parameter, or "" if no URL is set.
+func (d *MatrixDaemon) signupLink(pin string) string {
+	if d.signupURL == "" {
+		return ""
+	}
+	u, err := url.Parse(d.signupURL)
+	if err != nil {
+		d.app.debug.Printf("Matrix: Invalid sign-up URL \"%s\": %v", d.signupURL, err)
+		return ""
+	}
+	q := u.Query()
+	q.Set("pin", pin)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// matrixParagraphs escapes plain text for a formatted body, splitting it into paragraphs on blank lines.
+func matrixParagraphs(text string) (out string) {
+	for _, p := range strings.Split(text, "\n\n") {
+		out += "<p>" + strings.ReplaceAll(html.EscapeString(p), "\n", "<br>") + "</p>"
+	}
+	return
+}
+
+// validMatrixUserID returns whether the given user ID is well-formed, i.e. @user:server. The server can be any homeserver, not just the bot's.
+func validMatrixUserID(userID string) bool {
+	localpart, homeserver, err := id.UserID(userID).Parse()
+	return err == nil && localpart != "" && homeserver != ""
+}
+
+// validMatrixRoomID returns whether the given room ID is well-formed, i.e. !room:server.
+func validMatrixRoomID(roomID string) bool {
+	localpart, server, ok := strings.Cut(strings.TrimPrefix(roomID, "!"), ":")
+	return strings.HasPrefix(roomID, "!") && ok && localpart != "" && server != ""
+}
+
+func (d *MatrixDaemon) sendToRoom(content *event.MessageEventContent, roomID id.RoomID) (err error) {
+	_, err = d.sendToRoomEvent(content, roomID)
+	return
+}
+
+// sendToRoomEvent is sendToRoom, also returning the ID of the sent event.
+func (d *MatrixDaemon) sendToRoomEvent(content *event.MessageEventContent, roomID id.RoomID) (eventID id.EventID, err error) {
+	return d.sendToRoomTxn(content, roomID, "")
+}
+
+// sendToRoomTxn is sendToRoomEvent with the given transaction ID, or a new one if blank.
+// The same ID is used for every attempt, so the homeserver ignores a retry of a send which actually went through.
+func (d *MatrixDaemon) sendToRoomTxn(content *event.MessageEventContent, roomID id.RoomID, txnID string) (eventID id.EventID, err error) {
+	if txnID == "" {
+		txnID = d.bot.TxnID()
+	}
+	if !d.beginSend() {
+		return "", ErrMatrixStopped
+	}
+	defer d.sending.Done()
+	if d.showTyping {
+		d.setTyping(roomID, true)
+		defer d.setTyping(roomID, false)
+	}
+	err = d.retryRateLimited(func() (err error) {
+		if encrypted, _ := d.roomEncrypted(roomID); encrypted {
+			if d.cryptoFailed {
+				return ErrMatrixEncryptionUnavailable
+			}
+			eventID, err = SendEncrypted(d, content, roomID, txnID)
+		} else {
+			eventID, err = d.send(content, roomID, txnID)
+		}
+		return
+	})
+	return
+}
+
+// setTyping sets the bot's typing status in the room. Failures are only logged, as it's purely cosmetic.
+func (d *MatrixDaemon) setTyping(roomID id.RoomID, typing bool) {
+	if _, err := d.bot.UserTyping(roomID, typing, MATRIX_TYPING_TIMEOUT); err != nil {
+		d.app.debug.Printf("Matrix: Failed to set typing status in room \"%s\": %v", roomID, err)
+	}
+}
+
+// retryRateLimited calls f, and if the homeserver responds with M_LIMIT_EXCEEDED,
+// waits the requested time and tries again, up to d.maxRetries times.
+// The wait applies to every send, so concurrent ones (e.g. from Broadcast) don't keep hitting the limit.
+func (d *MatrixDaemon) retryRateLimited(f func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		d.limitedLock.Lock()
+		wait := time.Until(d.limitedUntil)
+		d.limitedLock.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		err = f()
+		wait, limited := matrixRetryAfter(err)
+		if !limited || attempt >= d.maxRetries {
+			return
+		}
+		d.app.debug.Printf("Matrix: Rate limited, retrying in %s", wait)
+		d.limitedLock.Lock()
+		if until := time.Now().Add(wait); until.After(d.limitedUntil) {
+			d.limitedUntil = until
+		}
+		d.limitedLock.Unlock()
+	}
+}
+
+// retryTransient calls f, also retrying rate limits with retryRateLimited, and if it fails with a matrixTransient error,
+// tries again with a doubling backoff up to d.transientRetries times. Once they're used up, ErrMatrixRetriesExhausted is returned.
+func (d *MatrixDaemon) retryTransient(f func() error) (err error) {
+	backoff := d.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = d.retryRateLimited(f)
+		if !matrixTransient(err) {
+			return
+		}
+		if attempt >= d.transientRetries {
+			return fmt.Errorf("%w after %d attempts: %v", ErrMatrixRetriesExhausted, attempt+1, err)
+		}
+		d.app.debug.Printf("Matrix: Request failed, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// matrixTransient returns whether err might not happen again: the homeserver couldn't be reached or had an internal error.
+// Errors like an invalid user ID are permanent, so aren't worth retrying.
+func matrixTransient(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.Response == nil || httpErr.Response.StatusCode >= 500
+}
+
+// matrixRetryAfter returns whether err is a rate-limit error, and how long the homeserver asked us to wait.
+func matrixRetryAfter(err error) (wait time.Duration, limited bool) {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || httpErr.RespError.ErrCode != mautrix.MLimitExceeded.ErrCode {
+		return
+	}
+	limited = true
+	wait = MATRIX_RATE_LIMIT_DEFAULT_WAIT
+	if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+		wait = time.Duration(ms) * time.Millisecond
+	}
+	return
+}
+
+// matrixTxnID derives the transaction ID for sending the given part of a message to a room from the message's TxnID,
+// or returns "" if it has none.
+func matrixTxnID(message *Message, roomID id.RoomID, part int) string {
+	if message.TxnID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(roomID))
+	txnID := "jfa-go_" + message.TxnID + "_" + hex.EncodeToString(sum[:4])
+	if part != 0 {
+		txnID += "_" + strconv.Itoa(part)
+	}
+	return txnID
+}
+
+func (d *MatrixDaemon) send(content *event.MessageEventContent, roomID id.RoomID, txnID string) (eventID id.EventID, err error) {
+	resp, err := d.bot.SendMessageEvent(roomID, event.EventMessage, content, mautrix.ReqSendEvent{TransactionID: txnID})
+	if err == nil {
+		eventID = resp.EventID
+	}
+	return
+}
+
+func (d *MatrixDaemon) Send(message *Message, users ...MatrixUser) (err error) {
+	contents := d.messageContents(message, event.MsgNotice)
+	for _, user := range users {
+		if !user.Contact {
+			d.app.debug.Printf("Matrix: Not sending to \"%s\", contact turned off", user.UserID)
+			continue
+		}
+		if user.Muted && message.Priority < PriorityCritical {
+			d.app.debug.Printf("Matrix: Not sending to \"%s\", notifications muted", user.UserID)
+			continue
+		}
+		if until, quiet := user.QuietUntil(time.Now()); quiet && message.Priority < PriorityCritical {
+			d.app.debug.Printf("Matrix: Holding message to \"%s\" until their quiet hours end at %s", user.UserID, until.Format(time.RFC3339))
+			d.app.storage.SetHeldMatrixMessageKey(shortuuid.New(), HeldMatrixMessage{Message: *message, JellyfinID: user.JellyfinID, Until: until})
+			continue
+		}
+		var eventID id.EventID
+		eventID, err = d.sendParts(id.RoomID(user.RoomID), message, contentsFor(user, contents))
+		notificationMetrics.record("matrix", message, err)
+		if err != nil {
+			d.dropIfUnreachable(user, err)
+			return
+		}
+		// Reading the last event means they've seen the rest.
+		if message.OnMatrixRead != nil {
+			d.trackDelivery(user, eventID, message.OnMatrixRead)
+		}
+	}
+	return
+}
+
+// SendToRoom sends the message to any room the bot is in, e.g. an admin or alert room, rather than a linked user's.
+// Whether the room is encrypted is looked up the first time it's used.
+func (d *MatrixDaemon) SendToRoom(roomID string, message *Message) error {
+	if !validMatrixRoomID(roomID) {
+		return ErrInvalidMatrixRoomID
+	}
+	room := id.RoomID(roomID)
+	if _, known := d.roomEncrypted(room); !known {
+		enc := event.EncryptionEventContent{}
+		err := d.bot.StateEvent(room, event.StateEncryption, "", &enc)
+		switch {
+		case err == nil:
+			d.setRoomEncrypted(room, enc.Algorithm != "")
+		case errors.Is(err, mautrix.MNotFound):
+			d.setRoomEncrypted(room, false)
+		case matrixRoomGone(err):
+			return fmt.Errorf("%w: %s", ErrMatrixUnknownRoom, roomID)
+		default:
+			return err
+		}
+	}
+	_, err := d.sendParts(room, message, d.messageContents(message, event.MsgNotice))
+	notificationMetrics.record("matrix", message, err)
+	if matrixRoomGone(err) {
+		return fmt.Errorf("%w: %s", ErrMatrixUnknownRoom, roomID)
+	}
+	return err
+}
+
+// Kinds of event announced in the admin room.
+const (
+	AdminNoticeSignup      = "signup"
+	AdminNoticeExpired     = "expired"
+	AdminNoticeLoginFailed = "loginFailed"
+	AdminNoticeLinked      = "linked"
+)
+
+// Strings for each kind of admin notice, for one user and for several.
+var matrixAdminNoticeStrings = map[string][2]string{
+	AdminNoticeSignup:      {"adminNoticeSignup", "adminNoticeSignups"},
+	AdminNoticeExpired:     {"adminNoticeExpired", "adminNoticeExpiries"},
+	AdminNoticeLoginFailed: {"adminNoticeLoginFailed", "adminNoticeLoginsFailed"},
+	AdminNoticeLinked:      {"adminNoticeLinked", "adminNoticeLinkedMany"},
+}
+
+// Most users named in one admin notice, the rest are counted.
+const MATRIX_ADMIN_NOTICE_MAX_NAMES = 20
+
+// AdminNotice announces that the event of the given kind happened to the named user in matrix.admin_room_id, if set.
+// Notices are held for d.adminNoticeDelay, so a burst (e.g. many accounts expiring at once) is sent as one message.
+func (d *MatrixDaemon) AdminNotice(kind, username string) {
+	if d.adminRoom == "" {
+		return
+	}
+	d.adminNoticesLock.Lock()
+	defer d.adminNoticesLock.Unlock()
+	if d.adminNotices == nil {
+		d.adminNotices = map[string][]string{}
+	}
+	if _, ok := d.adminNotices[kind]; !ok {
+		d.adminNoticeKinds = append(d.adminNoticeKinds, kind)
+	}
+	d.adminNotices[kind] = append(d.adminNotices[kind], username)
+	if d.adminNoticeTimer == nil {
+		d.adminNoticeTimer = time.AfterFunc(d.adminNoticeDelay, d.flushAdminNotices)
+	}
+}
+
+// OnVerified adds a hook called whenever a user verifies their PIN and is linked, e.g. for audit logging.
+// Hooks are called in their own goroutine, so a slow one doesn't hold up the user's reply.
+func (d *MatrixDaemon) OnVerified(hook func(MatrixVerification)) {
+	d.verifiedHooksLock.Lock()
+	defer d.verifiedHooksLock.Unlock()
+	d.verifiedHooks = append(d.verifiedHooks, hook)
+}
+
+// verified logs that the user with the given Jellyfin ID verified their PIN, and calls the OnVerified hooks.
+func (d *MatrixDaemon) verified(jellyfinID string, user MatrixUser, source string) {
+	user.JellyfinID = jellyfinID
+	d.app.info.Printf("Matrix: Verified user_id=\"%s\" room_id=\"%s\" jellyfin_id=\"%s\" source=%s", user.UserID, user.RoomID, jellyfinID, source)
+	v := MatrixVerification{User: user, Source: source, Time: time.Now()}
+	d.verifiedHooksLock.Lock()
+	hooks := append([]func(MatrixVerification){}, d.verifiedHooks...)
+	d.verifiedHooksLock.Unlock()
+	for _, hook := range hooks {
+		go hook(v)
+	}
+}
+
+// announceVerified notes the verification in the admin room. Sign-ups are already announced, so aren't repeated.
+func (d *MatrixDaemon) announceVerified(v MatrixVerification) {
+	if d.adminRoom == "" || v.Source == MatrixVerifiedSignup {
+		return
+	}
+	d.AdminNotice(AdminNoticeLinked, d.accountName(v.User))
+}
+
+// flushAdminNotices sends the held admin notices, one line per kind.
+func (d *MatrixDaemon) flushAdminNotices() {
+	d.adminNoticesLock.Lock()
+	notices, kinds := d.adminNotices, d.adminNoticeKinds
+	d.adminNotices, d.adminNoticeKinds = nil, nil
+	if d.adminNoticeTimer != nil {
+		d.adminNoticeTimer.Stop()
+		d.adminNoticeTimer = nil
+	}
+	d.adminNoticesLock.Unlock()
+	if len(kinds) == 0 {
+		return
+	}
+	strs := d.app.storage.lang.Matrix[d.defaultLang()].Strings
+	lines := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		users := notices[kind]
+		names := strings.Join(users, ", ")
+		if len(users) > MATRIX_ADMIN_NOTICE_MAX_NAMES {
+			names = strings.Join(users[:MATRIX_ADMIN_NOTICE_MAX_NAMES], ", ") + " " + strs.template("adminNoticeMore", tmpl{"n": strconv.Itoa(len(users) - MATRIX_ADMIN_NOTICE_MAX_NAMES)})
+		}
+		key := matrixAdminNoticeStrings[kind][0]
+		if len(users) > 1 {
+			key = matrixAdminNoticeStrings[kind][1]
+		}
+		lines = append(lines, "- "+strs.template(key, tmpl{"user": names, "users": names, "n": strconv.Itoa(len(users))}))
+	}
+	text := strings.Join(lines, "\n")
+	if err := d.SendToRoom(string(d.adminRoom), &Message{Text: text, Markdown: linkImages(text)}); err != nil {
+		d.app.err.Printf("Matrix: Failed to send notices to admin room \"%s\": %v", d.adminRoom, err)
+	}
+}
+
+// trackDelivery waits for a read receipt for the given event, calling callback once it's seen or after d.deliveryTimeout.
+func (d *MatrixDaemon) trackDelivery(user MatrixUser, eventID id.EventID, callback func(user MatrixUser, read bool)) {
+	roomID := id.RoomID(user.RoomID)
+	delivery := &matrixDelivery{user: user, eventID: eventID, sent: time.Now(), callback: callback}
+	d.deliveriesLock.Lock()
+	defer d.deliveriesLock.Unlock()
+	if d.deliveries == nil {
+		d.deliveries = map[id.RoomID][]*matrixDelivery{}
+	}
+	d.deliveries[roomID] = append(d.deliveries[roomID], delivery)
+	delivery.timer = time.AfterFunc(d.deliveryTimeout, func() { d.finishDelivery(roomID, delivery, false) })
+}
+
+// finishDelivery stops tracking the delivery and calls its callback, unless that's already been done.
+func (d *MatrixDaemon) finishDelivery(roomID id.RoomID, delivery *matrixDelivery, read bool) {
+	d.deliveriesLock.Lock()
+	pending := d.deliveries[roomID]
+	found := false
+	for i, p := range pending {
+		if p == delivery {
+			d.deliveries[roomID] = append(pending[:i:i], pending[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(d.deliveries[roomID]) == 0 {
+		delete(d.deliveries, roomID)
+	}
+	d.deliveriesLock.Unlock()
+	if !found {
+		return
+	}
+	delivery.timer.Stop()
+	delivery.callback(delivery.user, read)
+}
+
+// handleReceipt confirms delivery of tracked messages when their recipient reads them, or anything sent in the room after them.
+// Receipts aren't encrypted, so this works in encrypted rooms too.
+func (d *MatrixDaemon) handleReceipt(source mautrix.EventSource, evt *event.Event) {
+	d.deliveriesLock.Lock()
+	pending := append([]*matrixDelivery{}, d.deliveries[evt.RoomID]...)
+	d.deliveriesLock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	for eventID, receipts := range *evt.Content.AsReceipt() {
+		// Fetched when first needed, to tell whether the event read came after a tracked one.
+		var readTime time.Time
+		fetched := false
+		for _, users := range receipts {
+			for userID := range users {
+				for _, delivery := range pending {
+					if userID != id.UserID(delivery.user.UserID) {
+						continue
+					}
+					if delivery.eventID != eventID {
+						if !fetched {
+							readTime, fetched = d.eventTime(evt.RoomID, eventID), true
+						}
+						if readTime.IsZero() || readTime.Before(delivery.sent) {
+							continue
+						}
+					}
+					d.finishDelivery(evt.RoomID, delivery, true)
+				}
+			}
+		}
+	}
+}
+
+// eventTime returns when the event was sent, or the zero time if it can't be fetched.
+func (d *MatrixDaemon) eventTime(roomID id.RoomID, eventID id.EventID) time.Time {
+	e, err := d.bot.GetEvent(roomID, eventID)
+	if err != nil {
+		d.app.debug.Printf("Matrix: Failed to get event \"%s\" in room \"%s\": %v", eventID, roomID, err)
+		return time.Time{}
+	}
+	return time.UnixMilli(e.Timestamp)
+}
+
+// Broadcast sends the message to every linked Matrix user, continuing past rooms which fail.
+// Users who've turned contact off are skipped, as are those who've muted notifications unless the message is urgent.
+// Up to d.broadcastWorkers rooms are sent to at once, so a slow (e.g. encrypted) room doesn't hold up the rest.
+// Returns the number of rooms sent to, and the rooms which failed.
+func (d *MatrixDaemon) Broadcast(message *Message) (sent int, failed []id.RoomID) {
+	contents := d.messageContents(message, event.MsgNotice)
+	users := []MatrixUser{}
+	for _, user := range d.app.storage.GetMatrix() {
+		if user.Contact && (!user.Muted || message.Priority >= PriorityCritical) {
+			users = append(users, user)
+		}
+	}
+	workers := d.broadcastWorkers
+	if workers > len(users) {
+		workers = len(users)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	// Each worker only writes the errors of the users it takes, so no lock is needed.
+	errs := make([]error, len(users))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = d.broadcastTo(users[i], message, contents)
+			}
+		}()
+	}
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, id.RoomID(users[i].RoomID))
+		} else {
+			sent++
+		}
+	}
+	return
+}
+
+func (d *MatrixDaemon) broadcastTo(user MatrixUser, message *Message, contents []*event.MessageEventContent) (err error) {
+	roomID := id.RoomID(user.RoomID)
+	_, err = d.sendParts(roomID, message, contentsFor(user, contents))
+	notificationMetrics.record("matrix", message, err)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to broadcast to room \"%s\": %v", roomID, err)
+		d.dropIfUnreachable(user, err)
+	}
+	return
+}
+
+// sendParts sends the message's text, split into contents, then its attachments to the room, returning the last event sent.
+func (d *MatrixDaemon) sendParts(roomID id.RoomID, message *Message, contents []*event.MessageEventContent) (eventID id.EventID, err error) {
+	for i, content := range contents {
+		eventID, err = d.sendToRoomTxn(content, roomID, matrixTxnID(message, roomID, i))
+		if err != nil {
+			return
+		}
+		d.recordSent(roomID, eventID, message.Notification)
+	}
+	for i, a := range message.Attachments {
+		eventID, err = d.sendAttachment(roomID, a, matrixTxnID(message, roomID, len(contents)+i))
+		if err != nil {
+			return
+		}
+		d.recordSent(roomID, eventID, message.Notification)
+	}
+	return
+}
+
+// contentsFor is contentFor for each part of a message.
+func contentsFor(user MatrixUser, contents []*event.MessageEventContent) []*event.MessageEventContent {
+	out := make([]*event.MessageEventContent, len(contents))
+	for i, content := range contents {
+		out[i] = contentFor(user, content)
+	}
+	return out
+}
+
+// contentFor returns the content to send to the user, without the formatted body if they've chosen plain messages.
+func contentFor(user MatrixUser, content *event.MessageEventContent) *event.MessageEventContent {
+	if !user.PlainOnly {
+		return content
+	}
+	plain := *content
+	plain.Format = ""
+	plain.FormattedBody = ""
+	return &plain
+}
+
+// recordSent adds a sent notification to the room's history, dropping the oldest past MATRIX_SENT_HISTORY.
+func (d *MatrixDaemon) recordSent(roomID id.RoomID, eventID id.EventID, notification string) {
+	if eventID == "" {
+		return
+	}
+	d.sentLock.Lock()
+	defer d.sentLock.Unlock()
+	if d.sent == nil {
+		d.sent = map[id.RoomID][]sentMatrixMessage{}
+	}
+	history := append(d.sent[roomID], sentMatrixMessage{EventID: eventID, Notification: notification})
+	if len(history) > MATRIX_SENT_HISTORY {
+		history = history[len(history)-MATRIX_SENT_HISTORY:]
+	}
+	d.sent[roomID] = history
+}
+
+// LastSent returns the ID of the most recent notification of the given type sent to the room, if it's still in the history.
+// An empty notification type matches any message.
+func (d *MatrixDaemon) LastSent(roomID id.RoomID, notification string) (eventID id.EventID, ok bool) {
+	d.sentLock.Lock()
+	defer d.sentLock.Unlock()
+	history := d.sent[roomID]
+	for i := len(history) - 1; i >= 0; i-- {
+		if notification == "" || history[i].Notification == notification {
+			return history[i].EventID, true
+		}
+	}
+	return
+}
+
+// Edit replaces the content of a message the bot previously sent with the given one, using an m.replace relation.
+// Clients without edit support show the new content prefixed with "*".
+func (d *MatrixDaemon) Edit(roomID id.RoomID, eventID id.EventID, message *Message) error {
+	content := d.messageContent(message, event.MsgNotice)
+	content.SetEdit(eventID)
+	return d.sendToRoom(content, roomID)
+}
+
+// Redact removes a message the bot previously sent, and forgets it.
+func (d *MatrixDaemon) Redact(roomID id.RoomID, eventID id.EventID, reason string) error {
+	err := d.retryRateLimited(func() error {
+		_, err := d.bot.RedactEvent(roomID, eventID, mautrix.ReqRedact{Reason: reason})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.sentLock.Lock()
+	defer d.sentLock.Unlock()
+	history := []sentMatrixMessage{}
+	for _, sent := range d.sent[roomID] {
+		if sent.EventID != eventID {
+			history = append(history, sent)
+		}
+	}
+	d.sent[roomID] = history
+	return nil
+}
+
+// messageContent renders the message for Matrix. Automated messages should use m.notice, which clients may treat as lower priority.
+func (d *MatrixDaemon) messageContent(message *Message, msgType event.MessageType) *event.MessageEventContent {
+	md := ""
+	if message.Markdown != "" {
+		md = sanitizeMatrixHTML(string(markdown.ToHTML([]byte(d.uploadImages(message.Markdown)), nil, newMarkdownRenderer())))
+	}
+	content := &event.MessageEventContent{
+		MsgType: msgType,
+		Body:    message.Text,
+	}
+	if md != "" {
+		content.FormattedBody = md
+		content.Format = "org.matrix.custom.html"
+		// Clients which can't show HTML need something in the body.
+		if content.Body == "" {
+			content.Body = matrixPlainText(md)
+		}
+	}
+	if message.Notification == NotificationWelcome || message.Notification == NotificationAnnouncement {
+		d.addLogo(content)
+	}
+	return content
+}
+
+// messageContents is messageContent, split into several messages if the message is longer than d.maxLength.
+// Messages with only attachments have no text to send.
+func (d *MatrixDaemon) messageContents(message *Message, msgType event.MessageType) []*event.MessageEventContent {
+	source := message.Markdown
+	if source == "" {
+		source = message.Text
+	}
+	if source == "" && len(message.Attachments) != 0 {
+		return nil
+	}
+	chunks := splitMatrixText(source, d.maxLength)
+	if len(chunks) == 1 {
+		return []*event.MessageEventContent{d.messageContent(message, msgType)}
+	}
+	contents := make([]*event.MessageEventContent, len(chunks))
+	for i, chunk := range chunks {
+		part := *message
+		part.Text = chunk
+		if message.Markdown != "" {
+			part.Markdown = chunk
+			if message.Text == "" {
+				part.Text = ""
+			} else if message.Text != message.Markdown {
+				part.Text = stripMarkdown(chunk)
+			}
+		}
+		// Only the first part gets the logo.
+		if i != 0 {
+			part.Notification = ""
+		}
+		contents[i] = d.messageContent(&part, msgType)
+	}
+	return contents
+}
+
+var matrixHTMLTag = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)[^>]*?(/?)>`)
+
+// Tags which have no closing tag.
+var matrixVoidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// splitMatrixText splits text into parts of at most max characters, between paragraphs. If max is 0, it isn't split.
+// Paragraphs in a code block or HTML tag are kept together so their formatting isn't broken,
+// and a paragraph which is too long by itself is left whole.
+func splitMatrixText(text string, max int) []string {
+	if max <= 0 || utf8.RuneCountInString(text) <= max {
+		return []string{text}
+	}
+	blocks := []string{}
+	block := ""
+	fenced := false
+	depth := 0 // Of open HTML tags.
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if block == "" {
+			block = paragraph
+		} else {
+			block += "\n\n" + paragraph
+		}
+		for _, line := range strings.Split(paragraph, "\n") {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				fenced = !fenced
+				continue
+			}
+			if fenced {
+				continue
+			}
+			for _, tag := range matrixHTMLTag.FindAllStringSubmatch(line, -1) {
+				if matrixVoidTags[strings.ToLower(tag[2])] || tag[3] == "/" {
+					continue
+				}
+				if tag[1] == "/" {
+					if depth > 0 {
+						depth--
+					}
+				} else {
+					depth++
+				}
+			}
+		}
+		if !fenced && depth == 0 {
+			blocks = append(blocks, block)
+			block = ""
+		}
+	}
+	if block != "" {
+		blocks = append(blocks, block)
+	}
+	parts := []string{}
+	part := ""
+	for _, block := range blocks {
+		if part != "" && utf8.RuneCountInString(part)+2+utf8.RuneCountInString(block) > max {
+			parts = append(parts, part)
+			part = ""
+		}
+		if part == "" {
+			part = block
+		} else {
+			part += "\n\n" + block
+		}
+	}
+	return append(parts, part)
+}
+
+var markdownImage = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+
+// uploadImages uploads images in the given markdown to the homeserver and replaces their URLs with mxc:// ones, so clients can display them.
+// Images which fail to upload are converted to links.
+func (d *MatrixDaemon) uploadImages(md string) string {
+	return markdownImage.ReplaceAllStringFunc(md, func(img string) string {
+		match := markdownImage.FindStringSubmatch(img)
+		alt, src := match[1], match[2]
+		uri, err := d.uploadImage(src)
+		if err != nil {
+			d.app.debug.Printf("Matrix: Failed to upload image \"%s\", sending as link: %v", src, err)
+			return "[" + alt + "](" + src + ")"
+		}
+		return "![" + alt + "](" + uri.String() + ")"
+	})
+}
+
+// linkImages converts images in markdown from outside jfa-go to links, so sending it can't have the bot read local files
+// or fetch arbitrary URLs. Images already on a homeserver (mxc://) are left as they are.
+func linkImages(md string) string {
+	return markdownImage.ReplaceAllStringFunc(md, func(img string) string {
+		match := markdownImage.FindStringSubmatch(img)
+		if strings.HasPrefix(match[2], "mxc://") {
+			return img
+		}
+		return "[" + match[1] + "](" + match[2] + ")"
+	})
+}
+
+// matrixAvatar is stored in the bot's account data when it sets its avatar.
+type matrixAvatar struct {
+	Source string `json:"source"`         // avatar_path when it was uploaded.
+	Hash   string `json:"hash,omitempty"` // SHA-256 of the file, so changes at the same path are noticed.
+	URL    string `json:"url"`
+}
+
+// updateProfile sets the bot's display name and avatar to those in the config, if they differ from its current ones.
+// Failures are only logged, as the bot works fine without them.
+func (d *MatrixDaemon) updateProfile() {
+	if d.displayName != "" {
+		current, err := d.bot.GetOwnDisplayName()
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			d.app.err.Printf("Matrix: Failed to get display name: %v", err)
+		} else if current == nil || current.DisplayName != d.displayName {
+			if err := d.bot.SetDisplayName(d.displayName); err != nil {
+				d.app.err.Printf("Matrix: Failed to set display name: %v", err)
+			} else {
+				d.app.info.Printf("Matrix: Set display name to \"%s\"", d.displayName)
+			}
+		}
+	}
+	if d.avatar != "" {
+		if err := d.updateAvatar(); err != nil {
+			d.app.err.Printf("Matrix: Failed to set avatar from \"%s\": %v", d.avatar, err)
+		}
+	}
+}
+
+func (d *MatrixDaemon) updateAvatar() error {
+	current, err := d.bot.GetOwnAvatarURL()
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+	if strings.HasPrefix(d.avatar, "mxc://") {
+		uri, err := id.ParseContentURI(d.avatar)
+		if err != nil || uri == current {
+			return err
+		}
+		return d.bot.SetAvatarURL(uri)
+	}
+	avatar := matrixAvatar{Source: d.avatar}
+	if !strings.HasPrefix(d.avatar, "http://") && !strings.HasPrefix(d.avatar, "https://") {
+		data, err := os.ReadFile(strings.TrimPrefix(d.avatar, "file://"))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		avatar.Hash = hex.EncodeToString(sum[:])
+	}
+	saved := matrixAvatar{}
+	// Missing account data just means we haven't set an avatar before.
+	d.bot.GetAccountData(MATRIX_AVATAR_ACCOUNT_DATA, &saved)
+	if !current.IsEmpty() && saved.Source == avatar.Source && saved.Hash == avatar.Hash && saved.URL == current.String() {
+		return nil
+	}
+	uri, err := d.uploadImage(d.avatar)
+	if err != nil {
+		return err
+	}
+	if err := d.bot.SetAvatarURL(uri); err != nil {
+		return err
+	}
+	d.app.info.Printf("Matrix: Set avatar to \"%s\"", d.avatar)
+	avatar.URL = uri.String()
+	if err := d.bot.SetAccountData(MATRIX_AVATAR_ACCOUNT_DATA, avatar); err != nil {
+		d.app.debug.Printf("Matrix: Failed to save avatar to account data, it will be uploaded again next start: %v", err)
+	}
+	return nil
+}
+
+// uploadImage uploads the image at the given URL or file path, returning its mxc:// URI.
+// Uploads are cached, so images used in every message (e.g. a logo) are only uploaded once.
+func (d *MatrixDaemon) uploadImage(src string) (uri id.ContentURI, err error) {
+	if strings.HasPrefix(src, "mxc://") {
+		return id.ParseContentURI(src)
+	}
+	d.mediaLock.Lock()
+	defer d.mediaLock.Unlock()
+	if uri, ok := d.media[src]; ok {
+		return uri, nil
+	}
+	var data []byte
+	contentType := ""
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		data, contentType, err = d.fetchImage(src)
+	} else {
+		data, err = readImage(strings.TrimPrefix(src, "file://"))
+	}
+	if err != nil {
+		return
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	resp, err := d.bot.UploadBytesWithName(data, contentType, filepath.Base(src))
+	if err != nil {
+		return
+	}
+	if len(d.media) >= MATRIX_MEDIA_CACHE_SIZE {
+		for k := range d.media {
+			delete(d.media, k)
+			break
+		}
+	}
+	d.media[src] = resp.ContentURI
+	return resp.ContentURI, nil
+}
+
+// readImage reads the image file, refusing ones over MATRIX_MAX_IMAGE_SIZE.
+func readImage(fpath string) ([]byte, error) {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MATRIX_MAX_IMAGE_SIZE {
+		return nil, ErrMatrixImageTooLarge
+	}
+	return os.ReadFile(fpath)
+}
+
+// fetchImage downloads the image at the URL, giving up once it passes MATRIX_MAX_IMAGE_SIZE.
+func (d *MatrixDaemon) fetchImage(link string) (data []byte, contentType string, err error) {
+	resp, err := d.bot.Client.Get(link)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to fetch image: %s", resp.Status)
+		return
+	}
+	if resp.ContentLength > MATRIX_MAX_IMAGE_SIZE {
+		err = ErrMatrixImageTooLarge
+		return
+	}
+	data, err = io.ReadAll(io.LimitReader(resp.Body, MATRIX_MAX_IMAGE_SIZE+1))
+	if err == nil && len(data) > MATRIX_MAX_IMAGE_SIZE {
+		err = ErrMatrixImageTooLarge
+	}
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+// sendAttachment sends the attachment to the room as an m.file, m.image or m.location.
+// Files and images are uploaded first, encrypted in encrypted rooms so the homeserver can't read them either.
+func (d *MatrixDaemon) sendAttachment(roomID id.RoomID, a Attachment, txnID string) (id.EventID, error) {
+	if a.Type == AttachmentLocation {
+		body := a.Name
+		if body == "" {
+			body = a.GeoURI
+		}
+		return d.sendToRoomTxn(&event.MessageEventContent{MsgType: event.MsgLocation, Body: body, GeoURI: a.GeoURI}, roomID, txnID)
+	}
+	msgType := event.MsgFile
+	if a.Type == AttachmentImage {
+		msgType = event.MsgImage
+	}
+	content := &event.MessageEventContent{
+		MsgType:  msgType,
+		Body:     a.Name,
+		FileName: a.Name,
+		Info:     &event.FileInfo{MimeType: a.MimeType, Size: len(a.Data)},
+	}
+	encrypted, _ := d.roomEncrypted(roomID)
+	if encrypted && d.cryptoFailed {
+		return "", ErrMatrixEncryptionUnavailable
+	}
+	data := a.Data
+	var file *attachment.EncryptedFile
+	uploadType := a.MimeType
+	if encrypted {
+		file = attachment.NewEncryptedFile()
+		data = file.Encrypt(data)
+		uploadType = "application/octet-stream"
+	}
+	resp, err := d.bot.UploadBytesWithName(data, uploadType, a.Name)
+	if err != nil {
+		return "", err
+	}
+	if file != nil {
+		content.File = &event.EncryptedFileInfo{EncryptedFile: *file, URL: resp.ContentURI.CUString()}
+	} else {
+		content.URL = resp.ContentURI.CUString()
+	}
+	return d.sendToRoomTxn(content, roomID, txnID)
+}
+
+// commandExport sends the user a JSON file of everything jfa-go stores about them.
+func (d *MatrixDaemon) commandExport(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, strs.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	export, err := d.app.accountExport(user.JellyfinID)
+	var data []byte
+	if err == nil {
+		data, err = json.MarshalIndent(export, "", "    ")
+	}
+	if err == nil {
+		_, err = d.sendAttachment(evt.RoomID, Attachment{Type: AttachmentFile, Name: "jfa-go-" + export.Username + ".json", MimeType: "application/json", Data: data}, "")
+	}
+	if err == nil {
+		d.app.info.Printf("Matrix: Sent account data export to \"%s\"", user.UserID)
+		return
+	}
+	d.app.err.Printf("Matrix: Failed to export account data for \"%s\": %v", user.UserID, err)
+	if err := d.Reply(evt, strs.get("exportFailed")); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+func (d *MatrixDaemon) commandReset(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		d.app.debug.Printf("Matrix: Ignoring password reset request from unlinked room \"%s\"", evt.RoomID)
+		return
+	}
+	if !d.app.matrixResetsAllowed() {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("resetNotAllowed"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	if last, ok := d.lastReset[evt.RoomID]; ok && time.Since(last) < d.resetCooldown {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("resetCooldown"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	pwr, err := d.app.GenInternalReset(user.JellyfinID)
+	if err != nil {
+		d.app.err.Printf("Failed to get user from Jellyfin: %v", err)
+		d.replyResetFailed(evt, lang)
+		return
+	}
+	d.app.addInternalReset(pwr)
+	d.lastReset[evt.RoomID] = time.Now()
+	msg, err := d.app.email.constructReset(
+		PasswordReset{
+			Pin:      pwr.PIN,
+			Username: pwr.Username,
+			Expiry:   pwr.Expiry,
+			Internal: true,
+		}, d.app, false,
+	)
+	if err != nil {
+		d.app.err.Printf("Failed to construct password reset message for \"%s\": %v", pwr.Username, err)
+		d.replyResetFailed(evt, lang)
+		return
+	}
+	msg.OnMatrixRead = func(user MatrixUser, read bool) {
+		if read {
+			d.app.debug.Printf("Matrix: Password reset message read by \"%s\"", user.UserID)
+		} else {
+			d.app.info.Printf("Matrix: Password reset message to \"%s\" wasn't read within %s", user.UserID, d.deliveryTimeout)
+		}
+	}
+	// Matrix is sent to directly, as the request came from here whether or not notifications are on.
+	methods := []ContactMethod{}
+	for _, method := range d.app.contactMethods() {
+		if _, ok := method.(*MatrixDaemon); !ok {
+			methods = append(methods, method)
+		}
+	}
+	otherErr := d.app.sendByIDVia(methods, msg, user.JellyfinID)
+	requester := user
+	requester.Contact = true
+	matrixErr := d.Send(msg, requester)
+	if err := errors.Join(otherErr, matrixErr); err != nil {
+		d.app.err.Printf("Failed to send password reset message to \"%s\": %v", user.UserID, err)
+		if matrixErr != nil {
+			d.replyResetFailed(evt, lang)
+			return
+		}
+		err = d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("resetPartlySent"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	d.app.info.Printf("Sent password reset message to \"%s\"", user.UserID)
+	err = d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("resetSent"))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// replyResetFailed tells the user their !reset couldn't be completed.
+func (d *MatrixDaemon) replyResetFailed(evt *event.Event, lang string) {
+	err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("resetFailed"))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+func (d *MatrixDaemon) commandUnlink(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	d.app.storage.DeleteMatrixKey(user.JellyfinID)
+	d.app.storage.SetActivityKey(shortuuid.New(), Activity{
+		Type:       ActivityContactUnlinked,
+		UserID:     user.JellyfinID,
+		SourceType: ActivityUser,
+		Source:     user.JellyfinID,
+		Value:      "matrix",
+		Time:       time.Now(),
+	}, nil, true)
+	d.app.info.Printf("Matrix: Unlinked \"%s\" at their request", user.UserID)
+	err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixUnlinked"))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+	// Other accounts linked in the room still use it.
+	if len(d.roomAccounts(evt.RoomID)) != 0 {
+		return
+	}
+	d.forgetRoom(evt.RoomID)
+	// The room is of no use once unlinked.
+	if _, err := d.bot.LeaveRoom(evt.RoomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to leave room \"%s\": %v", evt.RoomID, err)
+	}
+}
+
+// commandMigrate copies the user's settings from their Telegram or Discord link ("!migrate telegram"),
+// and unlinks it if "remove" is given after.
+func (d *MatrixDaemon) commandMigrate(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.accountByRoom(evt.RoomID)
+	var content string
+	switch {
+	case !ok:
+		content = strs.get("matrixNotLinked")
+	case len(sects) < 2 || len(sects) > 3 || (len(sects) == 3 && !strings.EqualFold(sects[2], "remove")):
+		content = strs.template("migrateUsage", tmpl{"command": d.prefix + "migrate"})
+	default:
+		from := strings.ToLower(sects[1])
+		removeOld := len(sects) == 3
+		err := d.migrateContact(user, from, removeOld)
+		switch {
+		case errors.Is(err, ErrMatrixNothingToMigrate):
+			content = strs.template("migrateNothing", tmpl{"platform": from})
+		case err != nil:
+			content = strs.template("migrateUsage", tmpl{"command": d.prefix + "migrate"})
+		case removeOld:
+			d.app.info.Printf("Matrix: \"%s\" moved their %s link to Matrix", user.UserID, from)
+			content = strs.template("migrateRemoved", tmpl{"platform": from})
+		default:
+			d.app.info.Printf("Matrix: \"%s\" copied their %s settings to Matrix", user.UserID, from)
+			content = strs.template("migrateCopied", tmpl{"platform": from})
+		}
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// migrateContact copies the language, whether to contact them, and notification preferences of the user's
+// Telegram or Discord link (from, "telegram" or "discord") to their Matrix link, for users moving platform.
+// If removeOld is set, the old link and its preferences are deleted.
+// Returns ErrMatrixNothingToMigrate if there's no link to migrate from.
+func (d *MatrixDaemon) migrateContact(user MatrixUser, from string, removeOld bool) error {
+	var lang string
+	var contact bool
+	switch from {
+	case "telegram":
+		tgUser, ok := d.app.storage.GetTelegramKey(user.JellyfinID)
+		if !ok {
+			return ErrMatrixNothingToMigrate
+		}
+		lang, contact = tgUser.Lang, tgUser.Contact
+	case "discord":
+		dcUser, ok := d.app.storage.GetDiscordKey(user.JellyfinID)
+		if !ok {
+			return ErrMatrixNothingToMigrate
+		}
+		lang, contact = dcUser.Lang, dcUser.Contact
+	default:
+		return fmt.Errorf("can't migrate from unknown platform \"%s\"", from)
+	}
+	// The bots share language files, so codes are the same.
+	if _, ok := d.app.storage.lang.Matrix[lang]; ok {
+		user.Lang = lang
+		d.setRoomLang(id.RoomID(user.RoomID), lang)
+	}
+	user.Contact = contact
+	d.app.storage.SetMatrixKey(user.JellyfinID, user)
+	if prefs, ok := d.app.storage.GetNotificationPreferencesKey(user.JellyfinID); ok {
+		for _, notification := range notificationTypes {
+			prefs.Set(notification, "matrix", prefs.Allowed(notification, from))
+			if removeOld {
+				prefs.Set(notification, from, true)
+			}
+		}
+		d.app.storage.SetNotificationPreferencesKey(user.JellyfinID, prefs)
+	}
+	if !removeOld {
+		return nil
+	}
+	if from == "telegram" {
+		d.app.storage.DeleteTelegramKey(user.JellyfinID)
+	} else {
+		d.app.storage.DeleteDiscordKey(user.JellyfinID)
+	}
+	d.app.storage.SetActivityKey(shortuuid.New(), Activity{
+		Type:       ActivityContactUnlinked,
+		UserID:     user.JellyfinID,
+		SourceType: ActivityUser,
+		Source:     user.JellyfinID,
+		Value:      from,
+		Time:       time.Now(),
+	}, nil, true)
+	return nil
+}
+
+func (d *MatrixDaemon) commandEmail(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	if len(sects) < 2 || !validEmail(sects[1]) {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.template("emailInvalid", tmpl{"command": d.prefix + "email"}))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	address := sects[1]
+	content := d.app.storage.lang.Matrix[lang].Strings.template("emailChanged", tmpl{"email": address})
+	if d.app.emailConfirmationRequired() {
+		key, err := d.app.emailChangeKey(user.JellyfinID, address)
+		if err != nil {
+			d.app.err.Printf("Failed to generate confirmation token: %v", err)
+			content = d.app.storage.lang.Matrix[lang].Strings.get("emailChangeFailed")
+		} else {
+			d.app.sendEmailChangeConfirmation(user.JellyfinID, address, key)
+			content = d.app.storage.lang.Matrix[lang].Strings.template("emailConfirmationSent", tmpl{"email": address})
+		}
+	} else {
+		d.app.setMyEmail(user.JellyfinID, address, nil)
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandInvites lists unexpired invites as a table, oldest first, up to MATRIX_INVITE_LIST_LIMIT.
+func (d *MatrixDaemon) commandInvites(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	invites := []Invite{}
+	for _, inv := range d.app.storage.GetInvites() {
+		if inv.IsReferral || inv.ValidTill.Before(time.Now()) {
+			continue
+		}
+		invites = append(invites, inv)
+	}
+	if len(invites) == 0 {
+		err := d.Reply(evt, strs.get("noInvites"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Created.Before(invites[j].Created) })
+	md := fmt.Sprintf("| %s | %s | %s | %s |\n| --- | --- | --- | --- |\n", strs.get("inviteCode"), strs.get("inviteLabel"), strs.get("inviteRemainingUses"), strs.get("inviteExpiry"))
+	for i, inv := range invites {
+		if i == MATRIX_INVITE_LIST_LIMIT {
+			md += "\n" + strs.template("invitesTruncated", tmpl{"n": strconv.Itoa(len(invites) - i)}) + "\n"
+			break
+		}
+		uses := "∞"
+		if !inv.NoLimit {
+			uses = strconv.Itoa(inv.RemainingUses)
+		}
+		md += fmt.Sprintf("| %s | %s | %s | %s |\n", inv.Code, inv.Label, uses, d.app.formatDatetime(inv.ValidTill))
+	}
+	content := d.messageContent(&Message{Text: md, Markdown: md}, event.MsgText)
+	if err := d.sendToRoom(content, evt.RoomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandNewInvite replies with a link to the user's referral invite, for users whose profile has referrals enabled.
+func (d *MatrixDaemon) commandNewInvite(evt *event.Event, sects []string, lang string) {
+	content := d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked")
+	if user, ok := d.accountByRoom(evt.RoomID); ok {
+		content = d.app.storage.lang.Matrix[lang].Strings.get("inviteNotAllowed")
+		if d.app.config.Section("user_page").Key("referrals").MustBool(false) {
+			inv, err := d.app.referral(user.JellyfinID)
+			switch err {
+			case nil:
+				uses := "∞"
+				if !inv.NoLimit {
+					uses = strconv.Itoa(inv.RemainingUses)
+				}
+				content = d.app.storage.lang.Matrix[lang].Strings.template("newInvite", tmpl{
+					"link": d.app.inviteURL(inv.Code),
+					"date": d.app.formatDatetime(inv.ValidTill),
+					"uses": uses,
+				})
+			case ErrReferralExpired:
+				content = d.app.storage.lang.Matrix[lang].Strings.get("inviteLimitReached")
+			}
+		}
+	}
+	if err := d.Reply(evt, content); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+func (d *MatrixDaemon) commandMute(evt *event.Event, sects []string, lang string) {
+	d.setMuted(evt, lang, true)
+}
+
+func (d *MatrixDaemon) commandUnmute(evt *event.Event, sects []string, lang string) {
+	d.setMuted(evt, lang, false)
+}
+
+// commandVersion replies with the build and how long the bot's been running, for support requests.
+// The homeserver is only shown to admins, as regular users don't need to know about the infrastructure.
+func (d *MatrixDaemon) commandVersion(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	uptime := time.Since(time.UnixMilli(d.start)).Round(time.Second)
+	content := strs.template("matrixVersion", tmpl{"version": version, "commit": commit, "uptime": uptime.String()})
+	if d.isAdmin(evt) {
+		content += "\n" + strs.template("matrixHomeserver", tmpl{"homeserver": d.bot.HomeserverURL.String()})
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandTimezone shows or sets the timezone used for the user's reminders and dates.
+func (d *MatrixDaemon) commandTimezone(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, strs.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	var content string
+	if len(sects) == 2 {
+		// "Local" would mean whatever the server's set to, which is what an unset timezone already does.
+		loc, err := time.LoadLocation(sects[1])
+		if err != nil || sects[1] == "Local" {
+			content = strs.template("timezoneNotFound", tmpl{"timezone": sects[1], "command": d.prefix + "tz"})
+		} else {
+			user.Timezone = loc.String()
+			d.app.storage.SetMatrixKey(user.JellyfinID, user)
+			content = strs.template("timezoneSet", tmpl{"timezone": user.Timezone, "time": time.Now().In(loc).Format("15:04")})
+		}
+	} else if user.Timezone == "" {
+		content = strs.template("timezoneDefault", tmpl{"timezone": time.Local.String(), "command": d.prefix + "tz"})
+	} else {
+		content = strs.template("timezoneCurrent", tmpl{"timezone": user.Timezone, "command": d.prefix + "tz"})
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandQuiet shows, sets (with a start and end time) or turns off ("off") the user's quiet hours,
+// during which non-urgent notifications are held back.
+func (d *MatrixDaemon) commandQuiet(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, strs.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	var content string
+	switch {
+	case len(sects) == 2 && strings.EqualFold(sects[1], "off"):
+		user.QuietStart, user.QuietEnd = "", ""
+		d.app.storage.SetMatrixKey(user.JellyfinID, user)
+		content = strs.get("quietOff")
+	case len(sects) == 3:
+		start, startErr := time.Parse("15:04", sects[1])
+		end, endErr := time.Parse("15:04", sects[2])
+		if startErr != nil || endErr != nil || start.Equal(end) {
+			content = strs.template("quietInvalid", tmpl{"command": d.prefix + "quiet"})
+			break
+		}
+		user.QuietStart, user.QuietEnd = start.Format("15:04"), end.Format("15:04")
+		d.app.storage.SetMatrixKey(user.JellyfinID, user)
+		content = strs.template("quietSet", tmpl{"start": user.QuietStart, "end": user.QuietEnd, "timezone": user.Location().String()})
+	case len(sects) == 1 && user.QuietStart != "":
+		content = strs.template("quietCurrent", tmpl{"start": user.QuietStart, "end": user.QuietEnd, "timezone": user.Location().String(), "command": d.prefix + "quiet"})
+	default:
+		content = strs.template("quietInvalid", tmpl{"command": d.prefix + "quiet"})
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandDisable disables the user's Jellyfin account until they send the enable command, if self_service_disable is on.
+func (d *MatrixDaemon) commandDisable(evt *event.Event, sects []string, lang string) {
+	d.setAccountEnabled(evt, lang, false)
+}
+
+// commandEnable re-enables a Jellyfin account disabled with the disable command.
+func (d *MatrixDaemon) commandEnable(evt *event.Event, sects []string, lang string) {
+	d.setAccountEnabled(evt, lang, true)
+}
+
+// setAccountEnabled enables or disables the Jellyfin account linked to the room, for commandEnable and commandDisable.
+// Only IsDisabled is changed, so the rest of the account's policy is kept while it's disabled.
+func (d *MatrixDaemon) setAccountEnabled(evt *event.Event, lang string, enabled bool) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.accountByRoom(evt.RoomID)
+	var content string
+	switch {
+	case !ok:
+		content = strs.get("matrixNotLinked")
+	case !d.selfDisable:
+		content = strs.get("selfDisableForbidden")
+	case enabled && !user.SelfDisabled:
+		content = strs.get("selfEnableForbidden")
+	default:
+		content = d.setJellyfinEnabled(user, enabled, strs)
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// setJellyfinEnabled enables or disables the user's Jellyfin account, returning the reply for setAccountEnabled.
+func (d *MatrixDaemon) setJellyfinEnabled(user MatrixUser, enabled bool, strs langSection) string {
+	jfUser, status, err := d.app.jf.UserByID(user.JellyfinID, false)
+	if status != 200 || err != nil {
+		d.app.err.Printf("Matrix: Failed to get Jellyfin user \"%s\" (%d): %v", user.JellyfinID, status, err)
+		return strs.get("selfDisableFailed")
+	}
+	// Don't take over an account an admin has already disabled, or they could re-enable it.
+	if !enabled && jfUser.Policy.IsDisabled {
+		return strs.get("accountAlreadyDisabled")
+	}
+	jfUser.Policy.IsDisabled = !enabled
+	status, err = d.app.jf.SetPolicy(user.JellyfinID, jfUser.Policy)
+	if !(status == 200 || status == 204) || err != nil {
+		d.app.err.Printf("Matrix: Failed to set policy for user \"%s\" (%d): %v", user.JellyfinID, status, err)
+		return strs.get("selfDisableFailed")
+	}
+	user.SelfDisabled = !enabled
+	d.app.storage.SetMatrixKey(user.JellyfinID, user)
+	activityType := ActivityDisabled
+	if enabled {
+		activityType = ActivityEnabled
+	}
+	d.app.storage.SetActivityKey(shortuuid.New(), Activity{
+		Type:       activityType,
+		UserID:     user.JellyfinID,
+		SourceType: ActivityUser,
+		Source:     user.JellyfinID,
+		Time:       time.Now(),
+	}, nil, true)
+	if enabled {
+		d.app.info.Printf("Matrix: \"%s\" re-enabled their account", user.UserID)
+		return strs.get("selfEnabled")
+	}
+	d.app.info.Printf("Matrix: \"%s\" disabled their account", user.UserID)
+	return strs.template("selfDisabled", tmpl{"command": d.prefix + "enable"})
+}
+
+// clearSelfDisabled forgets that the user disabled their own account, once it's been enabled or disabled some other way.
+func (d *MatrixDaemon) clearSelfDisabled(jfID string) {
+	if user, ok := d.app.storage.GetMatrixKey(jfID); ok && user.SelfDisabled {
+		user.SelfDisabled = false
+		d.app.storage.SetMatrixKey(jfID, user)
+	}
+}
+
+// commandStatus replies with whether the media server can be reached and how many active users it has,
+// and whether the bot is syncing. The server is given d.statusTimeout to respond. The user list may
+// come from the Jellyfin cache, which the bot leaves to the rest of jfa-go to invalidate.
+func (d *MatrixDaemon) commandStatus(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	type usersResult struct {
+		users  []mediabrowser.User
+		status int
+		err    error
+	}
+	done := make(chan usersResult, 1)
+	go func() {
+		users, status, err := d.app.jf.GetUsers(false)
+		done <- usersResult{users, status, err}
+	}()
+	var content string
+	select {
+	case result := <-done:
+		if result.status != 200 || result.err != nil {
+			d.app.err.Printf("Matrix: Failed to get users for status (%d): %v", result.status, result.err)
+			content = strs.get("statusServerDown")
+			break
+		}
+		active := 0
+		for _, user := range result.users {
+			if !user.Policy.IsDisabled {
+				active++
+			}
+		}
+		content = strs.template("statusServerUp", tmpl{"n": strconv.Itoa(active)})
+	case <-time.After(d.statusTimeout):
+		content = strs.template("statusServerTimeout", tmpl{"seconds": strconv.Itoa(int(d.statusTimeout.Seconds()))})
+	}
+	connected, lastSync, lastError := d.Status()
+	switch {
+	case connected:
+		content += "\n" + strs.template("statusBotSyncing", tmpl{"time": time.Since(lastSync).Round(time.Second).String()})
+	case lastError != "":
+		content += "\n" + strs.template("statusBotSyncError", tmpl{"error": lastError})
+	default:
+		content += "\n" + strs.get("statusBotNotSyncing")
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandWhoami replies with the Jellyfin account linked to the room, its status and expiry, and whether the room is encrypted.
+func (d *MatrixDaemon) commandWhoami(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	jfUser, status, err := d.app.jf.UserByID(user.JellyfinID, false)
+	if status != 200 || err != nil {
+		d.app.err.Printf("Matrix: Failed to get Jellyfin user \"%s\" (%d): %v", user.JellyfinID, status, err)
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("whoamiFailed"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	state := d.app.storage.lang.Matrix[lang].Strings.get("accountEnabled")
+	if jfUser.Policy.IsDisabled {
+		state = d.app.storage.lang.Matrix[lang].Strings.get("accountDisabled")
+	}
+	content := d.app.storage.lang.Matrix[lang].Strings.template("whoami", tmpl{"username": jfUser.Name, "status": state}) + "\n"
+	if expiry, ok := d.app.storage.GetUserExpiryKey(user.JellyfinID); ok {
+		content += d.app.expiryMessage(d.app.storage.lang.Matrix[lang], expiry.Expiry.In(user.Location())) + "\n"
+	} else {
+		content += d.app.storage.lang.Matrix[lang].Strings.get("accountNoExpiry") + "\n"
+	}
+	if encrypted, _ := d.roomEncrypted(evt.RoomID); encrypted {
+		content += d.app.storage.lang.Matrix[lang].Strings.get("roomEncrypted")
+	} else {
+		content += d.app.storage.lang.Matrix[lang].Strings.get("roomNotEncrypted")
+	}
+	err = d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// accountName returns the Jellyfin username of the account, or its ID if it can't be found.
+func (d *MatrixDaemon) accountName(user MatrixUser) string {
+	jfUser, status, err := d.app.jf.UserByID(user.JellyfinID, false)
+	if status != 200 || err != nil {
+		d.app.debug.Printf("Matrix: Failed to get Jellyfin user \"%s\" (%d): %v", user.JellyfinID, status, err)
+		return user.JellyfinID
+	}
+	return jfUser.Name
+}
+
+// commandAccounts lists the Jellyfin accounts linked to the sender, numbered for the switch command.
+func (d *MatrixDaemon) commandAccounts(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	current, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		if err := d.Reply(evt, strs.get("matrixNotLinked")); err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	content := strs.template("accountsList", tmpl{"command": d.prefix + "switch"}) + "\n"
+	for i, account := range d.linkedAccounts(current.UserID) {
+		content += fmt.Sprintf("%d. %s", i+1, d.accountName(account))
+		if account.JellyfinID == current.JellyfinID {
+			content += " " + strs.get("accountsCurrent")
+		}
+		content += "\n"
+	}
+	if err := d.Reply(evt, content); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandSwitch chooses which of the sender's linked accounts, numbered as in the accounts command, commands act on.
+func (d *MatrixDaemon) commandSwitch(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.userByRoom(evt.RoomID)
+	if !ok {
+		if err := d.Reply(evt, strs.get("matrixNotLinked")); err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	accounts := d.linkedAccounts(user.UserID)
+	n := 0
+	if len(sects) == 2 {
+		n, _ = strconv.Atoi(sects[1])
+	}
+	if n < 1 || n > len(accounts) {
+		content := strs.template("switchUsage", tmpl{"command": d.prefix + "switch", "accounts": d.prefix + "accounts"})
+		if err := d.Reply(evt, content); err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	d.app.storage.SetMatrixSelectionKey(user.UserID, accounts[n-1].JellyfinID)
+	d.app.debug.Printf("Matrix: \"%s\" switched to account \"%s\"", evt.Sender, accounts[n-1].JellyfinID)
+	if err := d.Reply(evt, strs.template("switched", tmpl{"username": d.accountName(accounts[n-1])})); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandNotify lists which notifications are sent to the room, or with "<type> on|off", changes one.
+func (d *MatrixDaemon) commandNotify(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	prefs, _ := d.app.storage.GetNotificationPreferencesKey(user.JellyfinID)
+	var content string
+	switch {
+	case len(sects) == 1:
+		content = d.app.storage.lang.Matrix[lang].Strings.template("notifyList", tmpl{"command": d.prefix + "notify"}) + "\n"
+		for _, notification := range notificationTypes {
+			state := "on"
+			if !prefs.Allowed(notification, d.Name()) {
+				state = "off"
+			}
+			content += fmt.Sprintf("- %s: %s\n", notification, state)
+		}
+	case len(sects) == 3 && validNotificationType(sects[1]) && (sects[2] == "on" || sects[2] == "off"):
+		prefs.Set(sects[1], d.Name(), sects[2] == "on")
+		d.app.storage.SetNotificationPreferencesKey(user.JellyfinID, prefs)
+		content = d.app.storage.lang.Matrix[lang].Strings.template("notifySet", tmpl{"notification": sects[1], "state": sects[2]})
+	default:
+		content = d.app.storage.lang.Matrix[lang].Strings.template("notifyUsage", tmpl{"command": d.prefix + "notify", "types": strings.Join(notificationTypes, ", ")})
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandFormat sets whether messages to the room are sent formatted ("rich") or as plain text only ("plain").
+func (d *MatrixDaemon) commandFormat(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	var content string
+	if len(sects) == 2 && (sects[1] == "plain" || sects[1] == "rich") {
+		user.PlainOnly = sects[1] == "plain"
+		d.app.storage.SetMatrixKey(user.JellyfinID, user)
+		content = d.app.storage.lang.Matrix[lang].Strings.template("formatSet", tmpl{"format": sects[1]})
+	} else {
+		current := "rich"
+		if user.PlainOnly {
+			current = "plain"
+		}
+		content = d.app.storage.lang.Matrix[lang].Strings.template("formatUsage", tmpl{"command": d.prefix + "format", "format": current})
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandLocale lists or sets the user's Jellyfin display language, which is separate from the bot's language set with commandLang.
+func (d *MatrixDaemon) commandLocale(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	var content string
+	if len(sects) == 2 {
+		locale, err := d.app.setJellyfinLocale(user.JellyfinID, sects[1])
+		switch {
+		case err == ErrUnknownLocale:
+			content = d.app.storage.lang.Matrix[lang].Strings.template("localeNotFound", tmpl{"locale": sects[1], "command": d.prefix + "locale"})
+		case err != nil:
+			d.app.err.Printf("Matrix: Failed to set Jellyfin locale for \"%s\": %v", user.JellyfinID, err)
+			content = d.app.storage.lang.Matrix[lang].Strings.get("localeFailed")
+		default:
+			d.app.info.Printf("Matrix: Set Jellyfin locale for \"%s\" to \"%s\"", user.JellyfinID, locale)
+			content = d.app.storage.lang.Matrix[lang].Strings.template("localeSet", tmpl{"locale": locale})
+		}
+	} else {
+		locales, err := d.app.jellyfinLocales()
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to get Jellyfin locales: %v", err)
+			content = d.app.storage.lang.Matrix[lang].Strings.get("localeFailed")
+		} else {
+			current, err := d.app.jellyfinLocale(user.JellyfinID)
+			if err != nil {
+				d.app.debug.Printf("Matrix: Failed to get Jellyfin locale for \"%s\": %v", user.JellyfinID, err)
+			}
+			if current == "" {
+				current = d.app.storage.lang.Matrix[lang].Strings.get("localeDefault")
+			}
+			content = d.app.storage.lang.Matrix[lang].Strings.template("localeList", tmpl{"locale": current, "command": d.prefix + "locale"}) + "\n"
+			for _, l := range locales {
+				content += fmt.Sprintf("%s: %s\n", l.Value, l.Name)
+			}
+		}
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// matrixContact is stored in the bot's account data once it has opened a room with a contact_target user.
+type matrixContact struct {
+	UserID string `json:"user_id"`
+	RoomID string `json:"room_id"`
+}
+
+// contactRoomID returns the room !contact messages are forwarded to, opening one with contactTarget first if it's a user.
+func (d *MatrixDaemon) contactRoomID() (id.RoomID, error) {
+	if d.contactRoom != "" {
+		return d.contactRoom, nil
+	}
+	if !strings.HasPrefix(d.contactTarget, "@") {
+		d.contactRoom = id.RoomID(d.contactTarget)
+		return d.contactRoom, nil
+	}
+	saved := matrixContact{}
+	// Missing account data just means we haven't opened a room before.
+	d.bot.GetAccountData(MATRIX_CONTACT_ACCOUNT_DATA, &saved)
+	if saved.UserID == d.contactTarget && saved.RoomID != "" {
+		d.contactRoom = id.RoomID(saved.RoomID)
+		return d.contactRoom, nil
+	}
+	roomID, _, err := d.CreateRoom(d.contactTarget)
+	if err != nil {
+		return "", err
+	}
+	d.contactRoom = roomID
+	if err := d.bot.SetAccountData(MATRIX_CONTACT_ACCOUNT_DATA, matrixContact{UserID: d.contactTarget, RoomID: string(roomID)}); err != nil {
+		d.app.debug.Printf("Matrix: Failed to save contact room to account data, a new one will be opened next start: %v", err)
+	}
+	return roomID, nil
+}
+
+// commandContact forwards the user's message to contactTarget, so they can reach an admin from their existing room.
+func (d *MatrixDaemon) commandContact(evt *event.Event, sects []string, lang string) {
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	message := strings.TrimSpace(strings.Join(sects[1:], " "))
+	var content string
+	if message == "" {
+		content = d.app.storage.lang.Matrix[lang].Strings.template("contactUsage", tmpl{"command": d.prefix + "contact"})
+	} else if last, ok := d.lastContact[evt.RoomID]; ok && time.Since(last) < d.contactWait {
+		content = d.app.storage.lang.Matrix[lang].Strings.get("contactCooldown")
+	} else if err := d.forwardContact(user, evt.RoomID, message); err != nil {
+		d.app.err.Printf("Matrix: Failed to forward message from \"%s\": %v", evt.Sender, err)
+		content = d.app.storage.lang.Matrix[lang].Strings.get("contactFailed")
+	} else {
+		d.lastContact[evt.RoomID] = time.Now()
+		content = d.app.storage.lang.Matrix[lang].Strings.get("contactSent")
+	}
+	err := d.Reply(evt, content)
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandMessages sets whether the user is sent anything through Matrix with "on" or "off".
+// Replies to their own commands, e.g. a password reset they asked for, are still sent.
+func (d *MatrixDaemon) commandMessages(evt *event.Event, sects []string, lang string) {
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	user, ok := d.accountByRoom(evt.RoomID)
+	var content string
+	switch {
+	case !ok:
+		content = strs.get("matrixNotLinked")
+	case len(sects) != 2 || (!strings.EqualFold(sects[1], "on") && !strings.EqualFold(sects[1], "off")):
+		content = strs.template("messagesUsage", tmpl{"command": d.prefix + "messages"})
+	default:
+		user.Contact = strings.EqualFold(sects[1], "on")
+		d.app.storage.SetMatrixKey(user.JellyfinID, user)
+		reply := "contactOff"
+		if user.Contact {
+			reply = "contactOn"
+		}
+		content = strs.template(reply, tmpl{"command": d.prefix + "messages"})
+	}
+	if err := d.Reply(evt, content); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+func (d *MatrixDaemon) forwardContact(user MatrixUser, roomID id.RoomID, message string) error {
+	contactRoom, err := d.contactRoomID()
+	if err != nil {
+		return err
+	}
+	username := user.JellyfinID
+	if jfUser, status, err := d.app.jf.UserByID(user.JellyfinID, false); status == 200 && err == nil {
+		username = jfUser.Name
 	}
 	content := &event.MessageEventContent{
-		MsgType: "m.text",
-		Body:    message.Text,
+		MsgType: event.MsgText,
+		Body: d.app.storage.lang.Matrix[d.defaultLang()].Strings.template("contactForward", tmpl{
+			"username":   username,
+			"matrixUser": user.UserID,
+			"message":    message,
+		}),
 	}
-	if md != "" {
-		content.FormattedBody = md
-		content.Format = "org.matrix.custom.html"
+	eventID, err := d.sendToRoomEvent(content, contactRoom)
+	if err != nil {
+		return err
 	}
-	for _, user := range users {
-		err = d.sendToRoom(content, id.RoomID(user.RoomID))
+	d.contacts[eventID] = roomID
+	d.app.info.Printf("Matrix: Forwarded message from \"%s\" to \"%s\"", user.UserID, contactRoom)
+	return nil
+}
+
+// relayContactReply sends a reply to a forwarded !contact message back to the room it came from.
+// Returns false if the message isn't such a reply, so it can be handled as normal.
+func (d *MatrixDaemon) relayContactReply(evt *event.Event, body string) bool {
+	msg := *evt.Content.AsMessage()
+	parent := msg.RelatesTo.GetReplyTo()
+	if parent == "" {
+		parent = msg.RelatesTo.GetThreadParent()
+	}
+	roomID, ok := d.contacts[parent]
+	if !ok {
+		return false
+	}
+	if msg.Body != "" {
+		msg.RemoveReplyFallback()
+		body = msg.Body
+	}
+	lang := d.resolveLang(roomID)
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    d.app.storage.lang.Matrix[lang].Strings.template("contactReply", tmpl{"message": body}),
+	}
+	if err := d.sendToRoom(content, roomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to relay reply to \"%s\": %v", roomID, err)
+		if err := d.Reply(evt, d.app.storage.lang.Matrix[d.defaultLang()].Strings.get("contactFailed")); err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return true
+	}
+	d.markRead(evt)
+	return true
+}
+
+func (d *MatrixDaemon) setMuted(evt *event.Event, lang string, muted bool) {
+	command := "unmute"
+	if muted {
+		command = "mute"
+	}
+	user, ok := d.accountByRoom(evt.RoomID)
+	if !ok {
+		err := d.Acknowledge(evt, command, false, d.app.storage.lang.Matrix[lang].Strings.get("matrixNotLinked"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	user.Muted = muted
+	d.app.storage.SetMatrixKey(user.JellyfinID, user)
+	reply := "matrixUnmuted"
+	if muted {
+		reply = "matrixMuted"
+	}
+	err := d.Acknowledge(evt, command, true, d.app.storage.lang.Matrix[lang].Strings.template(reply, tmpl{"command": d.prefix + "unmute"}))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// token returns the unverified user with the given PIN, deleting it if it has expired.
+func (d *MatrixDaemon) token(pin string) (user UnverifiedUser, ok bool) {
+	d.tokensLock.Lock()
+	defer d.tokensLock.Unlock()
+	user, ok = d.tokens[pin]
+	if ok && d.expired(user) {
+		delete(d.tokens, pin)
+		return UnverifiedUser{}, false
+	}
+	return
+}
+
+func (d *MatrixDaemon) setToken(pin string, user UnverifiedUser) {
+	d.tokensLock.Lock()
+	d.tokens[pin] = user
+	d.tokensLock.Unlock()
+}
+
+func (d *MatrixDaemon) deleteToken(pin string) {
+	d.tokensLock.Lock()
+	delete(d.tokens, pin)
+	d.tokensLock.Unlock()
+}
+
+// recentStart returns the pending PIN and room of a user sent one by SendStart for the same jellyfinID within d.startCooldown.
+// PINs requested for another account (or for sign-up, with no jellyfinID) aren't reused, so a request can't take over another's PIN.
+// Verified PINs aren't returned, so the cooldown ends once the user's verified.
+func (d *MatrixDaemon) recentStart(userID, jellyfinID string) (pin string, roomID id.RoomID, ok bool) {
+	if d.startCooldown == 0 {
+		return
+	}
+	d.tokensLock.Lock()
+	defer d.tokensLock.Unlock()
+	for p, token := range d.tokens {
+		if token.Verified || token.User == nil || token.User.UserID != userID || token.JellyfinID != jellyfinID || d.expired(token) || time.Since(token.Created) > d.startCooldown {
+			continue
+		}
+		return p, id.RoomID(token.User.RoomID), true
+	}
+	return
+}
+
+func (d *MatrixDaemon) expired(user UnverifiedUser) bool {
+	return d.pinExpiry != 0 && time.Since(user.Created) > d.pinExpiry
+}
+
+// sweepTokens periodically removes expired PINs, so abandoned sign-ups don't pile up in memory. Stops on Shutdown.
+func (d *MatrixDaemon) sweepTokens() {
+	ticker := time.NewTicker(MATRIX_TOKEN_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ShutdownChannel:
+			return
+		case <-ticker.C:
+			d.removeExpiredTokens()
+		}
+	}
+}
+
+func (d *MatrixDaemon) removeExpiredTokens() {
+	expired := []*MatrixUser{}
+	d.tokensLock.Lock()
+	for pin, user := range d.tokens {
+		if d.expired(user) {
+			delete(d.tokens, pin)
+			expired = append(expired, user.User)
+		}
+	}
+	d.tokensLock.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	d.app.debug.Printf("Matrix: Removed %d expired PIN(s)", len(expired))
+	if !d.notifyExpired {
+		return
+	}
+	for _, user := range expired {
+		lang := d.resolveLang(id.RoomID(user.RoomID))
+		err := d.sendToRoom(&event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    d.app.storage.lang.Matrix[lang].Strings.get("matrixPINExpired"),
+		}, id.RoomID(user.RoomID))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", user.UserID, err)
+		}
+	}
+}
+
+func (d *MatrixDaemon) commandVerify(evt *event.Event, sects []string, lang string) {
+	var token UnverifiedUser
+	ok := false
+	if len(sects) > 1 {
+		token, ok = d.token(sects[1])
+	}
+	if !ok || token.User.RoomID != string(evt.RoomID) {
+		err := d.Acknowledge(evt, "verify", false, d.app.storage.lang.Matrix[lang].Strings.template("matrixInvalidPIN", tmpl{"command": d.prefix + "verify"}))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	pin := sects[1]
+	// Requested from the sign-up page, where the user still needs to finish creating their account.
+	if token.JellyfinID == "" {
+		token.Verified = true
+		d.setToken(pin, token)
+		err := d.Acknowledge(evt, "verify", true, d.app.storage.lang.Matrix[lang].Strings.get("matrixVerifiedSignup"))
+		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	mxUser := *token.User
+	mxUser.Contact = true
+	if existingUser, ok := d.app.storage.GetMatrixKey(token.JellyfinID); ok {
+		mxUser.Lang = existingUser.Lang
+		mxUser.Contact = existingUser.Contact
+	}
+	d.app.storage.SetMatrixKey(token.JellyfinID, mxUser)
+	d.app.storage.SetActivityKey(shortuuid.New(), Activity{
+		Type:       ActivityContactLinked,
+		UserID:     token.JellyfinID,
+		SourceType: ActivityUser,
+		Source:     token.JellyfinID,
+		Value:      "matrix",
+		Time:       time.Now(),
+	}, nil, true)
+	d.deleteToken(pin)
+	d.verified(token.JellyfinID, mxUser, MatrixVerifiedCommand)
+	err := d.Acknowledge(evt, "verify", true, d.linkedSummary(mxUser, ""))
+	if err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+	}
+}
+
+// commandResend replaces the room's pending PIN with a new one, for users who've lost the original.
+// The PIN is found by room, as the user doesn't have it, and expired ones aren't replaced.
+func (d *MatrixDaemon) commandResend(evt *event.Event, sects []string, lang string) {
+	var pending *UnverifiedUser
+	d.tokensLock.Lock()
+	for pin, token := range d.tokens {
+		if token.User.RoomID == string(evt.RoomID) && !token.Verified && !d.expired(token) {
+			token := token
+			pending = &token
+			delete(d.tokens, pin)
+		}
+	}
+	d.tokensLock.Unlock()
+	if pending == nil {
+		err := d.Reply(evt, d.app.storage.lang.Matrix[lang].Strings.get("matrixNoPendingPIN"))
 		if err != nil {
+			d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", evt.Sender, err)
+		}
+		return
+	}
+	if pending.User.Lang != "" {
+		d.setRoomLang(evt.RoomID, pending.User.Lang)
+	}
+	// sendPIN logs its own failures.
+	if err := d.sendPIN(evt.RoomID, pending.User.UserID, pending.JellyfinID, pending.User.Encrypted, pending.Server); err == nil {
+		d.app.info.Printf("Matrix: Sent a new PIN to \"%s\"", pending.User.UserID)
+	}
+}
+
+// linkedSummary confirms a newly linked user's account, along with their room's settings and the commands they can use.
+// If username is blank, it's looked up from Jellyfin.
+func (d *MatrixDaemon) linkedSummary(user MatrixUser, username string) string {
+	roomID := id.RoomID(user.RoomID)
+	lang := d.resolveLang(roomID)
+	strs := d.app.storage.lang.Matrix[lang].Strings
+	if username == "" {
+		username = user.JellyfinID
+		if jfUser, status, err := d.app.jf.UserByID(user.JellyfinID, false); status == 200 && err == nil {
+			username = jfUser.Name
+		}
+	}
+	encryption := strs.get("roomNotEncrypted")
+	if encrypted, _ := d.roomEncrypted(roomID); encrypted {
+		encryption = strs.get("roomEncrypted")
+	}
+	summary := strs.get("matrixVerified") + "\n" + strs.template("matrixLinkedSummary", tmpl{
+		"username": username,
+		"language": d.app.storage.lang.Matrix[lang].Meta.Name,
+		"command":  d.prefix + "lang",
+	})
+	return summary + "\n" + encryption + "\n\n" + d.helpMessage(lang, false)
+}
+
+// SendLinkedSummary sends linkedSummary to the user's room, for when they've verified through the web rather than the verify command.
+func (d *MatrixDaemon) SendLinkedSummary(user MatrixUser, username string) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    d.linkedSummary(user, username),
+	}
+	if err := d.sendToRoom(content, id.RoomID(user.RoomID)); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", user.UserID, err)
+	}
+}
+
+// unlink removes the user's link, recording it in the activity log.
+func (d *MatrixDaemon) unlink(user MatrixUser) {
+	d.app.storage.DeleteMatrixKey(user.JellyfinID)
+	d.app.storage.SetActivityKey(shortuuid.New(), Activity{
+		Type:       ActivityContactUnlinked,
+		UserID:     user.JellyfinID,
+		SourceType: ActivityDaemon,
+		Value:      "matrix",
+		Time:       time.Now(),
+	}, nil, true)
+}
+
+// Leave makes the bot leave the room, e.g. after its user's been unlinked. Failures are only logged.
+func (d *MatrixDaemon) Leave(roomID id.RoomID) {
+	if _, err := d.bot.LeaveRoom(roomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to leave room \"%s\": %v", roomID, err)
+	}
+}
+
+// ReinviteUser replaces the room of the account linked to the given Jellyfin ID with a new one, e.g. if they deleted the old one,
+// and tells them why. Other accounts the same Matrix user linked in the old room move with it.
+// The old room is left once the new one is stored, so leaving it doesn't unlink them.
+func (d *MatrixDaemon) ReinviteUser(jellyfinID string) (user MatrixUser, err error) {
+	user, ok := d.app.storage.GetMatrixKey(jellyfinID)
+	if !ok {
+		return user, ErrMatrixUnknownUser
+	}
+	userID := user.UserID
+	oldRoom := id.RoomID(user.RoomID)
+	roomID, encrypted, err := d.CreateRoom(userID)
+	if err != nil {
+		return
+	}
+	for _, account := range d.roomAccounts(oldRoom) {
+		if account.UserID != userID {
+			continue
+		}
+		account.RoomID, account.Encrypted = string(roomID), encrypted
+		d.app.storage.SetMatrixKey(account.JellyfinID, account)
+	}
+	user.RoomID, user.Encrypted = string(roomID), encrypted
+	if user.Lang != "" {
+		d.setRoomLang(roomID, user.Lang)
+	}
+	d.forgetRoom(oldRoom)
+	d.app.info.Printf("Matrix: Moved \"%s\" from room \"%s\" to \"%s\"", userID, oldRoom, roomID)
+	d.Leave(oldRoom)
+	text := d.app.storage.lang.Matrix[d.resolveLang(roomID)].Strings.get("matrixRoomRecreated")
+	if err := d.sendToRoom(d.messageContent(&Message{Text: text, Markdown: text}, event.MsgNotice), roomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to send message to \"%s\": %v", userID, err)
+	}
+	return user, nil
+}
+
+// matrixRoomGone returns whether err means the bot can no longer send to the room, e.g. because it was removed while jfa-go wasn't running.
+func matrixRoomGone(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil {
+		return false
+	}
+	switch httpErr.RespError.ErrCode {
+	case mautrix.MForbidden.ErrCode:
+		return true
+	case "M_UNKNOWN":
+		return strings.Contains(strings.ToLower(httpErr.RespError.Err), "not in room")
+	}
+	return false
+}
+
+// dropIfUnreachable unlinks the user if err from sending to them means their room is gone, so later notifications don't keep failing.
+// The unlink shows in the activity log, so admins can see why the user stopped receiving messages.
+func (d *MatrixDaemon) dropIfUnreachable(user MatrixUser, err error) {
+	if !matrixRoomGone(err) {
+		return
+	}
+	if d.reinviteLost {
+		// Another send to an account in the same room may have moved it already.
+		if stored, ok := d.app.storage.GetMatrixKey(user.JellyfinID); ok && stored.RoomID != user.RoomID {
+			return
+		}
+		_, err := d.ReinviteUser(user.JellyfinID)
+		if err == nil {
 			return
 		}
+		d.app.err.Printf("Matrix: Failed to recreate room for \"%s\", unlinking instead: %v", user.UserID, err)
+	}
+	d.unlink(user)
+	d.app.info.Printf("Matrix: Can't send to room \"%s\" anymore, unlinked \"%s\"", user.RoomID, user.UserID)
+	// If the bot is still in the room but can't speak there, there's no use staying.
+	if _, err := d.bot.LeaveRoom(id.RoomID(user.RoomID)); err != nil {
+		d.app.debug.Printf("Matrix: Failed to leave room \"%s\": %v", user.RoomID, err)
+	}
+}
+
+// handleMembership unlinks a user when they leave their room with the bot, or when the bot is kicked or banned from it.
+func (d *MatrixDaemon) handleMembership(source mautrix.EventSource, evt *event.Event) {
+	membership, _ := evt.Content.Raw["membership"].(string)
+	if membership == string(event.MembershipInvite) {
+		d.handleInvite(evt)
+		return
+	}
+	if membership != string(event.MembershipLeave) && membership != string(event.MembershipBan) {
+		return
+	}
+	if evt.StateKey == nil {
+		return
+	}
+	target := id.UserID(*evt.StateKey)
+	accounts := d.roomAccounts(evt.RoomID)
+	if target != d.userID && (len(accounts) == 0 || target != id.UserID(accounts[0].UserID)) {
+		return
+	}
+	d.forgetRoom(evt.RoomID)
+	if len(accounts) == 0 {
+		return
+	}
+	// Nothing linked in the room can be reached anymore, whichever account was chosen.
+	for _, account := range accounts {
+		d.unlink(account)
+	}
+	user := accounts[0]
+	if target == d.userID {
+		d.app.info.Printf("Matrix: Removed from room \"%s\" by \"%s\", unlinked \"%s\"", evt.RoomID, evt.Sender, user.UserID)
+		return
+	}
+	d.app.info.Printf("Matrix: \"%s\" left room \"%s\", unlinked", user.UserID, evt.RoomID)
+	if _, err := d.bot.LeaveRoom(evt.RoomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to leave room \"%s\": %v", evt.RoomID, err)
+	}
+}
+
+// handleInvite joins rooms the bot is invited to by expected users, and sends a PIN there rather than in a room of its own.
+// Invites from anyone else are ignored, so the bot can't be pulled into arbitrary rooms.
+func (d *MatrixDaemon) handleInvite(evt *event.Event) {
+	if !d.acceptInvites || evt.StateKey == nil || id.UserID(*evt.StateKey) != d.userID {
+		return
+	}
+	pending, jellyfinID, ok := d.expectedInviter(evt.Sender)
+	if !ok || d.UserExists(string(evt.Sender)) {
+		d.app.debug.Printf("Matrix: Ignoring invite to room \"%s\" from \"%s\"", evt.RoomID, evt.Sender)
+		return
+	}
+	if _, err := d.bot.JoinRoomByID(evt.RoomID); err != nil {
+		d.app.err.Printf("Matrix: Failed to join room \"%s\": %v", evt.RoomID, err)
+		return
+	}
+	encrypted := false
+	enc := event.EncryptionEventContent{}
+	if err := d.bot.StateEvent(evt.RoomID, event.StateEncryption, "", &enc); err == nil && enc.Algorithm != "" {
+		encrypted = true
+	}
+	if (encrypted && !d.Encryption) || (d.forceEncryption && !encrypted) {
+		d.app.info.Printf("Matrix: Leaving room \"%s\" from \"%s\", its encryption setting isn't supported", evt.RoomID, evt.Sender)
+		if _, err := d.bot.LeaveRoom(evt.RoomID); err != nil {
+			d.app.err.Printf("Matrix: Failed to leave room \"%s\": %v", evt.RoomID, err)
+		}
+		return
+	}
+	d.setRoomEncrypted(evt.RoomID, encrypted)
+	// The welcome names the same server as the PIN it replaces.
+	server := d.app.mediaServer()
+	// Abandon any room the bot created for the user, now they've made their own.
+	for _, pin := range pending {
+		if user, ok := d.token(pin); ok {
+			if user.Server != (MediaServer{}) {
+				server = user.Server
+			}
+			d.deleteToken(pin)
+			if _, err := d.bot.LeaveRoom(id.RoomID(user.User.RoomID)); err != nil {
+				d.app.err.Printf("Matrix: Failed to leave room \"%s\": %v", user.User.RoomID, err)
+			}
+		}
+	}
+	d.app.info.Printf("Matrix: Accepted invite to room \"%s\" from \"%s\"", evt.RoomID, evt.Sender)
+	d.sendPIN(evt.RoomID, string(evt.Sender), jellyfinID, encrypted, server)
+}
+
+// expectedInviter returns whether invites from the user should be accepted: they've requested a PIN,
+// are in the allowlist (by user ID or homeserver), or open enrollment is on.
+// If they have unverified PINs, those are returned along with the Jellyfin ID they were requested for.
+func (d *MatrixDaemon) expectedInviter(userID id.UserID) (pins []string, jellyfinID string, ok bool) {
+	d.tokensLock.Lock()
+	for pin, user := range d.tokens {
+		if !user.Verified && user.User != nil && id.UserID(user.User.UserID) == userID && !d.expired(user) {
+			pins = append(pins, pin)
+			if user.JellyfinID != "" {
+				jellyfinID = user.JellyfinID
+			}
+		}
+	}
+	d.tokensLock.Unlock()
+	if len(pins) != 0 || d.openEnrollment {
+		return pins, jellyfinID, true
+	}
+	_, server, _ := strings.Cut(string(userID), ":")
+	return pins, jellyfinID, d.inviteAllowlist[string(userID)] || (server != "" && d.inviteAllowlist[server])
+}
+
+// userByRoom returns the linked user whose private room with the bot has the given ID.
+// If several accounts are linked in the room, it's the first; use accountByRoom for the one commands should act on.
+func (d *MatrixDaemon) userByRoom(roomID id.RoomID) (user MatrixUser, ok bool) {
+	users := d.roomAccounts(roomID)
+	if len(users) == 0 {
+		return
+	}
+	return users[0], true
+}
+
+// roomAccounts returns the accounts linked in the room, sorted by Jellyfin ID.
+func (d *MatrixDaemon) roomAccounts(roomID id.RoomID) []MatrixUser {
+	users := []MatrixUser{}
+	if err := d.app.storage.db.Find(&users, badgerhold.Where("RoomID").Eq(string(roomID))); err != nil {
+		return nil
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].JellyfinID < users[j].JellyfinID })
+	return users
+}
+
+// accountByRoom returns the account commands in the room act on: the one chosen with the switch command
+// if the room's Matrix user has linked several, or otherwise the room's first.
+// A choice of an account that's since been unlinked is ignored.
+func (d *MatrixDaemon) accountByRoom(roomID id.RoomID) (user MatrixUser, ok bool) {
+	user, ok = d.userByRoom(roomID)
+	if !ok {
+		return
+	}
+	if jellyfinID, selected := d.app.storage.GetMatrixSelectionKey(user.UserID); selected {
+		if account, linked := d.app.storage.GetMatrixKey(jellyfinID); linked && account.UserID == user.UserID {
+			return account, true
+		}
 	}
 	return
 }
 
+// linkedAccounts returns the accounts linked to the Matrix user, in the order the accounts command lists them.
+func (d *MatrixDaemon) linkedAccounts(userID string) []MatrixUser {
+	users := []MatrixUser{}
+	if err := d.app.storage.db.Find(&users, badgerhold.Where("UserID").Eq(userID)); err != nil {
+		return nil
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].JellyfinID < users[j].JellyfinID })
+	return users
+}
+
 // UserExists returns whether or not a user with the given User ID exists.
 func (d *MatrixDaemon) UserExists(userID string) bool {
 	c, err := d.app.storage.db.Count(&MatrixUser{}, badgerhold.Where("UserID").Eq(userID))
 	return err != nil || c > 0
 }
 
-// User enters ID on sign-up, a PIN is sent to them. They enter it on sign-up.
+// remindExpiries periodically sends reminders to users whose accounts are about to expire. Stops on Shutdown.
+func (d *MatrixDaemon) remindExpiries() {
+	ticker := time.NewTicker(MATRIX_EXPIRY_REMINDER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ShutdownChannel:
+			return
+		case <-ticker.C:
+			d.sendExpiryReminders()
+		}
+	}
+}
 
-// Message the user first, to avoid E2EE by default
+// releaseHeldMessages periodically sends messages held back by users' quiet hours once they've ended. Stops on Shutdown.
+func (d *MatrixDaemon) releaseHeldMessages() {
+	ticker := time.NewTicker(MATRIX_QUIET_HOURS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ShutdownChannel:
+			return
+		case <-ticker.C:
+			d.sendHeldMessages(time.Now())
+		}
+	}
+}
+
+// sendHeldMessages sends the held messages due by now, dropping those to users who've since unlinked.
+func (d *MatrixDaemon) sendHeldMessages(now time.Time) {
+	for _, held := range d.app.storage.GetHeldMatrixMessages() {
+		if now.Before(held.Until) {
+			continue
+		}
+		d.app.storage.DeleteHeldMatrixMessageKey(held.ID)
+		user, ok := d.app.storage.GetMatrixKey(held.JellyfinID)
+		if !ok || !user.Contact {
+			continue
+		}
+		if err := d.Send(&held.Message, user); err != nil {
+			d.app.err.Printf("Matrix: Failed to send held message to \"%s\": %v", user.UserID, err)
+		}
+	}
+}
+
+// reminderTime returns the earliest time from now which is within the reminder hours in the given timezone.
+func (d *MatrixDaemon) reminderTime(now time.Time, loc *time.Location) time.Time {
+	if d.reminderFrom == d.reminderUntil {
+		return now
+	}
+	local := now.In(loc)
+	hour := local.Hour()
+	inWindow := hour >= d.reminderFrom && hour < d.reminderUntil
+	// The window may span midnight, e.g. 20 until 2.
+	if d.reminderFrom > d.reminderUntil {
+		inWindow = hour >= d.reminderFrom || hour < d.reminderUntil
+	}
+	if inWindow {
+		return now
+	}
+	next := time.Date(local.Year(), local.Month(), local.Day(), d.reminderFrom, 0, 0, 0, loc)
+	if !next.After(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// sendExpiryReminders reminds linked users whose accounts expire within one of d.reminderDays,
+// once per threshold.
+func (d *MatrixDaemon) sendExpiryReminders() {
+	now := time.Now()
+	for _, user := range d.app.storage.GetMatrix() {
+		if !user.Contact {
+			continue
+		}
+		expiry, ok := d.app.storage.GetUserExpiryKey(user.JellyfinID)
+		if !ok {
+			continue
+		}
+		remaining := time.Until(expiry.Expiry)
+		if remaining <= 0 {
+			continue
+		}
+		due := 0
+		for _, days := range d.reminderDays {
+			if remaining <= time.Duration(days)*24*time.Hour {
+				due = days
+			}
+		}
+		if due == 0 {
+			continue
+		}
+		reminder, ok := d.app.storage.GetExpiryReminderKey(user.JellyfinID)
+		if ok && reminder.Expiry.Equal(expiry.Expiry) && reminder.Days <= due {
+			continue
+		}
+		if prefs, ok := d.app.storage.GetNotificationPreferencesKey(user.JellyfinID); ok && !prefs.Allowed(NotificationExpiry, d.Name()) {
+			continue
+		}
+		// Wait for a sociable hour, unless the account would have expired by then.
+		loc := user.Location()
+		if at := d.reminderTime(now, loc); at.After(now) && at.Before(expiry.Expiry) {
+			continue
+		}
+		lang := d.resolveLang(id.RoomID(user.RoomID))
+		date, t := d.app.prettyTime(expiry.Expiry.In(loc))
+		text := d.app.storage.lang.Matrix[lang].Strings.template("expiryReminder", tmpl{
+			"days": d.app.storage.lang.Matrix[lang].quantity("days", int(math.Ceil(remaining.Hours()/24))),
+			"date": date,
+			"time": t,
+		})
+		msg := &Message{Text: text, Markdown: text, Notification: NotificationExpiry}
+		// A muted user shouldn't miss their account expiring tomorrow.
+		if remaining <= 24*time.Hour {
+			msg.Priority = PriorityCritical
+		}
+		if err := d.Send(msg, user); err != nil {
+			d.app.err.Printf("Matrix: Failed to send expiry reminder to \"%s\": %v", user.UserID, err)
+			continue
+		}
+		d.app.storage.SetExpiryReminderKey(user.JellyfinID, ExpiryReminder{Expiry: expiry.Expiry, Days: due})
+	}
+}
@@ -3,8 +3,12 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"os"
 	"strings"
 
+	_ "github.com/mattn/go-sqlite3"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/event"
@@ -12,19 +16,20 @@ import (
 )
 
 type Crypto struct {
-	cryptoStore *crypto.GobStore
+	cryptoStore crypto.Store
 	olm         *crypto.OlmMachine
+	db          *sql.DB // Set when the SQL store is used, and closed on shutdown.
 }
 
 func MatrixE2EE() bool { return true }
 
 type stateStore struct {
-	isEncrypted *map[id.RoomID]bool
+	d *MatrixDaemon
 }
 
 func (m *stateStore) IsEncrypted(roomID id.RoomID) bool {
-	// encrypted, ok := (*m.isEncrypted)[roomID]
-	// return ok && encrypted
+	// encrypted, _ := m.d.roomEncrypted(roomID)
+	// return encrypted
 	return true
 }
 
@@ -83,33 +88,65 @@ func (o olmLogger) Trace(message string, args ...interface{}) {
 	o.app.debug.Printf("OLM [TRACE]: "+message+"\n", args)
 }
 
+// sasHooks confirms SAS (emoji) verification automatically, as there is no one on the bot's end to compare them.
+type sasHooks struct {
+	d      *MatrixDaemon
+	device *id.Device
+}
+
+func (h *sasHooks) VerifySASMatch(otherDevice *id.Device, sas crypto.SASData) bool {
+	h.d.app.debug.Printf("Matrix: Confirming verification with \"%s\" (%s)", otherDevice.UserID, otherDevice.DeviceID)
+	return true
+}
+
+func (h *sasHooks) VerificationMethods() []crypto.VerificationMethod {
+	return []crypto.VerificationMethod{crypto.VerificationMethodEmoji{}, crypto.VerificationMethodDecimal{}}
+}
+
+func (h *sasHooks) OnCancel(cancelledByUs bool, reason string, reasonCode event.VerificationCancelCode) {
+	h.d.app.info.Printf("Matrix: Verification with \"%s\" cancelled (%s): %s", h.device.UserID, reasonCode, reason)
+}
+
+func (h *sasHooks) OnSuccess() {
+	h.d.app.info.Printf("Matrix: Verified by \"%s\" (%s)", h.device.UserID, h.device.DeviceID)
+}
+
 func InitMatrixCrypto(d *MatrixDaemon) (err error) {
 	d.Encryption = d.app.config.Section("matrix").Key("encryption").MustBool(false)
 	if !d.Encryption {
 		return
 	}
-	for _, user := range d.app.storage.matrix {
-		d.isEncrypted[id.RoomID(user.RoomID)] = user.Encrypted
-	}
 	dbPath := d.app.config.Section("files").Key("matrix_sql").String()
-	// If the db is maintained after restart, element reports "The secure channel with the sender was corrupted" when sending a message from the bot.
-	// This obviously isn't right, but it seems to work.
-	// Since its not really used anyway, just use the deprecated GobStore. This reduces cgo usage anyway.
-	var cryptoStore *crypto.GobStore
-	cryptoStore, err = crypto.NewGobStore(dbPath)
-	// d.db, err = sql.Open("sqlite3", dbPath)
+	olmLog := &olmLogger{d.app}
+	var cryptoStore crypto.Store
+	var db *sql.DB
+	switch backend := d.app.config.Section("matrix").Key("crypto_store").MustString("gob"); backend {
+	case "sqlite":
+		sqlPath := d.app.config.Section("files").Key("matrix_crypto_sql").String()
+		cryptoStore, db, err = openSQLCryptoStore(d, sqlPath, dbPath, olmLog)
+	case "gob":
+		// If the db is maintained after restart, element reports "The secure channel with the sender was corrupted" when sending a message from the bot.
+		// This obviously isn't right, but it seems to work.
+		// Since its not really used anyway, just use the deprecated GobStore. This reduces cgo usage anyway.
+		cryptoStore, err = crypto.NewGobStore(dbPath)
+	default:
+		err = fmt.Errorf("unknown crypto_store \"%s\", should be gob or sqlite", backend)
+	}
 	if err != nil {
 		return
 	}
-	olmLog := &olmLogger{d.app}
-	// deviceID := "jfa-go" + commit
-	// cryptoStore := crypto.NewSQLCryptoStore(d.db, "sqlite3", string(d.userID)+deviceID, id.DeviceID(deviceID), []byte("jfa-go"), olmLog)
-	// err = cryptoStore.CreateTables()
-	// if err != nil {
-	// 	return
-	// }
-	olm := crypto.NewOlmMachine(d.bot, olmLog, cryptoStore, &stateStore{&d.isEncrypted})
+	olm := crypto.NewOlmMachine(d.bot, olmLog, cryptoStore, &stateStore{d})
 	olm.AllowUnverifiedDevices = true
+	autoVerify := d.app.config.Section("matrix").Key("auto_verify").MustBool(false)
+	olm.AcceptVerificationFrom = func(transactionID string, device *id.Device, roomID id.RoomID) (crypto.VerificationRequestResponse, crypto.VerificationHooks) {
+		// Only linked users should be able to mark the bot as verified.
+		if !autoVerify || !d.UserExists(string(device.UserID)) {
+			d.app.debug.Printf("Matrix: Rejected verification request from \"%s\"", device.UserID)
+			return crypto.RejectRequest, nil
+		}
+		d.app.info.Printf("Matrix: Accepted verification request from \"%s\" (%s)", device.UserID, device.DeviceID)
+		return crypto.AcceptRequest, &sasHooks{d, device}
+	}
 	err = olm.Load()
 	if err != nil {
 		return
@@ -117,10 +154,110 @@ func InitMatrixCrypto(d *MatrixDaemon) (err error) {
 	d.crypto = Crypto{
 		cryptoStore: cryptoStore,
 		olm:         olm,
+		db:          db,
 	}
 	return
 }
 
+// openSQLCryptoStore opens the SQLite crypto store at path, copying the account, sessions and devices from the Gob store
+// at gobPath the first time, so switching backend doesn't lose the bot's identity or the keys to past messages.
+func openSQLCryptoStore(d *MatrixDaemon, path, gobPath string, olmLog crypto.Logger) (store *crypto.SQLCryptoStore, db *sql.DB, err error) {
+	if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+		if _, statErr := os.Stat(gobPath); statErr == nil {
+			if err = migrateGobCryptoStore(d, path, gobPath, olmLog); err != nil {
+				err = fmt.Errorf("failed to migrate Gob crypto store: %w", err)
+				return
+			}
+			d.app.info.Printf("Matrix: Migrated encryption keys from \"%s\" to \"%s\". The old file is no longer used, but is kept in case you switch back.", gobPath, path)
+		}
+	}
+	return newSQLCryptoStore(d, path, olmLog)
+}
+
+// newSQLCryptoStore opens the SQLite crypto store at path for the bot's current device.
+// The account is keyed on the device ID, so if it isn't known, e.g. because the homeserver couldn't be reached at startup,
+// this fails rather than creating a separate account which can't decrypt anything sent to the real device.
+func newSQLCryptoStore(d *MatrixDaemon, path string, olmLog crypto.Logger) (store *crypto.SQLCryptoStore, db *sql.DB, err error) {
+	deviceID := d.bot.DeviceID
+	if deviceID == "" {
+		err = fmt.Errorf("the bot's device ID is unknown, e.g. because the homeserver couldn't be reached at startup; restart once it can be")
+		return
+	}
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		return
+	}
+	// The store is used from several goroutines, which SQLite handles best over a single connection.
+	db.SetMaxOpenConns(1)
+	store = crypto.NewSQLCryptoStore(db, "sqlite3", string(d.userID)+"/"+string(deviceID), deviceID, []byte("jfa-go"), olmLog)
+	if err = store.CreateTables(); err != nil {
+		db.Close()
+	}
+	return
+}
+
+// migrateGobCryptoStore copies the Gob store at gobPath into a new SQLite store at path. It's built in a temporary file
+// which only replaces path once everything's copied, so a failure part way is retried from scratch on the next start
+// rather than leaving a store with some keys missing.
+func migrateGobCryptoStore(d *MatrixDaemon, path, gobPath string, olmLog crypto.Logger) error {
+	gobStore, err := crypto.NewGobStore(gobPath)
+	if err != nil {
+		return fmt.Errorf("failed to read Gob crypto store: %w", err)
+	}
+	tmpPath := path + ".migrating"
+	// Left by a previous attempt which failed.
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	store, db, err := newSQLCryptoStore(d, tmpPath, olmLog)
+	if err != nil {
+		return err
+	}
+	err = migrateCryptoStore(gobStore, store)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// migrateCryptoStore copies what the bot needs to keep decrypting and sending messages from a Gob store into another.
+// Outbound group sessions aren't copied, as new ones are shared when next needed.
+// The account is copied last, so a store with one always has the rest.
+func migrateCryptoStore(from *crypto.GobStore, to crypto.Store) error {
+	if from.Account == nil {
+		return nil
+	}
+	for senderKey, sessions := range from.Sessions {
+		for _, session := range sessions {
+			if err := to.AddSession(senderKey, session); err != nil {
+				return err
+			}
+		}
+	}
+	for roomID, senders := range from.GroupSessions {
+		for senderKey, sessions := range senders {
+			for sessionID, session := range sessions {
+				if err := to.PutGroupSession(roomID, senderKey, sessionID, session); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for userID, devices := range from.Devices {
+		if err := to.PutDevices(userID, devices); err != nil {
+			return err
+		}
+	}
+	if err := to.PutAccount(from.Account); err != nil {
+		return err
+	}
+	return to.Flush()
+}
+
 func HandleSyncerCrypto(startTime int64, d *MatrixDaemon, syncer *mautrix.DefaultSyncer) {
 	if !d.Encryption {
 		return
@@ -150,52 +287,89 @@ func HandleSyncerCrypto(startTime int64, d *MatrixDaemon, syncer *mautrix.Defaul
 			return
 		}
 		decrypted, err := d.crypto.olm.DecryptMegolmEvent(evt)
-		// if strings.Contains(err.Error(), crypto.NoSessionFound.Error()) {
-		// 	d.app.err.Printf("Failed to decrypt Matrix message: no session found")
-		// 	return
-		// }
 		if err != nil {
-			d.app.err.Printf("Failed to decrypt Matrix message: %v", err)
+			d.handleDecryptionFailure(evt, err)
+			return
+		}
+		if isVerificationEvent(decrypted) {
+			if err := d.crypto.olm.ProcessInRoomVerification(decrypted); err != nil {
+				d.app.err.Printf("Matrix: Failed to process verification event: %v", err)
+			}
 			return
 		}
 		d.handleMessage(source, decrypted)
 	})
 }
 
+// isVerificationEvent returns whether the event is part of an in-room device verification.
+func isVerificationEvent(evt *event.Event) bool {
+	if strings.HasPrefix(evt.Type.Type, "m.key.verification.") {
+		return true
+	}
+	msgType, _ := evt.Content.Raw["msgtype"].(string)
+	return evt.Type == event.EventMessage && msgType == string(event.MsgVerificationRequest)
+}
+
 func CryptoShutdown(d *MatrixDaemon) {
 	if d.Encryption {
 		d.crypto.olm.FlushStore()
+		if d.crypto.db != nil {
+			d.crypto.db.Close()
+		}
+	}
+}
+
+// ExportMatrixKeys exports the bot's Megolm sessions in the standard key export format, encrypted with the passphrase.
+func ExportMatrixKeys(d *MatrixDaemon, passphrase string) ([]byte, error) {
+	if !d.Encryption {
+		return nil, ErrMatrixEncryptionUnavailable
+	}
+	sessions, err := d.crypto.olm.CryptoStore.GetAllGroupSessions()
+	if err != nil {
+		return nil, err
 	}
+	return crypto.ExportKeys(passphrase, sessions)
 }
 
-func EncryptRoom(d *MatrixDaemon, room *mautrix.RespCreateRoom, userID id.UserID) (encrypted bool) {
+// ImportMatrixKeys imports Megolm sessions from a key export, returning how many were new and how many were in the file.
+func ImportMatrixKeys(d *MatrixDaemon, passphrase string, data []byte) (imported, total int, err error) {
+	if !d.Encryption {
+		return 0, 0, ErrMatrixEncryptionUnavailable
+	}
+	imported, total, err = d.crypto.olm.ImportKeys(passphrase, data)
+	if err == nil {
+		d.crypto.olm.FlushStore()
+	}
+	return
+}
+
+// EncryptRoom enables encryption in the room. The error is returned so CreateRoom can retry transient failures.
+func EncryptRoom(d *MatrixDaemon, room *mautrix.RespCreateRoom, userID id.UserID) (encrypted bool, err error) {
 	if !d.Encryption {
 		return
 	}
-	_, err := d.bot.SendStateEvent(room.RoomID, event.StateEncryption, "", &event.EncryptionEventContent{
+	_, err = d.bot.SendStateEvent(room.RoomID, event.StateEncryption, "", &event.EncryptionEventContent{
 		Algorithm:              id.AlgorithmMegolmV1,
 		RotationPeriodMillis:   7 * 24 * 60 * 60 * 1000,
 		RotationPeriodMessages: 100,
 	})
-	if err == nil {
-		encrypted = true
-	} else {
+	if err != nil {
 		d.app.debug.Printf("Matrix: Failed to enable encryption in room: %v", err)
 		return
 	}
-	d.isEncrypted[room.RoomID] = encrypted
-	var userIDs []id.UserID
-	userIDs, err = d.getUserIDs(room.RoomID)
-	if err != nil {
+	encrypted = true
+	d.setRoomEncrypted(room.RoomID, encrypted)
+	userIDs, userErr := d.getUserIDs(room.RoomID)
+	if userErr != nil {
 		return
 	}
 	userIDs = append(userIDs, userID)
 	return
 }
 
-func SendEncrypted(d *MatrixDaemon, content *event.MessageEventContent, roomID id.RoomID) (err error) {
+func SendEncrypted(d *MatrixDaemon, content *event.MessageEventContent, roomID id.RoomID, txnID string) (eventID id.EventID, err error) {
 	if !d.Encryption {
-		err = d.send(content, roomID)
+		eventID, err = d.send(content, roomID, txnID)
 		return
 	}
 	var encrypted *event.EncryptedEventContent
@@ -216,9 +390,10 @@ func SendEncrypted(d *MatrixDaemon, content *event.MessageEventContent, roomID i
 	if err != nil {
 		return
 	}
-	_, err = d.bot.SendMessageEvent(roomID, event.EventEncrypted, &event.Content{Parsed: encrypted})
+	resp, err := d.bot.SendMessageEvent(roomID, event.EventEncrypted, &event.Content{Parsed: encrypted}, mautrix.ReqSendEvent{TransactionID: txnID})
 	if err != nil {
 		return
 	}
+	eventID = resp.EventID
 	return
 }
@@ -0,0 +1,90 @@
+// +build e2ee
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+)
+
+// failingDevicesStore fails to store devices, which migrateCryptoStore copies after the sessions.
+type failingDevicesStore struct {
+	crypto.Store
+}
+
+func (s failingDevicesStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*crypto.DeviceIdentity) error {
+	return errors.New("disk full")
+}
+
+func TestMatrixCryptoMigrationPartialFailure(t *testing.T) {
+	d := newTestMatrixDaemon()
+	var err error
+	d.bot, err = mautrix.NewClient("https://example.org", d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	d.bot.DeviceID = "JFAGO"
+	olmLog := &olmLogger{d.app}
+	dir := t.TempDir()
+	gobPath, path := dir+"/crypto.gob", dir+"/crypto.db"
+	gobStore, err := crypto.NewGobStore(gobPath)
+	if err != nil {
+		t.Fatalf("failed to create Gob store: %v", err)
+	}
+	account := crypto.NewOlmAccount()
+	gobStore.PutAccount(account)
+	devices := map[id.DeviceID]*crypto.DeviceIdentity{"PHONE": {UserID: "@user:example.org", DeviceID: "PHONE"}}
+	gobStore.PutDevices("@user:example.org", devices)
+	gobStore.Flush()
+
+	// A migration which fails part way mustn't leave an account behind, or it'd never be retried.
+	store, db, err := newSQLCryptoStore(d, path+".migrating", olmLog)
+	if err != nil {
+		t.Fatalf("failed to open SQL store: %v", err)
+	}
+	if err := migrateCryptoStore(gobStore, failingDevicesStore{store}); err == nil {
+		t.Fatal("migration into failing store succeeded")
+	}
+	if stored, _ := store.GetAccount(); stored != nil {
+		t.Error("account stored by failed migration")
+	}
+	db.Close()
+
+	// The next start retries from scratch, ignoring what the failed attempt left.
+	store, db, err = openSQLCryptoStore(d, path, gobPath, olmLog)
+	if err != nil {
+		t.Fatalf("retried migration failed: %v", err)
+	}
+	defer db.Close()
+	if stored, err := store.GetAccount(); err != nil || stored == nil {
+		t.Fatalf("account not migrated: %v", err)
+	}
+	if stored, err := store.GetDevices("@user:example.org"); err != nil || len(stored) != 1 {
+		t.Errorf("devices not migrated: %v, %v", stored, err)
+	}
+	if _, err := os.Stat(path + ".migrating"); !os.IsNotExist(err) {
+		t.Errorf("temporary store left behind: %v", err)
+	}
+}
+
+func TestMatrixSQLCryptoStoreNeedsDeviceID(t *testing.T) {
+	d := newTestMatrixDaemon()
+	var err error
+	d.bot, err = mautrix.NewClient("https://example.org", d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	// An account created under an empty device ID would be separate from the real device's.
+	path := t.TempDir() + "/crypto.db"
+	if _, _, err := newSQLCryptoStore(d, path, &olmLogger{d.app}); err == nil {
+		t.Fatal("opened store without a device ID")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("store created without a device ID: %v", err)
+	}
+}
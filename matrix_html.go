@@ -0,0 +1,236 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Tags and attributes Matrix clients are expected to render, from https://spec.matrix.org/v1.8/client-server-api/#mroommessage-msgtypes.
+var matrixAllowedTags = map[string][]string{
+	"font":       {"data-mx-bg-color", "data-mx-color", "color"},
+	"del":        nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"blockquote": nil,
+	"p":          nil,
+	"a":          {"name", "target", "href"},
+	"ul":         nil,
+	"ol":         {"start"},
+	"sup":        nil,
+	"sub":        nil,
+	"li":         nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"strong":     nil,
+	"em":         nil,
+	"strike":     nil,
+	"code":       {"class"},
+	"hr":         nil,
+	"br":         nil,
+	"div":        nil,
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         nil,
+	"th":         nil,
+	"td":         nil,
+	"caption":    nil,
+	"pre":        nil,
+	"span":       {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler"},
+	"img":        {"width", "height", "alt", "title", "src"},
+	"details":    nil,
+	"summary":    nil,
+}
+
+// Tags whose content should be removed along with them.
+var matrixDroppedTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"head":     true,
+	"title":    true,
+	"iframe":   true,
+	"object":   true,
+	"noscript": true,
+}
+
+var matrixLinkSchemes = []string{"http://", "https://", "ftp://", "mailto:", "magnet:"}
+
+// sanitizeMatrixHTML strips tags and attributes Matrix doesn't allow from the given HTML.
+// Content of disallowed tags is kept, apart from those like <script> whose content would be meaningless.
+func sanitizeMatrixHTML(in string) string {
+	z := html.NewTokenizer(strings.NewReader(in))
+	var out strings.Builder
+	dropped := 0 // Depth inside tags in matrixDroppedTags.
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return out.String()
+		case html.TextToken:
+			if dropped == 0 {
+				out.WriteString(html.EscapeString(string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if matrixDroppedTags[tok.Data] {
+				if tt == html.StartTagToken {
+					dropped++
+				}
+				continue
+			}
+			allowedAttrs, ok := matrixAllowedTags[tok.Data]
+			if dropped != 0 || !ok {
+				continue
+			}
+			tok.Attr = filterMatrixAttrs(tok.Data, tok.Attr, allowedAttrs)
+			// Images can only be shown if they've been uploaded to the homeserver.
+			if tok.Data == "img" && !hasAttr(tok.Attr, "src") {
+				continue
+			}
+			out.WriteString(tok.String())
+		case html.EndTagToken:
+			tok := z.Token()
+			if matrixDroppedTags[tok.Data] {
+				if dropped != 0 {
+					dropped--
+				}
+				continue
+			}
+			if _, ok := matrixAllowedTags[tok.Data]; ok && dropped == 0 {
+				out.WriteString(tok.String())
+			}
+		}
+	}
+}
+
+func hasAttr(attrs []html.Attribute, key string) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func filterMatrixAttrs(tag string, attrs []html.Attribute, allowed []string) []html.Attribute {
+	out := []html.Attribute{}
+	for _, attr := range attrs {
+		found := false
+		for _, a := range allowed {
+			if attr.Key == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		switch {
+		case tag == "a" && attr.Key == "href":
+			found = false
+			for _, scheme := range matrixLinkSchemes {
+				if strings.HasPrefix(strings.ToLower(attr.Val), scheme) {
+					found = true
+					break
+				}
+			}
+		case tag == "img" && attr.Key == "src":
+			found = strings.HasPrefix(attr.Val, "mxc://")
+		case tag == "code" && attr.Key == "class":
+			found = strings.HasPrefix(attr.Val, "language-")
+		}
+		if found {
+			out = append(out, attr)
+		}
+	}
+	return out
+}
+
+// Tags which start on a new line when rendered as plain text.
+var matrixBlockTags = map[string]bool{
+	"p": true, "div": true, "blockquote": true, "pre": true, "ul": true, "ol": true, "li": true, "tr": true, "table": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true, "details": true, "summary": true,
+}
+
+// matrixPlainText renders HTML as plain text, for the body of messages which only have formatted content.
+// Links are shown as "text (url)", and images by their alt text.
+func matrixPlainText(in string) string {
+	z := html.NewTokenizer(strings.NewReader(in))
+	var out strings.Builder
+	hrefs := []string{} // href of each open <a>, and the position of its text in out.
+	starts := []int{}
+	newline := func() {
+		s := out.String()
+		if s != "" && !strings.HasSuffix(s, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.TrimSpace(matrixBlankLines.ReplaceAllString(out.String(), "\n\n"))
+		case html.TextToken:
+			text := string(z.Text())
+			// Skip the newlines between block tags.
+			if strings.TrimSpace(text) == "" && strings.Contains(text, "\n") {
+				continue
+			}
+			out.WriteString(text)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "br":
+				out.WriteString("\n")
+			case "img":
+				for _, attr := range tok.Attr {
+					if attr.Key == "alt" {
+						out.WriteString(attr.Val)
+					}
+				}
+			case "a":
+				href := ""
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" {
+						href = attr.Val
+					}
+				}
+				hrefs = append(hrefs, href)
+				starts = append(starts, out.Len())
+			default:
+				if matrixBlockTags[tok.Data] {
+					newline()
+				}
+				if tok.Data == "li" {
+					out.WriteString("- ")
+				}
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			if tok.Data == "a" && len(hrefs) != 0 {
+				href, start := hrefs[len(hrefs)-1], starts[len(starts)-1]
+				hrefs, starts = hrefs[:len(hrefs)-1], starts[:len(starts)-1]
+				text := strings.TrimSpace(out.String()[start:])
+				if href != "" && text != href && strings.TrimPrefix(href, "mailto:") != text {
+					out.WriteString(" (" + href + ")")
+				}
+			} else if matrixBlockTags[tok.Data] {
+				newline()
+				// Leave a blank line after paragraphs and headings.
+				switch tok.Data {
+				case "p", "h1", "h2", "h3", "h4", "h5", "h6":
+					out.WriteString("\n")
+				}
+			}
+		}
+	}
+}
+
+var matrixBlankLines = regexp.MustCompile(`\n{3,}`)
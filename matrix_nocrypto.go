@@ -25,11 +25,20 @@ func CryptoShutdown(d *MatrixDaemon) {
 	return
 }
 
-func EncryptRoom(d *MatrixDaemon, room *mautrix.RespCreateRoom, userID id.UserID) (encrypted bool) {
+func ExportMatrixKeys(d *MatrixDaemon, passphrase string) ([]byte, error) {
+	return nil, ErrMatrixEncryptionUnavailable
+}
+
+func ImportMatrixKeys(d *MatrixDaemon, passphrase string, data []byte) (imported, total int, err error) {
+	err = ErrMatrixEncryptionUnavailable
+	return
+}
+
+func EncryptRoom(d *MatrixDaemon, room *mautrix.RespCreateRoom, userID id.UserID) (encrypted bool, err error) {
 	return
 }
 
-func SendEncrypted(d *MatrixDaemon, content *event.MessageEventContent, roomID id.RoomID) (err error) {
-	err = d.send(content, roomID)
+func SendEncrypted(d *MatrixDaemon, content *event.MessageEventContent, roomID id.RoomID, txnID string) (eventID id.EventID, err error) {
+	eventID, err = d.send(content, roomID, txnID)
 	return
 }
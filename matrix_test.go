@@ -0,0 +1,3336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hrfee/jfa-go/logger"
+	"github.com/hrfee/mediabrowser"
+	"github.com/timshannon/badgerhold/v4"
+	"gopkg.in/ini.v1"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestMatrixDaemon() *MatrixDaemon {
+	app := &appContext{
+		info:  logger.NewEmptyLogger(),
+		debug: logger.NewEmptyLogger(),
+		err:   logger.NewEmptyLogger(),
+	}
+	app.storage.lang.Matrix = telegramLangs{
+		"en-us": telegramLang{
+			Meta: langMeta{Name: "English (US)"},
+			Strings: langSection{
+				"matrixHelpMessage":     "Available commands:",
+				"matrixWelcomeTemplate": "{startMessage}\n\n{pin}{signupLink}\n\n{verifyMessage}\n\n{languageMessage}",
+			},
+		},
+	}
+	d := &MatrixDaemon{
+		ShutdownChannel: make(chan string),
+		userID:          id.UserID("@jfa-bot:example.org"),
+		tokens:          map[string]UnverifiedUser{},
+		languages:       map[id.RoomID]string{},
+		isEncrypted:     map[id.RoomID]bool{},
+		app:             app,
+		start:           time.Now().UnixNano() / 1e6,
+		prefix:          "!",
+		maxRetries:      3,
+	}
+	d.registerCommands()
+	return d
+}
+
+// newTestMatrixHomeserver starts a fake homeserver which accepts any request, and points d.bot at it.
+// The bodies of messages sent through it are returned.
+func newTestMatrixHomeserver(t *testing.T, d *MatrixDaemon) *[]string {
+	sent := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/send/m.room.message/") {
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			sent = append(sent, content.Body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"event_id": "$event:example.org", "room_id": "!new:example.org"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return &sent
+}
+
+// openTestDB opens a temporary database for d's app.
+func openTestDB(t *testing.T, d *MatrixDaemon) {
+	opts := badgerhold.DefaultOptions
+	opts.Dir = t.TempDir()
+	opts.ValueDir = opts.Dir
+	opts.Logger = nil
+	db, err := badgerhold.Open(opts)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d.app.storage.db = db
+}
+
+func newTestMatrixEvent(d *MatrixDaemon, raw map[string]interface{}) *event.Event {
+	return &event.Event{
+		Sender:    id.UserID("@user:example.org"),
+		Type:      event.EventMessage,
+		RoomID:    id.RoomID("!room:example.org"),
+		Timestamp: d.start + 1,
+		Content:   event.Content{Raw: raw},
+	}
+}
+
+func TestMatrixHandleNonTextMessage(t *testing.T) {
+	d := newTestMatrixDaemon()
+	events := []map[string]interface{}{
+		{"msgtype": "m.image", "body": "image.png", "url": "mxc://example.org/abc"},
+		{"msgtype": "m.text"},
+		{"msgtype": "m.text", "body": 42},
+		{},
+	}
+	for _, raw := range events {
+		d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, raw))
+	}
+	if d.Stopped {
+		t.Fatal("daemon stopped after handling non-text messages")
+	}
+}
+
+func TestMatrixHelpListsCommands(t *testing.T) {
+	d := newTestMatrixDaemon()
+	help := d.helpMessage("en-us", true)
+	for name := range d.commands {
+		if !strings.Contains(help, "!"+name) {
+			t.Errorf("help message missing command \"%s\": %s", name, help)
+		}
+	}
+}
+
+func TestMatrixSendRetriesRateLimit(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 10}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	d := newTestMatrixDaemon()
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	err = d.sendToRoom(&event.MessageEventContent{MsgType: event.MsgText, Body: "test"}, id.RoomID("!room:example.org"))
+	if err != nil {
+		t.Fatalf("send failed after rate limit: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 requests, got %d", calls)
+	}
+}
+
+func TestMatrixUnlinkRemovesUser(t *testing.T) {
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!unlink"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{
+		RoomID: string(evt.RoomID),
+		UserID: string(evt.Sender),
+		Lang:   "en-us",
+	})
+	d.languages[evt.RoomID] = "en-us"
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.app.storage.GetMatrixKey("jellyfin-id"); ok {
+		t.Error("user still stored after unlinking")
+	}
+	if _, ok := d.languages[evt.RoomID]; ok {
+		t.Error("room language still stored after unlinking")
+	}
+}
+
+func TestSanitizeMatrixHTMLScript(t *testing.T) {
+	out := sanitizeMatrixHTML(`<p>Hello <script>alert("hi")</script><b onclick="alert()">world</b></p>`)
+	if strings.Contains(out, "script") || strings.Contains(out, "alert") || strings.Contains(out, "onclick") {
+		t.Errorf("script not removed: %s", out)
+	}
+	if out != "<p>Hello <b>world</b></p>" {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
+
+func TestSanitizeMatrixHTMLNestedTable(t *testing.T) {
+	in := `<table style="width: 100%"><tr><td><table><tr><td>inner</td></tr></table></td><td>outer</td></tr></table>`
+	expected := `<table><tr><td><table><tr><td>inner</td></tr></table></td><td>outer</td></tr></table>`
+	if out := sanitizeMatrixHTML(in); out != expected {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
+
+func TestMatrixBroadcastContinuesPastFailure(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.maxRetries = 0
+	openTestDB(t, d)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "broken") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Not in room"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	d.app.storage.SetMatrixKey("a", MatrixUser{RoomID: "!broken:example.org", Contact: true})
+	d.app.storage.SetMatrixKey("b", MatrixUser{RoomID: "!room:example.org", Contact: true})
+	sent, failed := d.Broadcast(&Message{Text: "test"})
+	if sent != 1 || len(failed) != 1 || failed[0] != "!broken:example.org" {
+		t.Errorf("unexpected result: sent %d, failed %v", sent, failed)
+	}
+}
+
+func TestMatrixMembershipUnlinksLeavingUser(t *testing.T) {
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	roomID := id.RoomID("!room:example.org")
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{RoomID: string(roomID), UserID: "@user:example.org"})
+	d.languages[roomID] = "en-us"
+	stateKey := "@user:example.org"
+	evt := &event.Event{
+		Sender:   id.UserID(stateKey),
+		Type:     event.StateMember,
+		RoomID:   roomID,
+		StateKey: &stateKey,
+		Content:  event.Content{Raw: map[string]interface{}{"membership": "join"}},
+	}
+	d.handleMembership(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.app.storage.GetMatrixKey("jellyfin-id"); !ok {
+		t.Fatal("user unlinked on join")
+	}
+	evt.Content.Raw["membership"] = "leave"
+	d.handleMembership(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.app.storage.GetMatrixKey("jellyfin-id"); ok {
+		t.Error("user still stored after leaving")
+	}
+	if _, ok := d.languages[roomID]; ok {
+		t.Error("room language still stored after leaving")
+	}
+}
+
+func TestMatrixVerifyCommand(t *testing.T) {
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.pinExpiry = time.Minute
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!verify A1-B2-C3"})
+	d.tokens["A1-B2-C3"] = UnverifiedUser{User: &MatrixUser{RoomID: string(evt.RoomID)}, Created: time.Now()}
+	d.tokens["D4-E5-F6"] = UnverifiedUser{User: &MatrixUser{RoomID: string(evt.RoomID)}, Created: time.Now().Add(-time.Hour)}
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if !d.tokens["A1-B2-C3"].Verified {
+		t.Error("PIN not verified")
+	}
+	evt = newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!verify D4-E5-F6"})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.tokens["D4-E5-F6"]; ok {
+		t.Error("expired PIN not removed")
+	}
+}
+
+func TestMatrixRemoveExpiredTokens(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.pinExpiry = time.Minute
+	d.tokens["old"] = UnverifiedUser{User: &MatrixUser{}, Created: time.Now().Add(-time.Hour)}
+	d.tokens["new"] = UnverifiedUser{User: &MatrixUser{}, Created: time.Now()}
+	d.removeExpiredTokens()
+	if _, ok := d.tokens["old"]; ok {
+		t.Error("expired token not removed")
+	}
+	if _, ok := d.tokens["new"]; !ok {
+		t.Error("valid token removed")
+	}
+}
+
+func TestMatrixSendShowsTyping(t *testing.T) {
+	typing := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/typing/") {
+			body, _ := io.ReadAll(r.Body)
+			typing = append(typing, string(body))
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	d := newTestMatrixDaemon()
+	d.showTyping = true
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	err = d.sendToRoom(&event.MessageEventContent{MsgType: event.MsgText, Body: "test"}, id.RoomID("!room:example.org"))
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if len(typing) != 2 || !strings.Contains(typing[0], `"typing":true`) || !strings.Contains(typing[1], `"typing":false`) {
+		t.Errorf("unexpected typing requests: %v", typing)
+	}
+}
+
+func TestMatrixEmailRejectsInvalid(t *testing.T) {
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!email not-an-email"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{RoomID: string(evt.RoomID), UserID: string(evt.Sender)})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.app.storage.GetEmailsKey("jellyfin-id"); ok {
+		t.Error("invalid email address stored")
+	}
+}
+
+func TestMatrixSendStartRejectsInvalidUserID(t *testing.T) {
+	d := newTestMatrixDaemon()
+	for _, userID := range []string{"user", "@user", "user:example.org", "@:example.org"} {
+		if err := d.SendStart(userID, "", MediaServer{}); err != ErrInvalidMatrixUserID {
+			t.Errorf("expected invalid user ID error for \"%s\", got %v", userID, err)
+		}
+	}
+}
+
+func TestMatrixAdminCommandsHidden(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.adminUsers = map[id.UserID]bool{"@admin:example.org": true}
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!invites"})
+	if d.isAdmin(evt) {
+		t.Error("ordinary user treated as admin")
+	}
+	if strings.Contains(d.helpMessage("en-us", false), "!invites") {
+		t.Error("admin command shown to ordinary user")
+	}
+	evt.Sender = "@admin:example.org"
+	if !d.isAdmin(evt) {
+		t.Error("admin user not treated as admin")
+	}
+}
+
+func TestMatrixLangUpdatesTopic(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixRoomTopic"] = "Jellyfin notifications"
+	d.app.storage.lang.Matrix["fr-fr"] = telegramLang{
+		Meta:    langMeta{Name: "Français (FR)"},
+		Strings: langSection{"matrixRoomTopic": "Notifications Jellyfin"},
+	}
+	topic := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/state/m.room.topic") {
+			body, _ := io.ReadAll(r.Body)
+			topic = string(body)
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if d.roomTopic(d.defaultLang()) != "Jellyfin notifications" {
+		t.Errorf("unexpected default topic: %s", d.roomTopic(d.defaultLang()))
+	}
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!lang fr-fr"}))
+	if !strings.Contains(topic, "Notifications Jellyfin") {
+		t.Errorf("topic not updated to selected language: %s", topic)
+	}
+}
+
+func TestMatrixLangListsLanguages(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["fr-fr"] = telegramLang{Meta: langMeta{Name: "Français (FR)"}}
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!lang"}))
+	if len(*sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(*sent))
+	}
+	if !strings.Contains((*sent)[0], "en-us: English (US)\nfr-fr: Français (FR)") {
+		t.Errorf("unexpected language list: %s", (*sent)[0])
+	}
+}
+
+func TestMatrixLangRejectsUnknown(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["languageNotFound"] = "Unknown language \"{language}\"."
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!lang xx-xx"})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.languages[evt.RoomID]; ok {
+		t.Error("unknown language stored")
+	}
+	if len(*sent) != 1 || (*sent)[0] != "Unknown language \"xx-xx\"." {
+		t.Errorf("unexpected reply: %v", *sent)
+	}
+}
+
+func TestMatrixLangPersists(t *testing.T) {
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["fr-fr"] = telegramLang{Meta: langMeta{Name: "Français (FR)"}}
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!lang fr-fr"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: string(evt.RoomID), Lang: "en-us"})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if user, _ := d.app.storage.GetMatrixKey("jellyfin-id"); user.Lang != "fr-fr" {
+		t.Errorf("language not stored, got \"%s\"", user.Lang)
+	}
+	if d.resolveLang(evt.RoomID) != "fr-fr" {
+		t.Errorf("language not used, got \"%s\"", d.resolveLang(evt.RoomID))
+	}
+}
+
+func TestMatrixResolveLangConcurrent(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["fr-fr"] = telegramLang{Meta: langMeta{Name: "Français (FR)"}}
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org", Lang: "fr-fr"})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if lang := d.resolveLang("!room:example.org"); lang != "fr-fr" {
+				t.Errorf("expected user's language, got \"%s\"", lang)
+			}
+			d.setRoomLang("!other:example.org", "en-us")
+		}()
+	}
+	wg.Wait()
+	if _, ok := d.roomLang("!room:example.org"); ok {
+		t.Error("resolveLang stored the room's language")
+	}
+}
+
+func TestMatrixCreateRoomEncryptionModes(t *testing.T) {
+	for _, mode := range []string{"auto", "forced", "disabled"} {
+		d := newTestMatrixDaemon()
+		newTestMatrixHomeserver(t, d)
+		d.forceEncryption = mode == "forced"
+		d.noEncryption = mode == "disabled"
+		// Crypto isn't available in tests, so forcing encryption should fail.
+		roomID, encrypted, err := d.CreateRoom("@user:example.org")
+		if mode == "forced" {
+			if err != ErrMatrixEncryptionUnavailable {
+				t.Errorf("%s: expected encryption error, got %v", mode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to create room: %v", mode, err)
+			continue
+		}
+		if encrypted || d.isEncrypted[roomID] {
+			t.Errorf("%s: room unexpectedly encrypted", mode)
+		}
+		if _, ok := d.isEncrypted[roomID]; !ok {
+			t.Errorf("%s: encryption state not stored", mode)
+		}
+	}
+}
+
+func TestMatrixMuteSkipsNotifications(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!mute"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: string(evt.RoomID), Contact: true})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	user, _ := d.app.storage.GetMatrixKey("jellyfin-id")
+	if !user.Muted {
+		t.Fatal("user not muted")
+	}
+	*sent = []string{}
+	d.Send(&Message{Text: "notification"}, user)
+	d.Send(&Message{Text: "urgent", Priority: PriorityCritical}, user)
+	if len(*sent) != 1 || (*sent)[0] != "urgent" {
+		t.Errorf("unexpected messages sent to muted user: %v", *sent)
+	}
+}
+
+func TestMatrixCryptoInitFailure(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	defer func(f func(*MatrixDaemon) error) { initMatrixCrypto = f }(initMatrixCrypto)
+	initMatrixCrypto = func(d *MatrixDaemon) error {
+		d.Encryption = true
+		return errors.New("no olm")
+	}
+	d.isEncrypted["!encrypted:example.org"] = true
+	d.isEncrypted["!plain:example.org"] = false
+	d.initCrypto()
+	if d.Encryption {
+		t.Fatal("encryption still enabled after failed init")
+	}
+	if err := d.sendToRoom(&event.MessageEventContent{MsgType: event.MsgNotice, Body: "secret"}, "!encrypted:example.org"); err != ErrMatrixEncryptionUnavailable {
+		t.Errorf("expected encryption error for encrypted room, got %v", err)
+	}
+	if err := d.sendToRoom(&event.MessageEventContent{MsgType: event.MsgNotice, Body: "plain"}, "!plain:example.org"); err != nil {
+		t.Errorf("failed to send to unencrypted room: %v", err)
+	}
+	if len(*sent) != 1 || (*sent)[0] != "plain" {
+		t.Errorf("unexpected messages sent: %v", *sent)
+	}
+}
+
+func TestMatrixSignupLink(t *testing.T) {
+	d := newTestMatrixDaemon()
+	if link := d.signupLink("1234"); link != "" {
+		t.Errorf("expected no link without a sign-up URL, got %s", link)
+	}
+	d.signupURL = "https://example.org/invite/abc?lang=en-us"
+	if link := d.signupLink("1234"); link != "https://example.org/invite/abc?lang=en-us&pin=1234" {
+		t.Errorf("unexpected link: %s", link)
+	}
+}
+
+func TestMatrixSendByIDSkipsUncontactable(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.SetMatrixKey("contact", MatrixUser{JellyfinID: "contact", RoomID: "!contact:example.org", Contact: true})
+	d.app.storage.SetMatrixKey("no-contact", MatrixUser{JellyfinID: "no-contact", RoomID: "!nocontact:example.org"})
+	var method ContactMethod = d
+	if !method.Reachable("contact") || method.Reachable("no-contact") || method.Reachable("unknown") {
+		t.Error("unexpected reachability")
+	}
+	if err := method.SendByID(&Message{Text: "notification"}, "contact", "no-contact", "unknown"); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(*sent) != 1 {
+		t.Errorf("expected one message, got %v", *sent)
+	}
+}
+
+func TestRetryQueueResendsFailedMessages(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	failing := true
+	sent := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "unavailable"}`))
+			return
+		}
+		content := event.MessageEventContent{}
+		json.NewDecoder(r.Body).Decode(&content)
+		sent = append(sent, content.Body)
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	d.bot, _ = mautrix.NewClient(srv.URL, d.userID, "token")
+	d.app.matrix = d
+	d.app.config = ini.Empty()
+	d.app.config.Section("messages").Key("retry_failed").SetValue("true")
+	defer func(enabled bool) { matrixEnabled = enabled }(matrixEnabled)
+	matrixEnabled = true
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org", Contact: true})
+
+	if err := d.app.sendByID(&Message{Text: "expiry warning"}, "jellyfin-id"); err == nil {
+		t.Fatal("expected send to fail")
+	}
+	if n := d.app.queuedMessages("Matrix"); n != 1 {
+		t.Fatalf("expected one queued message, got %d", n)
+	}
+	// Not due yet.
+	failing = false
+	d.app.retryQueuedMessages()
+	if len(sent) != 0 {
+		t.Fatalf("message resent before backoff: %v", sent)
+	}
+	qm := d.app.storage.GetQueuedMessages()[0]
+	qm.NextAttempt = time.Now()
+	d.app.storage.SetQueuedMessageKey(qm.ID, qm)
+	d.app.retryQueuedMessages()
+	if len(sent) != 1 || sent[0] != "expiry warning" {
+		t.Errorf("unexpected messages resent: %v", sent)
+	}
+	if n := d.app.queuedMessages("Matrix"); n != 0 {
+		t.Errorf("expected empty queue, got %d", n)
+	}
+}
+
+func TestRetryQueueDropsUnreachable(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.matrix = d
+	d.app.config = ini.Empty()
+	defer func(enabled bool) { matrixEnabled = enabled }(matrixEnabled)
+	matrixEnabled = true
+	info := &bytes.Buffer{}
+	d.app.info = logger.NewLogger(info, "", 0, 0)
+	// Contact turned off since the message was queued.
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org"})
+	d.app.queueMessage(&Message{Text: "expiry warning"}, "Matrix", "jellyfin-id", errors.New("unavailable"))
+	qm := d.app.storage.GetQueuedMessages()[0]
+	qm.NextAttempt = time.Now()
+	d.app.storage.SetQueuedMessageKey(qm.ID, qm)
+	d.app.retryQueuedMessages()
+	if len(*sent) != 0 || strings.Contains(info.String(), "Resent") {
+		t.Errorf("message resent to unreachable user: %v, %q", *sent, info.String())
+	}
+	if n := d.app.queuedMessages("Matrix"); n != 0 {
+		t.Errorf("expected empty queue, got %d", n)
+	}
+}
+
+func TestMatrixSendByIDKeepsEarlierErrors(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	sent := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "!bad:example.org") {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "unavailable"}`))
+			return
+		}
+		content := event.MessageEventContent{}
+		json.NewDecoder(r.Body).Decode(&content)
+		sent = append(sent, content.Body)
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	d.bot, _ = mautrix.NewClient(srv.URL, d.userID, "token")
+	d.app.config = ini.Empty()
+	d.app.storage.SetMatrixKey("bad", MatrixUser{JellyfinID: "bad", RoomID: "!bad:example.org", Contact: true})
+	d.app.storage.SetMatrixKey("good", MatrixUser{JellyfinID: "good", RoomID: "!good:example.org", Contact: true})
+	// The later successful send mustn't hide the earlier failure.
+	if err := d.SendByID(&Message{Text: "announcement"}, "bad", "good"); err == nil {
+		t.Error("expected error from failed send")
+	}
+	if len(sent) != 1 || sent[0] != "announcement" {
+		t.Errorf("unexpected messages sent: %v", sent)
+	}
+}
+
+func TestMatrixResetsCanBeDisallowed(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.matrix = d
+	d.app.config = ini.Empty()
+	defer func(enabled bool) { matrixEnabled = enabled }(matrixEnabled)
+	matrixEnabled = true
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org", Contact: true})
+	d.app.sendResetByID(&Message{Text: "reset"}, "jellyfin-id")
+	d.app.config.Section("password_resets").Key("allow_matrix").SetValue("false")
+	d.app.sendResetByID(&Message{Text: "disallowed reset"}, "jellyfin-id")
+	d.app.sendByID(&Message{Text: "notification"}, "jellyfin-id")
+	if len(*sent) != 2 || (*sent)[0] != "reset" || (*sent)[1] != "notification" {
+		t.Errorf("unexpected messages sent: %v", *sent)
+	}
+}
+
+func TestMatrixResetCommandRefusedWhenDisallowed(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	d.app.config.Section("password_resets").Key("allow_matrix").SetValue("false")
+	d.app.storage.lang.Matrix["en-us"].Strings["resetNotAllowed"] = "not allowed"
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!reset"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", UserID: string(evt.Sender), RoomID: string(evt.RoomID), Contact: true})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if len(*sent) != 1 || (*sent)[0] != "not allowed" {
+		t.Errorf("unexpected reply: %v", *sent)
+	}
+}
+
+func TestMatrixNotifyPreferences(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.matrix = d
+	d.app.config = ini.Empty()
+	defer func(enabled bool) { matrixEnabled = enabled }(matrixEnabled)
+	matrixEnabled = true
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!notify expiry off"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: string(evt.RoomID), Contact: true})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	prefs, _ := d.app.storage.GetNotificationPreferencesKey("jellyfin-id")
+	if prefs.Allowed(NotificationExpiry, "Matrix") || !prefs.Allowed(NotificationExpiry, "Email") {
+		t.Fatalf("unexpected preferences: %+v", prefs)
+	}
+	*sent = []string{}
+	d.app.sendByID(&Message{Text: "expiry", Notification: NotificationExpiry}, "jellyfin-id")
+	d.app.sendByID(&Message{Text: "announcement", Notification: NotificationAnnouncement}, "jellyfin-id")
+	if len(*sent) != 1 || (*sent)[0] != "announcement" {
+		t.Errorf("unexpected messages sent: %v", *sent)
+	}
+}
+
+func TestMatrixExpiryRemindersDeduplicated(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	d.reminderDays = []int{7, 1}
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org", Contact: true})
+	d.app.storage.SetUserExpiryKey("jellyfin-id", UserExpiry{Expiry: time.Now().Add(5 * 24 * time.Hour)})
+	d.sendExpiryReminders()
+	d.sendExpiryReminders()
+	if len(*sent) != 1 {
+		t.Fatalf("expected one reminder, got %v", *sent)
+	}
+	// Crossing the next threshold sends another.
+	d.app.storage.SetUserExpiryKey("jellyfin-id", UserExpiry{Expiry: time.Now().Add(12 * time.Hour)})
+	d.sendExpiryReminders()
+	d.sendExpiryReminders()
+	if len(*sent) != 2 {
+		t.Errorf("expected two reminders, got %v", *sent)
+	}
+}
+
+func TestMatrixWhoamiUnlinked(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixNotLinked"] = "not linked"
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!whoami"}))
+	if len(*sent) != 1 || (*sent)[0] != "not linked" {
+		t.Errorf("unexpected reply: %v", *sent)
+	}
+}
+
+func TestMatrixWhoamiLookupFailure(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(jf.Close)
+	d.app.jf, _ = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	d.app.storage.lang.Matrix["en-us"].Strings["whoamiFailed"] = "lookup failed"
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!whoami"})
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", UserID: string(evt.Sender), RoomID: string(evt.RoomID)})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if len(*sent) != 1 || (*sent)[0] != "lookup failed" {
+		t.Errorf("unexpected reply: %v", *sent)
+	}
+}
+
+func TestMatrixFilterRegisteredOnStartup(t *testing.T) {
+	test := newTestMatrixDaemon()
+	openTestDB(t, test)
+	app := test.app
+	var filter mautrix.Filter
+	created := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/filter") {
+			created++
+			json.NewDecoder(r.Body).Decode(&filter)
+			w.Write([]byte(`{"filter_id": "jfa-go"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/account/whoami") {
+			w.Write([]byte(`{"user_id": "@bot:example.org"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	app.config = ini.Empty()
+	app.config.Section("matrix").Key("homeserver").SetValue(srv.URL)
+	app.config.Section("matrix").Key("user_id").SetValue("@bot:example.org")
+	defer func(f func(*MatrixDaemon) error) { initMatrixCrypto = f }(initMatrixCrypto)
+	initMatrixCrypto = func(d *MatrixDaemon) error { return nil }
+	d, err := newMatrixDaemon(app)
+	if err != nil {
+		t.Fatalf("failed to start daemon: %v", err)
+	}
+	if created != 1 {
+		t.Fatalf("expected filter to be created once, got %d", created)
+	}
+	if id := d.bot.Store.LoadFilterID(d.userID); id != "jfa-go" {
+		t.Errorf("filter ID not saved, got %q", id)
+	}
+	fields := strings.Join(filter.EventFields, ",")
+	if !strings.Contains(fields, "content") || !strings.Contains(fields, "origin_server_ts") {
+		t.Errorf("filter drops fields handleMessage needs: %s", fields)
+	}
+	if err := d.registerFilter(); err != nil || created != 1 {
+		t.Errorf("expected saved filter to be reused, got %d creations (%v)", created, err)
+	}
+}
+
+func TestMatrixEditAndRedactSent(t *testing.T) {
+	d := newTestMatrixDaemon()
+	edits := []event.MessageEventContent{}
+	redacted := []string{}
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/redact/") {
+			redacted = append(redacted, r.URL.Path)
+		} else if strings.Contains(r.URL.Path, "/send/m.room.message/") {
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			if content.NewContent != nil {
+				edits = append(edits, content)
+			}
+		}
+		n++
+		fmt.Fprintf(w, `{"event_id": "$%d:example.org"}`, n)
+	}))
+	defer srv.Close()
+	d.bot, _ = mautrix.NewClient(srv.URL, d.userID, "token")
+	user := MatrixUser{RoomID: "!room:example.org", Contact: true}
+	room := id.RoomID(user.RoomID)
+	for i := 0; i < MATRIX_SENT_HISTORY+5; i++ {
+		if err := d.Send(&Message{Text: "announcement", Notification: NotificationAnnouncement}, user); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	if err := d.Send(&Message{Text: "expires soon", Notification: NotificationExpiry}, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(d.sent[room]) != MATRIX_SENT_HISTORY {
+		t.Errorf("expected history to be capped at %d, got %d", MATRIX_SENT_HISTORY, len(d.sent[room]))
+	}
+	eventID, ok := d.LastSent(room, NotificationExpiry)
+	if !ok {
+		t.Fatal("expiry message not found in history")
+	}
+	if err := d.Edit(room, eventID, &Message{Text: "expiry extended"}); err != nil {
+		t.Fatalf("failed to edit: %v", err)
+	}
+	if len(edits) != 1 || edits[0].NewContent.Body != "expiry extended" || edits[0].RelatesTo.GetReplaceID() != eventID {
+		t.Errorf("unexpected edit: %+v", edits)
+	}
+	if err := d.Redact(room, eventID, ""); err != nil {
+		t.Fatalf("failed to redact: %v", err)
+	}
+	if len(redacted) != 1 || !strings.Contains(redacted[0], string(eventID)) {
+		t.Errorf("unexpected redactions: %v", redacted)
+	}
+	if _, ok := d.LastSent(room, NotificationExpiry); ok {
+		t.Error("redacted message still in history")
+	}
+}
+
+func TestMatrixAcceptsInvitesFromExpectedUsers(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	d.acceptInvites = true
+	d.inviteAllowlist = map[string]bool{"trusted.org": true}
+	requests := []string{}
+	sent := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if strings.Contains(r.URL.Path, "/send/m.room.message/") {
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			sent = append(sent, strings.SplitN(r.URL.Path, "/", 7)[5]+" "+content.Body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"event_id": "$event:example.org", "room_id": "!joined:example.org"}`))
+	}))
+	defer srv.Close()
+	d.bot, _ = mautrix.NewClient(srv.URL, d.userID, "token")
+	invite := func(sender id.UserID, roomID id.RoomID) {
+		stateKey := string(d.userID)
+		d.handleMembership(mautrix.EventSourceInvite, &event.Event{
+			Sender:   sender,
+			Type:     event.StateMember,
+			RoomID:   roomID,
+			StateKey: &stateKey,
+			Content:  event.Content{Raw: map[string]interface{}{"membership": "invite"}},
+		})
+	}
+	joined := func(roomID id.RoomID) bool {
+		for _, path := range requests {
+			if strings.HasSuffix(path, "/rooms/"+string(roomID)+"/join") {
+				return true
+			}
+		}
+		return false
+	}
+	invite("@stranger:example.org", "!stranger:example.org")
+	if joined("!stranger:example.org") {
+		t.Error("joined room from unexpected user")
+	}
+	invite("@friend:trusted.org", "!friend:example.org")
+	if !joined("!friend:example.org") {
+		t.Error("didn't join room from allowlisted homeserver")
+	}
+	d.setToken("1234", UnverifiedUser{false, &MatrixUser{RoomID: "!created:example.org", UserID: "@user:example.org"}, "jfID", time.Now(), MediaServer{Name: "Films"}})
+	invite("@user:example.org", "!dm:example.org")
+	if !joined("!dm:example.org") {
+		t.Fatal("didn't join room from user with a pending PIN")
+	}
+	if _, ok := d.token("1234"); ok {
+		t.Error("old PIN not removed")
+	}
+	var pin string
+	for p, user := range d.tokens {
+		if user.User.RoomID == "!dm:example.org" {
+			pin = p
+			if user.JellyfinID != "jfID" {
+				t.Errorf("Jellyfin ID not carried over, got %q", user.JellyfinID)
+			}
+			if user.Server.Name != "Films" {
+				t.Errorf("server not carried over, got %+v", user.Server)
+			}
+		}
+	}
+	if pin == "" || len(sent) != 2 || !strings.Contains(sent[1], pin) || !strings.Contains(sent[1], "dm:example.org") {
+		t.Errorf("PIN not sent in the new room: %v", sent)
+	}
+}
+
+func TestMatrixSendMetrics(t *testing.T) {
+	defer func(m *sendMetrics) { notificationMetrics = m }(notificationMetrics)
+	notificationMetrics = &sendMetrics{counts: map[sendMetric]uint64{}}
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	d.cryptoFailed = true
+	d.isEncrypted["!encrypted:example.org"] = true
+	d.Send(&Message{Text: "expiring", Notification: NotificationExpiry}, MatrixUser{RoomID: "!room:example.org", Contact: true}, MatrixUser{RoomID: "!other:example.org", Contact: true})
+	d.Send(&Message{Text: "hello"}, MatrixUser{RoomID: "!encrypted:example.org", Contact: true})
+	var out strings.Builder
+	notificationMetrics.write(&out)
+	for _, line := range []string{
+		`jfa_go_notifications_sent_total{channel="matrix",type="expiry"} 2`,
+		`jfa_go_notifications_failed_total{channel="matrix",type="other"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMatrixResolveHomeserver(t *testing.T) {
+	defer func(f func(string) (*mautrix.ClientWellKnown, error)) { discoverMatrixClient = f }(discoverMatrixClient)
+	lookups := 0
+	discoverMatrixClient = func(serverName string) (*mautrix.ClientWellKnown, error) {
+		lookups++
+		switch serverName {
+		case "example.com":
+			return &mautrix.ClientWellKnown{Homeserver: mautrix.HomeserverInfo{BaseURL: "https://matrix.example.com/"}}, nil
+		case "nowellknown.org":
+			return nil, nil
+		}
+		return nil, errors.New("connection refused")
+	}
+	for in, want := range map[string]string{
+		"https://matrix.example.org/": "https://matrix.example.org",
+		"example.com":                 "https://matrix.example.com",
+		"nowellknown.org":             "https://nowellknown.org",
+	} {
+		if got, err := resolveHomeserver(in); err != nil || got != want {
+			t.Errorf("resolveHomeserver(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := resolveHomeserver("broken.net"); err == nil || !strings.Contains(err.Error(), "broken.net") {
+		t.Errorf("expected discovery error mentioning the domain, got %v", err)
+	}
+	lookups = 0
+	resolveHomeserver("example.com")
+	if lookups != 0 {
+		t.Error("resolved homeserver not cached")
+	}
+}
+
+func TestMatrixNewInvite(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	d.app.config.Section("invite_emails").Key("url_base").SetValue("https://example.org/invite")
+	d.app.storage.lang.Matrix["en-us"].Strings["inviteNotAllowed"] = "not allowed"
+	d.app.storage.lang.Matrix["en-us"].Strings["newInvite"] = "{link}"
+	d.app.storage.SetMatrixKey("jfID", MatrixUser{JellyfinID: "jfID", RoomID: "!room:example.org"})
+	d.app.storage.SetInvitesKey("template", Invite{Code: "template", RemainingUses: 1, Created: time.Now(), ValidTill: time.Now().Add(time.Hour)})
+	d.app.storage.SetEmailsKey("jfID", EmailAddress{JellyfinID: "jfID", ReferralTemplateKey: "template"})
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!invite"})
+	d.commandNewInvite(evt, []string{"!invite"}, "en-us")
+	d.app.config.Section("user_page").Key("referrals").SetValue("true")
+	d.commandNewInvite(evt, []string{"!invite"}, "en-us")
+	inv, err := d.app.referral("jfID")
+	if err != nil {
+		t.Fatalf("referral not created: %v", err)
+	}
+	if len(*sent) != 2 || (*sent)[0] != "not allowed" || (*sent)[1] != "https://example.org/invite/"+inv.Code {
+		t.Errorf("unexpected replies: %v", *sent)
+	}
+}
+
+func TestMatrixShutdownDrainsSends(t *testing.T) {
+	d := newTestMatrixDaemon()
+	received := make(chan struct{})
+	release := make(chan struct{})
+	order := []string{}
+	var orderLock sync.Mutex
+	record := func(step string) {
+		orderLock.Lock()
+		order = append(order, step)
+		orderLock.Unlock()
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/send/") {
+			close(received)
+			<-release
+			record("sent")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	d.bot, _ = mautrix.NewClient(srv.URL, d.userID, "token")
+	defer func(f func(*MatrixDaemon)) { shutdownMatrixCrypto = f }(shutdownMatrixCrypto)
+	shutdownMatrixCrypto = func(d *MatrixDaemon) { record("crypto") }
+	sendDone := make(chan error)
+	go func() {
+		sendDone <- d.sendToRoom(&event.MessageEventContent{MsgType: event.MsgNotice, Body: "in flight"}, "!room:example.org")
+	}()
+	<-received
+	shutdownDone := make(chan struct{})
+	go func() {
+		d.Shutdown()
+		close(shutdownDone)
+	}()
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the send finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-sendDone; err != nil {
+		t.Errorf("in-flight send failed: %v", err)
+	}
+	<-shutdownDone
+	if len(order) != 2 || order[0] != "sent" {
+		t.Errorf("crypto shut down before send completed: %v", order)
+	}
+	if err := d.sendToRoom(&event.MessageEventContent{MsgType: event.MsgNotice, Body: "late"}, "!room:example.org"); err != ErrMatrixStopped {
+		t.Errorf("expected send after shutdown to fail with ErrMatrixStopped, got %v", err)
+	}
+}
+
+func TestMatrixPlainOnlyOmitsFormatting(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	formatted := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/send/m.room.message/") {
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			formatted[strings.SplitN(r.URL.Path, "/", 7)[5]] = content.FormattedBody
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	defer srv.Close()
+	d.bot, _ = mautrix.NewClient(srv.URL, d.userID, "token")
+	d.app.storage.SetMatrixKey("plain", MatrixUser{JellyfinID: "plain", RoomID: "!plain:example.org", Contact: true})
+	d.app.storage.SetMatrixKey("rich", MatrixUser{JellyfinID: "rich", RoomID: "!rich:example.org", Contact: true})
+	d.commandFormat(&event.Event{Sender: "@user:example.org", RoomID: "!plain:example.org"}, []string{"!format", "plain"}, "en-us")
+	if user, _ := d.app.storage.GetMatrixKey("plain"); !user.PlainOnly {
+		t.Fatal("plain preference not saved")
+	}
+	if sent, _ := d.Broadcast(&Message{Text: "bold", Markdown: "**bold**"}); sent != 2 {
+		t.Fatalf("expected 2 rooms sent to, got %d", sent)
+	}
+	if formatted["!plain:example.org"] != "" {
+		t.Errorf("formatted body sent to plain room: %q", formatted["!plain:example.org"])
+	}
+	if !strings.Contains(formatted["!rich:example.org"], "<strong>bold</strong>") {
+		t.Errorf("formatted body missing from rich room: %q", formatted["!rich:example.org"])
+	}
+}
+
+func TestMatrixDecryptionFailureNotifiesOncePerSession(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.undecryptable = map[id.RoomID]string{}
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixDecryptionFailed"] = "couldn't read that"
+	encrypted := func(sessionID string) *event.Event {
+		evt := newTestMatrixEvent(d, map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2", "session_id": sessionID})
+		evt.Type = event.EventEncrypted
+		return evt
+	}
+	d.handleDecryptionFailure(encrypted("a"), errors.New("no session"))
+	if len(*sent) != 0 {
+		t.Fatalf("notified user without notify_decryption_failures: %v", *sent)
+	}
+	d.decryptNotice = true
+	d.handleDecryptionFailure(encrypted("a"), errors.New("no session"))
+	d.handleDecryptionFailure(encrypted("a"), errors.New("no session"))
+	d.handleDecryptionFailure(encrypted("b"), errors.New("no session"))
+	if len(*sent) != 2 || (*sent)[0] != "couldn't read that" {
+		t.Errorf("expected one notice per session, got %v", *sent)
+	}
+}
+
+func TestMatrixSendTest(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixTestMessage"] = "test"
+	d.app.storage.SetMatrixKey("jfID", MatrixUser{JellyfinID: "jfID", UserID: "@linked:example.org", RoomID: "!linked:example.org"})
+	if _, _, _, err := d.SendTest("not a user"); err != ErrInvalidMatrixUserID {
+		t.Errorf("expected invalid user ID error, got %v", err)
+	}
+	roomID, created, _, err := d.SendTest("@linked:example.org")
+	if err != nil || created || roomID != "!linked:example.org" {
+		t.Errorf("linked room not reused: %s, %t, %v", roomID, created, err)
+	}
+	roomID, created, _, err = d.SendTest("@new:example.org")
+	if err != nil || !created || roomID != "!new:example.org" {
+		t.Errorf("room not created for unlinked user: %s, %t, %v", roomID, created, err)
+	}
+	if len(*sent) != 2 || (*sent)[0] != "test" {
+		t.Errorf("unexpected messages sent: %v", *sent)
+	}
+}
+
+func TestMatrixExpiryPluralized(t *testing.T) {
+	d := newTestMatrixDaemon()
+	en := d.app.storage.lang.Matrix["en-us"]
+	en.Strings["accountExpiryDays"] = "expires in {days}"
+	en.QuantityStrings = map[string]quantityString{"days": {Singular: "{n} day", Plural: "{n} days"}}
+	d.app.storage.lang.Matrix["en-us"] = en
+	if got := d.app.expiryMessage(d.app.storage.lang.Matrix["en-us"], time.Now().Add(20*time.Hour)); got != "expires in 1 day" {
+		t.Errorf("unexpected singular: %q", got)
+	}
+	if got := d.app.expiryMessage(d.app.storage.lang.Matrix["en-us"], time.Now().Add(71*time.Hour)); got != "expires in 3 days" {
+		t.Errorf("unexpected plural: %q", got)
+	}
+	if got := (quantityString{Singular: "{n} day"}).get(2); got != "2 day" {
+		t.Errorf("expected fallback to singular, got %q", got)
+	}
+}
+
+func TestMatrixCommandRateLimit(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.registerCommands()
+	d.commandRate = 1.0 / 60
+	d.commandBurst = 3
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixRateLimited"] = "slow down"
+	for i := 0; i < 10; i++ {
+		d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!help"}))
+	}
+	if len(*sent) != 4 || (*sent)[3] != "slow down" {
+		t.Fatalf("expected 3 replies and one warning, got %v", *sent)
+	}
+	other := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!help"})
+	other.RoomID = "!other:example.org"
+	d.handleMessage(mautrix.EventSourceTimeline, other)
+	if len(*sent) != 5 {
+		t.Errorf("other room was limited too: %v", *sent)
+	}
+	if allowed, _ := d.allowCommand("!room:example.org", time.Now().Add(time.Minute)); !allowed {
+		t.Error("bucket didn't refill over time")
+	}
+}
+
+func TestMatrixUpdateProfileOnlyWhenChanged(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.media = map[string]id.ContentURI{}
+	profile := map[string]string{"displayname": "Old name", "avatar_url": ""}
+	accountData := "{}"
+	uploads := 0
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/upload"):
+			uploads++
+			w.Write([]byte(fmt.Sprintf(`{"content_uri": "mxc://example.org/avatar%d"}`, uploads)))
+		case strings.Contains(r.URL.Path, "/account_data/"):
+			if r.Method == http.MethodPut {
+				data, _ := io.ReadAll(r.Body)
+				accountData = string(data)
+			}
+			w.Write([]byte(accountData))
+		case strings.Contains(r.URL.Path, "/profile/"):
+			field := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			if r.Method == http.MethodPut {
+				body := map[string]string{}
+				json.NewDecoder(r.Body).Decode(&body)
+				profile[field] = body[field]
+			}
+			w.Write([]byte(fmt.Sprintf(`{%q: %q}`, field, profile[field])))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	path := t.TempDir() + "/avatar.png"
+	os.WriteFile(path, []byte("image"), 0600)
+	d.displayName, d.avatar = "jfa-go", path
+
+	d.updateProfile()
+	if profile["displayname"] != "jfa-go" || profile["avatar_url"] != "mxc://example.org/avatar1" {
+		t.Fatalf("profile not updated: %v", profile)
+	}
+	// A restart with the same config shouldn't upload the avatar again.
+	d.media = map[string]id.ContentURI{}
+	d.updateProfile()
+	if uploads != 1 {
+		t.Errorf("unchanged avatar uploaded again, %d uploads", uploads)
+	}
+	os.WriteFile(path, []byte("new image"), 0600)
+	d.media = map[string]id.ContentURI{}
+	d.updateProfile()
+	if uploads != 2 || profile["avatar_url"] != "mxc://example.org/avatar2" {
+		t.Errorf("changed avatar not uploaded: %d uploads, %v", uploads, profile)
+	}
+}
+
+func TestMatrixLocaleSetsJellyfinLanguage(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["localeSet"] = "set {locale}"
+	en["localeNotFound"] = "unknown {locale}"
+	d.app.storage.SetMatrixKey("jfID", MatrixUser{JellyfinID: "jfID", UserID: "@user:example.org", RoomID: "!room:example.org"})
+	var saved map[string]interface{}
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/Localization/Options":
+			w.Write([]byte(`[{"Name": "English", "Value": "en-US"}, {"Name": "Français", "Value": "fr"}]`))
+		case strings.HasPrefix(r.URL.Path, "/DisplayPreferences/") && r.Method == http.MethodPost:
+			json.NewDecoder(r.Body).Decode(&saved)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/DisplayPreferences/"):
+			w.Write([]byte(`{"Id": "usersettings", "CustomPrefs": {"homesection0": "smalllibrarytiles"}}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(jf.Close)
+	var err error
+	d.app.jf, err = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	if err != nil {
+		t.Fatalf("failed to create Jellyfin client: %v", err)
+	}
+	d.commandLocale(newTestMatrixEvent(d, nil), []string{"!locale", "xx"}, "en-us")
+	if saved != nil || len(*sent) != 1 || (*sent)[0] != "unknown xx" {
+		t.Fatalf("unknown locale not rejected: %v, %v", saved, *sent)
+	}
+	d.commandLocale(newTestMatrixEvent(d, nil), []string{"!locale", "FR"}, "en-us")
+	prefs, _ := saved["CustomPrefs"].(map[string]interface{})
+	if prefs["language"] != "fr" || prefs["homesection0"] != "smalllibrarytiles" {
+		t.Errorf("locale not saved alongside existing prefs: %v", saved)
+	}
+	if len(*sent) != 2 || (*sent)[1] != "set fr" {
+		t.Errorf("unexpected replies: %v", *sent)
+	}
+}
+
+func TestMatrixContactRelaysReplies(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(jf.Close)
+	d.app.jf, _ = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	d.contactTarget, d.contactWait = "!admins:example.org", time.Minute
+	d.lastContact, d.contacts = map[id.RoomID]time.Time{}, map[id.EventID]id.RoomID{}
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["contactForward"] = "from {username}: {message}"
+	en["contactSent"] = "sent"
+	en["contactCooldown"] = "wait"
+	en["contactReply"] = "reply: {message}"
+	d.app.storage.SetMatrixKey("jfID", MatrixUser{JellyfinID: "jfID", UserID: "@user:example.org", RoomID: "!room:example.org"})
+
+	// Messages which look like settings are still forwarded.
+	d.commandContact(newTestMatrixEvent(d, nil), []string{"!contact", "off"}, "en-us")
+	d.commandContact(newTestMatrixEvent(d, nil), []string{"!contact", "again"}, "en-us")
+	if len(*sent) != 3 || (*sent)[0] != "from jfID: off" || (*sent)[1] != "sent" || (*sent)[2] != "wait" {
+		t.Fatalf("unexpected messages: %v", *sent)
+	}
+	reply := newTestMatrixEvent(d, nil)
+	reply.RoomID, reply.Sender = "!admins:example.org", "@admin:example.org"
+	reply.Content.Parsed = &event.MessageEventContent{
+		MsgType:   event.MsgText,
+		Body:      "> <@jfa-bot:example.org> from jfID: help me\n\nsure",
+		RelatesTo: (&event.RelatesTo{}).SetReplyTo("$event:example.org"),
+	}
+	if !d.relayContactReply(reply, "") {
+		t.Fatal("reply to forwarded message not relayed")
+	}
+	if len(*sent) != 4 || (*sent)[3] != "reply: sure" {
+		t.Errorf("unexpected relayed reply: %v", *sent)
+	}
+	reply.Content.Parsed = &event.MessageEventContent{MsgType: event.MsgText, Body: "unrelated"}
+	if d.relayContactReply(reply, "unrelated") {
+		t.Error("unrelated message relayed")
+	}
+}
+
+func TestMatrixImminentExpiryBypassesMute(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	d.reminderDays = []int{7, 1}
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org", Contact: true, Muted: true})
+	d.app.storage.SetUserExpiryKey("jellyfin-id", UserExpiry{Expiry: time.Now().Add(5 * 24 * time.Hour)})
+	d.sendExpiryReminders()
+	if len(*sent) != 0 {
+		t.Fatalf("routine reminder sent to muted user: %v", *sent)
+	}
+	d.app.storage.SetUserExpiryKey("jellyfin-id", UserExpiry{Expiry: time.Now().Add(12 * time.Hour)})
+	d.sendExpiryReminders()
+	if len(*sent) != 1 {
+		t.Errorf("imminent expiry not sent to muted user: %v", *sent)
+	}
+}
+
+func TestMatrixStartupChecksToken(t *testing.T) {
+	test := newTestMatrixDaemon()
+	app := test.app
+	whoami := `{"user_id": "@other:example.org"}`
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/account/whoami") {
+			w.WriteHeader(status)
+			w.Write([]byte(whoami))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	app.config = ini.Empty()
+	app.config.Section("matrix").Key("homeserver").SetValue(srv.URL)
+	app.config.Section("matrix").Key("user_id").SetValue("@bot:example.org")
+	defer func(f func(*MatrixDaemon) error) { initMatrixCrypto = f }(initMatrixCrypto)
+	initMatrixCrypto = func(d *MatrixDaemon) error { return nil }
+	if _, err := newMatrixDaemon(app); err == nil || !strings.Contains(err.Error(), "@other:example.org") {
+		t.Errorf("expected mismatched user ID error, got %v", err)
+	}
+	whoami, status = `{"errcode": "M_UNKNOWN_TOKEN", "error": "Token revoked by admin"}`, http.StatusUnauthorized
+	if _, err := newMatrixDaemon(app); err == nil || !strings.Contains(err.Error(), "Token revoked by admin") {
+		t.Errorf("expected homeserver's error message, got %v", err)
+	}
+}
+
+func TestMatrixVerifySendsLinkedSummary(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Name": "alice", "Id": "jfID"}`))
+	}))
+	t.Cleanup(jf.Close)
+	d.app.jf, _ = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["matrixVerified"] = "linked"
+	en["matrixLinkedSummary"] = "as {username} in {language}"
+	en["roomEncrypted"] = "encrypted"
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!verify A1-B2-C3"})
+	d.isEncrypted[evt.RoomID] = true
+	d.tokens["A1-B2-C3"] = UnverifiedUser{JellyfinID: "jfID", User: &MatrixUser{UserID: string(evt.Sender), RoomID: string(evt.RoomID)}, Created: time.Now()}
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if len(*sent) != 1 {
+		t.Fatalf("expected one reply, got %v", *sent)
+	}
+	for _, want := range []string{"linked", "as alice in English (US)", "encrypted", "!help"} {
+		if !strings.Contains((*sent)[0], want) {
+			t.Errorf("summary missing %q: %q", want, (*sent)[0])
+		}
+	}
+}
+
+func TestMatrixLangFallsBackToTelegram(t *testing.T) {
+	st := Storage{}
+	st.lang.TelegramPath, st.lang.MatrixPath = "telegram", "matrix"
+	files := fstest.MapFS{
+		"telegram/en-us.json": {Data: []byte(`{"meta": {"name": "English"}, "strings": {"a": "telegram a", "b": "telegram b"}}`)},
+		"telegram/fr-fr.json": {Data: []byte(`{"meta": {"name": "Français"}, "strings": {"a": "telegram fr a"}}`)},
+		"matrix/en-us.json":   {Data: []byte(`{"strings": {"b": "matrix b", "c": "matrix c"}}`)},
+		"matrix/fr-fr.json":   {Data: []byte(`{"strings": {"b": "matrix fr b"}}`)},
+	}
+	if err := st.loadLangTelegram(files); err != nil {
+		t.Fatalf("failed to load Telegram strings: %v", err)
+	}
+	if err := st.loadLangMatrix(files); err != nil {
+		t.Fatalf("failed to load Matrix strings: %v", err)
+	}
+	want := map[string]langSection{
+		"en-us": {"a": "telegram a", "b": "matrix b", "c": "matrix c"},
+		"fr-fr": {"a": "telegram fr a", "b": "matrix fr b", "c": "matrix c"},
+	}
+	for lang, strs := range want {
+		for k, v := range strs {
+			if got := st.lang.Matrix[lang].Strings[k]; got != v {
+				t.Errorf("%s %s: expected %q, got %q", lang, k, v, got)
+			}
+		}
+	}
+	if st.lang.Matrix["fr-fr"].Meta.Name != "Français" || st.lang.Telegram["en-us"].Strings["b"] != "telegram b" {
+		t.Error("Telegram strings changed, or Matrix metadata not copied from them")
+	}
+}
+
+func TestMatrixReadReceiptConfirmsDelivery(t *testing.T) {
+	d := newTestMatrixDaemon()
+	newTestMatrixHomeserver(t, d)
+	d.deliveryTimeout = 50 * time.Millisecond
+	results := make(chan bool, 2)
+	msg := &Message{Text: "reset", OnMatrixRead: func(user MatrixUser, read bool) { results <- read }}
+	user := MatrixUser{UserID: "@user:example.org", RoomID: "!room:example.org", Contact: true}
+	if err := d.Send(msg, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	receipt := &event.Event{
+		Type:    event.EphemeralEventReceipt,
+		RoomID:  "!room:example.org",
+		Content: event.Content{Parsed: &event.ReceiptEventContent{}},
+	}
+	// The bot's own receipt doesn't count.
+	receipt.Content.AsReceipt().Set("$event:example.org", event.ReceiptTypeRead, d.userID, event.ReadReceipt{})
+	d.handleReceipt(mautrix.EventSourceEphemeral, receipt)
+	receipt.Content.AsReceipt().Set("$event:example.org", event.ReceiptTypeRead, "@user:example.org", event.ReadReceipt{})
+	d.handleReceipt(mautrix.EventSourceEphemeral, receipt)
+	if read := <-results; !read {
+		t.Error("receipt not counted as read")
+	}
+	if err := d.Send(msg, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	select {
+	case read := <-results:
+		if read {
+			t.Error("unread message reported as read")
+		}
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for unread callback")
+	}
+	time.Sleep(2 * d.deliveryTimeout)
+	if len(results) != 0 {
+		t.Error("callback called more than once")
+	}
+}
+
+func TestMatrixReceiptMatchesRecipient(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.deliveryTimeout = time.Minute
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/event/$earlier"):
+			fmt.Fprintf(w, `{"event_id": "$earlier:example.org", "origin_server_ts": %d}`, time.Now().Add(-time.Hour).UnixMilli())
+		case strings.Contains(r.URL.Path, "/event/$later"):
+			fmt.Fprintf(w, `{"event_id": "$later:example.org", "origin_server_ts": %d}`, time.Now().Add(time.Hour).UnixMilli())
+		default:
+			w.Write([]byte(`{"event_id": "$event:example.org"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	results := make(chan bool, 1)
+	msg := &Message{Text: "reset", OnMatrixRead: func(user MatrixUser, read bool) { results <- read }}
+	if err := d.Send(msg, MatrixUser{UserID: "@user:example.org", RoomID: "!room:example.org", Contact: true}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	receive := func(eventID id.EventID, userID id.UserID) bool {
+		receipt := &event.Event{
+			Type:    event.EphemeralEventReceipt,
+			RoomID:  "!room:example.org",
+			Content: event.Content{Parsed: &event.ReceiptEventContent{}},
+		}
+		receipt.Content.AsReceipt().Set(eventID, event.ReceiptTypeRead, userID, event.ReadReceipt{Timestamp: time.Now()})
+		d.handleReceipt(mautrix.EventSourceEphemeral, receipt)
+		return len(results) != 0
+	}
+	if receive("$event:example.org", "@other:example.org") {
+		t.Error("another member's receipt counted")
+	}
+	if receive("$earlier:example.org", "@user:example.org") {
+		t.Error("receipt for an earlier event counted")
+	}
+	if !receive("$later:example.org", "@user:example.org") {
+		t.Error("receipt for a later event not counted")
+	}
+}
+
+func TestMatrixResendReplacesPIN(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.pinExpiry = time.Minute
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixNoPendingPIN"] = "no PIN"
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!resend"})
+	d.tokens["OLD"] = UnverifiedUser{User: &MatrixUser{UserID: string(evt.Sender), RoomID: string(evt.RoomID)}, JellyfinID: "jfID", Created: time.Now()}
+	d.tokens["OTHER"] = UnverifiedUser{User: &MatrixUser{RoomID: "!other:example.org"}, Created: time.Now()}
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if _, ok := d.tokens["OLD"]; ok {
+		t.Error("old PIN still valid")
+	}
+	if _, ok := d.tokens["OTHER"]; !ok {
+		t.Error("other room's PIN removed")
+	}
+	var pin string
+	for p, token := range d.tokens {
+		if token.User.RoomID == string(evt.RoomID) {
+			pin = p
+			if token.JellyfinID != "jfID" {
+				t.Errorf("new PIN lost the pending Jellyfin ID: %+v", token)
+			}
+		}
+	}
+	if pin == "" || len(*sent) != 1 || !strings.Contains((*sent)[0], pin) {
+		t.Fatalf("new PIN not sent: %q, %v", pin, *sent)
+	}
+	// Expired PINs aren't replaced.
+	token := d.tokens[pin]
+	token.Created = time.Now().Add(-time.Hour)
+	d.tokens[pin] = token
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!resend"}))
+	if len(*sent) != 2 || (*sent)[1] != "no PIN" {
+		t.Errorf("expected expired PIN to be refused, got %v", *sent)
+	}
+}
+
+func TestMatrixWelcomeTemplate(t *testing.T) {
+	d := newTestMatrixDaemon()
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["matrixStartMessage"] = "Hi"
+	en["matrixVerifyMessage"] = "or send {command} <PIN>"
+	en["matrixSignupLink"] = "Sign up"
+	content := d.welcomeContent("en-us", "A1-B2-C3")
+	if content.Body != "Hi\n\nA1-B2-C3\n\nor send !verify <PIN>\n\n" || content.FormattedBody != "" {
+		t.Errorf("default layout changed: %q, %q", content.Body, content.FormattedBody)
+	}
+	d.welcomeTemplate = "Welcome to {serverName}!\nPIN: {pin}{signupLink}\nChange language with {langCommand}."
+	d.signupURL = "https://example.org/signup"
+	content = d.welcomeContent("en-us", "A1-B2-C3")
+	if content.Body != "Welcome to !\nPIN: A1-B2-C3\nhttps://example.org/signup?pin=A1-B2-C3\nChange language with !lang." {
+		t.Errorf("unexpected body: %q", content.Body)
+	}
+	want := `<p>Welcome to !<br>PIN: A1-B2-C3<br><a href="https://example.org/signup?pin=A1-B2-C3">Sign up</a><br>Change language with !lang.</p>`
+	if content.FormattedBody != want {
+		t.Errorf("unexpected formatted body: %q", content.FormattedBody)
+	}
+}
+
+func TestMatrixLogoUploadedOnce(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.media = map[string]id.ContentURI{}
+	uploads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"content_uri": "mxc://example.org/logo"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	d.logo = t.TempDir() + "/logo.png"
+	os.WriteFile(d.logo, []byte("image"), 0600)
+
+	for i := 0; i < 2; i++ {
+		content := d.messageContent(&Message{Text: "news", Notification: NotificationAnnouncement}, event.MsgNotice)
+		if want := `<img src="mxc://example.org/logo" alt="Logo" height="48"><p>news</p>`; content.FormattedBody != want {
+			t.Errorf("unexpected formatted body: %q", content.FormattedBody)
+		}
+	}
+	if uploads != 1 {
+		t.Errorf("logo uploaded %d times", uploads)
+	}
+	if content := d.messageContent(&Message{Text: "expiring", Notification: NotificationExpiry}, event.MsgNotice); content.FormattedBody != "" {
+		t.Errorf("logo added to expiry message: %q", content.FormattedBody)
+	}
+	if content := d.welcomeContent("en-us", "A1-B2-C3"); !strings.HasPrefix(content.FormattedBody, `<img src="mxc://example.org/logo"`) {
+		t.Errorf("logo missing from PIN message: %q", content.FormattedBody)
+	}
+}
+
+func TestMatrixImageLimits(t *testing.T) {
+	if got, want := linkImages("![a](/etc/passwd) ![b](https://example.org/b.png) ![c](mxc://example.org/c)"), "[a](/etc/passwd) [b](https://example.org/b.png) ![c](mxc://example.org/c)"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	d := newTestMatrixDaemon()
+	d.media = map[string]id.ContentURI{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big.png":
+			// Sent chunked, so the size is only known once it's read.
+			for i := 0; i <= MATRIX_MAX_IMAGE_SIZE/1024; i++ {
+				w.Write(make([]byte, 1024))
+			}
+		case "/small.png":
+			w.Write([]byte("image"))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"content_uri": "mxc://example.org/image"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := d.uploadImage(srv.URL + "/big.png"); !errors.Is(err, ErrMatrixImageTooLarge) {
+		t.Errorf("expected large download to fail, got %v", err)
+	}
+	big := t.TempDir() + "/big.png"
+	f, _ := os.Create(big)
+	f.Truncate(MATRIX_MAX_IMAGE_SIZE + 1)
+	f.Close()
+	if _, err := d.uploadImage(big); !errors.Is(err, ErrMatrixImageTooLarge) {
+		t.Errorf("expected large file to fail, got %v", err)
+	}
+
+	for i := 0; i < MATRIX_MEDIA_CACHE_SIZE+5; i++ {
+		if _, err := d.uploadImage(fmt.Sprintf("%s/small.png?%d", srv.URL, i)); err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+	}
+	if len(d.media) > MATRIX_MEDIA_CACHE_SIZE {
+		t.Errorf("cache grew to %d entries", len(d.media))
+	}
+}
+
+func TestMatrixUnreachableRoomUnlinked(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.maxRetries = 0
+	openTestDB(t, d)
+	sends := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/send/") {
+			sends++
+		}
+		if strings.Contains(r.URL.Path, "gone") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "User not in room"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	gone := MatrixUser{RoomID: "!gone:example.org", UserID: "@gone:example.org", Contact: true, JellyfinID: "gone"}
+	d.app.storage.SetMatrixKey("gone", gone)
+	d.app.storage.SetMatrixKey("here", MatrixUser{RoomID: "!room:example.org", Contact: true, JellyfinID: "here"})
+
+	if err := d.Send(&Message{Text: "test"}, gone); err == nil {
+		t.Fatal("send to removed room succeeded")
+	}
+	if _, ok := d.app.storage.GetMatrixKey("gone"); ok {
+		t.Error("unreachable user still linked")
+	}
+	if _, ok := d.app.storage.GetMatrixKey("here"); !ok {
+		t.Error("reachable user unlinked")
+	}
+	sends = 0
+	if sent, failed := d.Broadcast(&Message{Text: "test"}); sent != 1 || len(failed) != 0 || sends != 1 {
+		t.Errorf("removed room still sent to: sent %d, failed %v, %d requests", sent, failed, sends)
+	}
+}
+
+func TestMatrixGetUsersAndUnlink(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	left := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/leave") {
+			left <- r.URL.Path
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"Id": "jellyfin-id", "Name": "user"}]`))
+	}))
+	t.Cleanup(jf.Close)
+	d.app.jf, err = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	if err != nil {
+		t.Fatalf("failed to create Jellyfin client: %v", err)
+	}
+	d.app.matrix = d
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Lang: "en-us", Encrypted: true, JellyfinID: "jellyfin-id"})
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(w)
+	gc.Request = httptest.NewRequest(http.MethodGet, "/matrix/users", nil)
+	d.app.MatrixGetUsers(gc)
+	resp := MatrixUsersDTO{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	want := MatrixUserDTO{JellyfinID: "jellyfin-id", Username: "user", MatrixID: "@user:example.org", RoomID: "!room:example.org", Encrypted: true, Lang: "en-us"}
+	if len(resp.Users) != 1 || resp.Users[0] != want {
+		t.Fatalf("unexpected users: %+v", resp.Users)
+	}
+
+	matrixEnabled = true
+	t.Cleanup(func() { matrixEnabled = false })
+	// Another account linked in the same room keeps it, so the bot mustn't leave.
+	d.app.storage.SetMatrixKey("other-id", MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", JellyfinID: "other-id"})
+	w = httptest.NewRecorder()
+	gc, _ = gin.CreateTestContext(w)
+	gc.Request = httptest.NewRequest(http.MethodDelete, "/users/matrix", strings.NewReader(`{"id": "jellyfin-id"}`))
+	d.app.UnlinkMatrix(gc)
+	if _, ok := d.app.storage.GetMatrixKey("jellyfin-id"); ok {
+		t.Error("user still linked")
+	}
+	if _, ok := d.app.storage.GetMatrixKey("other-id"); !ok {
+		t.Error("other account in the room unlinked")
+	}
+	select {
+	case path := <-left:
+		t.Fatalf("left room still used by another account: %s", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	w = httptest.NewRecorder()
+	gc, _ = gin.CreateTestContext(w)
+	gc.Request = httptest.NewRequest(http.MethodDelete, "/users/matrix", strings.NewReader(`{"id": "other-id"}`))
+	d.app.UnlinkMatrix(gc)
+	select {
+	case path := <-left:
+		if !strings.Contains(path, "!room:example.org") {
+			t.Errorf("left wrong room: %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("bot didn't leave the room")
+	}
+}
+
+func TestMatrixBroadcastAttemptsAllRooms(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.maxRetries = 0
+	d.broadcastWorkers = 3
+	openTestDB(t, d)
+	attempted := map[string]bool{}
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.URL.Path, "/send/") {
+			w.Write([]byte("{}"))
+			return
+		}
+		lock.Lock()
+		attempted[strings.Split(r.URL.Path, "/")[5]] = true
+		lock.Unlock()
+		if strings.Contains(r.URL.Path, "broken") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Internal error"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		room := fmt.Sprintf("!room%d:example.org", i)
+		if i%3 == 0 {
+			room = fmt.Sprintf("!broken%d:example.org", i)
+		}
+		d.app.storage.SetMatrixKey(fmt.Sprint(i), MatrixUser{RoomID: room, JellyfinID: fmt.Sprint(i), Contact: true})
+	}
+	sent, failed := d.Broadcast(&Message{Text: "test"})
+	if sent != 6 || len(failed) != 4 {
+		t.Errorf("unexpected result: sent %d, failed %v", sent, failed)
+	}
+	if len(attempted) != 10 {
+		t.Errorf("only %d of 10 rooms attempted: %v", len(attempted), attempted)
+	}
+}
+
+func TestMatrixMatchLang(t *testing.T) {
+	d := newTestMatrixDaemon()
+	for code, name := range map[string]string{"en": "English", "en-gb": "English (UK)", "de-de": "Deutsch", "fr-fr": "Français (FR)"} {
+		d.app.storage.lang.Matrix[code] = telegramLang{Meta: langMeta{Name: name}}
+	}
+	tests := []struct {
+		input   string
+		code    string
+		options []string
+	}{
+		{"en-us", "en-us", nil},
+		{"EN_GB", "en-gb", nil},
+		{"en", "en", nil}, // Exact matches win, even if they're also a prefix of others.
+		{"de", "de-de", nil},
+		{"fran", "fr-fr", nil},
+		{"en-", "", []string{"en-gb", "en-us"}},
+		{"english", "", []string{"en", "en-gb", "en-us"}},
+		{"xx", "", nil},
+	}
+	for _, test := range tests {
+		code, options := d.matchLang(test.input)
+		if code != test.code || fmt.Sprint(options) != fmt.Sprint(test.options) {
+			t.Errorf("%q: got %q %v, want %q %v", test.input, code, options, test.code, test.options)
+		}
+	}
+}
+
+func TestMatrixCommandReactions(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	reactions, messages := []string{}, 0
+	rejectReactions := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/send/m.reaction/"):
+			if rejectReactions {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized event type"}`))
+				return
+			}
+			content := event.ReactionEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			if content.RelatesTo.EventID != "$command:example.org" {
+				t.Errorf("reaction to wrong event: %+v", content.RelatesTo)
+			}
+			reactions = append(reactions, content.RelatesTo.Key)
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			messages++
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	d.reactCommands = map[string]bool{"mute": true}
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!mute"})
+	evt.ID = "$command:example.org"
+
+	d.commandMute(evt, []string{"!mute"}, "en-us")
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{RoomID: string(evt.RoomID), JellyfinID: "jellyfin-id"})
+	d.commandMute(evt, []string{"!mute"}, "en-us")
+	if fmt.Sprint(reactions) != "[❌ ✅]" || messages != 0 {
+		t.Errorf("unexpected acknowledgements: reactions %v, %d messages", reactions, messages)
+	}
+	// Commands not listed still get text.
+	d.commandUnmute(evt, []string{"!unmute"}, "en-us")
+	if len(reactions) != 2 || messages != 1 {
+		t.Errorf("unmute not acknowledged with text: reactions %v, %d messages", reactions, messages)
+	}
+	rejectReactions = true
+	d.commandMute(evt, []string{"!mute"}, "en-us")
+	if messages != 2 {
+		t.Error("no text fallback when reaction failed")
+	}
+	rejectReactions = false
+	d.isEncrypted[evt.RoomID] = true
+	d.Encryption = false
+	d.commandMute(evt, []string{"!mute"}, "en-us")
+	if len(reactions) != 2 || messages != 3 {
+		t.Errorf("reaction sent in encrypted room: reactions %v, %d messages", reactions, messages)
+	}
+}
+
+func TestMatrixSyncResumesFromSavedToken(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.syncTimeout = 5 * time.Second
+	d.skipInitialSync = true
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/filter") {
+			w.Write([]byte(`{"filter_id": "jfa-go"}`))
+			return
+		}
+		requests = append(requests, r.URL.Query().Get("since")+"@"+r.URL.Query().Get("timeout"))
+		n := len(requests)
+		w.Write([]byte(fmt.Sprintf(`{"next_batch": "s%d", "rooms": {"join": {"!room:example.org": {"timeline": {"events": [
+			{"type": "m.room.message", "event_id": "$%d", "sender": "@user:example.org", "origin_server_ts": 1, "content": {"msgtype": "m.text", "body": "hi"}}
+		]}}}}}`, n, n)))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	var processed []id.EventID
+	var cancel context.CancelFunc
+	d.bot.Syncer.(*mautrix.DefaultSyncer).OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
+		processed = append(processed, evt.ID)
+		cancel()
+	})
+	sync := func() {
+		d.bot.Store = &matrixSyncStore{MemorySyncStore: mautrix.NewMemorySyncStore(), storage: &d.app.storage}
+		requests, processed = nil, nil
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		if err := d.sync(ctx); err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+	}
+
+	// The first response is history from before the bot's first start, so isn't processed.
+	sync()
+	if fmt.Sprint(requests) != "[@5000 s1@5000]" || fmt.Sprint(processed) != "[$2]" {
+		t.Errorf("unexpected first start: requests %v, processed %v", requests, processed)
+	}
+	// A restart resumes from the saved token, without skipping anything.
+	sync()
+	if fmt.Sprint(requests) != "[s2@5000]" || fmt.Sprint(processed) != "[$1]" {
+		t.Errorf("didn't resume from saved token: requests %v, processed %v", requests, processed)
+	}
+}
+
+func TestMatrixSendToRoom(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "!unknown:example.org"):
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "You aren't a member of the room"}`))
+		case strings.Contains(r.URL.Path, "/state/m.room.encryption"):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found"}`))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			sent[strings.Split(r.URL.Path, "/")[5]] = content.Body
+			w.Write([]byte(`{"event_id": "$event:example.org"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if err := d.SendToRoom("!alerts:example.org", &Message{Text: "alert"}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if sent["!alerts:example.org"] != "alert" {
+		t.Errorf("message not sent: %v", sent)
+	}
+	if encrypted, ok := d.isEncrypted["!alerts:example.org"]; !ok || encrypted {
+		t.Errorf("room's encryption not looked up: %v, %v", encrypted, ok)
+	}
+	for _, roomID := range []string{"", "alerts:example.org", "!alerts", "!:example.org", "@user:example.org"} {
+		if err := d.SendToRoom(roomID, &Message{Text: "alert"}); err != ErrInvalidMatrixRoomID {
+			t.Errorf("%q: expected invalid room error, got %v", roomID, err)
+		}
+	}
+	if err := d.SendToRoom("!unknown:example.org", &Message{Text: "alert"}); !errors.Is(err, ErrMatrixUnknownRoom) {
+		t.Errorf("expected unknown room error, got %v", err)
+	}
+}
+
+func TestMatrixSuggestCommand(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.registerCommands()
+	tests := []struct {
+		input      string
+		admin      bool
+		suggestion string
+	}{
+		{"lng", false, "lang"},
+		{"hepl", false, "help"},
+		{"MUTE", false, "mute"},
+		{"invitess", false, "invite"}, // invites is admin-only.
+		{"invitess", true, "invites"},
+		{"xyzzy", false, ""},
+		{"ab", false, ""},
+	}
+	for _, test := range tests {
+		if suggestion := d.suggestCommand(test.input, test.admin); suggestion != test.suggestion {
+			t.Errorf("%q (admin %v): got %q, want %q", test.input, test.admin, suggestion, test.suggestion)
+		}
+	}
+	if dist := levenshtein("kitten", "sitting"); dist != 3 {
+		t.Errorf("levenshtein(kitten, sitting) = %d, want 3", dist)
+	}
+}
+
+func TestMatrixUnknownCommandReply(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.registerCommands()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["matrixUnknownCommand"] = "Unknown command {command}. See {help}."
+	en["matrixUnknownCommandSuggestion"] = "Unknown command {command}. Did you mean {suggestion}?"
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!lng"}))
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!xyzzy"}))
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "lang"}))
+	if want := "[Unknown command !lng. Did you mean !lang? Unknown command !xyzzy. See !help.]"; fmt.Sprint(*sent) != want {
+		t.Errorf("unexpected replies: %q", *sent)
+	}
+}
+
+func TestMatrixReminderTimeFollowsTimezone(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.reminderFrom, d.reminderUntil = 9, 21
+	now := time.Date(2024, 1, 10, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		timezone string
+		want     time.Time
+	}{
+		{"UTC", time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC)},
+		{"America/New_York", time.Date(2024, 1, 10, 14, 0, 0, 0, time.UTC)}, // 22:00 the day before, so 09:00 EST.
+		{"Asia/Tokyo", now}, // Already midday.
+	}
+	for _, test := range tests {
+		loc := MatrixUser{Timezone: test.timezone}.Location()
+		if at := d.reminderTime(now, loc); !at.Equal(test.want) {
+			t.Errorf("%s: reminder at %s, want %s", test.timezone, at.UTC(), test.want)
+		}
+	}
+	// Windows can span midnight.
+	d.reminderFrom, d.reminderUntil = 20, 2
+	if at := d.reminderTime(now, time.UTC); !at.Equal(time.Date(2024, 1, 10, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("reminder at %s, want 20:00", at)
+	}
+	if at := d.reminderTime(now.Add(-2*time.Hour), time.UTC); !at.Equal(now.Add(-2 * time.Hour)) {
+		t.Errorf("reminder at %s, want 01:00", at)
+	}
+}
+
+func TestMatrixTimezoneCommand(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.registerCommands()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["timezoneSet"] = "set {timezone}"
+	en["timezoneNotFound"] = "unknown {timezone}"
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org"})
+	for _, body := range []string{"!tz Mars/Olympus_Mons", "!tz Local", "!tz Europe/London"} {
+		d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": body}))
+	}
+	if want := "[unknown Mars/Olympus_Mons unknown Local set Europe/London]"; fmt.Sprint(*sent) != want {
+		t.Errorf("unexpected replies: %v", *sent)
+	}
+	if user, _ := d.app.storage.GetMatrixKey("jellyfin-id"); user.Timezone != "Europe/London" {
+		t.Errorf("timezone not saved: %q", user.Timezone)
+	}
+}
+
+func TestMatrixVersionHidesHomeserver(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.registerCommands()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["matrixVersion"] = "jfa-go {version} ({commit})"
+	en["matrixHomeserver"] = "on {homeserver}"
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.0.0", "abc123"
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!version"})
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	d.adminUsers = map[id.UserID]bool{evt.Sender: true}
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	want := []string{"jfa-go v1.0.0 (abc123)", "jfa-go v1.0.0 (abc123)\non " + d.bot.HomeserverURL.String()}
+	if fmt.Sprint(*sent) != fmt.Sprint(want) {
+		t.Errorf("unexpected replies: %q", *sent)
+	}
+}
+
+func TestMatrixEnabledCommands(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.enabledCommands = map[string]bool{"lang": true, "nonexistent": true}
+	d.registerCommands()
+	names := []string{}
+	for name := range d.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[help lang]" {
+		t.Errorf("unexpected commands registered: %v", names)
+	}
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixVerifyMessage"] = "or send {command} <PIN>"
+	if content := d.welcomeContent("en-us", "A1-B2-C3"); strings.Contains(content.Body, "!verify") {
+		t.Errorf("PIN message mentions disabled command: %q", content.Body)
+	}
+
+	// With commands off entirely, messages are ignored.
+	sent := newTestMatrixHomeserver(t, d)
+	d.noCommands = true
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!help"}))
+	if len(*sent) != 0 {
+		t.Errorf("replied with commands disabled: %v", *sent)
+	}
+}
+
+func TestMatrixKeyExportNeedsEncryption(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.app.matrix = d
+	gin.SetMode(gin.TestMode)
+	for _, body := range []string{`{}`, `{"passphrase": "secret"}`} {
+		w := httptest.NewRecorder()
+		gc, _ := gin.CreateTestContext(w)
+		gc.Request = httptest.NewRequest(http.MethodPost, "/matrix/keys/export", strings.NewReader(body))
+		d.app.MatrixExportKeys(gc)
+		if w.Code != 400 {
+			t.Errorf("%s: expected 400 with encryption off, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestMatrixSendSplitsLongMessages(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	d.maxLength = 40
+	codeBlock := "```\nline one\n\nline two\n```"
+	parts := []string{"The first paragraph is here.", "The second one is **bold**.", codeBlock}
+	md := strings.Join(parts, "\n\n")
+	user := MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true}
+	if err := d.Send(&Message{Text: md, Markdown: md}, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(*sent) != 3 {
+		t.Fatalf("expected 3 messages, got %d: %q", len(*sent), *sent)
+	}
+	for i, part := range parts {
+		if (*sent)[i] != part {
+			t.Errorf("expected part %d to be %q, got %q", i, part, (*sent)[i])
+		}
+	}
+}
+
+func TestMatrixSendMarkdownOnly(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	user := MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true}
+	md := "# Welcome\n\nYour account is **ready**. Log in [here](https://jf.example.org).\n\n- one\n- two"
+	if err := d.Send(&Message{Markdown: md}, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(*sent) != 1 {
+		t.Fatalf("expected 1 message, got %d: %q", len(*sent), *sent)
+	}
+	want := "Welcome\n\nYour account is ready. Log in here (https://jf.example.org).\n\n- one\n- two"
+	if (*sent)[0] != want {
+		t.Errorf("expected body %q, got %q", want, (*sent)[0])
+	}
+}
+
+func TestMatrixSendReusesTransactionID(t *testing.T) {
+	d := newTestMatrixDaemon()
+	events := map[string]string{} // Transaction ID to event ID, as a homeserver would deduplicate them.
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.URL.Path, "/send/m.room.message/") {
+			w.Write([]byte("{}"))
+			return
+		}
+		requests++
+		txnID := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if _, ok := events[txnID]; !ok {
+			events[txnID] = fmt.Sprintf("$event%d:example.org", len(events))
+		}
+		// The first request goes through, but the response is lost to a rate limit.
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "` + events[txnID] + `"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	user := MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true}
+	message := &Message{Text: "hello", TxnID: "abc"}
+	for i := 0; i < 2; i++ {
+		if err := d.Send(message, user); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	if requests != 3 || len(events) != 1 {
+		t.Errorf("expected 3 requests for 1 event, got %d for %d", requests, len(events))
+	}
+	if err := d.Send(&Message{Text: "hello"}, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(events) != 2 {
+		t.Errorf("message without a transaction ID deduplicated: %v", events)
+	}
+	if matrixTxnID(message, "!room:example.org", 0) == matrixTxnID(message, "!other:example.org", 0) {
+		t.Error("same transaction ID used for different rooms")
+	}
+}
+
+func TestMatrixQuietHours(t *testing.T) {
+	day := func(hour, minute int) time.Time { return time.Date(2024, 1, 10, hour, minute, 0, 0, time.UTC) }
+	tests := []struct {
+		start, end string
+		now        time.Time
+		quiet      bool
+		until      time.Time
+	}{
+		{"09:00", "17:00", day(8, 59), false, time.Time{}},
+		{"09:00", "17:00", day(9, 0), true, day(17, 0)},
+		{"09:00", "17:00", day(16, 59), true, day(17, 0)},
+		{"09:00", "17:00", day(17, 0), false, time.Time{}},
+		// Spanning midnight.
+		{"22:00", "08:00", day(21, 59), false, time.Time{}},
+		{"22:00", "08:00", day(22, 0), true, day(32, 0)},
+		{"22:00", "08:00", day(3, 0), true, day(8, 0)},
+		{"22:00", "08:00", day(8, 0), false, time.Time{}},
+		{"", "", day(3, 0), false, time.Time{}},
+	}
+	for _, test := range tests {
+		user := MatrixUser{QuietStart: test.start, QuietEnd: test.end, Timezone: "UTC"}
+		until, quiet := user.QuietUntil(test.now)
+		if quiet != test.quiet || !until.Equal(test.until) {
+			t.Errorf("%s-%s at %s: got %v until %s, want %v until %s", test.start, test.end, test.now.Format("15:04"), quiet, until, test.quiet, test.until)
+		}
+	}
+	// The hours are in the user's timezone: 03:00 UTC is 22:00 in New York.
+	user := MatrixUser{QuietStart: "22:00", QuietEnd: "08:00", Timezone: "America/New_York"}
+	if until, quiet := user.QuietUntil(day(3, 0)); !quiet || !until.Equal(day(13, 0)) {
+		t.Errorf("New York: got %v until %s, want true until 13:00 UTC", quiet, until)
+	}
+}
+
+func TestMatrixQuietHoursHoldMessages(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	// Quiet all day, other than the minute before now.
+	now := time.Now().UTC()
+	user := MatrixUser{
+		JellyfinID: "jellyfin-id", RoomID: "!room:example.org", Contact: true, Timezone: "UTC",
+		QuietStart: now.Format("15:04"), QuietEnd: now.Add(-time.Minute).Format("15:04"),
+	}
+	d.app.storage.SetMatrixKey(user.JellyfinID, user)
+	if err := d.Send(&Message{Text: "announcement"}, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if err := d.Send(&Message{Text: "reset", Priority: PriorityCritical}, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if want := "[reset]"; fmt.Sprint(*sent) != want {
+		t.Fatalf("sent %v, want %s", *sent, want)
+	}
+	held := d.app.storage.GetHeldMatrixMessages()
+	if len(held) != 1 {
+		t.Fatalf("expected 1 held message, got %d", len(held))
+	}
+	d.sendHeldMessages(held[0].Until.Add(-time.Second))
+	if len(*sent) != 1 {
+		t.Errorf("held message sent early: %v", *sent)
+	}
+	// By then quiet hours are over.
+	user.QuietStart, user.QuietEnd = "", ""
+	d.app.storage.SetMatrixKey(user.JellyfinID, user)
+	d.sendHeldMessages(held[0].Until)
+	if want := "[reset announcement]"; fmt.Sprint(*sent) != want {
+		t.Errorf("sent %v, want %s", *sent, want)
+	}
+	if len(d.app.storage.GetHeldMatrixMessages()) != 0 {
+		t.Error("held message not removed once sent")
+	}
+}
+
+func TestMatrixQuietCommand(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.registerCommands()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["quietSet"] = "set {start}-{end}"
+	en["quietInvalid"] = "invalid"
+	en["quietOff"] = "off"
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{JellyfinID: "jellyfin-id", RoomID: "!room:example.org"})
+	for _, body := range []string{"!quiet 25:00 08:00", "!quiet 08:00 08:00", "!quiet 22:00", "!quiet 22:00 8:00"} {
+		d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": body}))
+	}
+	if want := "[invalid invalid invalid set 22:00-08:00]"; fmt.Sprint(*sent) != want {
+		t.Errorf("replied %v, want %s", *sent, want)
+	}
+	if user, _ := d.app.storage.GetMatrixKey("jellyfin-id"); user.QuietStart != "22:00" || user.QuietEnd != "08:00" {
+		t.Errorf("quiet hours not stored: %+v", user)
+	}
+	d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!quiet off"}))
+	if user, _ := d.app.storage.GetMatrixKey("jellyfin-id"); user.QuietStart != "" {
+		t.Errorf("quiet hours not cleared: %+v", user)
+	}
+}
+
+func TestMatrixLoginErrors(t *testing.T) {
+	d := newTestMatrixDaemon()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") == "Bearer expired" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token passed."}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Invalid username or password"}`))
+	}))
+	t.Cleanup(srv.Close)
+	// Not a homeserver, just a web server.
+	notMatrix := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<html>Not Found</html>"))
+	}))
+	t.Cleanup(notMatrix.Close)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	login := func(homeserver, password string) error {
+		_, err := d.generateAccessToken(homeserver, "@bot:example.org", password, "jfa-go", "jfa-go")
+		return err
+	}
+	tests := []struct {
+		name string
+		err  func() error
+		code string
+	}{
+		{"bad password", func() error { return login(srv.URL, "wrong") }, "errorMatrixForbidden"},
+		{"not a homeserver", func() error { return login(notMatrix.URL, "pass") }, "errorMatrixBadHomeserver"},
+		{"unreachable", func() error { return login(closed.URL, "pass") }, "errorMatrixUnreachable"},
+		{"no homeserver", func() error { return login("", "pass") }, "errorMatrixBadHomeserver"},
+		{"expired token", func() error { _, err := d.validateAccessToken(srv.URL, "expired"); return err }, "errorMatrixInvalidToken"},
+	}
+	for _, test := range tests {
+		var loginErr *MatrixLoginError
+		if err := test.err(); !errors.As(err, &loginErr) || loginErr.Code != test.code {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.code)
+		}
+	}
+}
+
+func TestMatrixLoginReusesDevice(t *testing.T) {
+	d := newTestMatrixDaemon()
+	var login map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/account/whoami"):
+			w.Write([]byte(`{"user_id": "@bot:example.org", "device_id": "jfa-go-abc123"}`))
+		case strings.HasSuffix(r.URL.Path, "/login"):
+			json.NewDecoder(r.Body).Decode(&login)
+			w.Write([]byte(`{"user_id": "@bot:example.org", "access_token": "new", "device_id": "jfa-go-abc123"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	config := ini.Empty()
+	if deviceID, name := d.loginDevice(config, srv.URL, "bot"); deviceID != "jfa-go" || name != "jfa-go" {
+		t.Errorf("expected default device, got %s (%s)", deviceID, name)
+	}
+	config.Section("matrix").Key("homeserver").SetValue(srv.URL)
+	config.Section("matrix").Key("token").SetValue("old")
+	config.Section("matrix").Key("device_name").SetValue("Media server bot")
+	for _, username := range []string{"bot", "@bot:example.org"} {
+		if deviceID, _ := d.loginDevice(config, srv.URL, username); deviceID != "jfa-go-abc123" {
+			t.Errorf("%s: current device not reused, got %s", username, deviceID)
+		}
+	}
+	if deviceID, _ := d.loginDevice(config, srv.URL, "other"); deviceID != "jfa-go" {
+		t.Errorf("another user's device reused: %s", deviceID)
+	}
+	deviceID, name := d.loginDevice(config, srv.URL, "bot")
+	token, err := d.generateAccessToken(srv.URL, "bot", "pass", deviceID, name)
+	if err != nil || token != "new" {
+		t.Fatalf("failed to log in: %s, %v", token, err)
+	}
+	if login["device_id"] != "jfa-go-abc123" || login["initial_device_display_name"] != "Media server bot" {
+		t.Errorf("logged in with wrong device: %v", login)
+	}
+}
+
+func TestMatrixExportEncryptedInEncryptedRooms(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.app.config = ini.Empty()
+	openTestDB(t, d)
+	uploads := [][]byte{}
+	files := []event.MessageEventContent{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/upload"):
+			data, _ := io.ReadAll(r.Body)
+			uploads = append(uploads, data)
+			w.Write([]byte(`{"content_uri": "mxc://example.org/export"}`))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			files = append(files, content)
+			w.Write([]byte(`{"event_id": "$event:example.org"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Id": "jellyfin-id", "Name": "user"}`))
+	}))
+	t.Cleanup(jf.Close)
+	d.app.jf, err = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	if err != nil {
+		t.Fatalf("failed to create Jellyfin client: %v", err)
+	}
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Timezone: "Europe/London", JellyfinID: "jellyfin-id"})
+
+	d.commandExport(newTestMatrixEvent(d, nil), []string{"!export"}, "en-us")
+	d.isEncrypted["!room:example.org"] = true
+	d.commandExport(newTestMatrixEvent(d, nil), []string{"!export"}, "en-us")
+	if len(uploads) != 2 || len(files) != 2 {
+		t.Fatalf("expected 2 uploads and files, got %d and %d", len(uploads), len(files))
+	}
+	export := AccountExportDTO{}
+	if err := json.Unmarshal(uploads[0], &export); err != nil {
+		t.Fatalf("export isn't JSON: %v", err)
+	}
+	if export.Username != "user" || export.Matrix == nil || export.Matrix.Timezone != "Europe/London" {
+		t.Errorf("unexpected export: %+v", export)
+	}
+	if files[0].MsgType != event.MsgFile || files[0].URL != "mxc://example.org/export" || files[0].File != nil {
+		t.Errorf("unexpected unencrypted file: %+v", files[0])
+	}
+	if bytes.Contains(uploads[1], []byte("Europe/London")) {
+		t.Error("export uploaded unencrypted to an encrypted room")
+	}
+	if files[1].URL != "" || files[1].File == nil || files[1].File.URL != "mxc://example.org/export" {
+		t.Fatalf("unexpected encrypted file: %+v", files[1])
+	}
+	decrypted, err := files[1].File.Decrypt(uploads[1])
+	if err != nil || !bytes.Contains(decrypted, []byte("Europe/London")) {
+		t.Errorf("couldn't decrypt export: %v", err)
+	}
+}
+
+func TestMatrixAdminNoticesCoalesced(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["adminNoticeSignup"] = "signup {user}"
+	en["adminNoticeExpiries"] = "{n} expired: {users}"
+	d.AdminNotice(AdminNoticeSignup, "nobody")
+	if d.adminNoticeTimer != nil {
+		t.Fatal("notice queued without an admin room")
+	}
+	d.adminRoom, d.adminNoticeDelay = "!admins:example.org", time.Hour
+	d.AdminNotice(AdminNoticeExpired, "a")
+	d.AdminNotice(AdminNoticeSignup, "new")
+	d.AdminNotice(AdminNoticeExpired, "b")
+	d.AdminNotice(AdminNoticeExpired, "c")
+	if len(*sent) != 0 {
+		t.Fatalf("notices sent before the delay: %v", *sent)
+	}
+	d.flushAdminNotices()
+	if want := "- 3 expired: a, b, c\n- signup new"; len(*sent) != 1 || (*sent)[0] != want {
+		t.Errorf("sent %q, want %q", *sent, want)
+	}
+	d.flushAdminNotices()
+	if len(*sent) != 1 {
+		t.Errorf("empty notice sent: %q", *sent)
+	}
+}
+
+func TestMatrixLostRoomRecreated(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.maxRetries = 0
+	d.reinviteLost = true
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixRoomRecreated"] = "recreated"
+	sent := map[string][]string{}
+	left := []string{}
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/createRoom"):
+			w.Write([]byte(`{"room_id": "!new:example.org"}`))
+		case strings.HasSuffix(r.URL.Path, "/leave"):
+			left = append(left, strings.Split(r.URL.Path, "/")[5])
+			w.Write([]byte("{}"))
+		case strings.Contains(r.URL.Path, "!gone"):
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "User not in room"}`))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			room := strings.Split(r.URL.Path, "/")[5]
+			sent[room] = append(sent[room], content.Body)
+			w.Write([]byte(`{"event_id": "$event:example.org"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	user := MatrixUser{RoomID: "!gone:example.org", UserID: "@user:example.org", Contact: true, JellyfinID: "jellyfin-id"}
+	d.app.storage.SetMatrixKey(user.JellyfinID, user)
+
+	if err := d.Send(&Message{Text: "test"}, user); err == nil {
+		t.Fatal("send to removed room succeeded")
+	}
+	stored, ok := d.app.storage.GetMatrixKey(user.JellyfinID)
+	if !ok || stored.RoomID != "!new:example.org" {
+		t.Fatalf("user not moved to the new room: %+v, %v", stored, ok)
+	}
+	if fmt.Sprint(sent["!new:example.org"]) != "[recreated]" {
+		t.Errorf("unexpected messages in new room: %v", sent)
+	}
+	if fmt.Sprint(left) != "[!gone:example.org]" {
+		t.Errorf("expected to leave the old room, left %v", left)
+	}
+	// The old room's leave event mustn't unlink them.
+	leave := "@jfa-bot:example.org"
+	d.handleMembership(mautrix.EventSourceTimeline, &event.Event{
+		RoomID: "!gone:example.org", StateKey: &leave, Sender: d.userID,
+		Content: event.Content{Raw: map[string]interface{}{"membership": "leave"}},
+	})
+	if _, ok := d.app.storage.GetMatrixKey(user.JellyfinID); !ok {
+		t.Error("user unlinked after leaving their old room")
+	}
+	if _, err := d.ReinviteUser("unknown"); err != ErrMatrixUnknownUser {
+		t.Errorf("expected unknown user error, got %v", err)
+	}
+
+	// Broadcasts recreate lost rooms from several goroutines at once.
+	d.broadcastWorkers = 4
+	for i := 0; i < 4; i++ {
+		jfID := fmt.Sprintf("broadcast-%d", i)
+		d.app.storage.SetMatrixKey(jfID, MatrixUser{RoomID: fmt.Sprintf("!gone%d:example.org", i), UserID: fmt.Sprintf("@user%d:example.org", i), Contact: true, JellyfinID: jfID})
+	}
+	d.Broadcast(&Message{Text: "broadcast"})
+	for i := 0; i < 4; i++ {
+		if stored, _ := d.app.storage.GetMatrixKey(fmt.Sprintf("broadcast-%d", i)); stored.RoomID != "!new:example.org" {
+			t.Errorf("user %d not moved to the new room: %+v", i, stored)
+		}
+	}
+
+	// Only the given account's room is replaced, along with others linked in it.
+	for jfID, room := range map[string]string{"a": "!gonea:example.org", "b": "!goneb:example.org", "c": "!goneb:example.org"} {
+		d.app.storage.SetMatrixKey(jfID, MatrixUser{RoomID: room, UserID: "@multi:example.org", Contact: true, JellyfinID: jfID})
+	}
+	if _, err := d.ReinviteUser("b"); err != nil {
+		t.Fatalf("reinvite failed: %v", err)
+	}
+	for jfID, room := range map[string]string{"a": "!gonea:example.org", "b": "!new:example.org", "c": "!new:example.org"} {
+		if stored, _ := d.app.storage.GetMatrixKey(jfID); stored.RoomID != room {
+			t.Errorf("expected %s in %s, got %+v", jfID, room, stored)
+		}
+	}
+}
+
+func TestMatrixSelfServiceDisable(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["selfDisableForbidden"] = "forbidden"
+	en["selfEnableForbidden"] = "not yours"
+	en["accountAlreadyDisabled"] = "already"
+	en["selfDisabled"] = "disabled, send {command}"
+	en["selfEnabled"] = "enabled"
+	d.app.storage.SetMatrixKey("jfID", MatrixUser{JellyfinID: "jfID", UserID: "@user:example.org", RoomID: "!room:example.org"})
+	disabled := false
+	policies := 0
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/Users/jfID/Policy" && r.Method == http.MethodPost:
+			var policy mediabrowser.Policy
+			json.NewDecoder(r.Body).Decode(&policy)
+			if !policy.EnableAllFolders {
+				t.Errorf("policy not kept: %+v", policy)
+			}
+			disabled = policy.IsDisabled
+			policies++
+			w.WriteHeader(http.StatusNoContent)
+		case strings.EqualFold(r.URL.Path, "/Users/jfID"):
+			fmt.Fprintf(w, `{"Id": "jfID", "Name": "user", "Policy": {"IsDisabled": %t, "EnableAllFolders": true}}`, disabled)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(jf.Close)
+	var err error
+	d.app.jf, err = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	if err != nil {
+		t.Fatalf("failed to create Jellyfin client: %v", err)
+	}
+	d.commandDisable(newTestMatrixEvent(d, nil), []string{"!disable"}, "en-us")
+	if policies != 0 || (*sent)[len(*sent)-1] != "forbidden" {
+		t.Fatalf("disabled without self_service_disable: %d policies set, %v", policies, *sent)
+	}
+	d.selfDisable = true
+	// Accounts disabled by an admin can't be re-enabled, or taken over by disabling them again.
+	disabled = true
+	d.commandEnable(newTestMatrixEvent(d, nil), []string{"!enable"}, "en-us")
+	d.commandDisable(newTestMatrixEvent(d, nil), []string{"!disable"}, "en-us")
+	if policies != 0 || !disabled || (*sent)[len(*sent)-2] != "not yours" || (*sent)[len(*sent)-1] != "already" {
+		t.Fatalf("admin-disabled account changed: %d policies set, %v", policies, *sent)
+	}
+	disabled = false
+	d.commandDisable(newTestMatrixEvent(d, nil), []string{"!disable"}, "en-us")
+	if user, _ := d.app.storage.GetMatrixKey("jfID"); !disabled || !user.SelfDisabled || (*sent)[len(*sent)-1] != "disabled, send !enable" {
+		t.Fatalf("account not disabled: %v, %+v, %v", disabled, user, *sent)
+	}
+	d.commandEnable(newTestMatrixEvent(d, nil), []string{"!enable"}, "en-us")
+	if user, _ := d.app.storage.GetMatrixKey("jfID"); disabled || user.SelfDisabled || (*sent)[len(*sent)-1] != "enabled" {
+		t.Errorf("account not re-enabled: %v, %+v, %v", disabled, user, *sent)
+	}
+}
+
+func TestMatrixSendAttachments(t *testing.T) {
+	d := newTestMatrixDaemon()
+	media := map[string][]byte{}
+	sent := []event.MessageEventContent{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/upload"):
+			data, _ := io.ReadAll(r.Body)
+			mediaID := fmt.Sprintf("media%d", len(media))
+			media[mediaID] = data
+			w.Write([]byte(`{"content_uri": "mxc://example.org/` + mediaID + `"}`))
+		case strings.Contains(r.URL.Path, "/download/example.org/"):
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(media[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]])
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			content := event.MessageEventContent{}
+			json.NewDecoder(r.Body).Decode(&content)
+			sent = append(sent, content)
+			w.Write([]byte(`{"event_id": "$event:example.org"}`))
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	user := MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true}
+	message := &Message{Text: "Your invite:", Attachments: []Attachment{
+		{Type: AttachmentImage, Name: "invite.png", MimeType: "image/png", Data: []byte("not really a png")},
+		{Type: AttachmentFile, Name: "invite.txt", MimeType: "text/plain", Data: []byte("https://example.org/invite/abc")},
+		{Type: AttachmentLocation, Name: "The server", GeoURI: "geo:51.5,-0.12"},
+	}}
+	if err := d.Send(message, user); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(sent) != 4 {
+		t.Fatalf("expected 4 messages, got %d: %+v", len(sent), sent)
+	}
+	if sent[0].Body != "Your invite:" {
+		t.Errorf("text not sent first: %+v", sent[0])
+	}
+	for i, msgType := range []event.MessageType{event.MsgImage, event.MsgFile} {
+		content, a := sent[i+1], message.Attachments[i]
+		if content.MsgType != msgType || content.Body != a.Name || content.Info == nil || content.Info.MimeType != a.MimeType {
+			t.Errorf("%s sent wrong: %+v", a.Name, content)
+			continue
+		}
+		uri, err := content.URL.Parse()
+		if err != nil {
+			t.Errorf("%s has no URL: %v", a.Name, err)
+			continue
+		}
+		data, err := d.bot.DownloadBytes(uri)
+		if err != nil || !bytes.Equal(data, a.Data) {
+			t.Errorf("%s not uploaded intact: %q, %v", a.Name, data, err)
+		}
+	}
+	if sent[3].MsgType != event.MsgLocation || sent[3].GeoURI != "geo:51.5,-0.12" || sent[3].Body != "The server" {
+		t.Errorf("location sent wrong: %+v", sent[3])
+	}
+}
+
+func TestMatrixRoomsAddedToSpace(t *testing.T) {
+	d := newTestMatrixDaemon()
+	spaceType := "m.space"
+	childLevel := 50
+	var child map[string]interface{}
+	childPath := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case !strings.Contains(r.URL.Path, "/rooms/!space:example.org/"):
+			w.Write([]byte(`{"event_id": "$event:example.org", "room_id": "!new:example.org"}`))
+		case strings.HasSuffix(r.URL.Path, "/m.room.create/"):
+			w.Write([]byte(`{"type": "` + spaceType + `"}`))
+		case strings.HasSuffix(r.URL.Path, "/m.room.power_levels/"):
+			fmt.Fprintf(w, `{"users": {"@jfa-bot:example.org": 50}, "events": {"m.space.child": %d}}`, childLevel)
+		case strings.Contains(r.URL.Path, "/state/m.space.child/") && r.Method == http.MethodPut:
+			childPath = r.URL.Path
+			json.NewDecoder(r.Body).Decode(&child)
+			w.Write([]byte(`{"event_id": "$child:example.org"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found."}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	for _, test := range []struct {
+		name       string
+		space      id.RoomID
+		spaceType  string
+		childLevel int
+		kept       bool
+	}{
+		{"missing", "!missing:example.org", "m.space", 50, false},
+		{"not a space", "!space:example.org", "", 50, false},
+		{"no permission", "!space:example.org", "m.space", 100, false},
+		{"allowed", "!space:example.org", "m.space", 50, true},
+	} {
+		d.space, spaceType, childLevel = test.space, test.spaceType, test.childLevel
+		d.checkSpace()
+		if (d.space != "") != test.kept {
+			t.Errorf("%s: expected space kept to be %t", test.name, test.kept)
+		}
+	}
+	roomID, _, err := d.CreateRoom("@user:example.org")
+	if err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	}
+	if !strings.HasSuffix(childPath, "/m.space.child/"+string(roomID)) {
+		t.Fatalf("room not added to space: %q", childPath)
+	}
+	if via, _ := child["via"].([]interface{}); len(via) != 1 || via[0] != "example.org" {
+		t.Errorf("unexpected space child content: %v", child)
+	}
+}
+
+func TestMatrixSendStartCooldown(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.startCooldown = 5 * time.Minute
+	for i := 0; i < 2; i++ {
+		if err := d.SendStart("@user:example.org", "", MediaServer{}); err != nil {
+			t.Fatalf("failed to start: %v", err)
+		}
+	}
+	if len(d.tokens) != 1 || len(*sent) != 2 || (*sent)[0] != (*sent)[1] {
+		t.Fatalf("expected the same PIN sent twice, got %d PINs: %q", len(d.tokens), *sent)
+	}
+	for pin, token := range d.tokens {
+		if !strings.Contains((*sent)[1], pin) {
+			t.Errorf("PIN %s not resent: %q", pin, (*sent)[1])
+		}
+		token.Verified = true
+		d.tokens[pin] = token
+	}
+	if err := d.SendStart("@user:example.org", "", MediaServer{}); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	if len(d.tokens) != 2 {
+		t.Errorf("expected a new PIN after verifying, got %d", len(d.tokens))
+	}
+	// A request for a logged-in account gets its own PIN, rather than taking over the sign-up one.
+	if err := d.SendStart("@user:example.org", "0123456789abcdef0123456789abcdef", MediaServer{}); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	if len(d.tokens) != 3 {
+		t.Errorf("expected a new PIN for another account, got %d", len(d.tokens))
+	}
+	for _, token := range d.tokens {
+		if token.JellyfinID != "" && token.JellyfinID != "0123456789abcdef0123456789abcdef" {
+			t.Errorf("PIN moved to another account: %+v", token)
+		}
+	}
+}
+
+func TestMatrixWelcomeNamesServer(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["matrixServerMessage"] = "for {serverName} at {serverURL}"
+	d.welcomeTemplate = "{pin}{serverMessage}"
+	if err := d.SendStart("@user:example.org", "", MediaServer{Name: "Films", URL: "https://films.example.org"}); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	var pin string
+	for p := range d.tokens {
+		pin = p
+	}
+	if len(*sent) != 1 || (*sent)[0] != pin+"\nfor Films at https://films.example.org" {
+		t.Errorf("server not named: %q", *sent)
+	}
+	if content := d.welcomeContent("en-us", "unknown"); content.Body != "unknown" {
+		t.Errorf("server named without a URL: %q", content.Body)
+	}
+}
+
+func TestMatrixStatusCommand(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["statusServerUp"] = "up with {n}"
+	en["statusServerTimeout"] = "timed out"
+	en["statusBotSyncing"] = "syncing"
+	en["statusBotSyncError"] = "error: {error}"
+	hang := make(chan struct{})
+	hanging := false
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hanging {
+			<-hang
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"Id": "0123456789abcdef0123456789abcdea", "Name": "a"}, {"Id": "0123456789abcdef0123456789abcdeb", "Name": "b", "Policy": {"IsDisabled": true}}]`))
+	}))
+	t.Cleanup(jf.Close)
+	t.Cleanup(func() { close(hang) })
+	var err error
+	d.app.jf, err = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	if err != nil {
+		t.Fatalf("failed to create Jellyfin client: %v", err)
+	}
+	d.statusTimeout = 5 * time.Second
+	d.status.syncing, d.status.lastSync = true, time.Now()
+	d.commandStatus(newTestMatrixEvent(d, nil), []string{"!status"}, "en-us")
+	if len(*sent) != 1 || (*sent)[0] != "up with 1\nsyncing" {
+		t.Fatalf("unexpected status: %q", *sent)
+	}
+	hanging = true
+	// The bot doesn't invalidate the cache itself, so expire it as the rest of jfa-go would.
+	d.app.jf.CacheExpiry = time.Now()
+	d.statusTimeout = 10 * time.Millisecond
+	d.status.syncing, d.status.lastError = false, "connection refused"
+	start := time.Now()
+	d.commandStatus(newTestMatrixEvent(d, nil), []string{"!status"}, "en-us")
+	if time.Since(start) > time.Second {
+		t.Errorf("status waited %s for an unresponsive server", time.Since(start))
+	}
+	if len(*sent) != 2 || (*sent)[1] != "timed out\nerror: connection refused" {
+		t.Errorf("unexpected status: %q", *sent)
+	}
+}
+
+func TestMatrixCreateRoomRetriesTransientFailures(t *testing.T) {
+	d := newTestMatrixDaemon()
+	d.transientRetries, d.retryBackoff = 2, time.Millisecond
+	attempts := 0
+	failures := []int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, "/createRoom") {
+			w.Write([]byte("{}"))
+			return
+		}
+		attempts++
+		if len(failures) != 0 {
+			w.WriteHeader(failures[0])
+			failures = failures[1:]
+			w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Something went wrong"}`))
+			return
+		}
+		w.Write([]byte(`{"room_id": "!new:example.org"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	for _, test := range []struct {
+		name      string
+		failures  []int
+		attempts  int
+		created   bool
+		exhausted bool
+	}{
+		{"transient", []int{http.StatusBadGateway}, 2, true, false},
+		{"permanent", []int{http.StatusBadRequest}, 1, false, false},
+		{"exhausted", []int{500, 500, 500}, 3, false, true},
+	} {
+		attempts, failures = 0, test.failures
+		roomID, _, err := d.CreateRoom("@user:example.org")
+		if attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, attempts)
+		}
+		if created := err == nil && roomID == "!new:example.org"; created != test.created {
+			t.Errorf("%s: expected room created to be %t, got %v", test.name, test.created, err)
+		}
+		if errors.Is(err, ErrMatrixRetriesExhausted) != test.exhausted {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestMatrixMigrateContact(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["fr-fr"] = telegramLang{Meta: langMeta{Name: "Français (FR)"}}
+	user := MatrixUser{JellyfinID: "jfID", UserID: "@user:example.org", RoomID: "!room:example.org"}
+	d.app.storage.SetMatrixKey("jfID", user)
+	if err := d.migrateContact(user, "telegram", false); !errors.Is(err, ErrMatrixNothingToMigrate) {
+		t.Errorf("expected nothing to migrate, got %v", err)
+	}
+	d.app.storage.SetTelegramKey("jfID", TelegramUser{ChatID: 1, Username: "user", Lang: "fr-fr", Contact: true})
+	prefs := NotificationPreferences{}
+	prefs.Set(NotificationAnnouncement, "telegram", false)
+	d.app.storage.SetNotificationPreferencesKey("jfID", prefs)
+
+	if err := d.migrateContact(user, "telegram", false); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	migrated, _ := d.app.storage.GetMatrixKey("jfID")
+	if migrated.Lang != "fr-fr" || !migrated.Contact || d.languages["!room:example.org"] != "fr-fr" {
+		t.Errorf("settings not copied: %+v", migrated)
+	}
+	prefs, _ = d.app.storage.GetNotificationPreferencesKey("jfID")
+	if prefs.Allowed(NotificationAnnouncement, "matrix") || !prefs.Allowed(NotificationExpiry, "matrix") {
+		t.Errorf("preferences not copied: %+v", prefs)
+	}
+	if _, ok := d.app.storage.GetTelegramKey("jfID"); !ok || prefs.Allowed(NotificationAnnouncement, "telegram") {
+		t.Errorf("old link changed without removeOld: %+v", prefs)
+	}
+
+	if err := d.migrateContact(migrated, "telegram", true); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	prefs, _ = d.app.storage.GetNotificationPreferencesKey("jfID")
+	if _, ok := d.app.storage.GetTelegramKey("jfID"); ok || !prefs.Allowed(NotificationAnnouncement, "telegram") {
+		t.Errorf("old link not removed: %+v", prefs)
+	}
+	if prefs.Allowed(NotificationAnnouncement, "matrix") {
+		t.Errorf("preferences lost when removing the old link: %+v", prefs)
+	}
+	if err := d.migrateContact(migrated, "irc", false); err == nil || errors.Is(err, ErrMatrixNothingToMigrate) {
+		t.Errorf("expected unknown platform error, got %v", err)
+	}
+}
+
+func TestMatrixDetectsProfileLanguage(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.detectLang = true
+	d.app.storage.lang.Matrix["fr-fr"] = telegramLang{Meta: langMeta{Name: "Français (FR)"}, Strings: langSection{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/profile/") {
+			w.Write([]byte(`{"displayname": "User", "m.locale": "fr_CA"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id": "$event:example.org"}`))
+	}))
+	t.Cleanup(srv.Close)
+	var err error
+	d.bot, err = mautrix.NewClient(srv.URL, d.userID, "token")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	langOf := func(roomID id.RoomID) string {
+		for _, token := range d.tokens {
+			if id.RoomID(token.User.RoomID) == roomID {
+				return token.User.Lang
+			}
+		}
+		return ""
+	}
+	if err := d.sendPIN("!detected:example.org", "@user:example.org", "", false, MediaServer{}); err != nil {
+		t.Fatalf("failed to send PIN: %v", err)
+	}
+	if lang := langOf("!detected:example.org"); lang != "fr-fr" {
+		t.Errorf("expected language from profile, got %q", lang)
+	}
+	// The lang command overrides detection.
+	d.languages["!chosen:example.org"] = "en-us"
+	if err := d.sendPIN("!chosen:example.org", "@user:example.org", "", false, MediaServer{}); err != nil {
+		t.Fatalf("failed to send PIN: %v", err)
+	}
+	if lang := langOf("!chosen:example.org"); lang != "en-us" {
+		t.Errorf("expected chosen language, got %q", lang)
+	}
+	d.detectLang = false
+	if lang := d.profileLang("@user:example.org"); lang != "" {
+		t.Errorf("detected %q with detection disabled", lang)
+	}
+}
+
+func TestMatrixWebhook(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.matrix = d
+	d.app.config = ini.Empty()
+	d.app.config.Section("matrix").Key("webhook_secret").SetValue("secret")
+	d.app.storage.SetMatrixKey("jellyfin-id", MatrixUser{RoomID: "!room:example.org", UserID: "@user:example.org", Lang: "en-us", Contact: true, Muted: true, JellyfinID: "jellyfin-id"})
+	d.isEncrypted["!alerts:example.org"] = false
+	gin.SetMode(gin.TestMode)
+	post := func(auth, body string) int {
+		w := httptest.NewRecorder()
+		gc, _ := gin.CreateTestContext(w)
+		gc.Request = httptest.NewRequest(http.MethodPost, "/matrix/webhook", strings.NewReader(body))
+		if auth != "" {
+			gc.Request.Header.Set("Authorization", auth)
+		}
+		d.app.MatrixWebhook(gc)
+		return w.Code
+	}
+	tests := []struct {
+		auth, body string
+		code       int
+		sent       string
+	}{
+		{"", `{"room_id": "!alerts:example.org", "text": "hi"}`, 401, ""},
+		{"Bearer wrong", `{"room_id": "!alerts:example.org", "text": "hi"}`, 401, ""},
+		{"Bearer secret", `{"text": "hi"}`, 400, ""},
+		{"Bearer secret", `{"room_id": "!alerts:example.org", "jellyfin_id": "jellyfin-id", "text": "hi"}`, 400, ""},
+		{"Bearer secret", `{"room_id": "!alerts:example.org"}`, 400, ""},
+		{"Bearer secret", `{"room_id": "!alerts:example.org", "text": "hi", "priority": "high"}`, 400, ""},
+		{"Bearer secret", `{"room_id": "alerts", "text": "hi"}`, 400, ""},
+		{"Bearer secret", `{"jellyfin_id": "unknown", "text": "hi"}`, 400, ""},
+		{"Bearer secret", `{"room_id": "!alerts:example.org", "markdown": "Disk **full**"}`, 200, "Disk full"},
+		{"Bearer secret", `{"room_id": "!alerts:example.org", "markdown": "![config](config.ini)"}`, 200, "config"},
+		// The user has muted notifications, so only critical messages reach them.
+		{"Bearer secret", `{"jellyfin_id": "jellyfin-id", "text": "normal"}`, 200, ""},
+		{"Bearer secret", `{"jellyfin_id": "jellyfin-id", "text": "critical", "priority": "critical"}`, 200, "critical"},
+	}
+	for _, test := range tests {
+		*sent = (*sent)[:0]
+		if code := post(test.auth, test.body); code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.body, test.code, code)
+		}
+		got := strings.Join(*sent, "\n")
+		if got != test.sent {
+			t.Errorf("%s: expected %q to be sent, got %q", test.body, test.sent, got)
+		}
+	}
+}
+
+func TestMatrixSkipsOptedOutUsers(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.storage.lang.Matrix["en-us"].Strings["contactOff"] = "off"
+	d.app.storage.lang.Matrix["en-us"].Strings["contactOn"] = "on"
+	optedOut := MatrixUser{JellyfinID: "out", RoomID: "!out:example.org", UserID: "@out:example.org"}
+	d.app.storage.SetMatrixKey("out", optedOut)
+	d.app.storage.SetMatrixKey("in", MatrixUser{JellyfinID: "in", RoomID: "!in:example.org", UserID: "@in:example.org", Contact: true})
+	d.Send(&Message{Text: "normal"}, optedOut)
+	// Unlike muting, turning contact off stops urgent messages too.
+	d.Send(&Message{Text: "urgent", Priority: PriorityCritical}, optedOut)
+	if len(*sent) != 0 {
+		t.Errorf("expected nothing to be sent, got %q", *sent)
+	}
+	if n, _ := d.Broadcast(&Message{Text: "broadcast"}); n != 1 {
+		t.Errorf("expected broadcast to reach 1 room, got %d", n)
+	}
+	if n, _ := d.Broadcast(&Message{Text: "urgent broadcast", Priority: PriorityCritical}); n != 1 {
+		t.Errorf("expected urgent broadcast to reach 1 room, got %d", n)
+	}
+
+	// Turning contact back on from the opted out room.
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!messages on"})
+	evt.RoomID = "!out:example.org"
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if user, _ := d.app.storage.GetMatrixKey("out"); !user.Contact {
+		t.Error("contact not turned on")
+	}
+	evt = newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!messages off"})
+	evt.RoomID = "!out:example.org"
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	if user, _ := d.app.storage.GetMatrixKey("out"); user.Contact {
+		t.Error("contact not turned off")
+	}
+}
+
+func TestMatrixSwitchAccounts(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	en := d.app.storage.lang.Matrix["en-us"].Strings
+	en["accountsList"] = "accounts:"
+	en["accountsCurrent"] = "(current)"
+	en["switched"] = "now {username}"
+	en["switchUsage"] = "usage"
+	en["accountNoExpiry"] = "no expiry"
+	en["accountExpiryDays"] = "expires in {days}"
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		name := "parent"
+		if strings.Contains(r.URL.Path, "0123456789abcdef0123456789abcdeb") {
+			name = "child"
+		}
+		w.Write([]byte(`{"Id": "` + r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:] + `", "Name": "` + name + `"}`))
+	}))
+	t.Cleanup(jf.Close)
+	var err error
+	d.app.jf, err = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	if err != nil {
+		t.Fatalf("failed to create Jellyfin client: %v", err)
+	}
+	parent, child := "0123456789abcdef0123456789abcdea", "0123456789abcdef0123456789abcdeb"
+	// Both accounts are linked by the same Matrix user, each with their own room.
+	d.app.storage.SetMatrixKey(parent, MatrixUser{JellyfinID: parent, RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true})
+	d.app.storage.SetMatrixKey(child, MatrixUser{JellyfinID: child, RoomID: "!child:example.org", UserID: "@user:example.org", Contact: true})
+	d.app.storage.SetUserExpiryKey(child, UserExpiry{Expiry: time.Now().Add(12 * time.Hour)})
+	command := func(body string) string {
+		*sent = (*sent)[:0]
+		d.handleMessage(mautrix.EventSourceTimeline, newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": body}))
+		return strings.Join(*sent, "\n")
+	}
+	if reply := command("!expiry"); reply != "no expiry" {
+		t.Errorf("expected the room's own account before switching, got %q", reply)
+	}
+	if reply := command("!accounts"); reply != "accounts:\n1. parent (current)\n2. child\n" {
+		t.Errorf("unexpected account list: %q", reply)
+	}
+	for _, body := range []string{"!switch", "!switch 0", "!switch 3", "!switch child"} {
+		if reply := command(body); reply != "usage" {
+			t.Errorf("%s: expected usage, got %q", body, reply)
+		}
+	}
+	if reply := command("!switch 2"); reply != "now child" {
+		t.Errorf("unexpected switch reply: %q", reply)
+	}
+	if reply := command("!expiry"); !strings.HasPrefix(reply, "expires") {
+		t.Errorf("expected the chosen account's expiry, got %q", reply)
+	}
+	if reply := command("!accounts"); reply != "accounts:\n1. parent\n2. child (current)\n" {
+		t.Errorf("unexpected account list after switching: %q", reply)
+	}
+	// Settings change on the chosen account too.
+	command("!mute")
+	if user, _ := d.app.storage.GetMatrixKey(child); !user.Muted {
+		t.Error("chosen account not muted")
+	}
+	if user, _ := d.app.storage.GetMatrixKey(parent); user.Muted {
+		t.Error("room's own account muted")
+	}
+	command("!switch 1")
+	if user, _ := d.accountByRoom("!room:example.org"); user.JellyfinID != parent {
+		t.Errorf("didn't switch back: %+v", user)
+	}
+
+	// With both accounts in one room, unlinking one leaves the room to the other.
+	d.app.storage.SetMatrixKey(child, MatrixUser{JellyfinID: child, RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true})
+	d.setRoomEncrypted("!room:example.org", false)
+	command("!unlink")
+	if _, ok := d.app.storage.GetMatrixKey(parent); ok {
+		t.Error("chosen account not unlinked")
+	}
+	if _, ok := d.app.storage.GetMatrixKey(child); !ok {
+		t.Error("other account unlinked")
+	}
+	if _, known := d.roomEncrypted("!room:example.org"); !known {
+		t.Error("left room still used by another account")
+	}
+	// The selection of an unlinked account falls back to what's left.
+	if user, _ := d.accountByRoom("!room:example.org"); user.JellyfinID != child {
+		t.Errorf("expected remaining account, got %+v", user)
+	}
+	// Leaving the room unlinks everything in it.
+	d.app.storage.SetMatrixKey(parent, MatrixUser{JellyfinID: parent, RoomID: "!room:example.org", UserID: "@user:example.org", Contact: true})
+	leave := "@user:example.org"
+	d.handleMembership(mautrix.EventSourceTimeline, &event.Event{
+		RoomID: "!room:example.org", StateKey: &leave, Sender: id.UserID(leave),
+		Content: event.Content{Raw: map[string]interface{}{"membership": "leave"}},
+	})
+	if accounts := d.roomAccounts("!room:example.org"); len(accounts) != 0 {
+		t.Errorf("accounts still linked after leaving: %+v", accounts)
+	}
+}
+
+func TestMatrixUsersMigratedToDB(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.app.config = ini.Empty()
+	path := t.TempDir() + "/matrix_users.json"
+	os.WriteFile(path, []byte(`{"jellyfin-id": {"RoomID": "!room:example.org", "UserID": "@user:example.org", "Lang": "fr-fr", "Contact": true}}`), 0600)
+	d.app.config.Section("files").Key("matrix_users").SetValue(path)
+	migrateToBadger(d.app)
+	user, ok := d.app.storage.GetMatrixKey("jellyfin-id")
+	if !ok || user.UserID != "@user:example.org" || user.RoomID != "!room:example.org" || user.Lang != "fr-fr" || !user.Contact {
+		t.Fatalf("user not migrated: %+v, %v", user, ok)
+	}
+	// Later changes to the file aren't imported again.
+	os.WriteFile(path, []byte(`{"other-id": {"UserID": "@other:example.org"}}`), 0600)
+	migrateToBadger(d.app)
+	if _, ok := d.app.storage.GetMatrixKey("other-id"); ok {
+		t.Error("users migrated twice")
+	}
+}
+
+func TestMatrixSelectionMigration(t *testing.T) {
+	d := newTestMatrixDaemon()
+	openTestDB(t, d)
+	d.app.storage.SetMatrixKey("a", MatrixUser{JellyfinID: "a", RoomID: "!a:example.org", UserID: "@user:example.org"})
+	d.app.storage.SetMatrixKey("b", MatrixUser{JellyfinID: "b", RoomID: "!b:example.org", UserID: "@user:example.org", Selected: true})
+	migrateMatrixSelections(d.app)
+	if jellyfinID, ok := d.app.storage.GetMatrixSelectionKey("@user:example.org"); !ok || jellyfinID != "b" {
+		t.Errorf("selection not migrated: %q, %v", jellyfinID, ok)
+	}
+	if user, _ := d.app.storage.GetMatrixKey("b"); user.Selected {
+		t.Error("old selection left set")
+	}
+	if user, _ := d.accountByRoom("!a:example.org"); user.JellyfinID != "b" {
+		t.Errorf("expected migrated selection to be used, got %+v", user)
+	}
+	// Running again doesn't overwrite newer choices.
+	d.app.storage.SetMatrixSelectionKey("@user:example.org", "a")
+	migrateMatrixSelections(d.app)
+	if jellyfinID, _ := d.app.storage.GetMatrixSelectionKey("@user:example.org"); jellyfinID != "a" {
+		t.Errorf("migration ran twice, selection is %q", jellyfinID)
+	}
+}
+
+func TestMatrixVerifiedHooks(t *testing.T) {
+	d := newTestMatrixDaemon()
+	sent := newTestMatrixHomeserver(t, d)
+	openTestDB(t, d)
+	jf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Name": "alice", "Id": "0123456789abcdef0123456789abcdef"}`))
+	}))
+	t.Cleanup(jf.Close)
+	d.app.jf, _ = mediabrowser.NewServer(mediabrowser.JellyfinServer, jf.URL, "jfa-go", "test", "test", "test", func() {}, 30)
+	d.app.storage.lang.Matrix["en-us"].Strings["adminNoticeLinked"] = "linked {user}"
+	d.adminRoom, d.adminNoticeDelay = "!admins:example.org", time.Hour
+	d.isEncrypted["!admins:example.org"] = false
+	verifications := make(chan MatrixVerification, 1)
+	d.OnVerified(func(v MatrixVerification) { verifications <- v })
+	d.OnVerified(d.announceVerified)
+	evt := newTestMatrixEvent(d, map[string]interface{}{"msgtype": "m.text", "body": "!verify A1-B2-C3"})
+	d.tokens["A1-B2-C3"] = UnverifiedUser{JellyfinID: "0123456789abcdef0123456789abcdef", User: &MatrixUser{UserID: string(evt.Sender), RoomID: string(evt.RoomID)}, Created: time.Now()}
+	d.handleMessage(mautrix.EventSourceTimeline, evt)
+	select {
+	case v := <-verifications:
+		if v.Source != MatrixVerifiedCommand || v.User.JellyfinID != "0123456789abcdef0123456789abcdef" || v.User.UserID != string(evt.Sender) || v.User.RoomID != string(evt.RoomID) {
+			t.Errorf("unexpected verification: %+v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook not called")
+	}
+	// The admin notice hook runs separately, so wait for it to queue the notice.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.adminNoticesLock.Lock()
+		queued := len(d.adminNotices[AdminNoticeLinked]) != 0
+		d.adminNoticesLock.Unlock()
+		if queued || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	*sent = (*sent)[:0]
+	d.flushAdminNotices()
+	if len(*sent) != 1 || (*sent)[0] != "- linked alice" {
+		t.Errorf("unexpected admin notice: %q", *sent)
+	}
+	// Sign-ups are announced on their own.
+	d.announceVerified(MatrixVerification{User: MatrixUser{JellyfinID: "0123456789abcdef0123456789abcdef"}, Source: MatrixVerifiedSignup})
+	if d.adminNoticeTimer != nil {
+		t.Error("sign-up announced twice")
+	}
+}
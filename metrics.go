@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notificationMetrics counts notifications sent through each contact method, exposed at /metrics in Prometheus' text format.
+var notificationMetrics = &sendMetrics{counts: map[sendMetric]uint64{}}
+
+type sendMetric struct {
+	channel      string // Lowercase contact method, e.g. "matrix".
+	notification string // Message.Notification, or "other".
+	failed       bool
+}
+
+type sendMetrics struct {
+	counts map[sendMetric]uint64
+	lock   sync.Mutex
+}
+
+// record counts a message sent to one recipient through the given channel, as failed if err is non-nil.
+func (m *sendMetrics) record(channel string, message *Message, err error) {
+	notification := message.Notification
+	if notification == "" {
+		notification = "other"
+	}
+	m.lock.Lock()
+	m.counts[sendMetric{channel, notification, err != nil}]++
+	m.lock.Unlock()
+}
+
+// write outputs the counters in Prometheus' text exposition format, in a stable order.
+func (m *sendMetrics) write(w io.Writer) {
+	m.lock.Lock()
+	metrics := make([]sendMetric, 0, len(m.counts))
+	for metric := range m.counts {
+		metrics = append(metrics, metric)
+	}
+	counts := make(map[sendMetric]uint64, len(m.counts))
+	for metric, count := range m.counts {
+		counts[metric] = count
+	}
+	m.lock.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].channel != metrics[j].channel {
+			return metrics[i].channel < metrics[j].channel
+		}
+		return metrics[i].notification < metrics[j].notification
+	})
+	for _, failed := range []bool{false, true} {
+		name, help := "jfa_go_notifications_sent_total", "Notifications sent successfully, per recipient."
+		if failed {
+			name, help = "jfa_go_notifications_failed_total", "Notifications which failed to send, per recipient."
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, metric := range metrics {
+			if metric.failed == failed {
+				fmt.Fprintf(w, "%s{channel=%q,type=%q} %d\n", name, metric.channel, metric.notification, counts[metric])
+			}
+		}
+	}
+}
+
+// @Summary Get notification counters in Prometheus' text format.
+// @Produce plain
+// @Success 200
+// @Router /metrics [get]
+// @tags Other
+func (app *appContext) GetMetrics(gc *gin.Context) {
+	gc.Header("Content-Type", "text/plain; version=0.0.4")
+	notificationMetrics.write(gc.Writer)
+}
+
+// serveMetrics serves /metrics on its own address, so it can be kept off the public interface.
+func (app *appContext) serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		notificationMetrics.write(w)
+	})
+	app.info.Printf("Serving metrics @ %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		app.err.Printf("Failed to serve metrics: %v", err)
+	}
+}
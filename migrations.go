@@ -17,6 +17,7 @@ func runMigrations(app *appContext) {
 	linkExistingOmbiDiscordTelegram(app)
 	// migrateHyphens(app)
 	migrateToBadger(app)
+	migrateMatrixSelections(app)
 	intialiseCustomContent(app)
 }
 
@@ -339,6 +340,29 @@ func migrateToBadger(app *appContext) {
 	app.info.Println("All data migrated to database. JSON files in the config folder can be deleted if you are sure all data is correct in the app. Create an issue if you have problems.")
 }
 
+// migrateMatrixSelections moves accounts chosen with the Matrix switch command from MatrixUser.Selected to a MatrixSelection
+// for their Matrix user, which can only hold one. If a user somehow had several selected, the first found is kept.
+func migrateMatrixSelections(app *appContext) {
+	migrated := MigrationStatus{}
+	app.storage.db.Get("migrated_matrix_selections", &migrated)
+	if migrated.Done {
+		return
+	}
+	for _, user := range app.storage.GetMatrix() {
+		if !user.Selected {
+			continue
+		}
+		if _, ok := app.storage.GetMatrixSelectionKey(user.UserID); !ok {
+			app.storage.SetMatrixSelectionKey(user.UserID, user.JellyfinID)
+		}
+		user.Selected = false
+		app.storage.SetMatrixKey(user.JellyfinID, user)
+	}
+	if err := app.storage.db.Upsert("migrated_matrix_selections", MigrationStatus{true}); err != nil {
+		app.err.Printf("Failed to migrate Matrix account selections: %v", err)
+	}
+}
+
 // Simply creates an emply CC template if not in the DB already.
 // Add new CC types here!
 func intialiseCustomContent(app *appContext) {
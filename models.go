@@ -295,6 +295,16 @@ type SetContactMethodsDTO struct {
 	Matrix   bool   `json:"matrix"`
 }
 
+type NotificationPreferencesDTO struct {
+	Preferences map[string]map[string]bool `json:"preferences"` // Map of notification types to contact methods to whether they're enabled
+}
+
+type SetNotificationPreferenceDTO struct {
+	Notification string `json:"notification"` // welcome/expiry/reset/announcement
+	Method       string `json:"method"`       // email/discord/telegram/matrix
+	Enabled      bool   `json:"enabled"`
+}
+
 type DiscordUserDTO struct {
 	Name      string `json:"name"`
 	AvatarURL string `json:"avatar_url"`
@@ -332,6 +342,66 @@ type MatrixLoginDTO struct {
 	Homeserver string `json:"homeserver"`
 	Username   string `json:"username"`
 	Password   string `json:"password"`
+	Token      string `json:"token"` // Existing access token, used instead of username & password if given.
+}
+
+type MatrixBroadcastDTO struct {
+	Subject string `json:"subject"`
+	Message string `json:"message"` // Markdown supported
+	Urgent  bool   `json:"urgent"`  // Send to users who've muted notifications
+}
+
+type MatrixWebhookDTO struct {
+	JellyfinID string `json:"jellyfin_id" example:"ab1234cd5678ef90"` // Linked user to message. Give this or room_id.
+	RoomID     string `json:"room_id" example:"!abc:example.org"`     // Room the bot is in to message.
+	Text       string `json:"text"`                                   // Plain text, shown by clients which can't display Markdown.
+	Markdown   string `json:"markdown"`                               // At least one of text or markdown is required.
+	Priority   string `json:"priority" example:"normal"`              // "normal" or "critical", which is sent to users who've muted notifications.
+}
+
+type MatrixBroadcastResponseDTO struct {
+	Sent   int `json:"sent"`   // Number of rooms the message was sent to
+	Failed int `json:"failed"` // Number of rooms which failed
+}
+
+type MatrixTestResponseDTO struct {
+	Success   bool   `json:"success"`
+	RoomID    string `json:"room_id"`   // Room the message was sent to, blank if one couldn't be created
+	NewRoom   bool   `json:"new_room"`  // Whether the room was created for the test, rather than being the user's linked room
+	Encrypted bool   `json:"encrypted"` // Whether the room is encrypted
+	Error     string `json:"error"`     // Error from the homeserver, if the message couldn't be sent
+}
+
+type MatrixUserDTO struct {
+	JellyfinID string `json:"jellyfin_id"`
+	Username   string `json:"username"` // Jellyfin username, blank if the user couldn't be found
+	MatrixID   string `json:"matrix_id"`
+	RoomID     string `json:"room_id"`
+	Encrypted  bool   `json:"encrypted"`
+	Lang       string `json:"lang"`
+	Contact    bool   `json:"contact"` // Whether the user receives notifications through Matrix
+	Muted      bool   `json:"muted"`   // Whether the user has muted all but urgent notifications
+}
+
+type MatrixUsersDTO struct {
+	Users []MatrixUserDTO `json:"users"`
+}
+
+type MatrixKeysDTO struct {
+	Passphrase string `json:"passphrase"`     // Passphrase the export is (or will be) encrypted with
+	Data       string `json:"data,omitempty"` // Contents of a key export, when importing
+}
+
+type MatrixKeyImportResponseDTO struct {
+	Imported int `json:"imported"` // Number of sessions the bot didn't already have
+	Total    int `json:"total"`    // Number of sessions in the export
+}
+
+type MatrixStatusDTO struct {
+	Connected bool   `json:"connected"`  // Whether the bot is syncing and has recently heard from the homeserver
+	LastSync  int64  `json:"last_sync"`  // Time of the last successful sync (Unix), 0 if never
+	LastError string `json:"last_error"` // Last sync error, if any
+	Queued    int    `json:"queued"`     // Number of failed messages waiting to be retried
 }
 
 type ResetPasswordDTO struct {
@@ -405,6 +475,26 @@ type MyDetailsContactMethodsDTO struct {
 	Enabled bool   `json:"enabled"`
 }
 
+// AccountExportDTO is everything jfa-go stores about a user, for data access requests.
+type AccountExportDTO struct {
+	MyDetailsDTO
+	Created               int64                    `json:"created,omitempty"`                // When the account was made through jfa-go, if it was
+	Label                 string                   `json:"label,omitempty"`                  // Label given to the user by an admin
+	Matrix                *MatrixSettingsExportDTO `json:"matrix_settings,omitempty"`        // Settings chosen through the Matrix bot
+	NotificationsDisabled map[string][]string      `json:"notifications_disabled,omitempty"` // Notification types turned off, and the contact methods they're off for
+	Exported              int64                    `json:"exported"`
+}
+
+type MatrixSettingsExportDTO struct {
+	RoomID     string `json:"room_id"`
+	Language   string `json:"language,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	Muted      bool   `json:"muted"`
+	PlainOnly  bool   `json:"plain_only"`
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+}
+
 type ModifyMyEmailDTO struct {
 	Email string `json:"email"`
 }
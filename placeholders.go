@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// messagePlaceholders are server stats which can be written as {name} in announcements and custom messages.
+// They're resolved when the message is constructed, so recurring announcements stay current. Add new ones here.
+var messagePlaceholders = map[string]func(app *appContext) interface{}{
+	"userCount": func(app *appContext) interface{} {
+		users, status, err := app.jf.GetUsers(false)
+		if status != 200 || err != nil {
+			app.err.Printf("Failed to get users for {userCount} (%d): %v", status, err)
+			return "?"
+		}
+		return len(users)
+	},
+	"inviteCount": func(app *appContext) interface{} {
+		count := 0
+		now := time.Now()
+		for _, invite := range app.storage.GetInvites() {
+			if invite.ValidTill.After(now) {
+				count++
+			}
+		}
+		return count
+	},
+}
+
+// resolvePlaceholders fills in any messagePlaceholders found in content, only looking up those which are used.
+func (app *appContext) resolvePlaceholders(content string) string {
+	variables := []string{}
+	values := map[string]interface{}{}
+	for name, value := range messagePlaceholders {
+		wrapped := "{" + name + "}"
+		if strings.Contains(content, wrapped) {
+			variables = append(variables, wrapped)
+			values[name] = value(app)
+		}
+	}
+	if len(variables) == 0 {
+		return content
+	}
+	return templateEmail(content, variables, variables, values)
+}
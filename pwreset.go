@@ -26,6 +26,31 @@ func (app *appContext) GenInternalReset(userID string) (InternalPWR, error) {
 	return pwr, nil
 }
 
+// addInternalReset stores a PIN from GenInternalReset, so it can be used.
+func (app *appContext) addInternalReset(pwr InternalPWR) {
+	app.internalPWRsLock.Lock()
+	defer app.internalPWRsLock.Unlock()
+	if app.internalPWRs == nil {
+		app.internalPWRs = map[string]InternalPWR{}
+	}
+	app.internalPWRs[pwr.PIN] = pwr
+}
+
+// internalReset returns the stored internal reset with the given PIN.
+func (app *appContext) internalReset(pin string) (InternalPWR, bool) {
+	app.internalPWRsLock.Lock()
+	defer app.internalPWRsLock.Unlock()
+	pwr, ok := app.internalPWRs[pin]
+	return pwr, ok
+}
+
+// deleteInternalReset forgets the internal reset with the given PIN.
+func (app *appContext) deleteInternalReset(pin string) {
+	app.internalPWRsLock.Lock()
+	defer app.internalPWRsLock.Unlock()
+	delete(app.internalPWRs, pin)
+}
+
 // GenResetLink generates and returns a password reset link.
 func (app *appContext) GenResetLink(pin string) (string, error) {
 	url := app.config.Section("password_resets").Key("url_base").String()
@@ -112,7 +137,7 @@ func pwrMonitor(app *appContext, watcher *fsnotify.Watcher) {
 						if err != nil {
 							app.err.Printf("Failed to construct password reset message for \"%s\"", pwr.Username)
 							app.debug.Printf("%s: Error: %s", pwr.Username, err)
-						} else if err := app.sendByID(msg, uid); err != nil {
+						} else if err := app.sendResetByID(msg, uid); err != nil {
 							app.err.Printf("Failed to send password reset message to \"%s\"", name)
 							app.debug.Printf("%s: Error: %s", pwr.Username, err)
 						} else {
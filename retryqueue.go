@@ -0,0 +1,105 @@
+package main
+
+import (
+	"time"
+
+	"github.com/lithammer/shortuuid/v3"
+)
+
+const (
+	RETRY_QUEUE_INTERVAL    = time.Minute
+	RETRY_QUEUE_MIN_BACKOFF = time.Minute
+	RETRY_QUEUE_MAX_BACKOFF = time.Hour
+)
+
+// queueMessage stores a message which failed to send to the given user through the named contact method, to be retried later.
+func (app *appContext) queueMessage(message *Message, method, jfID string, err error) {
+	now := time.Now()
+	app.storage.SetQueuedMessageKey(shortuuid.New(), QueuedMessage{
+		Message:     *message,
+		Method:      method,
+		JellyfinID:  jfID,
+		Created:     now,
+		NextAttempt: now.Add(RETRY_QUEUE_MIN_BACKOFF),
+		Attempts:    1,
+		LastError:   err.Error(),
+	})
+}
+
+// queuedMessages returns the number of messages waiting to be retried through the named contact method.
+func (app *appContext) queuedMessages(method string) (n int) {
+	for _, qm := range app.storage.GetQueuedMessages() {
+		if qm.Method == method {
+			n++
+		}
+	}
+	return
+}
+
+// retryQueueBackoff returns how long to wait before the next attempt, doubling each time up to RETRY_QUEUE_MAX_BACKOFF.
+func retryQueueBackoff(attempts int) time.Duration {
+	backoff := RETRY_QUEUE_MIN_BACKOFF
+	for i := 1; i < attempts && backoff < RETRY_QUEUE_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > RETRY_QUEUE_MAX_BACKOFF {
+		backoff = RETRY_QUEUE_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// retryQueuedMessages resends queued messages which are due, dropping those older than messages.retry_max_age_hours.
+func (app *appContext) retryQueuedMessages() {
+	maxAge := time.Duration(app.config.Section("messages").Key("retry_max_age_hours").MustInt(24)) * time.Hour
+	methods := map[string]ContactMethod{}
+	for _, method := range app.contactMethods() {
+		methods[method.Name()] = method
+	}
+	now := time.Now()
+	for _, qm := range app.storage.GetQueuedMessages() {
+		if now.Sub(qm.Created) > maxAge {
+			app.err.Printf("Giving up on %s message to \"%s\" after %d attempts: %s", qm.Method, qm.JellyfinID, qm.Attempts, qm.LastError)
+			app.storage.DeleteQueuedMessageKey(qm.ID)
+			continue
+		}
+		if now.Before(qm.NextAttempt) {
+			continue
+		}
+		method, ok := methods[qm.Method]
+		if !ok {
+			// The method has since been disabled.
+			app.storage.DeleteQueuedMessageKey(qm.ID)
+			continue
+		}
+		if !method.Reachable(qm.JellyfinID) {
+			// They've since unlinked or turned contact off, so SendByID would skip them without an error.
+			app.debug.Printf("Dropping %s message to \"%s\", no longer reachable", qm.Method, qm.JellyfinID)
+			app.storage.DeleteQueuedMessageKey(qm.ID)
+			continue
+		}
+		if err := method.SendByID(&qm.Message, qm.JellyfinID); err != nil {
+			qm.Attempts++
+			qm.LastError = err.Error()
+			qm.NextAttempt = now.Add(retryQueueBackoff(qm.Attempts))
+			app.debug.Printf("Failed to resend %s message to \"%s\" (attempt %d): %v", qm.Method, qm.JellyfinID, qm.Attempts, err)
+			app.storage.SetQueuedMessageKey(qm.ID, qm)
+			continue
+		}
+		app.info.Printf("Resent %s message to \"%s\"", qm.Method, qm.JellyfinID)
+		app.storage.DeleteQueuedMessageKey(qm.ID)
+	}
+}
+
+func newRetryQueueDaemon(app *appContext) *housekeepingDaemon {
+	daemon := housekeepingDaemon{
+		Stopped:         false,
+		ShutdownChannel: make(chan string),
+		Interval:        RETRY_QUEUE_INTERVAL,
+		period:          RETRY_QUEUE_INTERVAL,
+		app:             app,
+	}
+	daemon.jobs = []func(app *appContext){
+		func(app *appContext) { app.retryQueuedMessages() },
+	}
+	return &daemon
+}
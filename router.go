@@ -155,6 +155,9 @@ func (app *appContext) loadRoutes(router *gin.Engine) {
 			router.GET(p+"/invite/:invCode/matrix/verified/:userID/:pin", app.MatrixCheckPIN)
 			router.POST(p+"/invite/:invCode/matrix/user", app.MatrixSendPIN)
 			router.POST(p+"/users/matrix", app.MatrixConnect)
+			if app.config.Section("matrix").Key("webhook_secret").String() != "" {
+				router.POST(p+"/matrix/webhook", app.MatrixWebhook)
+			}
 		}
 		if userPageEnabled {
 			router.GET(p+"/my/account", app.MyUserPage)
@@ -164,6 +167,11 @@ func (app *appContext) loadRoutes(router *gin.Engine) {
 			router.POST(p+"/my/password/reset/:address", app.ResetMyPassword)
 		}
 	}
+	if app.config.Section("advanced").Key("metrics").MustBool(false) && app.config.Section("advanced").Key("metrics_address").String() == "" {
+		for _, p := range routePrefixes {
+			router.GET(p+"/metrics", app.GetMetrics)
+		}
+	}
 	if *SWAGGER {
 		app.info.Print(warning("\n\nWARNING: Swagger should not be used on a public instance.\n\n"))
 		for _, p := range routePrefixes {
@@ -234,6 +242,15 @@ func (app *appContext) loadRoutes(router *gin.Engine) {
 		if emailEnabled {
 			api.POST(p+"/users/contact", app.SetContactMethods)
 		}
+		if matrixEnabled {
+			api.POST(p+"/matrix/broadcast", app.MatrixBroadcast)
+			api.GET(p+"/matrix/status", app.MatrixStatus)
+			api.GET(p+"/matrix/users", app.MatrixGetUsers)
+			api.POST(p+"/matrix/users/reinvite", app.MatrixReinviteUser)
+			api.POST(p+"/matrix/keys/export", app.MatrixExportKeys)
+			api.POST(p+"/matrix/keys/import", app.MatrixImportKeys)
+			api.POST(p+"/matrix/test", app.MatrixSendTest)
+		}
 		if discordEnabled {
 			api.GET(p+"/users/discord/:username", app.DiscordGetUsers)
 			api.POST(p+"/users/discord", app.DiscordConnect)
@@ -258,6 +275,8 @@ func (app *appContext) loadRoutes(router *gin.Engine) {
 		if userPageEnabled {
 			user.GET("/details", app.MyDetails)
 			user.POST("/contact", app.SetMyContactMethods)
+			user.GET("/notifications", app.GetMyNotificationPreferences)
+			user.POST("/notifications", app.SetMyNotificationPreference)
 			user.POST("/logout", app.LogoutUser)
 			user.POST("/email", app.ModifyMyEmail)
 			user.GET("/discord/invite", app.MyDiscordServerInvite)
@@ -332,6 +332,55 @@ func (st *Storage) DeleteMatrixKey(k string) {
 	st.db.Delete(k, MatrixUser{})
 }
 
+// MatrixSyncToken is the bot's /sync next_batch token, keyed by its user ID.
+type MatrixSyncToken struct {
+	UserID    string `badgerhold:"key"`
+	NextBatch string
+}
+
+// GetMatrixSyncTokenKey returns the sync token saved for the given Matrix user ID, or "" if there isn't one.
+func (st *Storage) GetMatrixSyncTokenKey(k string) string {
+	result := MatrixSyncToken{}
+	err := st.db.Get(k, &result)
+	if err != nil {
+		return ""
+	}
+	return result.NextBatch
+}
+
+// SetMatrixSyncTokenKey stores the sync token for key k.
+func (st *Storage) SetMatrixSyncTokenKey(k string, v string) {
+	err := st.db.Upsert(k, MatrixSyncToken{UserID: k, NextBatch: v})
+	if err != nil {
+		// fmt.Printf("Failed to set sync token: %v\n", err)
+	}
+}
+
+// MatrixSelection is the account commands act on for a Matrix user who's linked several, keyed by their Matrix user ID.
+type MatrixSelection struct {
+	UserID     string `badgerhold:"key"`
+	JellyfinID string
+}
+
+// GetMatrixSelectionKey returns the Jellyfin ID of the account chosen by the given Matrix user ID, if they've chosen one.
+func (st *Storage) GetMatrixSelectionKey(k string) (string, bool) {
+	result := MatrixSelection{}
+	err := st.db.Get(k, &result)
+	if err != nil {
+		return "", false
+	}
+	return result.JellyfinID, true
+}
+
+// SetMatrixSelectionKey stores the chosen Jellyfin ID v for key k.
+func (st *Storage) SetMatrixSelectionKey(k string, v string) {
+	st.DebugWatch(StoredMatrix, k, v)
+	err := st.db.Upsert(k, MatrixSelection{UserID: k, JellyfinID: v})
+	if err != nil {
+		// fmt.Printf("Failed to set selection: %v\n", err)
+	}
+}
+
 // GetInvites returns a copy of the store.
 func (st *Storage) GetInvites() []Invite {
 	result := []Invite{}
@@ -582,6 +631,129 @@ func (st *Storage) DeleteActivityKey(k string) {
 	st.db.Delete(k, Activity{})
 }
 
+// NotificationPreferences stores which contact methods a user doesn't want each type of notification sent through.
+type NotificationPreferences struct {
+	JellyfinID string              `badgerhold:"key"`
+	Disabled   map[string][]string // Map of notification types to lowercase contact method names.
+}
+
+// GetNotificationPreferencesKey returns the value stored in the store's key.
+func (st *Storage) GetNotificationPreferencesKey(k string) (NotificationPreferences, bool) {
+	result := NotificationPreferences{}
+	err := st.db.Get(k, &result)
+	ok := true
+	if err != nil {
+		// fmt.Printf("Failed to find preferences: %v\n", err)
+		ok = false
+	}
+	return result, ok
+}
+
+// SetNotificationPreferencesKey stores value v in key k.
+func (st *Storage) SetNotificationPreferencesKey(k string, v NotificationPreferences) {
+	v.JellyfinID = k
+	err := st.db.Upsert(k, v)
+	if err != nil {
+		// fmt.Printf("Failed to set preferences: %v\n", err)
+	}
+}
+
+// ExpiryReminder records the last reminder a user was sent about their account expiring, so it isn't sent twice.
+type ExpiryReminder struct {
+	JellyfinID string    `badgerhold:"key"`
+	Expiry     time.Time // Expiry time the reminder was for. If it's changed since, reminders start again.
+	Days       int       // Threshold (in days before expiry) of the last reminder.
+}
+
+// GetExpiryReminderKey returns the value stored in the store's key.
+func (st *Storage) GetExpiryReminderKey(k string) (ExpiryReminder, bool) {
+	result := ExpiryReminder{}
+	err := st.db.Get(k, &result)
+	ok := true
+	if err != nil {
+		// fmt.Printf("Failed to find reminder: %v\n", err)
+		ok = false
+	}
+	return result, ok
+}
+
+// SetExpiryReminderKey stores value v in key k.
+func (st *Storage) SetExpiryReminderKey(k string, v ExpiryReminder) {
+	v.JellyfinID = k
+	err := st.db.Upsert(k, v)
+	if err != nil {
+		// fmt.Printf("Failed to set reminder: %v\n", err)
+	}
+}
+
+// QueuedMessage is a notification which failed to send, stored to be retried later.
+type QueuedMessage struct {
+	ID          string `badgerhold:"key"`
+	Message     Message
+	Method      string // Name of the ContactMethod it failed to send through.
+	JellyfinID  string
+	Created     time.Time
+	NextAttempt time.Time
+	Attempts    int
+	LastError   string
+}
+
+// GetQueuedMessages returns a copy of the store.
+func (st *Storage) GetQueuedMessages() []QueuedMessage {
+	result := []QueuedMessage{}
+	err := st.db.Find(&result, &badgerhold.Query{})
+	if err != nil {
+		// fmt.Printf("Failed to find queued messages: %v\n", err)
+	}
+	return result
+}
+
+// SetQueuedMessageKey stores value v in key k.
+func (st *Storage) SetQueuedMessageKey(k string, v QueuedMessage) {
+	v.ID = k
+	err := st.db.Upsert(k, v)
+	if err != nil {
+		// fmt.Printf("Failed to set queued message: %v\n", err)
+	}
+}
+
+// DeleteQueuedMessageKey deletes value at key k.
+func (st *Storage) DeleteQueuedMessageKey(k string) {
+	st.db.Delete(k, QueuedMessage{})
+}
+
+// HeldMatrixMessage is a Matrix notification held back by the user's quiet hours, to be sent once they end.
+type HeldMatrixMessage struct {
+	ID         string `badgerhold:"key"`
+	Message    Message
+	JellyfinID string
+	Until      time.Time
+}
+
+// GetHeldMatrixMessages returns a copy of the store.
+func (st *Storage) GetHeldMatrixMessages() []HeldMatrixMessage {
+	result := []HeldMatrixMessage{}
+	err := st.db.Find(&result, &badgerhold.Query{})
+	if err != nil {
+		// fmt.Printf("Failed to find held messages: %v\n", err)
+	}
+	return result
+}
+
+// SetHeldMatrixMessageKey stores value v in key k.
+func (st *Storage) SetHeldMatrixMessageKey(k string, v HeldMatrixMessage) {
+	v.ID = k
+	err := st.db.Upsert(k, v)
+	if err != nil {
+		// fmt.Printf("Failed to set held message: %v\n", err)
+	}
+}
+
+// DeleteHeldMatrixMessageKey deletes value at key k.
+func (st *Storage) DeleteHeldMatrixMessageKey(k string) {
+	st.db.Delete(k, HeldMatrixMessage{})
+}
+
 type TelegramUser struct {
 	JellyfinID string `badgerhold:"key"`
 	ChatID     int64  `badgerhold:"index"`
@@ -705,6 +877,9 @@ type Lang struct {
 	chosenTelegramLang string
 	TelegramPath       string
 	Telegram           telegramLangs
+	// Matrix translations are the Telegram ones, with any Matrix-specific wording from MatrixPath on top.
+	MatrixPath string
+	Matrix     telegramLangs
 }
 
 func (st *Storage) loadLang(filesystems ...fs.FS) (err error) {
@@ -729,6 +904,10 @@ func (st *Storage) loadLang(filesystems ...fs.FS) (err error) {
 		return
 	}
 	err = st.loadLangTelegram(filesystems...)
+	if err != nil {
+		return
+	}
+	err = st.loadLangMatrix(filesystems...)
 	return
 }
 
@@ -1320,10 +1499,12 @@ func (st *Storage) loadLangTelegram(filesystems ...fs.FS) error {
 				if err == nil {
 					loadedLangs[fsIndex][lang.Meta.Fallback+".json"] = true
 					patchLang(&lang.Strings, &fallback.Strings, &english.Strings)
+					patchQuantityStrings(&lang.QuantityStrings, &fallback.QuantityStrings, &english.QuantityStrings)
 				}
 			}
 			if (lang.Meta.Fallback != "" && err != nil) || lang.Meta.Fallback == "" {
 				patchLang(&lang.Strings, &english.Strings)
+				patchQuantityStrings(&lang.QuantityStrings, &english.QuantityStrings)
 			}
 		}
 		st.lang.Telegram[index] = lang
@@ -1365,6 +1546,54 @@ func (st *Storage) loadLangTelegram(filesystems ...fs.FS) error {
 	return nil
 }
 
+// loadLangMatrix builds st.lang.Matrix from the Telegram strings, which must be loaded first.
+// Strings in MatrixPath override those of the same language, and any only found there fall back to Matrix's English.
+// Languages without a Matrix file just use their Telegram strings.
+func (st *Storage) loadLangMatrix(filesystems ...fs.FS) error {
+	st.lang.Matrix = telegramLangs{}
+	overrides := map[string]langSection{}
+	for _, filesystem := range filesystems {
+		files, err := fs.ReadDir(filesystem, st.lang.MatrixPath)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			index := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+			data, err := fs.ReadFile(filesystem, FSJoin(st.lang.MatrixPath, f.Name()))
+			if err != nil {
+				return err
+			}
+			if substituteStrings != "" {
+				data = []byte(strings.ReplaceAll(string(data), "Jellyfin", substituteStrings))
+			}
+			lang := telegramLang{}
+			err = json.Unmarshal(data, &lang)
+			if err != nil {
+				return err
+			}
+			// Later filesystems, i.e. files.lang_files, take priority.
+			if overrides[index] == nil {
+				overrides[index] = langSection{}
+			}
+			for k, v := range lang.Strings {
+				overrides[index][k] = v
+			}
+		}
+	}
+	english := overrides["en-us"]
+	for index, lang := range st.lang.Telegram {
+		strs := langSection{}
+		for k, v := range overrides[index] {
+			strs[k] = v
+		}
+		patchLang(&strs, &lang.Strings)
+		patchLang(&strs, &english)
+		lang.Strings = strs
+		st.lang.Matrix[index] = lang
+	}
+	return nil
+}
+
 type Invites map[string]Invite
 
 func (st *Storage) loadInvites() error {
@@ -1424,10 +1653,6 @@ func (st *Storage) loadMatrixUsers() error {
 	return loadJSON(st.matrix_path, &st.deprecatedMatrix)
 }
 
-func (st *Storage) storeMatrixUsers() error {
-	return storeJSON(st.matrix_path, st.deprecatedMatrix)
-}
-
 func (st *Storage) loadCustomEmails() error {
 	return loadJSON(st.customEmails_path, &st.deprecatedCustomEmails)
 }
@@ -12,6 +12,9 @@ import (
 
 const (
 	VERIF_TOKEN_EXPIRY_SEC = 10 * 60
+	// Prefixes of the callback data sent by the buttons on a PIN confirmation message.
+	TELEGRAM_CONFIRM_PREFIX = "confirm:"
+	TELEGRAM_CANCEL_PREFIX  = "cancel:"
 )
 
 type TelegramVerifiedToken struct {
@@ -109,6 +112,10 @@ func (t *TelegramDaemon) run() {
 		var upd tg.Update
 		select {
 		case upd = <-updates:
+			if upd.CallbackQuery != nil {
+				t.handleCallback(upd.CallbackQuery)
+				continue
+			}
 			if upd.Message == nil {
 				continue
 			}
@@ -116,23 +123,7 @@ func (t *TelegramDaemon) run() {
 			if len(sects) == 0 {
 				continue
 			}
-			lang := t.app.storage.lang.chosenTelegramLang
-			storedLang, ok := t.languages[upd.Message.Chat.ID]
-			if !ok {
-				found := false
-				for code := range t.app.storage.lang.Telegram {
-					if code[:2] == upd.Message.From.LanguageCode {
-						lang = code
-						found = true
-						break
-					}
-				}
-				if found {
-					t.languages[upd.Message.Chat.ID] = lang
-				}
-			} else {
-				lang = storedLang
-			}
+			lang := t.chatLang(upd.Message.Chat.ID, upd.Message.From)
 			switch msg := sects[0]; msg {
 			case "/start":
 				t.commandStart(&upd, sects, lang)
@@ -152,6 +143,25 @@ func (t *TelegramDaemon) run() {
 	}
 }
 
+// chatLang returns the stored language for the chat, or guesses it from the user's Telegram language if there isn't one.
+func (t *TelegramDaemon) chatLang(chatID int64, from *tg.User) string {
+	if storedLang, ok := t.languages[chatID]; ok {
+		return storedLang
+	}
+	lang := t.app.storage.lang.chosenTelegramLang
+	if from == nil {
+		return lang
+	}
+	for code := range t.app.storage.lang.Telegram {
+		if code[:2] == from.LanguageCode {
+			lang = code
+			t.languages[chatID] = lang
+			break
+		}
+	}
+	return lang
+}
+
 func (t *TelegramDaemon) Reply(upd *tg.Update, content string) error {
 	msg := tg.NewMessage((*upd).Message.Chat.ID, content)
 	_, err := t.bot.Send(msg)
@@ -180,6 +190,7 @@ func (t *TelegramDaemon) Send(message *Message, ID ...int64) error {
 			msg.ParseMode = "MarkdownV2"
 		}
 		_, err := t.bot.Send(msg)
+		notificationMetrics.record("telegram", message, err)
 		if err != nil {
 			return err
 		}
@@ -194,7 +205,15 @@ func (t *TelegramDaemon) Shutdown() {
 	close(t.ShutdownChannel)
 }
 
+// commandStart sends the welcome message. If the PIN is passed as the start parameter
+// (i.e. the user followed a t.me/<bot>?start=<PIN> link), buttons to confirm or cancel verification are sent instead.
 func (t *TelegramDaemon) commandStart(upd *tg.Update, sects []string, lang string) {
+	if len(sects) > 1 {
+		if _, ok := t.tokens[sects[1]]; ok {
+			t.sendConfirmation(upd, sects[1], lang)
+			return
+		}
+	}
 	content := t.app.storage.lang.Telegram[lang].Strings.get("startMessage") + "\n"
 	content += t.app.storage.lang.Telegram[lang].Strings.template("languageMessage", tmpl{"command": "/lang"})
 	err := t.Reply(upd, content)
@@ -228,25 +247,70 @@ func (t *TelegramDaemon) commandLang(upd *tg.Update, sects []string, lang string
 }
 
 func (t *TelegramDaemon) commandPIN(upd *tg.Update, sects []string, lang string) {
-	token, ok := t.tokens[upd.Message.Text]
-	if !ok || time.Now().After(token.Expiry) {
-		err := t.QuoteReply(upd, t.app.storage.lang.Telegram[lang].Strings.get("invalidPIN"))
-		if err != nil {
-			t.app.err.Printf("Telegram: Failed to send message to \"%s\": %v", upd.Message.From.UserName, err)
-		}
-		delete(t.tokens, upd.Message.Text)
-		return
+	content := t.app.storage.lang.Telegram[lang].Strings.get("invalidPIN")
+	if t.verifyToken(upd.Message.Text, upd.Message.Chat.ID, upd.Message.Chat.UserName) {
+		content = t.app.storage.lang.Telegram[lang].Strings.get("pinSuccess")
 	}
-	err := t.QuoteReply(upd, t.app.storage.lang.Telegram[lang].Strings.get("pinSuccess"))
+	err := t.QuoteReply(upd, content)
 	if err != nil {
 		t.app.err.Printf("Telegram: Failed to send message to \"%s\": %v", upd.Message.From.UserName, err)
 	}
-	t.verifiedTokens[upd.Message.Text] = TelegramVerifiedToken{
-		ChatID:     upd.Message.Chat.ID,
-		Username:   upd.Message.Chat.UserName,
+}
+
+// verifyToken marks the pending token with the given PIN as verified by the chat, returning false if it's invalid or expired.
+func (t *TelegramDaemon) verifyToken(pin string, chatID int64, username string) bool {
+	token, ok := t.tokens[pin]
+	delete(t.tokens, pin)
+	if !ok || time.Now().After(token.Expiry) {
+		return false
+	}
+	t.verifiedTokens[pin] = TelegramVerifiedToken{
+		ChatID:     chatID,
+		Username:   username,
 		JellyfinID: token.JellyfinID,
 	}
-	delete(t.tokens, upd.Message.Text)
+	return true
+}
+
+// sendConfirmation asks the user to confirm verification with the given PIN, with an inline keyboard.
+func (t *TelegramDaemon) sendConfirmation(upd *tg.Update, pin, lang string) {
+	msg := tg.NewMessage(upd.Message.Chat.ID, t.app.storage.lang.Telegram[lang].Strings.template("confirmPIN", tmpl{"pin": pin}))
+	msg.ReplyMarkup = tg.NewInlineKeyboardMarkup(tg.NewInlineKeyboardRow(
+		tg.NewInlineKeyboardButtonData(t.app.storage.lang.Telegram[lang].Strings.get("confirm"), TELEGRAM_CONFIRM_PREFIX+pin),
+		tg.NewInlineKeyboardButtonData(t.app.storage.lang.Telegram[lang].Strings.get("cancel"), TELEGRAM_CANCEL_PREFIX+pin),
+	))
+	_, err := t.bot.Send(msg)
+	if err != nil {
+		t.app.err.Printf("Telegram: Failed to send message to \"%s\": %v", upd.Message.From.UserName, err)
+	}
+}
+
+// handleCallback handles presses of the buttons sent by sendConfirmation, replacing the message with the result.
+func (t *TelegramDaemon) handleCallback(query *tg.CallbackQuery) {
+	if _, err := t.bot.AnswerCallbackQuery(tg.NewCallback(query.ID, "")); err != nil {
+		t.app.debug.Printf("Telegram: Failed to answer callback query: %v", err)
+	}
+	if query.Message == nil || query.Message.Chat == nil {
+		return
+	}
+	lang := t.chatLang(query.Message.Chat.ID, query.From)
+	var content string
+	switch {
+	case strings.HasPrefix(query.Data, TELEGRAM_CONFIRM_PREFIX):
+		content = t.app.storage.lang.Telegram[lang].Strings.get("invalidPIN")
+		if t.verifyToken(strings.TrimPrefix(query.Data, TELEGRAM_CONFIRM_PREFIX), query.Message.Chat.ID, query.Message.Chat.UserName) {
+			content = t.app.storage.lang.Telegram[lang].Strings.get("pinSuccess")
+		}
+	case strings.HasPrefix(query.Data, TELEGRAM_CANCEL_PREFIX):
+		// The token is left pending, so the PIN can still be typed in or confirmed from another chat.
+		content = t.app.storage.lang.Telegram[lang].Strings.get("pinCancelled")
+	default:
+		return
+	}
+	_, err := t.bot.Send(tg.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, content))
+	if err != nil {
+		t.app.err.Printf("Telegram: Failed to send message to \"%s\": %v", query.Message.Chat.UserName, err)
+	}
 }
 
 // TokenVerified returns whether or not a token with the given PIN has been verified, and the token itself.
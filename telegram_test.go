@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTelegramVerifyToken(t *testing.T) {
+	td := &TelegramDaemon{
+		tokens:         map[string]VerifToken{},
+		verifiedTokens: map[string]TelegramVerifiedToken{},
+	}
+	td.tokens["AB-CD-EF"] = VerifToken{Expiry: time.Now().Add(time.Minute), JellyfinID: "jellyfin-id"}
+	td.tokens["GH-IJ-KL"] = VerifToken{Expiry: time.Now().Add(-time.Minute)}
+	if td.verifyToken("GH-IJ-KL", 1, "user") {
+		t.Error("expired token verified")
+	}
+	if td.verifyToken("MN-OP-QR", 1, "user") {
+		t.Error("unknown token verified")
+	}
+	if !td.verifyToken("AB-CD-EF", 1, "user") {
+		t.Fatal("valid token not verified")
+	}
+	token, ok := td.TokenVerified("AB-CD-EF")
+	if !ok || token.ChatID != 1 || token.Username != "user" || token.JellyfinID != "jellyfin-id" {
+		t.Errorf("unexpected verified token: %+v", token)
+	}
+	if len(td.tokens) != 0 {
+		t.Errorf("pending tokens not removed: %v", td.tokens)
+	}
+}
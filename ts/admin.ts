@@ -66,6 +66,8 @@ window.availableProfiles = window.availableProfiles || [];
 
     window.modals.matrix = new Modal(document.getElementById("modal-matrix"));
 
+    window.modals.matrixTest = new Modal(document.getElementById("modal-matrix-test"));
+
     window.modals.logs = new Modal(document.getElementById("modal-logs"));
 
     window.modals.backedUp = new Modal(document.getElementById("modal-backed-up"));
@@ -125,6 +125,7 @@ if (window.matrixEnabled) {
         verifiedURL: "/invite/" + window.code + "/matrix/verified/",
         invalidCodeError: window.messages["errorInvalidPIN"],
         accountLinkedError: window.messages["errorAccountLinked"],
+        invalidUserIDError: window.messages["errorInvalidMatrixID"],
         unknownError: window.messages["errorUnknown"],
         successError: window.messages["verified"],
         successFunc: () => {
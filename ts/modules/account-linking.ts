@@ -184,6 +184,7 @@ export interface MatrixConfiguration {
     verifiedURL: string;
     invalidCodeError: string;
     accountLinkedError: string;
+    invalidUserIDError: string;
     unknownError: string;
     successError: string;
     successFunc: () => void;
@@ -229,6 +230,9 @@ export class Matrix {
             this._conf.modal.close();
             window.notifications.customError("accountLinkedError", this._conf.accountLinkedError);
             return;
+        } else if (req.status == 400 && req.response["error"] == "errorInvalidMatrixID") {
+            window.notifications.customError("invalidUserIDError", this._conf.invalidUserIDError);
+            return;
         } else if (req.status != 200) {
             this._conf.modal.close();
             window.notifications.customError("unknownError", this._conf.unknownError);
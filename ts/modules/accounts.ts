@@ -1982,11 +1982,13 @@ export class accountsList {
         });
 
         this._announceSaveButton.onclick = this.saveAnnouncement;
-        const announceVarUsername = document.getElementById("announce-variables-username") as HTMLSpanElement;
-        announceVarUsername.onclick = () => {
-            insertText(this._announceTextarea, announceVarUsername.children[0].textContent);
-            this.loadPreview();
-        };
+        for (let variable of ["username", "user-count", "invite-count"]) {
+            const announceVar = document.getElementById("announce-variables-" + variable) as HTMLSpanElement;
+            announceVar.onclick = () => {
+                insertText(this._announceTextarea, announceVar.children[0].textContent);
+                this.loadPreview();
+            };
+        }
 
         const headerNames: string[] = ["username", "access-jfa", "email", "telegram", "matrix", "discord", "expiry", "last-active", "referrals"];
         const headerGetters: string[] = ["name", "accounts_admin", "email", "telegram", "matrix", "discord", "expiry", "last_active", "referrals_enabled"];
@@ -881,7 +881,8 @@ export class settingsList {
             let send = {
                 homeserver: (document.getElementById("matrix-homeserver") as HTMLInputElement).value,
                 username: (document.getElementById("matrix-user") as HTMLInputElement).value,
-                password: (document.getElementById("matrix-password") as HTMLInputElement).value
+                password: (document.getElementById("matrix-password") as HTMLInputElement).value,
+                token: (document.getElementById("matrix-token") as HTMLInputElement).value
             }
             _post("/matrix/login", send, (req: XMLHttpRequest) => {
                 if (req.readyState == 4) {
@@ -890,7 +891,7 @@ export class settingsList {
                         window.notifications.customError("errorUnknown", window.lang.notif(req.response["error"] as string));
                         return;
                     } else if (req.status == 401) {
-                        window.notifications.customError("errorUnauthorized", req.response["error"] as string);
+                        window.notifications.customError("errorUnauthorized", window.lang.notif(req.response["error"] as string));
                         return;
                     } else if (req.status == 500) {
                         window.notifications.customError("errorAddMatrix", window.lang.notif("errorFailureCheckLogs"));
@@ -905,6 +906,41 @@ export class settingsList {
         window.modals.matrix.show();
     }
 
+    private _testMatrix = () => {
+        const modal = document.getElementById("form-matrix-test") as HTMLFormElement;
+        modal.onsubmit = (event: Event) => {
+            event.preventDefault();
+            const button = modal.querySelector("span.submit") as HTMLSpanElement;
+            addLoader(button);
+            let send = {
+                user_id: (document.getElementById("matrix-test-user") as HTMLInputElement).value
+            }
+            _post("/matrix/test", send, (req: XMLHttpRequest) => {
+                if (req.readyState == 4) {
+                    removeLoader(button);
+                    if (req.status == 400) {
+                        window.notifications.customError("matrixTest", window.lang.notif(req.response["error"] as string));
+                        return;
+                    } else if (req.status != 200) {
+                        window.notifications.customError("matrixTest", window.lang.notif("errorFailureCheckLogs"));
+                        return;
+                    }
+                    const resp = req.response as { success: boolean, new_room: boolean, encrypted: boolean, error: string };
+                    if (!resp.success) {
+                        window.notifications.customError("matrixTest", window.lang.var("notifications", "errorMatrixTest", resp.error));
+                        return;
+                    }
+                    let msg = window.lang.var("notifications", "matrixTestSent", send.user_id) + " ";
+                    msg += window.lang.notif(resp.encrypted ? "matrixTestEncrypted" : "matrixTestNotEncrypted");
+                    if (resp.new_room) msg += " " + window.lang.notif("matrixTestNewRoom");
+                    window.notifications.customSuccess("matrixTest", msg);
+                    window.modals.matrixTest.close();
+                }
+            }, true);
+        };
+        window.modals.matrixTest.show();
+    }
+
     reload = () => _get("/config", null, (req: XMLHttpRequest) => {
         if (req.readyState == 4) {
             if (req.status != 200) {
@@ -950,6 +986,19 @@ export class settingsList {
                         `;
                         (addButton.querySelector("span.button") as HTMLSpanElement).onclick = this._addMatrix;
                         this.addSection(name, this._settings.sections[name], addButton);
+                    } else if (name == "matrix") {
+                        const testButton = document.createElement("div");
+                        testButton.classList.add("tooltip", "left");
+                        testButton.innerHTML = `
+                        <span class="button ~neutral @low">
+                            <i class="icon ri-send-plane-line"></i>
+                        </span>
+                        <span class="content sm">
+                        ${window.lang.strings("matrixSendTest")}
+                        </span>
+                        `;
+                        (testButton.querySelector("span.button") as HTMLSpanElement).onclick = this._testMatrix;
+                        this.addSection(name, this._settings.sections[name], testButton);
                     } else {
                         this.addSection(name, this._settings.sections[name]);
                     }
@@ -111,6 +111,7 @@ declare interface Modals {
     telegram: Modal;
     discord: Modal;
     matrix: Modal;
+    matrixTest?: Modal;
     sendPWR?: Modal;
     pwr?: Modal;
     logs: Modal;
@@ -91,6 +91,7 @@ var rootCard = document.getElementById("card-user");
 var contactCard = document.getElementById("card-contact");
 var statusCard = document.getElementById("card-status");
 var passwordCard = document.getElementById("card-password");
+var notificationsCard = document.getElementById("card-notifications");
 
 interface MyDetailsContactMethod {
     value: string;
@@ -247,6 +248,65 @@ class ContactMethods {
     };
 }
 
+interface NotificationPreferencesDTO {
+    preferences: { [notification: string]: { [method: string]: boolean } };
+}
+
+class NotificationPreferences {
+    private _card: HTMLElement;
+    private _content: HTMLElement;
+
+    constructor (card: HTMLElement) {
+        this._card = card;
+        this._content = this._card.querySelector(".content");
+    }
+
+    load = () => _get("/my/notifications", null, (req: XMLHttpRequest) => {
+        if (req.readyState != 4 || req.status != 200) return;
+        const prefs = (req.response as NotificationPreferencesDTO).preferences;
+        this._content.textContent = "";
+        const notifications = Object.keys(prefs);
+        const methods = notifications.length == 0 ? [] : Object.keys(prefs[notifications[0]]);
+        // Nothing to choose between with a single contact method.
+        if (methods.length < 2) {
+            this._card.classList.add("unfocused");
+            return;
+        }
+        this._card.classList.remove("unfocused");
+        let innerHTML = `<table class="table"><thead><tr><th></th>`;
+        for (let method of methods) {
+            innerHTML += `<th>${method[0].toUpperCase() + method.slice(1)}</th>`;
+        }
+        innerHTML += `</tr></thead><tbody>`;
+        for (let notification of notifications) {
+            innerHTML += `<tr><td>${window.lang.strings("notification" + notification[0].toUpperCase() + notification.slice(1))}</td>`;
+            for (let method of methods) {
+                innerHTML += `<td><input type="checkbox" class="notification-preference" data-notification="${notification}" data-method="${method}" ${prefs[notification][method] ? "checked" : ""}></td>`;
+            }
+            innerHTML += `</tr>`;
+        }
+        innerHTML += `</tbody></table>`;
+        this._content.innerHTML = innerHTML;
+        for (let checkbox of this._content.querySelectorAll(".notification-preference") as NodeListOf<HTMLInputElement>) {
+            checkbox.onchange = () => this._save(checkbox);
+        }
+    });
+
+    private _save = (checkbox: HTMLInputElement) => {
+        const data = {
+            "notification": checkbox.getAttribute("data-notification"),
+            "method": checkbox.getAttribute("data-method"),
+            "enabled": checkbox.checked
+        };
+        _post("/my/notifications", data, (req: XMLHttpRequest) => {
+            if (req.readyState == 4 && req.status != 200) {
+                window.notifications.customError("errorSetNotifications", window.lang.notif("errorSaveSettings"));
+                this.load();
+            }
+        });
+    };
+}
+
 class ReferralCard {
     private _card: HTMLElement;
     private _code: string;
@@ -454,6 +514,7 @@ var referralCard: ReferralCard;
 if (window.referralsEnabled) referralCard = new ReferralCard(document.getElementById("card-referrals"));
 
 var contactMethodList = new ContactMethods(contactCard);
+var notificationPreferences = new NotificationPreferences(notificationsCard);
 
 const addEditEmail = (add: boolean): void => {
     const heading = window.modals.email.modal.querySelector(".heading");
@@ -524,6 +585,7 @@ const matrixConf: MatrixConfiguration = {
     verifiedURL: "/my/matrix/verified/",
     invalidCodeError: window.lang.notif("errorInvalidPIN"),
     accountLinkedError: window.lang.notif("errorAccountLinked"),
+    invalidUserIDError: window.lang.notif("errorInvalidMatrixID"),
     unknownError: window.lang.notif("errorUnknown"),
     successError: window.lang.notif("verified"),
     successFunc: () => {
@@ -620,6 +682,8 @@ document.addEventListener("details-reload", () => {
                 }
             }
 
+            notificationPreferences.load();
+
             expiryCard.expiry = details.expiry;
 
             const adminBackButton = document.getElementById("admin-back-button") as HTMLAnchorElement;
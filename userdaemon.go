@@ -121,6 +121,10 @@ func (app *appContext) checkUsers() {
 			}
 
 			app.storage.SetActivityKey(shortuuid.New(), activity, nil, false)
+			if matrixEnabled {
+				app.matrix.AdminNotice(AdminNoticeExpired, user.Name)
+				app.matrix.clearSelfDisabled(expiry.JellyfinID)
+			}
 
 			app.storage.DeleteUserExpiryKey(expiry.JellyfinID)
 			app.jf.CacheExpiry = time.Now()
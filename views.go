@@ -280,7 +280,7 @@ func (app *appContext) ResetPassword(gc *gin.Context) {
 		"ombiEnabled":       app.config.Section("ombi").Key("enabled").MustBool(false),
 		"customSuccessCard": false,
 	}
-	pwr, isInternal := app.internalPWRs[pin]
+	pwr, isInternal := app.internalReset(pin)
 	// if isInternal && setPassword {
 	if setPassword {
 		data["helpMessage"] = app.config.Section("ui").Key("help_message").String()
@@ -748,9 +748,11 @@ func (app *appContext) InviteProxy(gc *gin.Context) {
 		"fromUser":           fromUser,
 	}
 	if telegram {
-		data["telegramPIN"] = app.telegram.NewAuthToken()
+		pin := app.telegram.NewAuthToken()
+		data["telegramPIN"] = pin
 		data["telegramUsername"] = app.telegram.username
-		data["telegramURL"] = app.telegram.link
+		// Following the link sends "/start <PIN>", so the user only has to press confirm.
+		data["telegramURL"] = app.telegram.link + "?start=" + pin
 		data["telegramRequired"] = app.config.Section("telegram").Key("required").MustBool(false)
 	}
 	if matrix {